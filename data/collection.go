@@ -15,6 +15,7 @@
 package data
 
 import (
+	"bytes"
 	"encoding/binary"
 
 	"github.com/HouzuoGuo/tiedot/dberr"
@@ -29,7 +30,11 @@ type Collection struct {
 // Open a collection file.
 func (conf *Config) OpenCollection(path string) (col *Collection, err error) {
 	col = new(Collection)
-	col.DataFile, err = OpenDataFile(path, conf.ColFileGrowth)
+	openFile := OpenDataFile
+	if conf.ReadOnly {
+		openFile = OpenDataFileReadOnly
+	}
+	col.DataFile, err = openFile(path, conf.ColFileGrowth)
 	col.Config = conf
 	col.Config.CalculateConfigConstants()
 	return
@@ -143,3 +148,36 @@ func (col *Collection) ForEachDoc(fun func(id int, doc []byte) bool) {
 		}
 	}
 }
+
+// Space taken by the documents of a collection file.
+type SpaceUsage struct {
+	Docs         int // Number of documents
+	DocBytes     int // Space taken by documents, including headers and room for growth
+	TextBytes    int // Length of document text, excluding padding
+	DeletedDocs  int // Number of deleted documents whose space is not yet reclaimed
+	DeletedBytes int // Space taken by deleted documents
+}
+
+// Add up the space taken by documents and by deleted documents.
+func (col *Collection) SpaceUsage() (usage SpaceUsage) {
+	for id := 0; id < col.Used-DocHeader && id >= 0; {
+		validity := col.Buf[id]
+		room, _ := binary.Varint(col.Buf[id+1 : id+11])
+		docEnd := id + DocHeader + int(room)
+		if (validity == 0 || validity == 1) && room <= int64(col.DocMaxRoom) && docEnd > 0 && docEnd <= col.Used {
+			if validity == 1 {
+				usage.Docs++
+				usage.DocBytes += docEnd - id
+				usage.TextBytes += len(bytes.TrimRight(col.Buf[id+DocHeader:docEnd], " "))
+			} else {
+				usage.DeletedDocs++
+				usage.DeletedBytes += docEnd - id
+			}
+			id = docEnd
+		} else {
+			// Corrupted document - move on
+			id++
+		}
+	}
+	return
+}
@@ -388,3 +388,27 @@ func TestCollectionGrowAndOutOfBoundAccess(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSpaceUsage(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	d := defaultConfig()
+	col, err := d.OpenCollection(tmp)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer col.Close()
+	ids := make([]int, 3)
+	for i, doc := range []string{"abc", "1234", "2345"} {
+		if ids[i], err = col.Insert([]byte(doc)); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	if err = col.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	expected := SpaceUsage{Docs: 2, DocBytes: 2*DocHeader + 6 + 8, TextBytes: 7, DeletedDocs: 1, DeletedBytes: DocHeader + 8}
+	if usage := col.SpaceUsage(); usage != expected {
+		t.Fatal(usage, expected)
+	}
+}
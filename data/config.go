@@ -15,6 +15,13 @@ const (
 	BucketHeader      = 10          // BucketHeader is the size of hash table bucket's header fields.
 )
 
+const (
+	WALSyncNone     = "none"     // WALSyncNone disables the write-ahead log.
+	WALSyncOS       = "os"       // WALSyncOS writes every log entry to the WAL file and leaves it to OS to flush the file.
+	WALSyncInterval = "interval" // WALSyncInterval writes every log entry to the WAL file and flushes the file periodically.
+	WALSyncAlways   = "always"   // WALSyncAlways flushes the WAL file after writing every log entry.
+)
+
 /*
 Config consists of tuning parameters initialised once upon creation of a new database, the properties heavily influence
 performance characteristics of all collections in a database. Adjust with care!
@@ -26,6 +33,37 @@ type Config struct {
 	HTFileGrowth  int  /// HTFileGrowth is the size (in bytes) to grow hash table file to fit in more entries.
 	HashBits      uint // HashBits is the number of bits to consider for hashing indexed key, also determines the initial number of buckets in a hash table file.
 
+	WALSync            string // WALSync is the write-ahead log sync policy, one of WALSyncNone/OS/Interval/Always.
+	WALIntervalMS      int    // WALIntervalMS is the number of milliseconds between WAL file flushes under WALSyncInterval policy.
+	WALCheckpointBytes int    // WALCheckpointBytes is the size of WAL file above which it is emptied in the background, 0 means no limit.
+
+	SoftDelete   bool // SoftDelete makes document delete put a tombstone on the document instead of removing it.
+	TrackModTime bool // TrackModTime keeps the time of the latest modification of every document.
+
+	Versioning      bool // Versioning keeps previous versions of every document on insert, update and soft-delete.
+	KeepVersions    int  // KeepVersions is the maximum number of versions kept for a document, 0 means no limit.
+	KeepVersionDays int  // KeepVersionDays is the number of days to keep a replaced version, 0 means no limit.
+
+	MaxResultSize int  // MaxResultSize is the maximum number of documents in a query result, 0 means no limit.
+	StrictPaths   bool // StrictPaths makes a query operation on a path that no document has fail instead of matching nothing.
+
+	MaxConcurrentScans int // MaxConcurrentScans is the maximum number of full document scans running at the same time, 0 means no limit.
+	ScanWaitMS         int // ScanWaitMS is the number of milliseconds a scan waits for another to finish when MaxConcurrentScans are running, 0 means no wait.
+
+	CacheAllIDs bool // CacheAllIDs keeps the IDs of all documents of each collection in memory for query "all" and complement of "all".
+
+	IntersectMemoryLimit int // IntersectMemoryLimit is the estimated result size of an intersection sub-query above which its documents are checked one by one, 0 means no limit.
+
+	WarmupOnOpen bool // WarmupOnOpen loads all index files into memory when the database is opened.
+
+	ResultSetTTLSec int // ResultSetTTLSec is the number of seconds a stored query result set is kept after it was last used, 0 means no limit.
+	MaxResultSets   int // MaxResultSets is the maximum number of stored query result sets, 0 means no limit.
+	MaxResultSetIDs int // MaxResultSetIDs is the maximum number of document IDs in all stored query result sets, 0 means no limit.
+
+	AsyncIndex      bool // AsyncIndex makes document writes return before the document is put on indexes, which a background goroutine does.
+	AsyncIndexQueue int  // AsyncIndexQueue is the maximum number of pending index updates, above which a write applies them itself, 0 means no limit.
+
+	ReadOnly       bool   `json:"-"` // ReadOnly opens data files without write access.
 	InitialBuckets int    `json:"-"` // InitialBuckets is the number of buckets initially allocated in a hash table file.
 	Padding        string `json:"-"` // Padding is pre-allocated filler (space characters) for new documents.
 	LenPadding     int    `json:"-"` // LenPadding is the calculated length of Padding string.
@@ -95,17 +133,44 @@ func CreateOrReadConfig(path string) (conf *Config, err error) {
 	return
 }
 
+// ReadConfig reads performance configuration underneath the input database directory without creating or modifying
+// anything. The default configuration is used if the database does not have one.
+func ReadConfig(path string) (conf *Config, err error) {
+	if _, err = os.Stat(path); err != nil {
+		return nil, err
+	}
+	conf = defaultConfig()
+	b, err := ioutil.ReadFile(fmt.Sprintf("%s/data-config.json", path))
+	if os.IsNotExist(err) {
+		return conf, nil
+	} else if err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(b, conf); err != nil {
+		return nil, err
+	}
+	conf.CalculateConfigConstants()
+	return
+}
+
 func defaultConfig() *Config {
 	/*
 		The default configuration matches the constants defined in tiedot version 3.2 and older. They correspond to ~16MB
 		of space per computer CPU core being pre-allocated to each collection.
 	*/
 	ret := &Config{
-		DocMaxRoom:    DefaultDocMaxRoom,
-		ColFileGrowth: COL_FILE_GROWTH,
-		PerBucket:     16,
-		HTFileGrowth:  HT_FILE_GROWTH,
-		HashBits:      HASH_BITS,
+		DocMaxRoom:         DefaultDocMaxRoom,
+		ColFileGrowth:      COL_FILE_GROWTH,
+		PerBucket:          16,
+		HTFileGrowth:       HT_FILE_GROWTH,
+		HashBits:           HASH_BITS,
+		WALSync:            WALSyncNone,
+		WALIntervalMS:      1000,
+		WALCheckpointBytes: 64 * 1048576,
+
+		ResultSetTTLSec: 600,
+		MaxResultSets:   100,
+		MaxResultSetIDs: 10000000,
+		AsyncIndexQueue: 10000,
 	}
 
 	ret.CalculateConfigConstants()
@@ -3,6 +3,7 @@
 package data
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/HouzuoGuo/tiedot/gommap"
@@ -15,6 +16,7 @@ type DataFile struct {
 	Size, Used, Growth int
 	Fh                 *os.File
 	Buf                gommap.MMap
+	ReadOnly           bool // The file is opened and mapped without write access
 }
 
 // Return true if the buffer begins with 64 consecutive zero bytes.
@@ -33,23 +35,45 @@ func LooksEmpty(buf gommap.MMap) bool {
 
 // Open a data file that grows by the specified size.
 func OpenDataFile(path string, growth int) (file *DataFile, err error) {
-	file = &DataFile{Path: path, Growth: growth}
-	if file.Fh, err = os.OpenFile(file.Path, os.O_CREATE|os.O_RDWR, 0600); err != nil {
+	return openDataFile(path, growth, false)
+}
+
+// Open an existing data file without write access. The file cannot grow, and its buffer must not be modified.
+func OpenDataFileReadOnly(path string, growth int) (file *DataFile, err error) {
+	return openDataFile(path, growth, true)
+}
+
+func openDataFile(path string, growth int, readOnly bool) (file *DataFile, err error) {
+	file = &DataFile{Path: path, Growth: growth, ReadOnly: readOnly}
+	if readOnly {
+		file.Fh, err = os.OpenFile(file.Path, os.O_RDONLY, 0600)
+	} else {
+		file.Fh, err = os.OpenFile(file.Path, os.O_CREATE|os.O_RDWR, 0600)
+	}
+	if err != nil {
 		return
 	}
 	var size int64
 	if size, err = file.Fh.Seek(0, os.SEEK_END); err != nil {
 		return
 	}
-	// Ensure the file is not smaller than file growth
-	if file.Size = int(size); file.Size < file.Growth {
+	if file.Size = int(size); readOnly {
+		if file.Size == 0 {
+			return nil, fmt.Errorf("%s is empty and cannot be opened read-only", file.Path)
+		}
+		file.Buf, err = gommap.MapReadOnly(file.Fh)
+	} else if file.Size < file.Growth {
+		// Ensure the file is not smaller than file growth
 		if err = file.EnsureSize(file.Growth); err != nil {
 			return
 		}
 	}
-	if file.Buf == nil {
+	if file.Buf == nil && err == nil {
 		file.Buf, err = gommap.Map(file.Fh)
 	}
+	if err != nil {
+		return
+	}
 	defer tdlog.Infof("%s opened: %d of %d bytes in-use", file.Path, file.Used, file.Size)
 	// Bi-sect file buffer to find out how much space is in-use
 	for low, mid, high := 0, file.Size/2, file.Size; ; {
@@ -76,6 +100,19 @@ func OpenDataFile(path string, growth int) (file *DataFile, err error) {
 	return
 }
 
+// Keeps the bytes read by Touch, so that the reads are not optimised away.
+var touched byte
+
+// Read a byte from every memory page of the in-use portion of the file, so that the pages are loaded into memory.
+// Return the size of the in-use portion.
+func (file *DataFile) Touch() int {
+	pageSize := os.Getpagesize()
+	for i := 0; i < file.Used; i += pageSize {
+		touched ^= file.Buf[i]
+	}
+	return file.Used
+}
+
 // Fill up portion of a file with 0s.
 func (file *DataFile) overwriteWithZero(from int, size int) (err error) {
 	if _, err = file.Fh.Seek(int64(from), os.SEEK_SET); err != nil {
@@ -101,6 +138,8 @@ func (file *DataFile) overwriteWithZero(from int, size int) (err error) {
 func (file *DataFile) EnsureSize(more int) (err error) {
 	if file.Used+more <= file.Size {
 		return
+	} else if file.ReadOnly {
+		return fmt.Errorf("%s is opened read-only and cannot grow", file.Path)
 	} else if file.Buf != nil {
 		if err = file.Buf.Unmap(); err != nil {
 			return
@@ -116,6 +155,16 @@ func (file *DataFile) EnsureSize(more int) (err error) {
 	return file.EnsureSize(more)
 }
 
+// Write modified file buffer and file content back to storage device.
+func (file *DataFile) Sync() (err error) {
+	if file.ReadOnly {
+		return nil
+	} else if err = file.Buf.Flush(); err != nil {
+		return
+	}
+	return file.Fh.Sync()
+}
+
 // Un-map the file buffer and close the file handle.
 func (file *DataFile) Close() (err error) {
 	if err = file.Buf.Unmap(); err != nil {
@@ -126,7 +175,9 @@ func (file *DataFile) Close() (err error) {
 
 // Clear the entire file and resize it to initial size.
 func (file *DataFile) Clear() (err error) {
-	if err = file.Close(); err != nil {
+	if file.ReadOnly {
+		return fmt.Errorf("%s is opened read-only and cannot be cleared", file.Path)
+	} else if err = file.Close(); err != nil {
 		return
 	} else if err = os.Truncate(file.Path, 0); err != nil {
 		return
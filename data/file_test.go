@@ -293,3 +293,29 @@ func TestEnsureSizeMapErr(t *testing.T) {
 		t.Error("Expected error `gommap.Map` in inner function `EnsureSize`")
 	}
 }
+func TestOpenReadOnly(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	if _, err := OpenDataFileReadOnly(tmp, 1024); err == nil {
+		t.Fatal("Did not error")
+	}
+	tmpFile, err := OpenDataFile(tmp, 1024)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	tmpFile.Buf[500] = 1
+	tmpFile.Close()
+	if tmpFile, err = OpenDataFileReadOnly(tmp, 1024); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer tmpFile.Close()
+	if tmpFile.Used != 501 || tmpFile.Size != 1024 || tmpFile.Buf[500] != 1 {
+		t.Fatal("Incorrect Used or Size", tmpFile.Used, tmpFile.Size)
+	}
+	if tmpFile.EnsureSize(1024) == nil || tmpFile.Clear() == nil {
+		t.Fatal("Did not error")
+	}
+	if err = tmpFile.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
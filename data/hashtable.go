@@ -14,6 +14,7 @@ package data
 import (
 	"encoding/binary"
 	"sync"
+	"sync/atomic"
 
 	"github.com/HouzuoGuo/tiedot/tdlog"
 )
@@ -24,12 +25,17 @@ type HashTable struct {
 	*DataFile
 	numBuckets int
 	Lock       *sync.RWMutex
+	corrupt    int32 // Set to 1 (atomically) once a bad bucket chain is found, reset by Clear
 }
 
 // Open a hash table file.
 func (conf *Config) OpenHashTable(path string) (ht *HashTable, err error) {
 	ht = &HashTable{Config: conf, Lock: new(sync.RWMutex)}
-	if ht.DataFile, err = OpenDataFile(path, ht.HTFileGrowth); err != nil {
+	openFile := OpenDataFile
+	if conf.ReadOnly {
+		openFile = OpenDataFileReadOnly
+	}
+	if ht.DataFile, err = openFile(path, ht.HTFileGrowth); err != nil {
 		return
 	}
 	conf.CalculateConfigConstants()
@@ -69,6 +75,7 @@ func (ht *HashTable) nextBucket(bucket int) int {
 		return 0
 	} else if err < 0 || next <= bucket || next >= ht.numBuckets || next < ht.InitialBuckets {
 		tdlog.CritNoRepeat("Bad hash table - repair ASAP %s", ht.Path)
+		atomic.StoreInt32(&ht.corrupt, 1)
 		return 0
 	} else {
 		return next
@@ -100,10 +107,17 @@ func (ht *HashTable) Clear() (err error) {
 	if err = ht.DataFile.Clear(); err != nil {
 		return
 	}
+	atomic.StoreInt32(&ht.corrupt, 0)
 	ht.calculateNumBuckets()
 	return
 }
 
+// Return true if a bad bucket chain has been found in the hash table since it was opened or cleared; entries beyond the
+// bad link are out of reach.
+func (ht *HashTable) Corrupt() bool {
+	return atomic.LoadInt32(&ht.corrupt) == 1
+}
+
 // Store the entry into a vacant (invalidated or empty) place in the appropriate bucket.
 func (ht *HashTable) Put(key, val int) {
 	for bucket, entry := ht.HashKey(key), 0; ; {
@@ -237,3 +251,20 @@ func (ht *HashTable) GetPartition(partNum, partSize int) (keys, vals []int) {
 	}
 	return
 }
+
+// Return approximate number of entries in the hash table, estimated from a portion of its buckets.
+func (ht *HashTable) ApproxEntryCount() int {
+	totalPart := 24 // not magic; a larger number makes estimation less accurate, but improves performance
+	for {
+		keys, _ := ht.GetPartition(0, totalPart)
+		if len(keys) == 0 {
+			if totalPart < 8 {
+				return 0 // the hash table is really really empty
+			}
+			// Try a larger partition size
+			totalPart = totalPart / 2
+		} else {
+			return int(float64(len(keys)) * float64(totalPart))
+		}
+	}
+}
@@ -251,3 +251,30 @@ func TestNextBucketZero(t *testing.T) {
 	}
 
 }
+
+func TestCorruptBucketChain(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	d := defaultConfig()
+	ht, err := d.OpenHashTable(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ht.Close()
+	// Fill the first bucket so that lookup follows its chain
+	for i := 0; i <= ht.PerBucket; i++ {
+		ht.Put(0, i)
+	}
+	if len(ht.Get(0, 0)) != ht.PerBucket+1 || ht.Corrupt() {
+		t.Fatal("Failed to put")
+	}
+	// Link the bucket to a bucket that cannot be chained
+	bucketAddr := ht.HashKey(0) * ht.BucketSize
+	binary.PutVarint(ht.Buf[bucketAddr:bucketAddr+10], -1)
+	if vals := ht.Get(0, 0); len(vals) != ht.PerBucket || !ht.Corrupt() {
+		t.Fatal(vals, ht.Corrupt())
+	}
+	if err = ht.Clear(); err != nil || ht.Corrupt() {
+		t.Fatal(err, ht.Corrupt())
+	}
+}
@@ -140,21 +140,25 @@ func (part *Partition) ForEachDoc(partNum, totalPart int, fun func(id int, doc [
 	return true
 }
 
+// Return IDs of all documents in the partition, in no particular order.
+func (part *Partition) AllIDs() []int {
+	ids, _ := part.lookup.GetPartition(0, 1)
+	return ids
+}
+
 // Return approximate number of documents in the partition.
 func (part *Partition) ApproxDocCount() int {
-	totalPart := 24 // not magic; a larger number makes estimation less accurate, but improves performance
-	for {
-		keys, _ := part.lookup.GetPartition(0, totalPart)
-		if len(keys) == 0 {
-			if totalPart < 8 {
-				return 0 // the hash table is really really empty
-			}
-			// Try a larger partition size
-			totalPart = totalPart / 2
-		} else {
-			return int(float64(len(keys)) * float64(totalPart))
-		}
-	}
+	return part.lookup.ApproxEntryCount()
+}
+
+// Return the space taken by documents and by deleted documents in the partition.
+func (part *Partition) SpaceUsage() SpaceUsage {
+	return part.col.SpaceUsage()
+}
+
+// Load the lookup hash table into memory, return its size in bytes.
+func (part *Partition) TouchLookup() int {
+	return part.lookup.Touch()
 }
 
 // Clear data file and lookup hash table.
@@ -177,6 +181,22 @@ func (part *Partition) Clear() error {
 	return err
 }
 
+// Write document data and lookup hash table back to storage device.
+func (part *Partition) Sync() error {
+
+	var err error
+
+	if e := part.col.Sync(); e != nil {
+		tdlog.CritNoRepeat("Failed to sync %s: %v", part.col.Path, e)
+		err = dberr.New(dberr.ErrorIO)
+	}
+	if e := part.lookup.Sync(); e != nil {
+		tdlog.CritNoRepeat("Failed to sync %s: %v", part.lookup.Path, e)
+		err = dberr.New(dberr.ErrorIO)
+	}
+	return err
+}
+
 // Close all file handles.
 func (part *Partition) Close() error {
 
@@ -67,6 +67,9 @@ func TestPartitionDocCRUD(t *testing.T) {
 		}
 		return true
 	})
+	if ids := part.AllIDs(); !reflect.DeepEqual(ids, []int{2}) {
+		t.Fatal(ids)
+	}
 	// Finish up
 	if err = part.Clear(); err != nil {
 		t.Fatal(err)
@@ -0,0 +1,76 @@
+// Cache of all document IDs.
+//
+// Query "all", and a complement of the universe "all" such as {"not": [...]}, collect the IDs of all documents by
+// reading through every document of the collection. With CacheAllIDs configured, the IDs collected by the first such
+// query are kept in memory, and following queries copy them instead of reading documents again. Insert, delete,
+// soft-delete and undelete keep the cache up to date, so that it always has the IDs of the documents that are not
+// soft-deleted; truncate drops it. The cache takes memory in proportion to the number of documents.
+
+package db
+
+import (
+	"sync"
+)
+
+// IDs of all documents of a collection that are not soft-deleted.
+type allIDsCache struct {
+	lock    sync.Mutex
+	ids     map[int]struct{} // nil until the first query collects them
+	changes int              // Number of changes made to the documents, which tells whether IDs collected meanwhile are stale
+}
+
+// Put all document IDs into result from the cache, collecting them for the cache first if necessary.
+func (col *Col) cachedAllIDs(result *map[int]struct{}) (err error) {
+	cache := col.allIDs
+	cache.lock.Lock()
+	if cache.ids != nil {
+		for id := range cache.ids {
+			(*result)[id] = struct{}{}
+		}
+		cache.lock.Unlock()
+		col.traceNote("Took %d document IDs from cache", len(cache.ids))
+		return resultTooLarge(col, result)
+	}
+	changes := cache.changes
+	cache.lock.Unlock()
+	ids := make(map[int]struct{})
+	candidates := 0
+	col.forEachDoc(col.skipDeleted(func(id int, _ []byte) bool {
+		candidates++
+		ids[id] = struct{}{}
+		return true
+	}), false)
+	col.countQueryCost(candidates, 0, 1)
+	cache.lock.Lock()
+	if cache.changes == changes {
+		// No document has changed while collecting the IDs
+		cache.ids = ids
+	}
+	cache.lock.Unlock()
+	for id := range ids {
+		(*result)[id] = struct{}{}
+	}
+	return resultTooLarge(col, result)
+}
+
+// Add or remove the document ID in the cache of all document IDs. Does not place schema lock.
+func (col *Col) cacheDocID(id int, exists bool) {
+	cache := col.allIDs
+	cache.lock.Lock()
+	cache.changes++
+	if cache.ids != nil && exists {
+		cache.ids[id] = struct{}{}
+	} else if cache.ids != nil {
+		delete(cache.ids, id)
+	}
+	cache.lock.Unlock()
+}
+
+// Drop the cache of all document IDs, e.g. after the collection is truncated. Does not place schema lock.
+func (col *Col) dropAllIDs() {
+	cache := col.allIDs
+	cache.lock.Lock()
+	cache.changes++
+	cache.ids = nil
+	cache.lock.Unlock()
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCacheAllIDs(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Config.SoftDelete = true
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	db.Config.CacheAllIDs = true
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 0)
+	for i := 0; i < 10; i++ {
+		id, err := col.Insert(map[string]interface{}{"a": i % 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// Compare the cached IDs with documents read through
+	check := func(expected ...int) {
+		for _, q := range []interface{}{"all", map[string]interface{}{"not": map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}}} {
+			result := make(map[int]struct{})
+			if err := EvalQuery(q, col, &result); err != nil {
+				t.Fatal(err)
+			}
+			db.Config.CacheAllIDs = false
+			uncached := make(map[int]struct{})
+			if err := EvalQuery(q, col, &uncached); err != nil {
+				t.Fatal(err)
+			}
+			db.Config.CacheAllIDs = true
+			if len(result) != len(uncached) {
+				t.Fatal(q, result, uncached)
+			}
+			for id := range uncached {
+				if _, cached := result[id]; !cached {
+					t.Fatal(q, id)
+				}
+			}
+		}
+		result := make(map[int]struct{})
+		if err := EvalQuery("all", col, &result); err != nil || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(result, expected, err)
+		}
+	}
+	check(ids...)
+	if _, trace, err := EvalQueryWithTrace("all", col); err != nil || !strings.Contains(strings.Join(trace.Notes, "\n"), "from cache") {
+		t.Fatal(trace, err)
+	}
+	// Insert, soft-delete, undelete and purge change the cache
+	id, err := col.Insert(map[string]interface{}{"a": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = append(ids, id)
+	check(ids...)
+	if err = col.Delete(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	check(ids[1:]...)
+	if err = col.Undelete(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	check(ids...)
+	if err = col.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	ids = append(ids[:1], ids[2:]...)
+	check(ids...)
+	// Truncate empties the cache
+	if err = db.Truncate("col"); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if id, err = col.Insert(map[string]interface{}{"a": 0}); err != nil {
+		t.Fatal(err)
+	}
+	check(id)
+}
@@ -0,0 +1,143 @@
+// Asynchronous index updates.
+//
+// With AsyncIndex configured, a document write returns once the document data is written, and the index updates of
+// the write are queued and applied in the order of writes by a background goroutine. Until the queued updates are
+// applied, queries do not see the new values of written documents. Queries with option "wait-for-index" and
+// DB.WaitForIndex apply the queued updates before going ahead, and so does every schema change.
+
+package db
+
+import (
+	"sync"
+)
+
+// Index update of a document write, before is the previously indexed document and after is the written one.
+type indexUpdate struct {
+	col           *Col
+	id            int
+	before, after map[string]interface{}
+}
+
+// Queue of index updates waiting for the background goroutine.
+type indexQueue struct {
+	lock    sync.Mutex    // Protects pending updates and the goroutine channels
+	apply   sync.Mutex    // Held while applying updates, so that they are applied in the order of writes
+	pending []indexUpdate // Updates in the order of writes
+	wake    chan struct{} // Signals the goroutine that there are pending updates, nil if the goroutine is not running
+	stop    chan struct{} // Closed to stop the goroutine
+}
+
+// Take the document off its previously indexed values and put it on the new ones, either right away or, with async
+// index updates, by the background goroutine. Document may be nil for an insert (before) or a delete (after). Async
+// index updates take a private copy of the new document from docJS, so that the caller may reuse the document.
+// Caller must place schema lock.
+func (col *Col) reindexDoc(id int, before, after map[string]interface{}, docJS []byte) {
+	if !col.db.Config.AsyncIndex {
+		if before != nil {
+			col.unindexDoc(id, before)
+		}
+		if after != nil {
+			col.indexDoc(id, after)
+		}
+		return
+	}
+	if after != nil {
+		if private, err := decodeDoc(docJS); err == nil {
+			after = private
+		}
+	}
+	queue := &col.db.indexQueue
+	queue.lock.Lock()
+	queue.pending = append(queue.pending, indexUpdate{col: col, id: id, before: before, after: after})
+	backlog := len(queue.pending)
+	if queue.wake == nil {
+		queue.wake, queue.stop = make(chan struct{}, 1), make(chan struct{})
+		go col.db.applyIndexUpdates(queue.wake, queue.stop)
+	}
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+	queue.lock.Unlock()
+	// Writes faster than the goroutine apply the backlog themselves
+	if limit := col.db.Config.AsyncIndexQueue; limit > 0 && backlog >= limit {
+		col.db.flushIndexUpdates()
+	}
+}
+
+// Apply queued index updates whenever there are any, until told to stop.
+func (db *DB) applyIndexUpdates(wake, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-wake:
+			db.schemaLock.RLock()
+			db.flushIndexUpdates()
+			db.schemaLock.RUnlock()
+		}
+	}
+}
+
+// Apply all queued index updates. Caller must place schema lock.
+func (db *DB) flushIndexUpdates() {
+	queue := &db.indexQueue
+	queue.apply.Lock()
+	defer queue.apply.Unlock()
+	queue.lock.Lock()
+	pending := queue.pending
+	queue.pending = nil
+	queue.lock.Unlock()
+	for _, update := range pending {
+		if update.col.closed {
+			continue
+		}
+		if update.before != nil {
+			update.col.unindexDoc(update.id, update.before)
+		}
+		if update.after != nil {
+			update.col.indexDoc(update.id, update.after)
+		}
+	}
+}
+
+// Stop the background goroutine. Caller must place schema lock and apply queued index updates beforehand.
+func (db *DB) stopIndexUpdates() {
+	queue := &db.indexQueue
+	queue.lock.Lock()
+	if queue.stop != nil {
+		close(queue.stop)
+		queue.wake, queue.stop = nil, nil
+	}
+	queue.lock.Unlock()
+}
+
+// Apply queued index updates if the query has option "wait-for-index". Caller must place schema lock.
+func waitForIndex(q interface{}, src *Col) {
+	if expr, isMap := q.(map[string]interface{}); isMap {
+		if wait, _ := expr["wait-for-index"].(bool); wait {
+			src.db.flushIndexUpdates()
+		}
+	}
+}
+
+// Place schema write lock, then apply queued index updates so that schema changes see all written documents indexed.
+func (db *DB) lockSchema() {
+	db.schemaLock.Lock()
+	db.flushIndexUpdates()
+}
+
+// Return the number of index updates queued but not yet applied.
+func (db *DB) PendingIndexUpdates() int {
+	db.indexQueue.lock.Lock()
+	defer db.indexQueue.lock.Unlock()
+	return len(db.indexQueue.pending)
+}
+
+// Apply queued index updates, so that queries see every document written before the call. Does nothing unless
+// AsyncIndex is configured.
+func (db *DB) WaitForIndex() {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	db.flushIndexUpdates()
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAsyncIndex(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Config.AsyncIndex = true
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(val interface{}, wait bool) map[int]struct{} {
+		result := make(map[int]struct{})
+		if err := EvalQuery(map[string]interface{}{"eq": val, "in": []interface{}{"a"}, "wait-for-index": wait}, col, &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	// Hold up the background goroutine, so that the writes stay queued
+	db.indexQueue.apply.Lock()
+	doc := map[string]interface{}{"a": 1}
+	first, err := col.Insert(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc["a"] = 100 // the queued update keeps its own copy
+	second, err := col.Insert(map[string]interface{}{"a": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending := db.PendingIndexUpdates(); pending != 2 {
+		t.Fatal(pending)
+	} else if result := lookup(1, false); len(result) != 0 {
+		t.Fatal(result)
+	}
+	db.indexQueue.apply.Unlock()
+	if result := lookup(1, true); len(result) != 1 {
+		t.Fatal(result)
+	} else if _, found := result[first]; !found {
+		t.Fatal(result)
+	} else if pending := db.PendingIndexUpdates(); pending != 0 {
+		t.Fatal(pending)
+	}
+	// Update and delete take the documents off their old values
+	if err = col.Update(first, map[string]interface{}{"a": 3}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(second); err != nil {
+		t.Fatal(err)
+	}
+	db.WaitForIndex()
+	if result := lookup(1, false); len(result) != 0 {
+		t.Fatal(result)
+	} else if result := lookup(2, false); len(result) != 0 {
+		t.Fatal(result)
+	} else if result := lookup(3, false); len(result) != 1 {
+		t.Fatal(result)
+	}
+	// Schema change applies queued updates before it goes ahead, so the new index does not get a document twice
+	db.indexQueue.apply.Lock()
+	if _, err = col.Insert(map[string]interface{}{"a": 4, "b": 4}); err != nil {
+		t.Fatal(err)
+	}
+	db.indexQueue.apply.Unlock()
+	if err = col.Index([]string{"b"}); err != nil {
+		t.Fatal(err)
+	} else if pending := db.PendingIndexUpdates(); pending != 0 {
+		t.Fatal(pending)
+	}
+	if entries, err := col.IndexEntriesFor([]string{"b"}, 4); err != nil || len(entries) != 1 {
+		t.Fatal(entries, err)
+	}
+	// A full queue is applied by the write that fills it
+	db.Config.AsyncIndexQueue = 2
+	db.indexQueue.apply.Lock()
+	if _, err = col.Insert(map[string]interface{}{"a": 5}); err != nil {
+		t.Fatal(err)
+	}
+	db.indexQueue.apply.Unlock()
+	if _, err = col.Insert(map[string]interface{}{"a": 6}); err != nil {
+		t.Fatal(err)
+	}
+	if result := lookup(5, false); len(result) != 1 {
+		t.Fatal(result)
+	}
+	// Close applies queued updates before flushing indexes
+	db.indexQueue.apply.Lock()
+	if _, err = col.Insert(map[string]interface{}{"a": 7}); err != nil {
+		t.Fatal(err)
+	}
+	db.indexQueue.apply.Unlock()
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("col")
+	if result := lookup(7, false); len(result) != 1 {
+		t.Fatal(result)
+	}
+}
@@ -0,0 +1,153 @@
+// Bloom filter of index keys.
+//
+// A lookup of a value that no document has still reads the bucket chain of the value on the hash table, which on a
+// huge collection is likely to be out of memory. An index may keep a Bloom filter of its hash keys in memory, so that
+// lookup of such a value finds out from the filter alone that the value is definitely not on the index. A value the
+// filter may have is looked up on the hash table as usual, so the filter never changes a query result. The filter is
+// built from the hash table when the index is opened, sized for twice the number of keys on the index, and every key
+// put on the index afterwards is added to it. A Bloom filter cannot forget a key: keys removed from the index stay in
+// the filter until it is built again, and as more keys are added than it was sized for, more values it rules out
+// turn out to be possibly there. The filter is off by default, and turned on for an index by a marker file in the
+// index directory.
+
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	BLOOM_INDEX_FILE     = "bloom" // Name of the file in index directory that turns on the Bloom filter of the index.
+	BLOOM_BITS_PER_KEY   = 10      // Bits of Bloom filter for every key it is sized for, which gives about 1% false positives.
+	BLOOM_HASHES         = 7       // Number of bits set in Bloom filter for a key.
+	BLOOM_MIN_SIZED_KEYS = 1024    // Number of keys a Bloom filter is sized for at least.
+)
+
+// Bloom filter of the hash keys of an index.
+type bloomFilter struct {
+	lock sync.RWMutex
+	bits []uint64
+}
+
+// Make a Bloom filter sized for the number of keys.
+func newBloomFilter(sizedKeys int) *bloomFilter {
+	if sizedKeys < BLOOM_MIN_SIZED_KEYS {
+		sizedKeys = BLOOM_MIN_SIZED_KEYS
+	}
+	return &bloomFilter{bits: make([]uint64, (sizedKeys*BLOOM_BITS_PER_KEY+63)/64)}
+}
+
+// Return the positions of the bits of the hash key, calculated by double hashing of the key mixed by two multipliers.
+func (bloom *bloomFilter) positions(hashKey int) (pos [BLOOM_HASHES]uint64) {
+	h1 := uint64(hashKey) * 0x9E3779B97F4A7C15
+	h1 ^= h1 >> 31
+	h2 := uint64(hashKey)*0xC2B2AE3D27D4EB4F | 1
+	h2 ^= h2 >> 29
+	size := uint64(len(bloom.bits)) * 64
+	for i := range pos {
+		pos[i] = (h1 + uint64(i)*h2) % size
+	}
+	return
+}
+
+// Add a hash key to the filter.
+func (bloom *bloomFilter) add(hashKey int) {
+	pos := bloom.positions(hashKey)
+	bloom.lock.Lock()
+	for _, bit := range pos {
+		bloom.bits[bit/64] |= 1 << (bit % 64)
+	}
+	bloom.lock.Unlock()
+}
+
+// Return false if the hash key is definitely not in the filter.
+func (bloom *bloomFilter) mayContain(hashKey int) bool {
+	pos := bloom.positions(hashKey)
+	bloom.lock.RLock()
+	defer bloom.lock.RUnlock()
+	for _, bit := range pos {
+		if bloom.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Turn the Bloom filter of the index on or off. Turning it on builds the filter from the index.
+func (col *Col) SetIndexBloom(idxPath []string, bloom bool) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, exists := col.indexPaths[idxName]; !exists {
+		return fmt.Errorf("Path %v is not indexed", idxPath)
+	}
+	markerFile := path.Join(col.db.path, col.name, idxName, BLOOM_INDEX_FILE)
+	if !bloom {
+		delete(col.blooms, idxName)
+		if err := os.Remove(markerFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := ioutil.WriteFile(markerFile, []byte{}, 0600); err != nil {
+		return err
+	}
+	col.buildBloom(idxName)
+	return nil
+}
+
+// Return true if the index on the path has a Bloom filter.
+func (col *Col) IndexBloom(idxPath []string) bool {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	_, bloom := col.blooms[strings.Join(idxPath, INDEX_PATH_SEP)]
+	return bloom
+}
+
+// Build the Bloom filter of the index if it is turned on. Does not place schema lock.
+func (col *Col) loadBloom(idxName string) error {
+	if _, err := os.Stat(path.Join(col.db.path, col.name, idxName, BLOOM_INDEX_FILE)); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	col.buildBloom(idxName)
+	return nil
+}
+
+// Build the Bloom filter of the index from all of its hash keys. Does not place schema lock.
+func (col *Col) buildBloom(idxName string) {
+	keys := make([]int, 0)
+	col.forEachHashEntry(idxName, func(hashKey int, _ []int) bool {
+		keys = append(keys, hashKey)
+		return true
+	})
+	// Leave room for as many keys to be added
+	bloom := newBloomFilter(2 * len(keys))
+	for _, key := range keys {
+		bloom.add(key)
+	}
+	col.blooms[idxName] = bloom
+}
+
+// Add the hash key to the Bloom filter of the index, if the index has one. Does not place schema lock.
+func (col *Col) bloomAdd(idxName string, hashKey int) {
+	if bloom, exists := col.blooms[idxName]; exists {
+		bloom.add(hashKey)
+	}
+}
+
+// Return true if the Bloom filter of the index tells that the hash key is definitely not on the index. Does not place
+// schema lock.
+func (col *Col) bloomRulesOut(idxName string, hashKey int) bool {
+	bloom, exists := col.blooms[idxName]
+	return exists && !bloom.mayContain(hashKey)
+}
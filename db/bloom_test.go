@@ -0,0 +1,116 @@
+package db
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIndexBloom(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err = col.Insert(map[string]interface{}{"a": i * 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = col.SetIndexBloom([]string{"b"}, true); err == nil {
+		t.Fatal("did not error")
+	} else if err = col.SetIndexBloom([]string{"a"}, true); err != nil {
+		t.Fatal(err)
+	} else if !col.IndexBloom([]string{"a"}) {
+		t.Fatal("no bloom filter")
+	}
+	// Documents inserted afterwards are added to the filter
+	if _, err = col.Insert(map[string]interface{}{"a": 1001}); err != nil {
+		t.Fatal(err)
+	}
+	count := func(q map[string]interface{}) int {
+		result := make(map[int]struct{})
+		if err := EvalQuery(q, col, &result); err != nil {
+			t.Fatal(err)
+		}
+		return len(result)
+	}
+	check := func() {
+		for i := 0; i < 200; i++ {
+			if n := count(map[string]interface{}{"eq": i, "in": []interface{}{"a"}}); n != 1-i%2 {
+				t.Fatal(i, n)
+			}
+		}
+		if n := count(map[string]interface{}{"eq": 1001, "in": []interface{}{"a"}}); n != 1 {
+			t.Fatal(n)
+		} else if n = count(map[string]interface{}{"int-from": 0, "int-to": 20, "in": []interface{}{"a"}}); n != 11 {
+			t.Fatal(n)
+		} else if n = count(map[string]interface{}{"int-set": []interface{}{3, 4, 1001}, "in": []interface{}{"a"}}); n != 2 {
+			t.Fatal(n)
+		}
+	}
+	check()
+	// Lookup of a value ruled out does not read the hash table
+	if result, trace, err := EvalQueryWithTrace(map[string]interface{}{"eq": "absent", "in": []interface{}{"a"}}, col); err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	} else if notes := strings.Join(trace.Notes, "\n"); !strings.Contains(notes, "Bloom filter of index a rules out absent") {
+		t.Fatal(notes)
+	}
+	// The filter is built again on reopen, scrub and rebuild
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("col")
+	if !col.IndexBloom([]string{"a"}) {
+		t.Fatal("bloom filter is lost")
+	}
+	check()
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if !col.IndexBloom([]string{"a"}) {
+		t.Fatal("bloom filter is lost")
+	}
+	check()
+	if err = col.RebuildIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if err = col.SetIndexBloom([]string{"a"}, false); err != nil {
+		t.Fatal(err)
+	} else if col.IndexBloom([]string{"a"}) {
+		t.Fatal("still has bloom filter")
+	}
+	check()
+}
+
+func TestBloomFilterFalsePositives(t *testing.T) {
+	bloom := newBloomFilter(10000)
+	for i := 0; i < 10000; i++ {
+		bloom.add(StrHash(indexString(i)))
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if !bloom.mayContain(StrHash(indexString(i))) {
+			t.Fatal("false negative", i)
+		} else if bloom.mayContain(StrHash(indexString(i + 10000))) {
+			falsePositives++
+		}
+	}
+	// About 1% as sized
+	if falsePositives > 300 {
+		t.Fatal(falsePositives)
+	}
+}
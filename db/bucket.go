@@ -0,0 +1,81 @@
+// Numeric bucket grouping.
+//
+// A bucket query {"bucket": [path], "size": #} groups documents by the numeric bucket their value on the path falls
+// into, for histograms and range sliders. The bucket index of a value is the value divided by bucket size, rounded
+// down; e.g. with size 10, values 0 to 9.99 are in bucket 0, values 10 to 19.99 are in bucket 1, and values -10 to
+// -0.01 are in bucket -1. Optional "q" restricts the grouping to documents matching the sub-query.
+
+package db
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// Evaluate a bucket query and return IDs of documents in each bucket (bucket index as map key) in ascending order.
+// A document having several values on the path is in the bucket of every value; non-numeric values are ignored.
+func EvalBuckets(q interface{}, src *Col) (map[int][]int, error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	if src.closed {
+		return nil, dberr.New(dberr.ErrorColClosed, src.name)
+	}
+	expr, ok := q.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expecting a bucket query, but %v given", q)
+	}
+	bucketPath, hasPath := expr["bucket"]
+	if !hasPath {
+		return nil, dberr.New(dberr.ErrorMissing, "bucket")
+	}
+	vecPath, err := queryPath(bucketPath)
+	if err != nil {
+		return nil, err
+	}
+	sizeVal, hasSize := expr["size"]
+	if !hasSize {
+		return nil, dberr.New(dberr.ErrorMissing, "size")
+	}
+	size, err := queryFloat("size", sizeVal)
+	if err != nil {
+		return nil, err
+	} else if size <= 0 {
+		return nil, fmt.Errorf("Expecting `size` to be a positive number, but %v given", sizeVal)
+	}
+	// Documents having a value on the (indexed) path are the candidates, unless a sub-query narrows them down
+	candidates := make(map[int]struct{})
+	if subExpr, narrowed := expr["q"]; narrowed {
+		err = evalQuery(optimizeQuery(subExpr, src), src, &candidates, false)
+	} else {
+		err = PathExistence(bucketPath, map[string]interface{}{}, src, &candidates)
+	}
+	if err != nil {
+		return nil, err
+	}
+	buckets := make(map[int][]int)
+	for id := range candidates {
+		doc, err := src.readForIndex(id)
+		if err != nil {
+			continue
+		}
+		inBucket := make(map[int]struct{})
+		for _, val := range GetIn(doc, vecPath) {
+			num, err := queryFloat("bucket", val)
+			if err != nil {
+				continue
+			}
+			bucket := int(math.Floor(num / size))
+			if _, in := inBucket[bucket]; !in {
+				inBucket[bucket] = struct{}{}
+				buckets[bucket] = append(buckets[bucket], id)
+			}
+		}
+	}
+	for _, ids := range buckets {
+		sort.Ints(ids)
+	}
+	return buckets, nil
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestEvalBuckets(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"price"})
+	col.Index([]string{"kind"})
+	cheap, _ := col.Insert(map[string]interface{}{"price": 5, "kind": "a"})
+	edge, _ := col.Insert(map[string]interface{}{"price": 10, "kind": "b"})
+	fraction, _ := col.Insert(map[string]interface{}{"price": 19.99, "kind": "a"})
+	negative, _ := col.Insert(map[string]interface{}{"price": -0.5, "kind": "a"})
+	several, _ := col.Insert(map[string]interface{}{"price": []interface{}{1, 2, 35}, "kind": "b"})
+	col.Insert(map[string]interface{}{"price": "free", "kind": "a"})
+	col.Insert(map[string]interface{}{"kind": "a"})
+	check := func(query string, expected map[int][]int) {
+		var q interface{}
+		if err := json.Unmarshal([]byte(query), &q); err != nil {
+			t.Fatal(err)
+		}
+		if buckets, err := EvalBuckets(q, col); err != nil || !reflect.DeepEqual(buckets, expected) {
+			t.Fatal(query, buckets, err)
+		}
+	}
+	sortedIDs := func(ids ...int) []int {
+		sort.Ints(ids)
+		return ids
+	}
+	check(`{"bucket": ["price"], "size": 10}`, map[int][]int{
+		-1: {negative},
+		0:  sortedIDs(cheap, several),
+		1:  sortedIDs(edge, fraction),
+		3:  {several},
+	})
+	check(`{"bucket": ["price"], "size": 10, "q": {"eq": "a", "in": ["kind"]}}`, map[int][]int{
+		-1: {negative},
+		0:  {cheap},
+		1:  {fraction},
+	})
+	check(`{"bucket": ["price"], "size": 100, "q": {"eq": "c", "in": ["kind"]}}`, map[int][]int{})
+	for _, q := range []interface{}{
+		"all",
+		map[string]interface{}{"size": 10.0},
+		map[string]interface{}{"bucket": []interface{}{"price"}},
+		map[string]interface{}{"bucket": []interface{}{"price"}, "size": 0.0},
+		map[string]interface{}{"bucket": 1.0, "size": 10.0},
+	} {
+		if _, err := EvalBuckets(q, col); err == nil {
+			t.Fatal("Did not error", q)
+		}
+	}
+	if _, err := EvalBuckets(map[string]interface{}{"bucket": []interface{}{"size"}, "size": 1.0}, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+}
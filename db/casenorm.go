@@ -0,0 +1,103 @@
+// Case-normalized indexes.
+//
+// A case-normalized index is an index on a path that stores string values in lower case, so that case-insensitive
+// lookup {"eq-ci": "John", "in": ["name"]} is a hash lookup just like {"eq": ...}. A path may have both an ordinary
+// index and a case-normalized index. The case-normalized index lives in a directory named by the path following
+// CASE_NORMALIZED_INDEX_PREFIX, which marks the index as case-normalized when the collection is opened again.
+
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	CASE_NORMALIZED_INDEX_PREFIX = "^" // Prefix of case-normalized index directory name.
+)
+
+// Create a case-normalized index on the path, and put all documents on the index.
+func (col *Col) IndexCaseNormalized(idxPath []string) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	if len(idxPath) == 0 {
+		return fmt.Errorf("Case-normalized index path may not be empty")
+	}
+	return col.index(CASE_NORMALIZED_INDEX_PREFIX+strings.Join(idxPath, INDEX_PATH_SEP), idxPath)
+}
+
+// Remove the case-normalized index of the path.
+func (col *Col) UnindexCaseNormalized(idxPath []string) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	return col.unindex(CASE_NORMALIZED_INDEX_PREFIX+strings.Join(idxPath, INDEX_PATH_SEP), idxPath)
+}
+
+// Return all paths that have a case-normalized index.
+func (col *Col) AllCaseNormalizedIndexes() (ret [][]string) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	ret = make([][]string, 0)
+	for idxName, idxPath := range col.indexPaths {
+		if strings.HasPrefix(idxName, CASE_NORMALIZED_INDEX_PREFIX) {
+			ret = append(ret, append([]string{}, idxPath...))
+		}
+	}
+	return
+}
+
+// Case-insensitive value equity check using hash lookup on the case-normalized index of the path.
+func LookupCaseInsensitive(lookupValue interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) error {
+	return lookup(lookupValue, expr, src, result, CASE_NORMALIZED_INDEX_PREFIX, nil)
+}
+
+// Return a string value in lower case, or a value of other type as it is.
+func lowerCase(val interface{}) interface{} {
+	if str, isStr := val.(string); isStr {
+		return strings.ToLower(str)
+	}
+	return val
+}
+
+// Return the prefix of the index name that tells how the index normalizes values - CASE_NORMALIZED_INDEX_PREFIX or
+// COLLATED_INDEX_PREFIX - or an empty string if the index stores values as they are.
+func normalizationOf(idxName string) string {
+	for _, prefix := range []string{CASE_NORMALIZED_INDEX_PREFIX, COLLATED_INDEX_PREFIX} {
+		if strings.HasPrefix(idxName, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// Return the value as the index of the name stores it: lower-cased on a case-normalized index, by collation key on a
+// collated index, or as it is.
+func normalizeIndexValue(idxName string, val interface{}) interface{} {
+	switch normalizationOf(idxName) {
+	case CASE_NORMALIZED_INDEX_PREFIX:
+		return lowerCase(val)
+	case COLLATED_INDEX_PREFIX:
+		return collated(val)
+	}
+	return val
+}
+
+// Return the distinct values of the document along the path in string form as they are put on the index, normalized
+// if the index is case-normalized or collated.
+func pathIndexValues(idxName string, doc interface{}, idxPath []string) []string {
+	if normalizationOf(idxName) == "" {
+		return indexValues(doc, idxPath)
+	}
+	vals := GetIn(doc, idxPath)
+	normalized := make([]interface{}, len(vals))
+	for i, val := range vals {
+		normalized[i] = normalizeIndexValue(idxName, val)
+	}
+	return distinctStrings(withNumericStrings(normalized))
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestIndexCaseNormalized(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	john, _ := col.Insert(map[string]interface{}{"name": "John"})
+	if err = col.IndexCaseNormalized([]string{"name"}); err != nil {
+		t.Fatal(err)
+	} else if col.IndexCaseNormalized([]string{"name"}) == nil {
+		t.Fatal("Did not error")
+	}
+	upper, _ := col.Insert(map[string]interface{}{"name": "JOHN"})
+	bob, _ := col.Insert(map[string]interface{}{"name": []interface{}{"Bob", "Robert"}})
+	number, _ := col.Insert(map[string]interface{}{"name": 1})
+	// Both existing and new documents are on the index, only string values are normalized
+	check := func(query string, expected ...int) {
+		result, err := runQuery(query, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+	}
+	check(`{"eq-ci": "john", "in": ["name"]}`, john, upper)
+	check(`{"eq-ci": "jOhN", "in": ["name"]}`, john, upper)
+	check(`{"eq-ci": ["ROBERT", 1], "in": ["name"]}`, bob, number)
+	check(`{"eq-ci": "john", "in": ["name"], "limit": 1}`, john)
+	if err = col.Update(upper, map[string]interface{}{"name": "Jane"}); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"eq-ci": "JOHN", "in": ["name"]}`, john)
+	// Case-sensitive lookup needs an ordinary index, which may live alongside
+	if _, err = runQuery(`{"eq": "John", "in": ["name"]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	} else if _, err = runQuery(`{"eq-ci": "John", "in": ["other"]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	if err = col.Index([]string{"name"}); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"eq": "John", "in": ["name"]}`, john)
+	if indexes := col.AllIndexes(); !reflect.DeepEqual(indexes, [][]string{{"name"}}) {
+		t.Fatal(indexes)
+	} else if indexes := col.AllCaseNormalizedIndexes(); !reflect.DeepEqual(indexes, [][]string{{"name"}}) {
+		t.Fatal(indexes)
+	}
+	if match, err := matchDoc(map[string]interface{}{"eq-ci": "jane", "in": []interface{}{"name"}}, upper, map[string]interface{}{"name": "JANE"}); err != nil || !match {
+		t.Fatal(match, err)
+	}
+	// The index survives reopen and scrub
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	check(`{"eq-ci": "john", "in": ["name"]}`, john)
+	if report, err := col.VerifyIndexes(); err != nil || len(report.Missing) != 0 || len(report.Orphaned) != 0 {
+		t.Fatal(report, err)
+	}
+	if err = col.UnindexCaseNormalized([]string{"name"}); err != nil {
+		t.Fatal(err)
+	} else if col.UnindexCaseNormalized([]string{"name"}) == nil {
+		t.Fatal("Did not error")
+	}
+	check(`{"eq": "John", "in": ["name"]}`, john)
+	if indexes := col.AllCaseNormalizedIndexes(); len(indexes) != 0 {
+		t.Fatal(indexes)
+	}
+}
@@ -3,30 +3,54 @@
 package db
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
 )
 
 const (
-	DOC_DATA_FILE   = "dat_" // Prefix of partition collection data file name.
-	DOC_LOOKUP_FILE = "id_"  // Prefix of partition hash table (ID lookup) file name.
-	INDEX_PATH_SEP  = "!"    // Separator between index keys in index directory name.
+	DOC_DATA_FILE           = "dat_" // Prefix of partition collection data file name.
+	DOC_LOOKUP_FILE         = "id_"  // Prefix of partition hash table (ID lookup) file name.
+	DOC_TOMBSTONE_FILE      = "del_" // Prefix of partition hash table (soft-deleted document IDs) file name.
+	DOC_MODTIME_FILE        = "mod_" // Prefix of partition hash table (document modification time) file name.
+	DOC_VERSION_FILE        = "ver_" // Prefix of partition document version file name.
+	DOC_VERSION_LOOKUP_FILE = "vid_" // Prefix of partition hash table (document version lookup) file name.
+	INDEX_PATH_SEP          = "!"    // Separator between index keys in index directory name.
 )
 
 // Collection has data partitions and some index meta information.
 type Col struct {
-	db         *DB
-	name       string
-	parts      []*data.Partition            // Collection partitions
-	hts        []map[string]*data.HashTable // Index partitions
-	indexPaths map[string][]string          // Index names and paths
+	db           *DB
+	name         string
+	parts        []colPart                    // Collection partitions
+	hts          []map[string]*data.HashTable // Index partitions
+	indexPaths   map[string][]string          // Index names and paths
+	derived      map[string]DeriveFunc        // Derived index names and derivation functions
+	validators   map[string]ValidateFunc      // Validator names and validation functions
+	virtual      map[string]*virtualField     // Virtual field names and expressions
+	partial      map[string]interface{}       // Partial index names and predicates
+	singleValued map[string]struct{}          // Names of indexes hinted single-valued
+	blooms       map[string]*bloomFilter      // Bloom filters of index keys
+	sorted       map[string]*sortedIndex      // Sorted integer indexes
+	existence    map[string]*existenceIndex   // Existence indexes
+	config       map[string]interface{}       // Collection configuration
+	views        colViews                     // Materialized query views
+	tombs        []*data.HashTable            // Tombstones of soft-deleted documents, nil if the collection never had soft-delete
+	modTimes     *modTimes                    // Document modification time, nil if the collection does not track it
+	versions     *versions                    // Document versions, nil if the collection does not keep them
+	allIDs       *allIDsCache                 // IDs of all documents, if CacheAllIDs is configured
+	closed       bool                         // Collection files are closed, e.g. by rename or scrub
+	stats        *QueryStats                  // Statistics of the query evaluated on this handle, nil if not collected
+	trace        *queryTracer                 // Trace of the query evaluated on this handle, nil if not traced
+	deadline     *queryDeadline               // Deadline of the query evaluated on this handle, nil if it has none
+	scope        []interface{}                // Sub-queries of the intersections that the query evaluated on this handle is part of
 }
 
 // Open a collection and load all indexes.
@@ -37,24 +61,38 @@ func OpenCol(db *DB, name string) (*Col, error) {
 
 // Load collection schema including index schema.
 func (col *Col) load() error {
-	if err := os.MkdirAll(path.Join(col.db.path, col.name), 0700); err != nil {
-		return err
+	if !col.db.Config.ReadOnly {
+		if err := os.MkdirAll(path.Join(col.db.path, col.name), 0700); err != nil {
+			return err
+		}
 	}
-	col.parts = make([]*data.Partition, col.db.numParts)
+	col.parts = make([]colPart, col.db.numParts)
 	col.hts = make([]map[string]*data.HashTable, col.db.numParts)
 	for i := 0; i < col.db.numParts; i++ {
 		col.hts[i] = make(map[string]*data.HashTable)
 	}
 	col.indexPaths = make(map[string][]string)
+	col.derived = make(map[string]DeriveFunc)
+	col.validators = make(map[string]ValidateFunc)
+	col.virtual = make(map[string]*virtualField)
+	col.partial = make(map[string]interface{})
+	col.singleValued = make(map[string]struct{})
+	col.blooms = make(map[string]*bloomFilter)
+	col.allIDs = new(allIDsCache)
 	// Open collection document partitions
 	for i := 0; i < col.db.numParts; i++ {
 		var err error
-		if col.parts[i], err = col.db.Config.OpenPartition(
-			path.Join(col.db.path, col.name, DOC_DATA_FILE+strconv.Itoa(i)),
-			path.Join(col.db.path, col.name, DOC_LOOKUP_FILE+strconv.Itoa(i))); err != nil {
+		if col.parts[i], err = col.db.openPart(col.name, i); err != nil {
 			return err
 		}
 	}
+	if err := col.loadTombstones(); err != nil {
+		return err
+	} else if err := col.loadModTimes(); err != nil {
+		return err
+	} else if err := col.loadVersions(); err != nil {
+		return err
+	}
 	// Look for index directories
 	colDirContent, err := ioutil.ReadDir(path.Join(col.db.path, col.name))
 	if err != nil {
@@ -66,20 +104,49 @@ func (col *Col) load() error {
 		}
 		// Open index partitions
 		idxName := htDir.Name()
-		idxPath := strings.Split(idxName, INDEX_PATH_SEP)
+		if strings.HasPrefix(idxName, DERIVED_INDEX_PREFIX) {
+			// Derivation function is gone with the previous process, the index must be created again
+			if col.db.Config.ReadOnly {
+				continue
+			} else if err := os.RemoveAll(path.Join(col.db.path, col.name, idxName)); err != nil {
+				return err
+			}
+			continue
+		}
+		idxPath := strings.Split(strings.TrimPrefix(idxName, normalizationOf(idxName)), INDEX_PATH_SEP)
 		col.indexPaths[idxName] = idxPath
+		if err := col.loadPartialIndex(idxName); err != nil {
+			return err
+		} else if err := col.loadSingleValued(idxName); err != nil {
+			return err
+		}
+		idxConf, err := col.indexConfig(idxName)
+		if err != nil {
+			return err
+		}
 		for i := 0; i < col.db.numParts; i++ {
-			if col.hts[i][idxName], err = col.db.Config.OpenHashTable(
+			if col.hts[i][idxName], err = idxConf.OpenHashTable(
 				path.Join(col.db.path, col.name, idxName, strconv.Itoa(i))); err != nil {
 				return err
 			}
 		}
+		if err := col.loadBloom(idxName); err != nil {
+			return err
+		}
 	}
-	return nil
+	if err := col.loadSortedIndexes(); err != nil {
+		return err
+	} else if err := col.loadExistenceIndexes(); err != nil {
+		return err
+	} else if err := col.loadConfig(); err != nil {
+		return err
+	}
+	return col.loadViews()
 }
 
 // Close all collection files. Do not use the collection afterwards!
 func (col *Col) close() error {
+	col.closed = true
 	errs := make([]error, 0, 0)
 	for i := 0; i < col.db.numParts; i++ {
 		col.parts[i].DataLock.Lock()
@@ -91,6 +158,24 @@ func (col *Col) close() error {
 				errs = append(errs, err)
 			}
 		}
+		if col.tombs != nil {
+			if err := col.tombs[i].Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if col.modTimes != nil {
+			if err := col.modTimes.hts[i].Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if col.versions != nil {
+			if err := col.versions.cols[i].Close(); err != nil {
+				errs = append(errs, err)
+			}
+			if err := col.versions.hts[i].Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
 		col.parts[i].DataLock.Unlock()
 	}
 	if len(errs) == 0 {
@@ -99,6 +184,38 @@ func (col *Col) close() error {
 	return fmt.Errorf("%v", errs)
 }
 
+// Flush all collection files to storage device. Caller must place schema lock.
+func (col *Col) sync() error {
+	for i := 0; i < col.db.numParts; i++ {
+		if err := col.parts[i].Sync(); err != nil {
+			return err
+		}
+		for _, ht := range col.hts[i] {
+			if err := ht.Sync(); err != nil {
+				return err
+			}
+		}
+		if col.tombs != nil {
+			if err := col.tombs[i].Sync(); err != nil {
+				return err
+			}
+		}
+		if col.modTimes != nil {
+			if err := col.modTimes.hts[i].Sync(); err != nil {
+				return err
+			}
+		}
+		if col.versions != nil {
+			if err := col.versions.cols[i].Sync(); err != nil {
+				return err
+			} else if err := col.versions.hts[i].Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (col *Col) forEachDoc(fun func(id int, doc []byte) (moveOn bool), placeSchemaLock bool) {
 	if placeSchemaLock {
 		col.db.schemaLock.RLock()
@@ -122,53 +239,106 @@ func (col *Col) forEachDoc(fun func(id int, doc []byte) (moveOn bool), placeSche
 	}
 }
 
-// Do fun for all documents in the collection.
+// Do fun for all documents in the ascending order of document ID. Unlike forEachDoc, which follows the physical layout of
+// partitions, all document IDs are collected and sorted first, and then documents are read one by one.
+func (col *Col) forEachDocInOrder(fun func(id int, doc []byte) (moveOn bool), placeSchemaLock bool) {
+	if placeSchemaLock {
+		col.db.schemaLock.RLock()
+		defer col.db.schemaLock.RUnlock()
+	}
+	ids := make([]int, 0, col.approxDocCount(false))
+	for _, part := range col.parts {
+		part.DataLock.RLock()
+		ids = append(ids, part.AllIDs()...)
+		part.DataLock.RUnlock()
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		part := col.parts[id%col.db.numParts]
+		part.DataLock.RLock()
+		doc, err := part.Read(id)
+		part.DataLock.RUnlock()
+		// A document deleted in the meantime is skipped
+		if err == nil && !fun(id, doc) {
+			return
+		}
+	}
+}
+
+// Do fun for all documents in the collection, except soft-deleted documents.
 func (col *Col) ForEachDoc(fun func(id int, doc []byte) (moveOn bool)) {
-	col.forEachDoc(fun, true)
+	col.forEachDoc(col.skipDeleted(fun), true)
+}
+
+// Do fun for all documents in the collection in the ascending order of document ID, except soft-deleted documents.
+// The order comes at a cost: IDs of all documents are held in memory and sorted, and documents are read in random
+// order of their physical location.
+func (col *Col) ForEachDocInOrder(fun func(id int, doc []byte) (moveOn bool)) {
+	col.forEachDocInOrder(col.skipDeleted(fun), true)
 }
 
 // Create an index on the path.
 func (col *Col) Index(idxPath []string) (err error) {
-	col.db.schemaLock.Lock()
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
 	defer col.db.schemaLock.Unlock()
-	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	return col.index(strings.Join(idxPath, INDEX_PATH_SEP), idxPath)
+}
+
+// Create an index of the name on the path, and put all documents on it. Does not place schema lock.
+func (col *Col) index(idxName string, idxPath []string) (err error) {
 	if _, exists := col.indexPaths[idxName]; exists {
 		return fmt.Errorf("Path %v is already indexed", idxPath)
 	}
-	col.indexPaths[idxName] = idxPath
 	idxDir := path.Join(col.db.path, col.name, idxName)
 	if err = os.MkdirAll(idxDir, 0700); err != nil {
 		return err
 	}
+	idxConf, err := col.indexConfig(idxName)
+	if err != nil {
+		return err
+	}
+	// The index becomes visible only after all of its partitions are open
+	hts := make([]*data.HashTable, col.db.numParts)
 	for i := 0; i < col.db.numParts; i++ {
-		if col.hts[i][idxName], err = col.db.Config.OpenHashTable(path.Join(idxDir, strconv.Itoa(i))); err != nil {
+		if hts[i], err = idxConf.OpenHashTable(path.Join(idxDir, strconv.Itoa(i))); err != nil {
+			for _, ht := range hts[:i] {
+				ht.Close()
+			}
 			return err
 		}
 	}
+	for i, ht := range hts {
+		col.hts[i][idxName] = ht
+	}
+	col.indexPaths[idxName] = idxPath
 	// Put all documents on the new index
 	col.forEachDoc(func(id int, doc []byte) (moveOn bool) {
-		var docObj map[string]interface{}
-		if err := json.Unmarshal(doc, &docObj); err != nil {
+		docObj, err := decodeDoc(doc)
+		if err != nil {
 			// Skip corrupted document
 			return true
 		}
-		for _, idxVal := range GetIn(docObj, idxPath) {
-			if idxVal != nil {
-				hashKey := StrHash(fmt.Sprint(idxVal))
-				col.hts[hashKey%col.db.numParts][idxName].Put(hashKey, id)
-			}
+		for _, idxVal := range col.indexedValues(idxName, id, docObj, idxPath) {
+			hashKey := StrHash(idxVal)
+			col.hts[hashKey%col.db.numParts][idxName].Put(hashKey, id)
 		}
 		return true
 	}, false)
 	return
 }
 
-// Return all indexed paths.
+// Return all indexed paths, except case-normalized and collated indexes.
 func (col *Col) AllIndexes() (ret [][]string) {
 	col.db.schemaLock.RLock()
 	defer col.db.schemaLock.RUnlock()
 	ret = make([][]string, 0, len(col.indexPaths))
-	for _, path := range col.indexPaths {
+	for idxName, path := range col.indexPaths {
+		if normalizationOf(idxName) != "" {
+			continue
+		}
 		pathCopy := make([]string, len(path))
 		for i, p := range path {
 			pathCopy[i] = p
@@ -180,13 +350,23 @@ func (col *Col) AllIndexes() (ret [][]string) {
 
 // Remove an index.
 func (col *Col) Unindex(idxPath []string) error {
-	col.db.schemaLock.Lock()
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
 	defer col.db.schemaLock.Unlock()
-	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	return col.unindex(strings.Join(idxPath, INDEX_PATH_SEP), idxPath)
+}
+
+// Remove the index of the name on the path. Does not place schema lock.
+func (col *Col) unindex(idxName string, idxPath []string) error {
 	if _, exists := col.indexPaths[idxName]; !exists {
 		return fmt.Errorf("Path %v is not indexed", idxPath)
 	}
 	delete(col.indexPaths, idxName)
+	delete(col.partial, idxName)
+	delete(col.singleValued, idxName)
+	delete(col.blooms, idxName)
 	for i := 0; i < col.db.numParts; i++ {
 		col.hts[i][idxName].Close()
 		delete(col.hts[i], idxName)
@@ -197,6 +377,145 @@ func (col *Col) Unindex(idxPath []string) error {
 	return nil
 }
 
+// Rebuild all indexes of the collection from documents in a single pass, e.g. after a bulk load. Hash indexes (including
+// case-normalized and derived indexes) are cleared and refilled, sorted and existence indexes and views are rebuilt as
+// well.
+func (col *Col) RebuildIndexes() error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	for i := 0; i < col.db.numParts; i++ {
+		for _, ht := range col.hts[i] {
+			if err := ht.Clear(); err != nil {
+				return err
+			}
+		}
+	}
+	col.clearSortedIndexes()
+	col.clearExistenceIndexes()
+	col.clearViews()
+	col.forEachDoc(func(id int, doc []byte) (moveOn bool) {
+		docObj, err := decodeDoc(doc)
+		if err != nil {
+			// Skip corrupted document
+			return true
+		}
+		col.indexDoc(id, docObj)
+		return true
+	}, false)
+	// Forget the keys cleared from the index
+	for idxName := range col.blooms {
+		col.buildBloom(idxName)
+	}
+	return nil
+}
+
+// Return the number of distinct values on the indexed path. Exact count reads back documents to tell apart values
+// sharing the same hash key; approximate count only counts distinct hash keys, without reading any document.
+func (col *Col) DistinctCount(idxPath []string, approximate bool) (count int, err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	err = col.forEachIndexEntry(idxPath, func(key int, docIDs []int) bool {
+		if approximate {
+			count++
+			return true
+		}
+		valsOfKey := make(map[string]struct{})
+		for _, id := range docIDs {
+			doc, err := col.readForIndex(id)
+			if err != nil {
+				continue
+			}
+			for _, idxVal := range indexValues(doc, idxPath) {
+				if StrHash(idxVal) == key {
+					valsOfKey[idxVal] = struct{}{}
+				}
+			}
+		}
+		count += len(valsOfKey)
+		return true
+	})
+	return
+}
+
+// Do fun for each hash key on the indexed path and the IDs of documents having the key, until fun returns false.
+// Schema must not be changed by fun.
+func (col *Col) ForEachIndexEntry(idxPath []string, fun func(hashKey int, docIDs []int) (moveOn bool)) error {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	return col.forEachIndexEntry(idxPath, fun)
+}
+
+// Return the IDs of documents in ascending order that the index on the path has under the hash key of the value. This is
+// a low-level view of index content for tests and diagnosis: the IDs are not checked against document content, hence
+// they include documents having other values of the same hash key, as well as soft-deleted documents. Use a query to
+// find documents by value.
+func (col *Col) IndexEntriesFor(idxPath []string, value interface{}) ([]int, error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.closed {
+		return nil, dberr.New(dberr.ErrorColClosed, col.name)
+	}
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, indexed := col.indexPaths[idxName]; !indexed {
+		return nil, dberr.New(dberr.ErrorNeedIndex, idxPath, "index entries")
+	}
+	ids, err := col.hashScan(idxName, StrHash(indexString(value)), 0)
+	if err != nil {
+		return nil, err
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// Iterate hash keys of the index, one portion of index partition at a time. Does not place schema lock.
+func (col *Col) forEachIndexEntry(idxPath []string, fun func(hashKey int, docIDs []int) (moveOn bool)) error {
+	if col.closed {
+		return dberr.New(dberr.ErrorColClosed, col.name)
+	}
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, indexed := col.indexPaths[idxName]; !indexed {
+		return dberr.New(dberr.ErrorNeedIndex, idxPath, "index iteration")
+	}
+	col.forEachHashEntry(idxName, fun)
+	return nil
+}
+
+// Iterate hash keys of the index (path or derived) by its internal name. Does not place schema lock.
+func (col *Col) forEachHashEntry(idxName string, fun func(hashKey int, docIDs []int) (moveOn bool)) {
+	partDiv := col.approxDocCount(false) / col.db.numParts / 4000 // collect approx. 4k entries in each iteration
+	if partDiv == 0 {
+		partDiv++
+	} else if partDiv > col.db.Config.InitialBuckets {
+		partDiv = col.db.Config.InitialBuckets
+	}
+	for iteratePart := 0; iteratePart < col.db.numParts; iteratePart++ {
+		ht := col.hts[iteratePart][idxName]
+		// All entries of a hash key are in the same bucket chain, hence the same portion
+		for i := 0; i < partDiv; i++ {
+			ht.Lock.RLock()
+			keys, ids := ht.GetPartition(i, partDiv)
+			ht.Lock.RUnlock()
+			// Keep hash keys in the order they are found
+			orderedKeys := make([]int, 0)
+			docsOfKey := make(map[int][]int)
+			for j, key := range keys {
+				if _, seen := docsOfKey[key]; !seen {
+					orderedKeys = append(orderedKeys, key)
+				}
+				docsOfKey[key] = append(docsOfKey[key], ids[j])
+			}
+			for _, key := range orderedKeys {
+				if !fun(key, docsOfKey[key]) {
+					return
+				}
+			}
+		}
+	}
+}
+
 func (col *Col) approxDocCount(placeSchemaLock bool) int {
 	if placeSchemaLock {
 		col.db.schemaLock.RLock()
@@ -216,17 +535,60 @@ func (col *Col) ApproxDocCount() int {
 	return col.approxDocCount(true)
 }
 
-// Divide the collection into roughly equally sized pages, and do fun on all documents in the specified page.
+// Divide the collection into roughly equally sized pages, and do fun on all documents in the specified page, except
+// soft-deleted documents.
 func (col *Col) ForEachDocInPage(page, total int, fun func(id int, doc []byte) bool) {
 	col.db.schemaLock.RLock()
 	defer col.db.schemaLock.RUnlock()
 	for iteratePart := 0; iteratePart < col.db.numParts; iteratePart++ {
 		part := col.parts[iteratePart]
 		part.DataLock.RLock()
-		if !part.ForEachDoc(page, total, fun) {
+		if !part.ForEachDoc(page, total, col.skipDeleted(fun)) {
 			part.DataLock.RUnlock()
 			return
 		}
 		part.DataLock.RUnlock()
 	}
 }
+
+// Do fun for the documents whose ID is from the specified one onwards, in the ascending order of document ID, except
+// soft-deleted documents. Locks are only held while reading each document, not while fun runs, so that a slow fun (e.g.
+// one writing to a network client) does not hold up document or collection changes; a document deleted in the meantime
+// is skipped. An iteration that stopped midway is resumed from the ID following the last one done. Return
+// dberr.ErrorColClosed if the collection is closed (e.g. by rename or drop) during iteration.
+func (col *Col) ForEachDocFrom(from int, fun func(id int, doc []byte) (moveOn bool)) error {
+	col.db.schemaLock.RLock()
+	if col.closed {
+		col.db.schemaLock.RUnlock()
+		return dberr.New(dberr.ErrorColClosed, col.name)
+	}
+	ids := make([]int, 0)
+	for _, part := range col.parts {
+		part.DataLock.RLock()
+		for _, id := range part.AllIDs() {
+			if id >= from {
+				ids = append(ids, id)
+			}
+		}
+		part.DataLock.RUnlock()
+	}
+	col.db.schemaLock.RUnlock()
+	sort.Ints(ids)
+	for _, id := range ids {
+		col.db.schemaLock.RLock()
+		if col.closed {
+			col.db.schemaLock.RUnlock()
+			return dberr.New(dberr.ErrorColClosed, col.name)
+		}
+		part := col.parts[id%col.db.numParts]
+		part.DataLock.RLock()
+		doc, err := part.Read(id)
+		part.DataLock.RUnlock()
+		deleted := col.isDeleted(id)
+		col.db.schemaLock.RUnlock()
+		if err == nil && !deleted && !fun(id, doc) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -1,14 +1,16 @@
 package db
 
 import (
-	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
 
 	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
 	"github.com/bouk/monkey"
 	"github.com/pkg/errors"
 )
@@ -133,8 +135,8 @@ func TestIndexErrorJsUnmarshal(t *testing.T) {
 	errMessage := "error json encoding"
 	col, _ := OpenCol(db, "test")
 
-	patch := monkey.Patch(json.Unmarshal, func(data []byte, v interface{}) error {
-		return errors.New(errMessage)
+	patch := monkey.Patch(decodeDoc, func(docB []byte) (map[string]interface{}, error) {
+		return nil, errors.New(errMessage)
 	})
 	defer patch.Unpatch()
 	var part *data.Partition
@@ -182,3 +184,310 @@ func TestForEachDocInPageForEachDocIsFalse(t *testing.T) {
 		return true
 	})
 }
+func TestDistinctCount(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Values of the same length share the same hash key
+	patch := monkey.Patch(StrHash, func(str string) int {
+		return len(str)
+	})
+	defer patch.Unpatch()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"status"})
+	for _, status := range []interface{}{"a", "bb", "cc", "a", []interface{}{"dd", "bb"}, nil} {
+		col.Insert(map[string]interface{}{"status": status})
+	}
+	if count, err := col.DistinctCount([]string{"status"}, false); err != nil || count != 4 {
+		t.Fatal(count, err)
+	}
+	if count, err := col.DistinctCount([]string{"status"}, true); err != nil || count != 2 {
+		t.Fatal(count, err)
+	}
+	if _, err := col.DistinctCount([]string{"nothing"}, false); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+}
+func TestForEachIndexEntry(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	expected := make(map[int]map[int]struct{})
+	for i := 0; i < 100; i++ {
+		id, _ := col.Insert(map[string]interface{}{"a": i % 10})
+		key := StrHash(fmt.Sprint(float64(i % 10)))
+		if expected[key] == nil {
+			expected[key] = make(map[int]struct{})
+		}
+		expected[key][id] = struct{}{}
+	}
+	entries := make(map[int]map[int]struct{})
+	if err = col.ForEachIndexEntry([]string{"a"}, func(hashKey int, docIDs []int) bool {
+		if _, dup := entries[hashKey]; dup {
+			t.Fatal("Key visited twice", hashKey)
+		}
+		entries[hashKey] = make(map[int]struct{})
+		for _, id := range docIDs {
+			entries[hashKey][id] = struct{}{}
+		}
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatal(entries)
+	}
+	// Stop early
+	visited := 0
+	col.ForEachIndexEntry([]string{"a"}, func(hashKey int, docIDs []int) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Fatal(visited)
+	}
+	if err = col.ForEachIndexEntry([]string{"b"}, func(int, []int) bool { return true }); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexEntriesFor(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	entriesFor := func(value interface{}, expected ...int) {
+		sort.Ints(expected)
+		if ids, err := col.IndexEntriesFor([]string{"a"}, value); err != nil || len(ids) != len(expected) ||
+			len(expected) > 0 && !reflect.DeepEqual(ids, expected) {
+			t.Fatal(value, ids, expected, err)
+		}
+	}
+	one, _ := col.Insert(map[string]interface{}{"a": 1})
+	both, _ := col.Insert(map[string]interface{}{"a": []interface{}{1, "x"}})
+	x, _ := col.Insert(map[string]interface{}{"a": "x"})
+	entriesFor(1, one, both)
+	entriesFor("1", one, both)
+	entriesFor("x", both, x)
+	entriesFor("y")
+	// Update moves the document from the entry of old value to that of new value
+	if err = col.Update(one, map[string]interface{}{"a": "y"}); err != nil {
+		t.Fatal(err)
+	}
+	entriesFor(1, both)
+	entriesFor("y", one)
+	if err = col.Delete(both); err != nil {
+		t.Fatal(err)
+	}
+	entriesFor(1)
+	entriesFor("x", x)
+	if _, err = col.IndexEntriesFor([]string{"b"}, 1); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+}
+
+func TestForEachDocInOrder(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 0, 100)
+	for i := 0; i < 100; i++ {
+		id, _ := col.Insert(map[string]interface{}{"a": i % 2})
+		ids = append(ids, id)
+	}
+	if err = col.Delete(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	ids = ids[1:]
+	sort.Ints(ids)
+	iterated := make([]int, 0, len(ids))
+	col.ForEachDocInOrder(func(id int, doc []byte) bool {
+		iterated = append(iterated, id)
+		return true
+	})
+	if !reflect.DeepEqual(iterated, ids) {
+		t.Fatal(iterated, ids)
+	}
+	// Iteration stops early, and limited ordered scan finds the lowest IDs
+	iterated = iterated[:0]
+	col.ForEachDocInOrder(func(id int, doc []byte) bool {
+		iterated = append(iterated, id)
+		return len(iterated) < 3
+	})
+	if !reflect.DeepEqual(iterated, ids[:3]) {
+		t.Fatal(iterated, ids[:3])
+	}
+	result, err := runQuery(`{"contains-anywhere": 1, "limit": 3, "ordered": true}`, col)
+	if err != nil || len(result) != 3 {
+		t.Fatal(result, err)
+	}
+	for id := range result {
+		if doc, err := col.Read(id); err != nil || doc["a"].(float64) != 1 {
+			t.Fatal(doc, err)
+		}
+	}
+	expected := 0
+	for _, id := range ids {
+		if _, found := result[id]; found {
+			expected++
+		} else if doc, _ := col.Read(id); doc["a"].(float64) == 1 {
+			break
+		}
+	}
+	if expected != 3 {
+		t.Fatal(result, ids)
+	}
+}
+
+func TestForEachDocFrom(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Config.SoftDelete = true
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 0, 20)
+	for i := 0; i < 20; i++ {
+		id, _ := col.Insert(map[string]interface{}{"a": i})
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	// Soft-deleted documents are skipped
+	if err = col.Delete(ids[15]); err != nil {
+		t.Fatal(err)
+	}
+	// Iteration stops midway and resumes from the next ID, deleting documents while fun runs
+	iterated := make([]int, 0, len(ids))
+	if err = col.ForEachDocFrom(0, func(id int, doc []byte) bool {
+		iterated = append(iterated, id)
+		return len(iterated) < 10
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.ForEachDocFrom(iterated[len(iterated)-1]+1, func(id int, doc []byte) bool {
+		if id == ids[10] {
+			col.Delete(ids[11])
+		}
+		iterated = append(iterated, id)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append(append([]int{}, ids[:11]...), ids[12:15]...), ids[16:]...)
+	if !reflect.DeepEqual(iterated, expected) {
+		t.Fatal(iterated, expected)
+	}
+	// Closing the collection stops the iteration
+	err = col.ForEachDocFrom(0, func(id int, doc []byte) bool {
+		if err := db.Rename("col", "col2"); err != nil {
+			t.Fatal(err)
+		}
+		return true
+	})
+	if dberr.Type(err) != dberr.ErrorColClosed {
+		t.Fatal(err)
+	}
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	col.IndexCaseNormalized([]string{"name"})
+	col.IndexDerived("lower name", lowerName)
+	if err = col.IndexSorted([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.CreateView("small", map[string]interface{}{"int-from": 0.0, "int-to": 4.0, "in": []interface{}{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		col.Insert(map[string]interface{}{"a": i % 10, "name": fmt.Sprintf("Name%d", i%3)})
+	}
+	queries := []string{
+		`{"eq": 3, "in": ["a"]}`,
+		`{"int-from": 2, "int-to": 5, "in": ["a"]}`,
+		`{"eq-ci": "NAME1", "in": ["name"]}`,
+		`{"eq": "name2", "in": ["lower name"]}`,
+	}
+	expected := make([]map[int]struct{}, len(queries))
+	for i, query := range queries {
+		if expected[i], err = runQuery(query, col); err != nil || len(expected[i]) == 0 {
+			t.Fatal(query, expected[i], err)
+		}
+	}
+	view := col.View("small")
+	// Rebuild from documents loaded without indexing gives the same results as incremental indexing
+	for i := 0; i < db.numParts; i++ {
+		for _, ht := range col.hts[i] {
+			ht.Clear()
+		}
+	}
+	col.clearSortedIndexes()
+	col.clearViews()
+	if result, err := runQuery(queries[0], col); err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+	for round := 0; round < 2; round++ {
+		if err = col.RebuildIndexes(); err != nil {
+			t.Fatal(err)
+		}
+		for i, query := range queries {
+			if result, err := runQuery(query, col); err != nil || !reflect.DeepEqual(result, expected[i]) {
+				t.Fatal(query, result, err)
+			}
+		}
+		if ids := col.View("small"); !reflect.DeepEqual(ids, view) {
+			t.Fatal(ids, view)
+		}
+		if report, err := col.VerifyIndexes(); err != nil || len(report.Missing) != 0 || len(report.Orphaned) != 0 {
+			t.Fatal(report, err)
+		}
+	}
+}
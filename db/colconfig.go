@@ -0,0 +1,84 @@
+// Collection configuration.
+//
+// A collection keeps its own settings as JSON key-value pairs in a file of collection directory, so that
+// collection-level options survive reopen. The file is replaced as a whole on every change, hence a crash leaves either
+// the previous or the new configuration behind, never a partially written one.
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const (
+	COL_CONFIG_FILE = "col_config.json" // Name of collection configuration file in collection directory.
+)
+
+// Load collection configuration. Does not place schema lock.
+func (col *Col) loadConfig() error {
+	col.config = make(map[string]interface{})
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, COL_CONFIG_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, &col.config)
+}
+
+// Set a collection configuration value and save the configuration, or remove the key if value is nil. The value must be
+// serializable into JSON; it is saved and returned by Config in its decoded JSON form, e.g. integers become float64.
+func (col *Col) SetConfig(key string, value interface{}) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	} else if key == "" {
+		return errors.New("Collection configuration key must not be empty")
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	config := make(map[string]interface{}, len(col.config)+1)
+	for k, v := range col.config {
+		config[k] = v
+	}
+	if value == nil {
+		delete(config, key)
+	} else {
+		valueJS, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		var decoded interface{}
+		if err = json.Unmarshal(valueJS, &decoded); err != nil {
+			return err
+		}
+		config[key] = decoded
+	}
+	content, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	// Replace the file by renaming a complete copy over it
+	configFile := path.Join(col.db.path, col.name, COL_CONFIG_FILE)
+	if err = ioutil.WriteFile(configFile+".tmp", content, 0600); err != nil {
+		return err
+	} else if err = os.Rename(configFile+".tmp", configFile); err != nil {
+		return err
+	}
+	col.config = config
+	return nil
+}
+
+// Return a copy of all collection configuration values.
+func (col *Col) Config() map[string]interface{} {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	ret := make(map[string]interface{}, len(col.config))
+	for key, value := range col.config {
+		ret[key] = value
+	}
+	return ret
+}
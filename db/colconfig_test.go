@@ -0,0 +1,66 @@
+package db
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestColConfig(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if config := col.Config(); len(config) != 0 {
+		t.Fatal(config)
+	}
+	if err = col.SetConfig("ttl", 3600); err != nil {
+		t.Fatal(err)
+	} else if err = col.SetConfig("unique", []string{"email"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.SetConfig("removed", true); err != nil {
+		t.Fatal(err)
+	} else if err = col.SetConfig("removed", nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"ttl": 3600.0, "unique": []interface{}{"email"}}
+	// Returned configuration is a copy
+	config := col.Config()
+	config["ttl"] = 1
+	if config := col.Config(); !reflect.DeepEqual(config, expected) {
+		t.Fatal(config)
+	}
+	// Invalid change leaves the configuration unchanged
+	if col.SetConfig("", 1) == nil || col.SetConfig("ttl", func() {}) == nil {
+		t.Fatal("Did not error")
+	}
+	if _, err = os.Stat(path.Join(TEST_DATA_DIR, "col", COL_CONFIG_FILE+".tmp")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	// Configuration survives reopen, scrub and rename
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if config := db.Use("col").Config(); !reflect.DeepEqual(config, expected) {
+		t.Fatal(config)
+	}
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Rename("col", "col2"); err != nil {
+		t.Fatal(err)
+	}
+	if config := db.Use("col2").Config(); !reflect.DeepEqual(config, expected) {
+		t.Fatal(config)
+	}
+}
@@ -0,0 +1,111 @@
+// Collated indexes.
+//
+// A collated index is an index on a path that stores string values by their collation key - in lower case and without
+// accents of Latin letters - so that accent- and case-insensitive lookup {"eq-co": "Cafe", "in": ["name"]} matches
+// "café", "CAFÉ" and "Cafe" alike, and is a hash lookup just like {"eq": ...}. Like a case-normalized index, the
+// collated index lives in a directory named by the path following COLLATED_INDEX_PREFIX. CollatedLess orders strings
+// by the same collation key, for sorted query results.
+
+package db
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	COLLATED_INDEX_PREFIX = "%" // Prefix of collated index directory name.
+)
+
+// Letters with accents (in lower case) and what they become in collation key.
+var collationFolds = map[rune]string{}
+
+func init() {
+	for base, accented := range map[string]string{
+		"a": "àáâãäåāăą", "c": "çćĉċč", "d": "ďđð", "e": "èéêëēĕėęě", "g": "ĝğġģ", "h": "ĥħ", "i": "ìíîïĩīĭįı",
+		"j": "ĵ", "k": "ķ", "l": "ĺļľŀł", "n": "ñńņňŉ", "o": "òóôõöøōŏő", "r": "ŕŗř", "s": "śŝşšſ", "t": "ţťŧ",
+		"u": "ùúûüũūŭůűų", "w": "ŵ", "y": "ýÿŷ", "z": "źżž", "ae": "æ", "oe": "œ", "ss": "ß", "th": "þ",
+	} {
+		for _, letter := range accented {
+			collationFolds[letter] = base
+		}
+	}
+}
+
+// Create a collated index on the path, and put all documents on the index.
+func (col *Col) IndexCollated(idxPath []string) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	if len(idxPath) == 0 {
+		return fmt.Errorf("Collated index path may not be empty")
+	}
+	return col.index(COLLATED_INDEX_PREFIX+strings.Join(idxPath, INDEX_PATH_SEP), idxPath)
+}
+
+// Remove the collated index of the path.
+func (col *Col) UnindexCollated(idxPath []string) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	return col.unindex(COLLATED_INDEX_PREFIX+strings.Join(idxPath, INDEX_PATH_SEP), idxPath)
+}
+
+// Return all paths that have a collated index.
+func (col *Col) AllCollatedIndexes() (ret [][]string) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	ret = make([][]string, 0)
+	for idxName, idxPath := range col.indexPaths {
+		if strings.HasPrefix(idxName, COLLATED_INDEX_PREFIX) {
+			ret = append(ret, append([]string{}, idxPath...))
+		}
+	}
+	return
+}
+
+// Accent- and case-insensitive value equity check using hash lookup on the collated index of the path.
+func LookupCollated(lookupValue interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) error {
+	return lookup(lookupValue, expr, src, result, COLLATED_INDEX_PREFIX, nil)
+}
+
+// Return the collation key of a string: the string in lower case, with accented Latin letters replaced by their base
+// letters, e.g. "Crème Brûlée" becomes "creme brulee".
+func CollationKey(str string) string {
+	var key strings.Builder
+	for _, letter := range str {
+		letter = unicode.ToLower(letter)
+		if base, accented := collationFolds[letter]; accented {
+			key.WriteString(base)
+		} else {
+			key.WriteRune(letter)
+		}
+	}
+	return key.String()
+}
+
+// Return the collation key of a string value, or a value of other type as it is.
+func collated(val interface{}) interface{} {
+	if str, isStr := val.(string); isStr {
+		return CollationKey(str)
+	}
+	return val
+}
+
+// Compare values like NaturalLess, except that strings are ordered by their collation key, and strings of the same key
+// are ordered by their bytes.
+func CollatedLess(a, b interface{}) bool {
+	aStr, aIsStr := a.(string)
+	bStr, bIsStr := b.(string)
+	if !aIsStr || !bIsStr {
+		return NaturalLess(a, b)
+	} else if aKey, bKey := CollationKey(aStr), CollationKey(bStr); aKey != bKey {
+		return aKey < bKey
+	}
+	return aStr < bStr
+}
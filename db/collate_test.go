@@ -0,0 +1,103 @@
+package db
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestCollationKey(t *testing.T) {
+	for str, key := range map[string]string{
+		"Café": "cafe", "CRÈME BRÛLÉE": "creme brulee", "Straße": "strasse", "Ærø": "aero", "naïve 42": "naive 42", "日本": "日本",
+	} {
+		if collated := CollationKey(str); collated != key {
+			t.Fatal(str, collated, key)
+		}
+	}
+	if !CollatedLess("éclair", "Fudge") || CollatedLess("Fudge", "éclair") {
+		t.Fatal("accented letter is not ordered by base letter")
+	} else if !CollatedLess("Cafe", "Café") || CollatedLess("Café", "Cafe") {
+		t.Fatal("strings of same key are not ordered by bytes")
+	} else if !CollatedLess(1, "a") || !CollatedLess(1, 2) {
+		t.Fatal("values other than strings are not ordered naturally")
+	}
+}
+
+func TestIndexCollated(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	cafe, _ := col.Insert(map[string]interface{}{"name": "Café"})
+	if err = col.IndexCollated([]string{"name"}); err != nil {
+		t.Fatal(err)
+	} else if col.IndexCollated([]string{"name"}) == nil {
+		t.Fatal("Did not error")
+	}
+	upper, _ := col.Insert(map[string]interface{}{"name": "CAFE"})
+	creme, _ := col.Insert(map[string]interface{}{"name": []interface{}{"Crème", "Brûlée"}})
+	number, _ := col.Insert(map[string]interface{}{"name": 1})
+	check := func(query string, expected ...int) {
+		result, err := runQuery(query, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+	}
+	check(`{"eq-co": "cafe", "in": ["name"]}`, cafe, upper)
+	check(`{"eq-co": "CAFÉ", "in": ["name"]}`, cafe, upper)
+	check(`{"eq-co": ["brulee", 1], "in": ["name"]}`, creme, number)
+	check(`{"eq-co": "cafe", "in": ["name"], "limit": 1}`, cafe)
+	if err = col.Update(upper, map[string]interface{}{"name": "Tea"}); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"eq-co": "cafe", "in": ["name"]}`, cafe)
+	// Case-normalized index does not fold accents, and neither index serves the other lookup
+	if _, err = runQuery(`{"eq-ci": "cafe", "in": ["name"]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	if err = col.IndexCaseNormalized([]string{"name"}); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"eq-ci": "cafe", "in": ["name"]}`)
+	check(`{"eq-ci": "café", "in": ["name"]}`, cafe)
+	if indexes := col.AllIndexes(); len(indexes) != 0 {
+		t.Fatal(indexes)
+	} else if indexes := col.AllCollatedIndexes(); !reflect.DeepEqual(indexes, [][]string{{"name"}}) {
+		t.Fatal(indexes)
+	}
+	if match, err := matchDoc(map[string]interface{}{"eq-co": "TEA", "in": []interface{}{"name"}}, upper, map[string]interface{}{"name": "téa"}); err != nil || !match {
+		t.Fatal(match, err)
+	}
+	// Collated order
+	if sorted, err := EvalQuerySortedBy(map[string]interface{}{"eq-co": []interface{}{"tea", "cafe", 1}, "in": []interface{}{"name"}}, col, []string{"name"}, CollatedLess, 0); err != nil || !reflect.DeepEqual(sorted, []int{number, cafe, upper}) {
+		t.Fatal(sorted, err)
+	}
+	// The index survives reopen and scrub
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	check(`{"eq-co": "CAFE", "in": ["name"]}`, cafe)
+	if report, err := col.VerifyIndexes(); err != nil || len(report.Missing) != 0 || len(report.Orphaned) != 0 {
+		t.Fatal(report, err)
+	}
+	if err = col.UnindexCollated([]string{"name"}); err != nil {
+		t.Fatal(err)
+	} else if _, err = runQuery(`{"eq-co": "cafe", "in": ["name"]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+}
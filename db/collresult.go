@@ -0,0 +1,94 @@
+// Set operations on query results of different collections.
+//
+// Document IDs are only unique within a collection, hence results of different collections cannot be combined by ID.
+// Instead, documents are matched by the value of a key they share, such as a user name that appears in documents of
+// both "users" and "orders". The value is resolved via GetIn, so a document having an array at the key path matches on
+// each of its elements.
+
+package db
+
+import (
+	"errors"
+)
+
+// Result of a query on a collection.
+type CollResult struct {
+	Col *Col
+	IDs map[int]struct{}
+}
+
+// Match the documents of query results by their value at the key path, and return the documents of every value that
+// appears in any of the results: for each value, the matching documents of each collection at the same position as its
+// result, which has no document if the value does not appear in the result. Documents without the key are left out.
+func UnionResults(results []CollResult, keyPath []string) (map[interface{}][]CollResult, error) {
+	return groupResultsByKey(results, keyPath)
+}
+
+// Match the documents of query results by their value at the key path, and return the documents of every value that
+// appears in all of the results, in the same form as UnionResults.
+func IntersectResults(results []CollResult, keyPath []string) (map[interface{}][]CollResult, error) {
+	groups, err := groupResultsByKey(results, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	for key, group := range groups {
+		for _, result := range group {
+			if len(result.IDs) == 0 {
+				delete(groups, key)
+				break
+			}
+		}
+	}
+	return groups, nil
+}
+
+// Read the documents of query results, and group them by their values at the key path. A document deleted in between
+// evaluation and reading is left out.
+func groupResultsByKey(results []CollResult, keyPath []string) (map[interface{}][]CollResult, error) {
+	if len(keyPath) == 0 {
+		return nil, errors.New("Key path of matching query results must not be empty")
+	}
+	for _, result := range results {
+		if result.Col == nil {
+			return nil, errors.New("Query result does not specify collection")
+		}
+	}
+	groups := make(map[interface{}][]CollResult)
+	for i, result := range results {
+		for id := range result.IDs {
+			doc, err := result.Col.Read(id)
+			if err != nil {
+				continue
+			}
+			for _, val := range GetIn(doc, keyPath) {
+				key, ok := resultKey(val)
+				if !ok {
+					continue
+				}
+				group, exists := groups[key]
+				if !exists {
+					group = make([]CollResult, len(results))
+					for j := range results {
+						group[j] = CollResult{Col: results[j].Col, IDs: make(map[int]struct{})}
+					}
+					groups[key] = group
+				}
+				group[i].IDs[id] = struct{}{}
+			}
+		}
+	}
+	return groups, nil
+}
+
+// Return the value as a key of matching query results, numbers of different representations become the same float64.
+// Return false if the value cannot be matched, e.g. null or an object.
+func resultKey(val interface{}) (interface{}, bool) {
+	switch key := val.(type) {
+	case string, bool:
+		return key, true
+	}
+	if num, err := queryFloat("key", val); err == nil {
+		return num, true
+	}
+	return nil, false
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+func TestUnionIntersectResults(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("users"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("orders"); err != nil {
+		t.Fatal(err)
+	}
+	users, orders := db.Use("users"), db.Use("orders")
+	alice, _ := users.Insert(map[string]interface{}{"name": "alice", "uid": 1})
+	bob, _ := users.Insert(map[string]interface{}{"name": "bob", "uid": 2})
+	nobody, _ := users.Insert(map[string]interface{}{"name": "nobody"})
+	order1, _ := orders.Insert(map[string]interface{}{"uid": 1})
+	order2, _ := orders.Insert(map[string]interface{}{"uid": []interface{}{1, 3}})
+	userResult := CollResult{Col: users, IDs: map[int]struct{}{alice: {}, bob: {}, nobody: {}}}
+	orderResult := CollResult{Col: orders, IDs: map[int]struct{}{order1: {}, order2: {}}}
+	// Numbers match regardless of representation, documents without the key are left out
+	union, err := UnionResults([]CollResult{userResult, orderResult}, []string{"uid"})
+	if err != nil || len(union) != 3 {
+		t.Fatal(union, err)
+	}
+	if group := union[1.0]; group[0].Col != users || group[1].Col != orders {
+		t.Fatal(group)
+	} else {
+		ensureMapHasKeys(group[0].IDs, alice)
+		ensureMapHasKeys(group[1].IDs, order1, order2)
+	}
+	if group := union[2.0]; len(group[0].IDs) != 1 || len(group[1].IDs) != 0 {
+		t.Fatal(group)
+	}
+	if group := union[3.0]; len(group[0].IDs) != 0 || len(group[1].IDs) != 1 {
+		t.Fatal(group)
+	}
+	intersection, err := IntersectResults([]CollResult{userResult, orderResult}, []string{"uid"})
+	if err != nil || len(intersection) != 1 || len(intersection[1.0][1].IDs) != 2 {
+		t.Fatal(intersection, err)
+	}
+	if _, err = IntersectResults([]CollResult{userResult, {IDs: orderResult.IDs}}, []string{"uid"}); err == nil {
+		t.Fatal("Did not error")
+	} else if _, err = UnionResults([]CollResult{userResult}, nil); err == nil {
+		t.Fatal("Did not error")
+	}
+}
@@ -0,0 +1,121 @@
+// Collection storage statistics.
+//
+// Deleting or growing a document leaves its old space in the collection data file until the collection is scrubbed.
+// Stats reports the space taken by documents and indexes along with an estimate of how much of the data file is taken
+// by such leftovers, so that it is possible to tell when a scrub is worth its time.
+
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// Storage and index space usage of a collection.
+type CollStats struct {
+	Docs            int            // Number of documents, including soft-deleted ones
+	SoftDeleted     int            // Number of soft-deleted documents
+	DeletedDocs     int            // Number of deleted documents whose space is not yet reclaimed by scrub
+	AvgDocSize      int            // Average length of document text in bytes
+	DataFileBytes   int            // Size of collection data files
+	DataUsedBytes   int            // Space taken in collection data files by documents and deleted documents
+	DeletedBytes    int            // Space taken in collection data files by deleted documents
+	LookupFileBytes int            // Size of document ID lookup files
+	IndexFileBytes  map[string]int // Size of index files by index name
+	OtherFileBytes  int            // Size of the other collection files, e.g. tombstones and document versions
+	Fragmentation   float64        // Fraction of used data file space that scrub would reclaim, between 0 and 1
+}
+
+// Return the storage and index space usage of the collection. The fragmentation estimate counts the space of deleted
+// documents along with the room left for documents to grow beyond twice their length.
+func (col *Col) Stats() (stats CollStats, err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.closed {
+		return stats, dberr.New(dberr.ErrorColClosed, col.name)
+	}
+	wastedBytes := 0
+	textBytes := 0
+	for _, part := range col.parts {
+		part.DataLock.RLock()
+		usage := part.SpaceUsage()
+		part.DataLock.RUnlock()
+		stats.Docs += usage.Docs
+		stats.DeletedDocs += usage.DeletedDocs
+		stats.DataUsedBytes += usage.DocBytes + usage.DeletedBytes
+		stats.DeletedBytes += usage.DeletedBytes
+		textBytes += usage.TextBytes
+		// A freshly written document takes twice its length as room, the rest is left over from updates
+		if excess := usage.DocBytes - usage.Docs*data.DocHeader - 2*usage.TextBytes; excess > 0 {
+			wastedBytes += excess
+		}
+	}
+	for _, ht := range col.tombs {
+		ht.Lock.RLock()
+		_, ids := ht.GetPartition(0, 1)
+		ht.Lock.RUnlock()
+		stats.SoftDeleted += len(ids)
+	}
+	if stats.Docs > 0 {
+		stats.AvgDocSize = textBytes / stats.Docs
+	}
+	if stats.DataUsedBytes > 0 {
+		stats.Fragmentation = float64(stats.DeletedBytes+wastedBytes) / float64(stats.DataUsedBytes)
+		if stats.Fragmentation > 1 {
+			stats.Fragmentation = 1
+		}
+	}
+	stats.IndexFileBytes = make(map[string]int)
+	colDir := path.Join(col.db.path, col.name)
+	entries, err := ioutil.ReadDir(colDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case entry.IsDir():
+			size, err := dirSize(path.Join(colDir, name))
+			if err != nil {
+				return stats, err
+			}
+			if _, indexed := col.hts[0][name]; indexed {
+				stats.IndexFileBytes[name] = size
+			} else {
+				stats.OtherFileBytes += size
+			}
+		case strings.HasPrefix(name, DOC_DATA_FILE):
+			stats.DataFileBytes += int(entry.Size())
+		case strings.HasPrefix(name, DOC_LOOKUP_FILE):
+			stats.LookupFileBytes += int(entry.Size())
+		default:
+			stats.OtherFileBytes += int(entry.Size())
+		}
+	}
+	return stats, nil
+}
+
+// Return the total size of the files in a directory and its sub-directories.
+func dirSize(dir string) (size int, err error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			subSize, err := dirSize(path.Join(dir, entry.Name()))
+			if err != nil {
+				return 0, err
+			}
+			size += subSize
+		} else if entry.Mode()&os.ModeType == 0 {
+			size += int(entry.Size())
+		}
+	}
+	return
+}
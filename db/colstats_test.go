@@ -0,0 +1,75 @@
+package db
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestColStats(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := col.Stats()
+	if err != nil || stats.Docs != 0 || stats.AvgDocSize != 0 || stats.Fragmentation != 0 {
+		t.Fatal(stats, err)
+	}
+	ids := make([]int, 0, 10)
+	for i := 0; i < 10; i++ {
+		id, _ := col.Insert(map[string]interface{}{"a": i})
+		ids = append(ids, id)
+	}
+	stats, err = col.Stats()
+	if err != nil || stats.Docs != 10 || stats.DeletedDocs != 0 || stats.AvgDocSize != len(`{"a":0}`) || stats.Fragmentation != 0 {
+		t.Fatal(stats, err)
+	}
+	if stats.DataFileBytes < stats.DataUsedBytes || stats.DataUsedBytes == 0 || stats.LookupFileBytes == 0 || stats.IndexFileBytes["a"] == 0 || len(stats.IndexFileBytes) != 1 {
+		t.Fatal(stats)
+	}
+	// Deleted documents and documents outgrowing their room leave space behind
+	for _, id := range ids[:5] {
+		col.Delete(id)
+	}
+	if err = col.Update(ids[5], map[string]interface{}{"a": strings.Repeat("x", 100)}); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = col.Stats()
+	if err != nil || stats.Docs != 5 || stats.DeletedDocs != 6 || stats.DeletedBytes == 0 || stats.Fragmentation <= 0 || stats.Fragmentation >= 1 {
+		t.Fatal(stats, err)
+	}
+	// Scrub reclaims the space
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if stats, err = col.Stats(); err != nil || stats.Docs != 5 || stats.DeletedDocs != 0 || stats.Fragmentation != 0 {
+		t.Fatal(stats, err)
+	}
+	// Soft-deleted documents still take their space
+	db.Config.SoftDelete = true
+	if err = col.loadTombstones(); err != nil {
+		t.Fatal(err)
+	}
+	col.Delete(ids[9])
+	if stats, err = col.Stats(); err != nil || stats.Docs != 5 || stats.SoftDeleted != 1 || stats.OtherFileBytes == 0 {
+		t.Fatal(stats, err)
+	}
+	col.closed = true
+	if _, err = col.Stats(); dberr.Type(err) != dberr.ErrorColClosed {
+		t.Fatal(err)
+	}
+	col.closed = false
+}
@@ -0,0 +1,281 @@
+// Computed conditions.
+//
+// A compute query scans all documents for those satisfying an arithmetic comparison of their values, such as
+// {"compute": "price * quantity > 100"}. The condition compares two arithmetic expressions of numbers and document
+// paths, made of "+", "-", "*", "/", unary minus and parentheses:
+//   condition  := sum op sum
+//   op         := "==" | "!=" | ">" | ">=" | "<" | "<="
+//   sum        := product (("+" | "-") product)*
+//   product    := operand (("*" | "/") operand)*
+//   operand    := "-" operand | "(" sum ")" | number | path
+//   path       := identifier ("." identifier)*
+// A path must lead to a single number in the document, otherwise (e.g. the value is missing, a string or an array of
+// numbers) the document does not satisfy the condition, and neither does it when dividing by zero.
+
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// Value of an arithmetic expression on a document, false if the document has no value for it.
+type computeFunc func(doc map[string]interface{}) (float64, bool)
+
+// Scan all documents for those satisfying the computed condition.
+func Compute(condition interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	satisfies, err := computeParams(condition)
+	if err != nil {
+		return
+	}
+	// Figure out result number limit
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	forEachDoc, err := scanFunc(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("compute", nil, &candidates, result, len(*result), time.Now())
+	}
+	tdlog.CritNoRepeat("Query %v scans all documents, which can be very inefficient", expr)
+	src.traceNote("Scanned all documents")
+	counter := 0
+	forEachDoc(func(id int, docB []byte) bool {
+		candidates++
+		if skip != nil && skip(id) {
+			return true
+		}
+		doc, decodeErr := decodeDoc(docB)
+		if decodeErr != nil || !satisfies(doc) {
+			return true
+		}
+		(*result)[id] = struct{}{}
+		counter++
+		if err = resultTooLarge(src, result); err != nil {
+			return false
+		}
+		return intLimit <= 0 || counter < intLimit
+	}, false)
+	src.countQueryCost(candidates, 0, 1)
+	return
+}
+
+// Parse the condition of compute query, and return the function that tells whether a document satisfies it. Syntax
+// error reports the column where it occurs.
+func computeParams(condition interface{}) (func(doc map[string]interface{}) bool, error) {
+	str, isString := condition.(string)
+	if !isString {
+		return nil, fmt.Errorf("Expecting `compute` to be a condition string, but %v given", condition)
+	}
+	tokens, err := tokenizeComputation(str)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	opTok := p.next()
+	if opTok.kind != tokenOp || !strings.ContainsAny(opTok.text, "=<>") {
+		return nil, dberr.New(dberr.ErrorQuerySyntax, opTok.col, "expecting a comparison")
+	}
+	right, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	} else if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, dberr.New(dberr.ErrorQuerySyntax, tok.col, fmt.Sprintf("unexpected '%s'", tok.text))
+	}
+	var compare func(a, b float64) bool
+	switch opTok.text {
+	case "==":
+		compare = func(a, b float64) bool { return a == b }
+	case "!=":
+		compare = func(a, b float64) bool { return a != b }
+	case ">":
+		compare = func(a, b float64) bool { return a > b }
+	case ">=":
+		compare = func(a, b float64) bool { return a >= b }
+	case "<":
+		compare = func(a, b float64) bool { return a < b }
+	case "<=":
+		compare = func(a, b float64) bool { return a <= b }
+	}
+	return func(doc map[string]interface{}) bool {
+		leftVal, hasLeft := left(doc)
+		if !hasLeft {
+			return false
+		}
+		rightVal, hasRight := right(doc)
+		return hasRight && compare(leftVal, rightVal)
+	}, nil
+}
+
+// Split computed condition (or virtual field expression) into tokens.
+func tokenizeComputation(str string) (tokens []queryToken, err error) {
+	runes := []rune(str)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		col := i + 1
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, queryToken{tokenLParen, "(", col})
+			i++
+		case c == ')':
+			tokens = append(tokens, queryToken{tokenRParen, ")", col})
+			i++
+		case strings.ContainsRune("+-*/", c):
+			tokens = append(tokens, queryToken{tokenOp, string(c), col})
+			i++
+		case c == '"':
+			var str string
+			if str, i, err = readStringLiteral(runes, i); err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, queryToken{tokenString, str, col})
+		case strings.ContainsRune("=!<>", c):
+			op := string(c)
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				op += "="
+			}
+			if op == "=" || op == "!" {
+				return nil, dberr.New(dberr.ErrorQuerySyntax, col, fmt.Sprintf("unknown operator '%s'", op))
+			}
+			tokens = append(tokens, queryToken{tokenOp, op, col})
+			i += len(op)
+		case unicode.IsDigit(c) || c == '.':
+			start := i
+			for i++; i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' ||
+				(runes[i] == 'e' || runes[i] == 'E') ||
+				(runes[i] == '+' || runes[i] == '-') && (runes[i-1] == 'e' || runes[i-1] == 'E')); i++ {
+			}
+			tokens = append(tokens, queryToken{tokenNumber, string(runes[start:i]), col})
+		case unicode.IsLetter(c) || c == '_' || c == '@':
+			start := i
+			for i++; i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || strings.ContainsRune("_@.", runes[i])); i++ {
+			}
+			tokens = append(tokens, queryToken{tokenIdent, string(runes[start:i]), col})
+		default:
+			return nil, dberr.New(dberr.ErrorQuerySyntax, col, fmt.Sprintf("unexpected character '%c'", c))
+		}
+	}
+	return append(tokens, queryToken{tokenEOF, "", len(runes) + 1}), nil
+}
+
+// sum := product (("+" | "-") product)*
+func (p *queryParser) parseSum() (computeFunc, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok.kind == tokenOp && (tok.text == "+" || tok.text == "-"); tok = p.peek() {
+		p.next()
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = arithmetic(tok.text, left, right)
+	}
+	return left, nil
+}
+
+// product := operand (("*" | "/") operand)*
+func (p *queryParser) parseProduct() (computeFunc, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok.kind == tokenOp && (tok.text == "*" || tok.text == "/"); tok = p.peek() {
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		left = arithmetic(tok.text, left, right)
+	}
+	return left, nil
+}
+
+// operand := "-" operand | "(" sum ")" | number | path
+func (p *queryParser) parseOperand() (computeFunc, error) {
+	tok := p.next()
+	switch {
+	case tok.kind == tokenOp && tok.text == "-":
+		operand, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return func(doc map[string]interface{}) (float64, bool) {
+			val, ok := operand(doc)
+			return -val, ok
+		}, nil
+	case tok.kind == tokenLParen:
+		inner, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		} else if closing := p.next(); closing.kind != tokenRParen {
+			return nil, dberr.New(dberr.ErrorQuerySyntax, closing.col, "expecting ')'")
+		}
+		return inner, nil
+	case tok.kind == tokenNumber:
+		num, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, dberr.New(dberr.ErrorQuerySyntax, tok.col, fmt.Sprintf("invalid number '%s'", tok.text))
+		}
+		return func(map[string]interface{}) (float64, bool) {
+			return num, true
+		}, nil
+	case tok.kind == tokenIdent:
+		vecPath := strings.Split(tok.text, ".")
+		return func(doc map[string]interface{}) (float64, bool) {
+			vals := GetIn(doc, vecPath)
+			if len(vals) != 1 {
+				return 0, false
+			}
+			num, err := queryFloat(tok.text, vals[0])
+			return num, err == nil
+		}, nil
+	case tok.kind == tokenEOF:
+		return nil, dberr.New(dberr.ErrorQuerySyntax, tok.col, "unexpected end of condition")
+	}
+	return nil, dberr.New(dberr.ErrorQuerySyntax, tok.col, fmt.Sprintf("unexpected '%s'", tok.text))
+}
+
+// Return the function that applies the arithmetic operator to the values of both operands.
+func arithmetic(op string, left, right computeFunc) computeFunc {
+	return func(doc map[string]interface{}) (float64, bool) {
+		leftVal, hasLeft := left(doc)
+		if !hasLeft {
+			return 0, false
+		}
+		rightVal, hasRight := right(doc)
+		if !hasRight {
+			return 0, false
+		}
+		switch op {
+		case "+":
+			return leftVal + rightVal, true
+		case "-":
+			return leftVal - rightVal, true
+		case "*":
+			return leftVal * rightVal, true
+		}
+		return leftVal / rightVal, rightVal != 0
+	}
+}
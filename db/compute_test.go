@@ -0,0 +1,78 @@
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestCompute(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	cheap, _ := col.Insert(map[string]interface{}{"price": 2, "quantity": 10})
+	bulk, _ := col.Insert(map[string]interface{}{"price": 2.5, "quantity": 100})
+	nested, _ := col.Insert(map[string]interface{}{"item": map[string]interface{}{"price": 30}, "quantity": 4})
+	zero, _ := col.Insert(map[string]interface{}{"price": 0, "quantity": 0})
+	col.Insert(map[string]interface{}{"price": "2", "quantity": 1000})
+	col.Insert(map[string]interface{}{"price": []interface{}{1, 2}, "quantity": 1000})
+	col.Insert(map[string]interface{}{"quantity": 1000})
+	for query, expected := range map[string][]int{
+		`{"compute": "price * quantity > 100"}`:                           {bulk},
+		`{"compute": "price * quantity <= 20"}`:                           {cheap, zero},
+		`{"compute": "item.price * quantity == 120"}`:                     {nested},
+		`{"compute": "(price + 1) * -2 < -6.5"}`:                          {bulk},
+		`{"compute": "quantity / price >= 5"}`:                            {cheap, bulk},
+		`{"compute": "price - quantity / 10 != 2 - 1"}`:                   {bulk, zero},
+		`{"compute": "price * 1e1 == 1e2 - 75"}`:                          {bulk},
+		`{"compute": "price * quantity > 100", "limit": 1}`:               {bulk},
+		`{"compute": "missing > 0 - 1"}`:                                  {},
+		`{"n": [{"compute": "price > 1"}, {"compute": "quantity < 50"}]}`: {cheap},
+	} {
+		result, err := runQuery(query, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+		// Views agree with the scan
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		if _, limited := q.(map[string]interface{})["limit"]; limited {
+			continue
+		}
+		col.ForEachDoc(func(id int, docB []byte) bool {
+			doc, _ := decodeDoc(docB)
+			_, inResult := result[id]
+			if match, err := matchDoc(q, id, doc); err != nil || match != inResult {
+				t.Fatal(query, id, match, err)
+			}
+			return true
+		})
+	}
+	for _, query := range []string{
+		`{"compute": 1}`,
+		`{"compute": "price * quantity"}`,
+		`{"compute": "price * > 1"}`,
+		`{"compute": "(price > 1"}`,
+		`{"compute": "price > 1 > 0"}`,
+		`{"compute": "price = 1"}`,
+		`{"compute": "price % 2 > 0"}`,
+		`{"compute": "price > 1.2.3"}`,
+	} {
+		if _, err = runQuery(query, col); err == nil {
+			t.Fatal("Did not error", query)
+		}
+	}
+	if _, err = runQuery(`{"compute": "price >"}`, col); dberr.Type(err) != dberr.ErrorQuerySyntax {
+		t.Fatal(err)
+	}
+}
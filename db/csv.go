@@ -0,0 +1,94 @@
+// Query result export to CSV.
+
+package db
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	CSV_EXPORT_BATCH = 100 // Number of documents read and written at a time by CSV export.
+)
+
+// Evaluate the query and write the values of the matched documents on the column paths as CSV: a header row of the
+// column paths in dot-delimited form, followed by a row for each document in ascending order of ID. A string value
+// makes a cell of its own text, any other value is written as JSON, several values along a path (e.g. elements of an
+// array) are written as a JSON array of them, and a path without value (or with null) makes an empty cell. Documents
+// are read and written in batches, so the result is not held in memory as documents; a document deleted during the
+// export is left out.
+func EvalQueryCSV(q interface{}, src *Col, columns [][]string, w io.Writer) error {
+	if len(columns) == 0 {
+		return errors.New("CSV export needs at least one column")
+	}
+	result := make(map[int]struct{})
+	if err := EvalQuery(q, src, &result); err != nil {
+		return err
+	}
+	ids := make([]int, 0, len(result))
+	for id := range result {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	out := csv.NewWriter(w)
+	row := make([]string, len(columns))
+	for i, column := range columns {
+		row[i] = strings.Join(column, ".")
+	}
+	if err := out.Write(row); err != nil {
+		return err
+	}
+	for start := 0; start < len(ids); start += CSV_EXPORT_BATCH {
+		end := start + CSV_EXPORT_BATCH
+		if end > len(ids) {
+			end = len(ids)
+		}
+		docs := src.ReadMany(ids[start:end])
+		for _, id := range ids[start:end] {
+			doc, exists := docs[id]
+			if !exists {
+				continue
+			}
+			for i, column := range columns {
+				row[i] = csvCell(GetIn(doc, column))
+			}
+			if err := out.Write(row); err != nil {
+				return err
+			}
+		}
+		if out.Flush(); out.Error() != nil {
+			return out.Error()
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// Return the CSV cell of the values along a path.
+func csvCell(vals []interface{}) string {
+	present := make([]interface{}, 0, len(vals))
+	for _, val := range vals {
+		if val != nil {
+			present = append(present, val)
+		}
+	}
+	var cell interface{} = present
+	switch len(present) {
+	case 0:
+		return ""
+	case 1:
+		if str, isStr := present[0].(string); isStr {
+			return str
+		}
+		cell = present[0]
+	}
+	cellJS, err := json.Marshal(cell)
+	if err != nil {
+		return ""
+	}
+	return string(cellJS)
+}
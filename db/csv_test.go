@@ -0,0 +1,66 @@
+package db
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestEvalQueryCSV(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"kind"}); err != nil {
+		t.Fatal(err)
+	}
+	docs := []map[string]interface{}{
+		{"kind": "a", "name": "plain", "price": 1.5, "tags": []interface{}{"x", "y"}, "addr": map[string]interface{}{"city": "Oslo"}},
+		{"kind": "a", "name": "with, comma \"quoted\"", "price": 2, "addr": nil},
+		{"kind": "a", "price": true, "tags": []interface{}{"z"}, "addr": map[string]interface{}{"zip": 1}},
+		{"kind": "b", "name": "other"},
+	}
+	for _, doc := range docs {
+		if _, err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	columns := [][]string{{"name"}, {"price"}, {"tags"}, {"addr", "city"}, {"addr"}}
+	var out bytes.Buffer
+	if err = EvalQueryCSV(map[string]interface{}{"eq": "a", "in": []interface{}{"kind"}}, col, columns, &out); err != nil {
+		t.Fatal(err)
+	}
+	// Rows are in the order of document ID, which is random
+	lines := bytes.Split(bytes.TrimSuffix(out.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != 4 || string(lines[0]) != "name,price,tags,addr.city,addr" {
+		t.Fatal(out.String())
+	}
+	expected := map[string]bool{
+		`plain,1.5,"[""x"",""y""]",Oslo,"{""city"":""Oslo""}"`: true,
+		`"with, comma ""quoted""",2,,,`:                        true,
+		`,true,z,,"{""zip"":1}"`:                               true,
+	}
+	for _, line := range lines[1:] {
+		if !expected[string(line)] {
+			t.Fatal(string(line))
+		}
+		delete(expected, string(line))
+	}
+	// No match writes the header alone
+	out.Reset()
+	if err = EvalQueryCSV(map[string]interface{}{"eq": "c", "in": []interface{}{"kind"}}, col, columns, &out); err != nil || out.String() != "name,price,tags,addr.city,addr\n" {
+		t.Fatal(out.String(), err)
+	}
+	if err = EvalQueryCSV("all", col, nil, &out); err == nil {
+		t.Fatal("did not error")
+	} else if err = EvalQueryCSV(map[string]interface{}{"eq": "a", "in": []interface{}{"nope"}}, col, columns, &out); err == nil {
+		t.Fatal("did not error")
+	}
+}
@@ -0,0 +1,101 @@
+// Date bucket counting.
+//
+// A date bucket query {"date-bucket": [path], "granularity": "day"} counts documents by the calendar period their
+// timestamp on the path falls into, for charting activity over time. Granularity is "month", "day" or "hour", and the
+// bucket label is the start of the period in UTC - "2006-01", "2006-01-02" or "2006-01-02T15" respectively. Timestamps
+// are RFC3339 strings (e.g. "2006-01-02T15:04:05Z07:00"), dates ("2006-01-02"), or numbers of seconds since Unix epoch.
+// Optional "q" restricts the counting to documents matching the sub-query.
+
+package db
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// Label layouts of date bucket granularities.
+var dateBucketLayouts = map[string]string{"month": "2006-01", "day": "2006-01-02", "hour": "2006-01-02T15"}
+
+// Evaluate a date bucket query and return the number of documents in each bucket by bucket label, along with the number
+// of documents left out for having no timestamp that can be parsed. A document having several timestamps on the path is
+// counted once in the bucket of every timestamp.
+func EvalDateBuckets(q interface{}, src *Col) (counts map[string]int, skipped int, err error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	if src.closed {
+		return nil, 0, dberr.New(dberr.ErrorColClosed, src.name)
+	}
+	expr, ok := q.(map[string]interface{})
+	if !ok {
+		return nil, 0, fmt.Errorf("Expecting a date bucket query, but %v given", q)
+	}
+	bucketPath, hasPath := expr["date-bucket"]
+	if !hasPath {
+		return nil, 0, dberr.New(dberr.ErrorMissing, "date-bucket")
+	}
+	vecPath, err := queryPath(bucketPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	granularity, hasGranularity := expr["granularity"]
+	if !hasGranularity {
+		return nil, 0, dberr.New(dberr.ErrorMissing, "granularity")
+	}
+	strGranularity, _ := granularity.(string)
+	layout, valid := dateBucketLayouts[strGranularity]
+	if !valid {
+		return nil, 0, fmt.Errorf("Expecting `granularity` to be month, day or hour, but %v given", granularity)
+	}
+	// Documents having a value on the (indexed) path are the candidates, unless a sub-query narrows them down
+	candidates := make(map[int]struct{})
+	if subExpr, narrowed := expr["q"]; narrowed {
+		err = evalQuery(optimizeQuery(subExpr, src), src, &candidates, false)
+	} else {
+		err = PathExistence(bucketPath, map[string]interface{}{}, src, &candidates)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	counts = make(map[string]int)
+	for id := range candidates {
+		doc, err := src.readForIndex(id)
+		if err != nil {
+			continue
+		}
+		inBucket := make(map[string]struct{})
+		for _, val := range GetIn(doc, vecPath) {
+			timestamp, parsed := parseTimestamp(val)
+			if !parsed {
+				continue
+			}
+			label := timestamp.UTC().Format(layout)
+			if _, in := inBucket[label]; !in {
+				inBucket[label] = struct{}{}
+				counts[label]++
+			}
+		}
+		if len(inBucket) == 0 {
+			skipped++
+		}
+	}
+	return counts, skipped, nil
+}
+
+// Return the time of an RFC3339 string, a date string, or a number of seconds since Unix epoch, or false if the value
+// is none of them.
+func parseTimestamp(val interface{}) (time.Time, bool) {
+	if str, isStr := val.(string); isStr {
+		if timestamp, err := time.Parse(time.RFC3339Nano, str); err == nil {
+			return timestamp, true
+		} else if timestamp, err = time.Parse("2006-01-02", str); err == nil {
+			return timestamp, true
+		}
+	} else if num, err := queryFloat("date-bucket", val); err == nil && !math.IsNaN(num) && !math.IsInf(num, 0) {
+		sec, frac := math.Modf(num)
+		return time.Unix(int64(sec), int64(frac*1e9)), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestEvalDateBuckets(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"at"})
+	col.Index([]string{"kind"})
+	for _, doc := range []map[string]interface{}{
+		{"at": "2024-01-31T23:30:00Z", "kind": "a"},
+		{"at": "2024-02-01T01:30:00+02:00", "kind": "b"}, // 23:30 UTC of the day before
+		{"at": "2024-02-01T10:00:00.5Z", "kind": "a"},
+		{"at": "2024-02-01", "kind": "a"},
+		{"at": 1706781600, "kind": "b"}, // 2024-02-01T10:00:00Z
+		{"at": []interface{}{"2024-03-05T10:00:00Z", "2024-03-05T11:00:00Z"}, "kind": "a"},
+		{"at": "yesterday", "kind": "a"},
+		{"at": true, "kind": "b"},
+		{"kind": "a"},
+	} {
+		if _, err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(query string, expected map[string]int, expectedSkipped int) {
+		var q interface{}
+		if err := json.Unmarshal([]byte(query), &q); err != nil {
+			t.Fatal(err)
+		}
+		if counts, skipped, err := EvalDateBuckets(q, col); err != nil || !reflect.DeepEqual(counts, expected) || skipped != expectedSkipped {
+			t.Fatal(query, counts, skipped, err)
+		}
+	}
+	check(`{"date-bucket": ["at"], "granularity": "month"}`, map[string]int{"2024-01": 2, "2024-02": 3, "2024-03": 1}, 2)
+	check(`{"date-bucket": ["at"], "granularity": "day"}`, map[string]int{"2024-01-31": 2, "2024-02-01": 3, "2024-03-05": 1}, 2)
+	check(`{"date-bucket": ["at"], "granularity": "hour"}`, map[string]int{
+		"2024-01-31T23": 2, "2024-02-01T00": 1, "2024-02-01T10": 2, "2024-03-05T10": 1, "2024-03-05T11": 1,
+	}, 2)
+	// Sub-query narrows down the documents, those without the path are skipped
+	check(`{"date-bucket": ["at"], "granularity": "day", "q": {"eq": "a", "in": ["kind"]}}`, map[string]int{
+		"2024-01-31": 1, "2024-02-01": 2, "2024-03-05": 1,
+	}, 2)
+	for _, q := range []interface{}{
+		"all",
+		map[string]interface{}{"granularity": "day"},
+		map[string]interface{}{"date-bucket": []interface{}{"at"}},
+		map[string]interface{}{"date-bucket": []interface{}{"at"}, "granularity": "week"},
+		map[string]interface{}{"date-bucket": []interface{}{"unindexed"}, "granularity": "day"},
+	} {
+		if _, _, err = EvalDateBuckets(q, col); err == nil {
+			t.Fatal("did not error", q)
+		}
+	}
+	if _, _, err = EvalDateBuckets(map[string]interface{}{"granularity": "day"}, col); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	}
+}
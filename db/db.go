@@ -3,7 +3,7 @@
 package db
 
 import (
-	"encoding/json"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -18,6 +18,7 @@ import (
 	"time"
 
 	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
 	"github.com/HouzuoGuo/tiedot/tdlog"
 )
 
@@ -32,6 +33,17 @@ type DB struct {
 	numParts   int             // Total number of partitions
 	cols       map[string]*Col // All collections
 	schemaLock *sync.RWMutex   // Control access to collection instances.
+	wal        *wal            // Write-ahead log of document writes, nil if disabled.
+
+	resultSetLock sync.Mutex               // Protects stored query result sets.
+	resultSets    map[string]*storedResult // Stored query result sets by token, created on demand.
+	resultSetIDs  int                      // Number of document IDs in all stored query result sets.
+
+	indexQueue indexQueue // Index updates waiting to be applied, if AsyncIndex is configured.
+
+	scans scanSlots // Full document scans running, if MaxConcurrentScans is configured.
+
+	storage DocStorage // Opens document partitions, nil if documents are kept in data files.
 }
 
 // Open database and load all collections & indexes.
@@ -46,15 +58,42 @@ func OpenDB(dbPath string) (*DB, error) {
 	return db, db.load()
 }
 
+// Open an existing database without write access, for example to query a backup or a database that is being served by
+// another process. Collections, indexes and documents cannot be changed, and no file is created or modified; write-ahead
+// log left over from last run is not replayed.
+func OpenReadOnly(dbPath string) (*DB, error) {
+	d, err := data.ReadConfig(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	d.ReadOnly = true
+	db := &DB{Config: d, path: dbPath, schemaLock: new(sync.RWMutex)}
+	db.Config.CalculateConfigConstants()
+	return db, db.load()
+}
+
+// Return dberr.ErrorReadOnly if the database is opened read-only.
+func (db *DB) checkWritable() error {
+	if db.Config.ReadOnly {
+		return dberr.New(dberr.ErrorReadOnly, db.path)
+	}
+	return nil
+}
+
 // Load all collection schema.
 func (db *DB) load() error {
 	// Create DB directory and PART_NUM_FILE if necessary
 	var numPartsAssumed = false
 	numPartsFilePath := path.Join(db.path, PART_NUM_FILE)
-	if err := os.MkdirAll(db.path, 0700); err != nil {
-		return err
+	if !db.Config.ReadOnly {
+		if err := os.MkdirAll(db.path, 0700); err != nil {
+			return err
+		}
 	}
 	if partNumFile, err := os.Stat(numPartsFilePath); err != nil {
+		if db.Config.ReadOnly {
+			return err
+		}
 		// The new database has as many partitions as number of CPUs recognized by OS
 		if err := ioutil.WriteFile(numPartsFilePath, []byte(strconv.Itoa(runtime.NumCPU())), 0600); err != nil {
 			return err
@@ -86,19 +125,69 @@ func (db *DB) load() error {
 			return err
 		}
 	}
-	return err
+	if err := db.recoverWAL(); err != nil {
+		return err
+	}
+	if db.Config.WarmupOnOpen {
+		took, size := db.Warmup()
+		tdlog.Noticef("Loaded %d bytes of indexes into memory in %v", size, took)
+	}
+	return nil
+}
+
+// Replay write-ahead log left over from last run, then open the log according to configured sync policy.
+func (db *DB) recoverWAL() error {
+	walPath := path.Join(db.path, WAL_FILE)
+	entries, err := readWAL(walPath)
+	if err != nil {
+		return err
+	}
+	if db.Config.ReadOnly {
+		if len(entries) > 0 {
+			tdlog.Noticef("Database is opened read-only, %d write-ahead log entries from %s are not replayed", len(entries), walPath)
+		}
+		return nil
+	}
+	if len(entries) > 0 {
+		tdlog.Noticef("Replaying %d write-ahead log entries from %s", len(entries), walPath)
+		db.replayWAL(entries)
+		for _, col := range db.cols {
+			if err := col.sync(); err != nil {
+				return err
+			}
+		}
+	}
+	if db.Config.WALSync == "" || db.Config.WALSync == data.WALSyncNone {
+		if err := os.Remove(walPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if db.wal, err = openWAL(walPath, db.Config); err != nil {
+		return err
+	}
+	db.wal.full = db.checkpointInBackground
+	return db.wal.reset()
 }
 
 // Close all database files. Do not use the DB afterwards!
 func (db *DB) Close() error {
-	db.schemaLock.Lock()
+	db.lockSchema()
 	defer db.schemaLock.Unlock()
+	db.stopIndexUpdates()
 	errs := make([]error, 0, 0)
+	if err := db.checkpoint(); err != nil {
+		errs = append(errs, err)
+	}
 	for _, col := range db.cols {
 		if err := col.close(); err != nil {
 			errs = append(errs, err)
 		}
 	}
+	if err := db.wal.close(); err != nil {
+		errs = append(errs, err)
+	}
+	db.wal = nil
 	if len(errs) == 0 {
 		return nil
 	}
@@ -107,6 +196,9 @@ func (db *DB) Close() error {
 
 // create creates collection files. The function does not place a schema lock.
 func (db *DB) create(name string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
 	if _, exists := db.cols[name]; exists {
 		return fmt.Errorf("Collection %s already exists", name)
 	} else if err := os.MkdirAll(path.Join(db.path, name), 0700); err != nil {
@@ -119,7 +211,7 @@ func (db *DB) create(name string) error {
 
 // Create a new collection.
 func (db *DB) Create(name string) error {
-	db.schemaLock.Lock()
+	db.lockSchema()
 	defer db.schemaLock.Unlock()
 	return db.create(name)
 }
@@ -147,30 +239,45 @@ func (db *DB) Use(name string) *Col {
 
 // Rename a collection.
 func (db *DB) Rename(oldName, newName string) error {
-	db.schemaLock.Lock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	db.lockSchema()
 	defer db.schemaLock.Unlock()
 	if _, exists := db.cols[oldName]; !exists {
 		return fmt.Errorf("Collection %s does not exist", oldName)
 	} else if _, exists := db.cols[newName]; exists {
 		return fmt.Errorf("Collection %s already exists", newName)
+	} else if err := db.checkpoint(); err != nil {
+		return err
 	} else if err := db.cols[oldName].close(); err != nil {
 		return err
 	} else if err := os.Rename(path.Join(db.path, oldName), path.Join(db.path, newName)); err != nil {
 		return err
 	} else if db.cols[newName], err = OpenCol(db, newName); err != nil {
 		return err
+	} else if err := db.cols[newName].reindexDerived(db.cols[oldName].derived); err != nil {
+		return err
 	}
+	db.cols[newName].validators = db.cols[oldName].validators
+	db.cols[newName].virtual = db.cols[oldName].virtual
 	delete(db.cols, oldName)
 	return nil
 }
 
 // Truncate a collection - delete all documents and clear
 func (db *DB) Truncate(name string) error {
-	db.schemaLock.Lock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	db.lockSchema()
 	defer db.schemaLock.Unlock()
 	if _, exists := db.cols[name]; !exists {
 		return fmt.Errorf("Collection %s does not exist", name)
 	}
+	if err := db.checkpoint(); err != nil {
+		return err
+	}
 	col := db.cols[name]
 	for i := 0; i < db.numParts; i++ {
 		if err := col.parts[i].Clear(); err != nil {
@@ -181,16 +288,45 @@ func (db *DB) Truncate(name string) error {
 				return err
 			}
 		}
+		if col.tombs != nil {
+			if err := col.tombs[i].Clear(); err != nil {
+				return err
+			}
+		}
+		if col.modTimes != nil {
+			if err := col.modTimes.hts[i].Clear(); err != nil {
+				return err
+			}
+		}
+		if col.versions != nil {
+			if err := col.versions.cols[i].Clear(); err != nil {
+				return err
+			} else if err := col.versions.hts[i].Clear(); err != nil {
+				return err
+			}
+		}
+	}
+	if col.modTimes != nil {
+		col.modTimes.sorted = newSkipList()
 	}
+	col.dropAllIDs()
+	col.clearSortedIndexes()
+	col.clearExistenceIndexes()
+	col.clearViews()
 	return nil
 }
 
 // Scrub a collection - fix corrupted documents and de-fragment free space.
 func (db *DB) Scrub(name string) error {
-	db.schemaLock.Lock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	db.lockSchema()
 	defer db.schemaLock.Unlock()
 	if _, exists := db.cols[name]; !exists {
 		return fmt.Errorf("Collection %s does not exist", name)
+	} else if err := db.checkpoint(); err != nil {
+		return err
 	}
 	// Prepare a temporary collection in file system
 	tmpColName := fmt.Sprintf("scrub-%s-%d", name, time.Now().UnixNano())
@@ -199,10 +335,26 @@ func (db *DB) Scrub(name string) error {
 		return err
 	}
 	// Mirror indexes from original collection
-	for _, idxPath := range db.cols[name].indexPaths {
-		if err := os.MkdirAll(path.Join(tmpColDir, strings.Join(idxPath, INDEX_PATH_SEP)), 0700); err != nil {
+	for idxName, idxPath := range db.cols[name].indexPaths {
+		idxDir := normalizationOf(idxName) + strings.Join(idxPath, INDEX_PATH_SEP)
+		if err := os.MkdirAll(path.Join(tmpColDir, idxDir), 0700); err != nil {
 			return err
 		}
+		for _, defFile := range []string{INDEX_SIZING_FILE, PARTIAL_INDEX_FILE, SINGLE_VALUED_INDEX_FILE, BLOOM_INDEX_FILE} {
+			if defs, err := ioutil.ReadFile(path.Join(db.path, name, idxDir, defFile)); err == nil {
+				if err := ioutil.WriteFile(path.Join(tmpColDir, idxDir, defFile), defs, 0600); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// Mirror view definitions, sorted and existence indexes and configuration from original collection
+	for _, defFile := range []string{VIEW_FILE, SORTED_INDEX_FILE, EXISTENCE_INDEX_FILE, COL_CONFIG_FILE} {
+		if defs, err := ioutil.ReadFile(path.Join(db.path, name, defFile)); err == nil {
+			if err := ioutil.WriteFile(path.Join(tmpColDir, defFile), defs, 0600); err != nil {
+				return err
+			}
+		}
 	}
 	// Iterate through all documents and put them into the temporary collection
 	tmpCol, err := OpenCol(db, tmpColName)
@@ -210,8 +362,8 @@ func (db *DB) Scrub(name string) error {
 		return err
 	}
 	db.cols[name].forEachDoc(func(id int, doc []byte) bool {
-		var docObj map[string]interface{}
-		if err := json.Unmarshal([]byte(doc), &docObj); err != nil {
+		docObj, err := decodeDoc(doc)
+		if err != nil {
 			// Skip corrupted document
 			return true
 		}
@@ -220,10 +372,66 @@ func (db *DB) Scrub(name string) error {
 		}
 		return true
 	}, false)
+	// Carry over tombstones of soft-deleted documents
+	if tombs := db.cols[name].tombs; tombs != nil {
+		if tmpCol.tombs == nil {
+			if err := tmpCol.openTombstones(); err != nil {
+				return err
+			}
+		}
+		for _, ht := range tombs {
+			_, ids := ht.GetPartition(0, 1)
+			for _, id := range ids {
+				if _, err := tmpCol.parts[id%db.numParts].Read(id); err == nil {
+					tmpCol.tombstone(id)
+				}
+			}
+		}
+	}
+	// Carry over document modification time
+	if modTimes := db.cols[name].modTimes; modTimes != nil {
+		if tmpCol.modTimes == nil {
+			if err := tmpCol.openModTimes(); err != nil {
+				return err
+			}
+		}
+		for _, ht := range modTimes.hts {
+			ids, times := ht.GetPartition(0, 1)
+			for i, id := range ids {
+				if _, err := tmpCol.parts[id%db.numParts].Read(id); err == nil {
+					tmpCol.setModTime(id, times[i])
+				}
+			}
+		}
+	}
+	// Carry over document versions
+	if versions := db.cols[name].versions; versions != nil {
+		if tmpCol.versions == nil {
+			if err := tmpCol.openVersions(); err != nil {
+				return err
+			}
+		}
+		for partNum, ht := range versions.hts {
+			ids, locs := ht.GetPartition(0, 1)
+			for i, id := range ids {
+				if _, err := tmpCol.parts[id%db.numParts].Read(id); err != nil {
+					continue
+				}
+				record := bytes.TrimSpace(versions.cols[partNum].Read(locs[i]))
+				if len(record) == 0 {
+					continue
+				}
+				if loc, err := tmpCol.versions.cols[partNum].Insert(record); err == nil {
+					tmpCol.versions.hts[partNum].Put(id, loc)
+				}
+			}
+		}
+	}
 	if err := tmpCol.close(); err != nil {
 		return err
 	}
 	// Replace the original collection with the "temporary" one
+	derived, validators, virtual := db.cols[name].derived, db.cols[name].validators, db.cols[name].virtual
 	db.cols[name].close()
 	if err := os.RemoveAll(path.Join(db.path, name)); err != nil {
 		return err
@@ -234,15 +442,22 @@ func (db *DB) Scrub(name string) error {
 	if db.cols[name], err = OpenCol(db, name); err != nil {
 		return err
 	}
-	return nil
+	db.cols[name].validators = validators
+	db.cols[name].virtual = virtual
+	return db.cols[name].reindexDerived(derived)
 }
 
 // Drop a collection and lose all of its documents and indexes.
 func (db *DB) Drop(name string) error {
-	db.schemaLock.Lock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	db.lockSchema()
 	defer db.schemaLock.Unlock()
 	if _, exists := db.cols[name]; !exists {
 		return fmt.Errorf("Collection %s does not exist", name)
+	} else if err := db.checkpoint(); err != nil {
+		return err
 	} else if err := db.cols[name].close(); err != nil {
 		return err
 	} else if err := os.RemoveAll(path.Join(db.path, name)); err != nil {
@@ -252,9 +467,68 @@ func (db *DB) Drop(name string) error {
 	return nil
 }
 
+// Replace the named collection with another collection of the database, e.g. one freshly loaded and indexed alongside
+// the live collection. The replacement takes over the name along with its documents, indexes, views and configuration,
+// and is no longer available under its own name; the documents and indexes of the replaced collection are lost. Both
+// happen under the schema write-lock, so a query sees either collection as a whole, never a mix of the two. Handles of
+// both collections obtained beforehand are closed - call Use again to continue with the replacement.
+func (db *DB) SwapCollection(name string, newCol *Col) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	db.lockSchema()
+	defer db.schemaLock.Unlock()
+	if _, exists := db.cols[name]; !exists {
+		return fmt.Errorf("Collection %s does not exist", name)
+	} else if newCol == nil || newCol.closed || db.cols[newCol.name] != newCol {
+		return fmt.Errorf("Expecting a collection of the database to swap in for %s", name)
+	} else if newCol.name == name {
+		return fmt.Errorf("Cannot swap collection %s with itself", name)
+	} else if err := db.checkpoint(); err != nil {
+		return err
+	}
+	// Move the original collection out of the way first, so that it can be put back if the replacement cannot move in
+	oldDir, newDir := path.Join(db.path, name), path.Join(db.path, newCol.name)
+	trashDir := path.Join(db.path, fmt.Sprintf("swap-%s-%d", name, time.Now().UnixNano()))
+	if err := db.cols[name].close(); err != nil {
+		return err
+	} else if err := newCol.close(); err != nil {
+		return err
+	} else if err := os.Rename(oldDir, trashDir); err != nil {
+		return err
+	} else if err := os.Rename(newDir, oldDir); err != nil {
+		if restoreErr := os.Rename(trashDir, oldDir); restoreErr != nil {
+			return fmt.Errorf("%v (failed to restore collection %s: %v)", err, name, restoreErr)
+		}
+		// Both collections stay as they were
+		for _, col := range []*Col{db.cols[name], newCol} {
+			reopened, reopenErr := OpenCol(db, col.name)
+			if reopenErr == nil {
+				db.cols[col.name] = reopened
+				reopened.validators = col.validators
+				reopened.virtual = col.virtual
+				reopenErr = reopened.reindexDerived(col.derived)
+			}
+			if reopenErr != nil {
+				return fmt.Errorf("%v (failed to reopen collection %s: %v)", err, col.name, reopenErr)
+			}
+		}
+		return err
+	} else if db.cols[name], err = OpenCol(db, name); err != nil {
+		return err
+	}
+	delete(db.cols, newCol.name)
+	db.cols[name].validators = newCol.validators
+	db.cols[name].virtual = newCol.virtual
+	if err := os.RemoveAll(trashDir); err != nil {
+		tdlog.Noticef("Swap collection %s: failed to remove the replaced collection files in %s - %v", name, trashDir, err)
+	}
+	return db.cols[name].reindexDerived(newCol.derived)
+}
+
 // Copy this database into destination directory (for backup).
 func (db *DB) Dump(dest string) error {
-	db.schemaLock.Lock()
+	db.lockSchema()
 	defer db.schemaLock.Unlock()
 	cpFun := func(currPath string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -2,9 +2,9 @@ package db
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
 	"github.com/bouk/monkey"
 	"github.com/pkg/errors"
 	"io/ioutil"
@@ -16,6 +16,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -457,7 +458,7 @@ func TestTruncatePartitionClear(t *testing.T) {
 	db, err := OpenDB(TEST_DATA_DIR)
 	col, _ := OpenCol(db, "test")
 	db.cols = map[string]*Col{"test": col}
-	col.parts = []*data.Partition{&data.Partition{}}
+	col.parts = []colPart{{DocStore: &data.Partition{}, DataLock: new(sync.RWMutex)}}
 
 	if err != nil {
 		t.Fatal(err)
@@ -487,7 +488,7 @@ func TestTruncateHashClearErr(t *testing.T) {
 	db, _ := OpenDB(TEST_DATA_DIR)
 	col, _ := OpenCol(db, collectName)
 	db.cols = map[string]*Col{collectName: col}
-	col.parts = []*data.Partition{&data.Partition{}}
+	col.parts = []colPart{{DocStore: &data.Partition{}, DataLock: new(sync.RWMutex)}}
 	col.hts = []map[string]*data.HashTable{map[string]*data.HashTable{collectName: &data.HashTable{}}}
 
 	var (
@@ -612,8 +613,8 @@ func TestScrubInsertRecoveryErr(t *testing.T) {
 		return errors.New(errMessage)
 	})
 
-	patch := monkey.Patch(json.Unmarshal, func(data []byte, v interface{}) error {
-		return nil
+	patch := monkey.Patch(decodeDoc, func(docB []byte) (map[string]interface{}, error) {
+		return nil, nil
 	})
 	defer patch.Unpatch()
 	defer objPatch.Unpatch()
@@ -730,6 +731,73 @@ func TestDropCloseColErr(t *testing.T) {
 	defer patch.Unpatch()
 	database.Drop(collectName)
 }
+func TestSwapCollection(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("live"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("rebuilt"); err != nil {
+		t.Fatal(err)
+	}
+	live, rebuilt := db.Use("live"), db.Use("rebuilt")
+	if _, err = live.Insert(map[string]interface{}{"a": "old"}); err != nil {
+		t.Fatal(err)
+	} else if err = live.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err = rebuilt.Index([]string{"b"}); err != nil {
+		t.Fatal(err)
+	} else if err = rebuilt.IndexDerived("upper b", func(doc map[string]interface{}) []interface{} {
+		return []interface{}{strings.ToUpper(fmt.Sprint(doc["b"]))}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	newID, err := rebuilt.Insert(map[string]interface{}{"b": "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []*Col{nil, live} {
+		if err = db.SwapCollection("live", bad); err == nil {
+			t.Fatal("did not error")
+		}
+	}
+	if err = db.SwapCollection("does not exist", rebuilt); err == nil {
+		t.Fatal("did not error")
+	} else if err = db.SwapCollection("live", rebuilt); err != nil {
+		t.Fatal(err)
+	}
+	// The replacement has taken over the name, and the handles obtained before are closed
+	if cols := db.AllCols(); len(cols) != 1 || cols[0] != "live" {
+		t.Fatal(cols)
+	} else if err = EvalQuery("all", live, &map[int]struct{}{}); dberr.Type(err) != dberr.ErrorColClosed {
+		t.Fatal(err)
+	} else if err = db.SwapCollection("live", rebuilt); err == nil {
+		t.Fatal("did not error")
+	}
+	swapped := db.Use("live")
+	if doc, err := swapped.Read(newID); err != nil || doc["b"] != "new" {
+		t.Fatal(doc, err)
+	} else if indexes := swapped.AllIndexes(); len(indexes) != 1 || indexes[0][0] != "b" {
+		t.Fatal(indexes)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": "NEW", "in": []interface{}{"upper b"}}, swapped, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	entries, err := ioutil.ReadDir(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != "live" {
+			t.Fatal("left behind", entry.Name())
+		}
+	}
+}
 func TestCloseErrorCloseCol(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
@@ -780,3 +848,88 @@ func TestDumpMkDirErr(t *testing.T) {
 		t.Error("Expected error make dir error")
 	}
 }
+
+func TestOpenReadOnly(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if _, err := OpenReadOnly(TEST_DATA_DIR); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", []byte(`{"SoftDelete": true, "TrackModTime": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	id, _ := col.Insert(map[string]interface{}{"a": 1})
+	deleted, _ := col.Insert(map[string]interface{}{"a": 2})
+	if err = col.Delete(deleted); err != nil {
+		t.Fatal(err)
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Remember size and modification time of every file
+	snapshot := func() map[string]string {
+		files := make(map[string]string)
+		filepath.Walk(TEST_DATA_DIR, func(path string, info os.FileInfo, err error) error {
+			if err == nil {
+				files[path] = fmt.Sprint(info.Size(), info.ModTime())
+			}
+			return err
+		})
+		return files
+	}
+	before := snapshot()
+	if db, err = OpenReadOnly(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if doc, err := col.Read(id); err != nil || doc["a"].(float64) != 1 {
+		t.Fatal(doc, err)
+	}
+	if result, err := runQuery(`{"eq": 1, "in": ["a"]}`, col); err != nil || !ensureMapHasKeys(result, id) {
+		t.Fatal(result, err)
+	}
+	if result, err := runQuery(`"all"`, col); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	if _, err := col.ModTime(id); err != nil {
+		t.Fatal(err)
+	}
+	// Every change is refused
+	for _, err := range []error{
+		func() error { _, err := col.Insert(map[string]interface{}{"a": 3}); return err }(),
+		col.Update(id, map[string]interface{}{"a": 3}),
+		col.Delete(id),
+		col.Undelete(deleted),
+		func() error { _, err := col.Purge(); return err }(),
+		col.Index([]string{"b"}),
+		col.Unindex([]string{"a"}),
+		col.IndexSorted([]string{"a"}),
+		col.CreateView("v", "all"),
+		db.Create("col2"),
+		db.Rename("col", "col2"),
+		db.Truncate("col"),
+		db.Scrub("col"),
+		db.Drop("col"),
+	} {
+		if dberr.Type(err) != dberr.ErrorReadOnly {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after := snapshot(); !reflect.DeepEqual(before, after) {
+		t.Fatal(before, after)
+	}
+}
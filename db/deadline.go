@@ -0,0 +1,53 @@
+// Query time budget.
+//
+// A query evaluated with a timeout shares one deadline among all of its sub-queries, so that a union of ten sub-queries
+// takes as long as the timeout in total, not ten times as long. Once the deadline passes, sub-queries that have not
+// started are not evaluated, a document scan or candidate verification in progress stops, and the evaluation returns
+// dberr.ErrorTimeout along with the partial result: a union keeps the documents of the sub-queries evaluated so far,
+// while intersection and complement - whose result cannot be told until all sub-queries are evaluated - add nothing.
+
+package db
+
+import (
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// Deadline of a query evaluation.
+type queryDeadline struct {
+	timeout time.Duration
+	at      time.Time
+	passed  bool // The evaluation has found the deadline passed, and has stopped
+}
+
+// Evaluate the query like EvalQuery does, within the time budget. If the evaluation takes longer, return
+// dberr.ErrorTimeout, and the result has the documents that were found in time.
+func EvalQueryWithTimeout(q interface{}, src *Col, timeout time.Duration, result *map[int]struct{}) error {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	// The query is evaluated on a copy of collection handle that carries the deadline, so that concurrent queries on
+	// the collection are not affected.
+	timed := *src
+	timed.deadline = &queryDeadline{timeout: timeout, at: time.Now().Add(timeout)}
+	return evalQuery(optimizeQuery(q, &timed), &timed, result, false)
+}
+
+// Return true if the query evaluated on the handle has a deadline that has passed. Does not place schema lock.
+func (col *Col) pastDeadline() bool {
+	if col.deadline == nil {
+		return false
+	} else if !col.deadline.passed && time.Now().After(col.deadline.at) {
+		col.deadline.passed = true
+		col.traceNote("Deadline passed after %v, evaluation stopped", col.deadline.timeout)
+	}
+	return col.deadline.passed
+}
+
+// Return dberr.ErrorTimeout if the query evaluated on the handle has run past its deadline. Does not place schema lock.
+func (col *Col) deadlineErr() error {
+	if col.pastDeadline() {
+		return dberr.New(dberr.ErrorTimeout, col.deadline.timeout)
+	}
+	return nil
+}
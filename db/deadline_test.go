@@ -0,0 +1,78 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestEvalQueryWithTimeout(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	fast, _ := col.Insert(map[string]interface{}{"a": 1})
+	later, _ := col.Insert(map[string]interface{}{"a": 2})
+	for i := 0; i < 10; i++ {
+		if _, err = col.Insert(map[string]interface{}{"a": 3}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Verifying a candidate of the derived index takes a while
+	slow := false
+	if err = col.IndexDerived("slow", func(doc map[string]interface{}) []interface{} {
+		if slow {
+			time.Sleep(30 * time.Millisecond)
+		}
+		return []interface{}{doc["a"]}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	slow = true
+	union := []interface{}{
+		map[string]interface{}{"eq": 1, "in": []interface{}{"a"}},
+		map[string]interface{}{"eq": 3, "in": []interface{}{"slow"}},
+		map[string]interface{}{"eq": 2, "in": []interface{}{"a"}},
+	}
+	// The union shares the budget, and keeps the documents found in time
+	result := make(map[int]struct{})
+	start := time.Now()
+	if err = EvalQueryWithTimeout(union, col, 100*time.Millisecond, &result); dberr.Type(err) != dberr.ErrorTimeout {
+		t.Fatal(err)
+	} else if took := time.Since(start); took > 250*time.Millisecond {
+		t.Fatal(took)
+	} else if _, found := result[fast]; !found || len(result) >= 11 {
+		t.Fatal(result)
+	} else if _, found = result[later]; found {
+		t.Fatal(result)
+	}
+	// Intersection adds nothing when it runs out of time
+	result = make(map[int]struct{})
+	intersect := map[string]interface{}{"n": []interface{}{"all", map[string]interface{}{"eq": 3, "in": []interface{}{"slow"}}}}
+	if err = EvalQueryWithTimeout(intersect, col, 100*time.Millisecond, &result); dberr.Type(err) != dberr.ErrorTimeout || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+	// A scan stops at the deadline
+	result = make(map[int]struct{})
+	if err = EvalQueryWithTimeout(map[string]interface{}{"not-contains": 1, "in": []interface{}{"a"}}, col, 0, &result); dberr.Type(err) != dberr.ErrorTimeout || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+	// In time, the result is complete
+	slow = false
+	result = make(map[int]struct{})
+	if err = EvalQueryWithTimeout(union, col, 10*time.Second, &result); err != nil || len(result) != 12 {
+		t.Fatal(result, err)
+	}
+}
@@ -0,0 +1,132 @@
+// Document references.
+//
+// A document refers to a document of another (or the same) collection by an object {"$ref": "users", "$id": "42"} that
+// names the collection and the document ID, given as string or number. References are not followed by index or query operations; instead, the
+// documents of a query result may have their references resolved, that is replaced by the referenced documents, so
+// that normalized data is returned in one piece.
+
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	REF_COL = "$ref" // Attribute of reference object naming the referenced collection.
+	REF_ID  = "$id"  // Attribute of reference object giving the referenced document ID.
+)
+
+// A reference in query result document that could not be resolved.
+type UnresolvedRef struct {
+	DocID int         // ID of the result document having the reference
+	Path  []string    // Reference field the reference was found on
+	Col   interface{} // Referenced collection as given by the reference
+	ID    interface{} // Referenced document ID as given by the reference
+	Err   error       // Reason, such as the collection or document does not exist
+}
+
+// Evaluate a query and read the result documents, then replace the references found along each of the reference fields
+// by the referenced documents. A field may have a single reference or an array of them, and an array along the path is
+// descended into like GetIn does. References inside the referenced documents are not resolved. A reference that cannot
+// be resolved is left in place and reported among the unresolved references, it does not fail the query.
+func EvalQueryResolve(q interface{}, src *Col, refFields [][]string) (docs map[int]map[string]interface{}, unresolved []UnresolvedRef, err error) {
+	result := make(map[int]struct{})
+	if err = EvalQuery(q, src, &result); err != nil {
+		return
+	}
+	ids := make([]int, 0, len(result))
+	for id := range result {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	docs = src.ReadMany(ids)
+	for _, id := range ids {
+		doc, exists := docs[id]
+		if !exists {
+			continue
+		}
+		for _, refPath := range refFields {
+			resolveRefs(doc, refPath, func(ref map[string]interface{}) (interface{}, bool) {
+				resolved, err := src.db.readRef(ref)
+				if err != nil {
+					unresolved = append(unresolved, UnresolvedRef{DocID: id, Path: refPath, Col: ref[REF_COL], ID: ref[REF_ID], Err: err})
+					return nil, false
+				}
+				return resolved, true
+			})
+		}
+	}
+	return
+}
+
+// Replace the references along the path by what resolve returns, unless it cannot resolve them. Values along the path
+// that are not references are left alone.
+func resolveRefs(thing interface{}, path []string, resolve func(ref map[string]interface{}) (interface{}, bool)) {
+	switch val := thing.(type) {
+	case map[string]interface{}:
+		if len(path) == 0 {
+			return
+		}
+		attr, exists := val[path[0]]
+		if !exists {
+			return
+		} else if ref, isRef := refOf(attr); isRef && len(path) == 1 {
+			if resolved, ok := resolve(ref); ok {
+				val[path[0]] = resolved
+			}
+			return
+		}
+		if elements, isArray := attr.([]interface{}); isArray && len(path) == 1 {
+			for i, element := range elements {
+				if ref, isRef := refOf(element); isRef {
+					if resolved, ok := resolve(ref); ok {
+						elements[i] = resolved
+					}
+				}
+			}
+			return
+		}
+		resolveRefs(attr, path[1:], resolve)
+	case []interface{}:
+		for _, element := range val {
+			resolveRefs(element, path, resolve)
+		}
+	}
+}
+
+// Return the value as reference object, or false if it is not one.
+func refOf(val interface{}) (map[string]interface{}, bool) {
+	ref, isMap := val.(map[string]interface{})
+	if !isMap {
+		return nil, false
+	}
+	_, hasCol := ref[REF_COL]
+	_, hasID := ref[REF_ID]
+	return ref, hasCol && hasID
+}
+
+// Read the document that the reference object refers to.
+func (db *DB) readRef(ref map[string]interface{}) (doc map[string]interface{}, err error) {
+	colName, isStr := ref[REF_COL].(string)
+	if !isStr {
+		return nil, fmt.Errorf("Expecting `%s` to be a collection name, but %v given", REF_COL, ref[REF_COL])
+	}
+	// Document IDs are too large for float64 to keep them exact, they are usually given as strings
+	var id int
+	if strID, isStr := ref[REF_ID].(string); isStr {
+		if id, err = strconv.Atoi(strID); err != nil {
+			return nil, dberr.New(dberr.ErrorExpectingInt, REF_ID, strID)
+		}
+	} else if id, err = queryInt(REF_ID, ref[REF_ID]); err != nil {
+		return nil, err
+	}
+	col := db.Use(colName)
+	if col == nil {
+		return nil, fmt.Errorf("Collection %s does not exist", colName)
+	}
+	return col.Read(id)
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestEvalQueryResolve(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("users"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("posts"); err != nil {
+		t.Fatal(err)
+	}
+	users, posts := db.Use("users"), db.Use("posts")
+	alice, _ := users.Insert(map[string]interface{}{"name": "alice"})
+	bob, _ := users.Insert(map[string]interface{}{"name": "bob"})
+	ref := func(col string, id int) map[string]interface{} {
+		return map[string]interface{}{"$ref": col, "$id": strconv.Itoa(id)}
+	}
+	single, _ := posts.Insert(map[string]interface{}{"author": ref("users", alice), "title": "a"})
+	many, _ := posts.Insert(map[string]interface{}{"meta": []interface{}{
+		map[string]interface{}{"editors": []interface{}{ref("users", alice), ref("users", bob), "nobody"}},
+	}})
+	// Document ID may be given as number too
+	broken, _ := posts.Insert(map[string]interface{}{"author": map[string]interface{}{"$ref": "users", "$id": 123456789}})
+	noCol, _ := posts.Insert(map[string]interface{}{"author": ref("nothing", alice)})
+	docs, unresolved, err := EvalQueryResolve("all", posts, [][]string{{"author"}, {"meta", "editors"}, {"title"}})
+	if err != nil || len(docs) != 4 {
+		t.Fatal(docs, err)
+	}
+	if author := docs[single]["author"]; !reflect.DeepEqual(author, map[string]interface{}{"name": "alice"}) {
+		t.Fatal(author)
+	} else if docs[single]["title"] != "a" {
+		t.Fatal(docs[single])
+	}
+	editors := docs[many]["meta"].([]interface{})[0].(map[string]interface{})["editors"].([]interface{})
+	if !reflect.DeepEqual(editors, []interface{}{map[string]interface{}{"name": "alice"}, map[string]interface{}{"name": "bob"}, "nobody"}) {
+		t.Fatal(editors)
+	}
+	// Unresolved references are reported and left in place
+	if len(unresolved) != 2 {
+		t.Fatal(unresolved)
+	}
+	for _, missing := range unresolved {
+		if missing.DocID != broken && missing.DocID != noCol || !reflect.DeepEqual(missing.Path, []string{"author"}) || missing.Err == nil {
+			t.Fatal(missing)
+		} else if _, isRef := refOf(docs[missing.DocID]["author"]); !isRef {
+			t.Fatal(docs[missing.DocID])
+		}
+	}
+	if unresolved[0].DocID == broken && dberr.Type(unresolved[0].Err) != dberr.ErrorNoDoc {
+		t.Fatal(unresolved[0].Err)
+	}
+	if _, _, err = EvalQueryResolve(map[string]interface{}{"eq": 1.0, "in": []interface{}{"a"}}, posts, nil); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,164 @@
+// Indexes on derived values.
+//
+// A derived index stores values calculated from each document by a Go function, rather than values found along a
+// path; e.g. lower-cased name for case-insensitive lookup. Lookup queries refer to a derived index by its name:
+// {"eq": "john", "in": ["lower name"]}. Derivation functions cannot be saved, therefore a derived index lives only as
+// long as the opened database, and has to be created again after the database is re-opened.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	DERIVED_INDEX_PREFIX = "~" // Prefix of derived index directory name.
+)
+
+// Calculate values to be put on a derived index. The function must be deterministic.
+type DeriveFunc func(doc map[string]interface{}) []interface{}
+
+// Create an index on values derived by the function, and put all documents on the index.
+func (col *Col) IndexDerived(name string, derive DeriveFunc) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("Derived index name %s is invalid", name)
+	} else if derive == nil {
+		return fmt.Errorf("Derived index %s must have a derivation function", name)
+	} else if _, exists := col.indexPaths[name]; exists {
+		return fmt.Errorf("Path %s is already indexed", name)
+	} else if _, exists := col.derived[name]; exists {
+		return fmt.Errorf("Derived index %s already exists", name)
+	}
+	return col.indexDerived(name, derive)
+}
+
+// Open hash tables of the derived index and put all documents on it. Does not place schema lock.
+func (col *Col) indexDerived(name string, derive DeriveFunc) (err error) {
+	idxName := DERIVED_INDEX_PREFIX + name
+	idxDir := path.Join(col.db.path, col.name, idxName)
+	if err = os.MkdirAll(idxDir, 0700); err != nil {
+		return err
+	}
+	col.derived[name] = derive
+	for i := 0; i < col.db.numParts; i++ {
+		if col.hts[i][idxName], err = col.db.Config.OpenHashTable(path.Join(idxDir, strconv.Itoa(i))); err != nil {
+			return err
+		}
+	}
+	col.forEachDoc(func(id int, doc []byte) (moveOn bool) {
+		docObj, err := decodeDoc(doc)
+		if err != nil {
+			// Skip corrupted document
+			return true
+		}
+		for _, idxVal := range derivedValues(derive, docObj) {
+			hashKey := StrHash(idxVal)
+			col.hts[hashKey%col.db.numParts][idxName].Put(hashKey, id)
+		}
+		return true
+	}, false)
+	return nil
+}
+
+// Create all derived indexes again, e.g. after the collection is re-opened. Does not place schema lock.
+func (col *Col) reindexDerived(derived map[string]DeriveFunc) error {
+	for name, derive := range derived {
+		if err := col.indexDerived(name, derive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove a derived index.
+func (col *Col) UnindexDerived(name string) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	if _, exists := col.derived[name]; !exists {
+		return fmt.Errorf("Derived index %s does not exist", name)
+	}
+	return col.unindexDerived(name)
+}
+
+// Close and remove the derived index. Does not place schema lock.
+func (col *Col) unindexDerived(name string) error {
+	delete(col.derived, name)
+	idxName := DERIVED_INDEX_PREFIX + name
+	for i := 0; i < col.db.numParts; i++ {
+		col.hts[i][idxName].Close()
+		delete(col.hts[i], idxName)
+	}
+	return os.RemoveAll(path.Join(col.db.path, col.name, idxName))
+}
+
+// Return names of all derived indexes.
+func (col *Col) AllDerivedIndexes() (ret []string) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	ret = make([]string, 0, len(col.derived))
+	for name := range col.derived {
+		ret = append(ret, name)
+	}
+	return
+}
+
+// Return the distinct values derived from the document in string form. The derivation function sees numbers as float64,
+// no matter whether the document was given to Insert/Update or read back for index maintenance and verification.
+func derivedValues(derive DeriveFunc, doc map[string]interface{}) []string {
+	return distinctStrings(derive(floatNumbers(doc).(map[string]interface{})))
+}
+
+// Put the values derived from the document into it under the derived index names, so that matching the document against
+// a lookup on a derived index finds the same values as the index does. Does not place schema lock.
+func (col *Col) addDerivedValues(doc map[string]interface{}) {
+	floatDoc := floatNumbers(doc).(map[string]interface{})
+	for name, derive := range col.derived {
+		if vals := derive(floatDoc); len(vals) > 0 {
+			doc[name] = vals
+		} else {
+			delete(doc, name)
+		}
+	}
+}
+
+// Return a copy of the document value in which json.Number and integers became float64.
+func floatNumbers(val interface{}) interface{} {
+	switch v := val.(type) {
+	case json.Number:
+		if floatVal, err := v.Float64(); err == nil {
+			return floatVal
+		}
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			converted[key] = floatNumbers(elem)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, elem := range v {
+			converted[i] = floatNumbers(elem)
+		}
+		return converted
+	}
+	return val
+}
@@ -0,0 +1,166 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func lowerName(doc map[string]interface{}) []interface{} {
+	if name, ok := doc["name"].(string); ok {
+		return []interface{}{strings.ToLower(name)}
+	}
+	return nil
+}
+
+func TestIndexDerived(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	existing, _ := col.Insert(map[string]interface{}{"name": "John"})
+	if err = col.IndexDerived("lower name", lowerName); err != nil {
+		t.Fatal(err)
+	}
+	if col.IndexDerived("lower name", lowerName) == nil || col.IndexDerived("a", lowerName) == nil ||
+		col.IndexDerived("", lowerName) == nil || col.IndexDerived("x", nil) == nil {
+		t.Fatal("Did not error")
+	}
+	if names := col.AllDerivedIndexes(); len(names) != 1 || names[0] != "lower name" {
+		t.Fatal(names)
+	}
+	lookup := func(val string) map[int]struct{} {
+		var q interface{}
+		json.Unmarshal([]byte(fmt.Sprintf(`{"eq": "%s", "in": ["lower name"]}`, val)), &q)
+		result := make(map[int]struct{})
+		if err := EvalQuery(q, col, &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	// Existing and new documents are on the index
+	inserted, _ := col.Insert(map[string]interface{}{"name": "JOHN"})
+	col.Insert(map[string]interface{}{"name": "Jane"})
+	if result := lookup("john"); len(result) != 2 || !ensureMapHasKeys(result, existing, inserted) {
+		t.Fatal(result)
+	}
+	if result := lookup("John"); len(result) != 0 {
+		t.Fatal(result)
+	}
+	// Update and delete maintain the index
+	if err = col.Update(existing, map[string]interface{}{"name": "Jack"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.Delete(inserted); err != nil {
+		t.Fatal(err)
+	}
+	if result := lookup("john"); len(result) != 0 {
+		t.Fatal(result)
+	}
+	if result := lookup("jack"); len(result) != 1 || !ensureMapHasKeys(result, existing) {
+		t.Fatal(result)
+	}
+	// Derived index survives scrub and rename
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Rename("col", "col2"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col2")
+	if result := lookup("jack"); len(result) != 1 || !ensureMapHasKeys(result, existing) {
+		t.Fatal(result)
+	}
+	if err = col.UnindexDerived("lower name"); err != nil {
+		t.Fatal(err)
+	}
+	if col.UnindexDerived("lower name") == nil {
+		t.Fatal("Did not error")
+	}
+	if _, err := os.Stat(path.Join(TEST_DATA_DIR, "col2", DERIVED_INDEX_PREFIX+"lower name")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	// Derived index does not survive reopening the database
+	if err = col.IndexDerived("lower name", lowerName); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("col2")
+	if names := col.AllDerivedIndexes(); len(names) != 0 {
+		t.Fatal(names)
+	}
+	if indexes := col.AllIndexes(); len(indexes) != 1 {
+		t.Fatal(indexes)
+	}
+	if _, err := os.Stat(path.Join(TEST_DATA_DIR, "col2", DERIVED_INDEX_PREFIX+"lower name")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexDerivedNumber(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	double := func(doc map[string]interface{}) []interface{} {
+		if n, ok := doc["n"].(float64); ok {
+			return []interface{}{n * 2}
+		}
+		return nil
+	}
+	if err = col.IndexDerived("double", double); err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(val int) map[int]struct{} {
+		var q interface{}
+		json.Unmarshal([]byte(fmt.Sprintf(`{"eq": %d, "in": ["double"]}`, val)), &q)
+		result := make(map[int]struct{})
+		if err := EvalQuery(q, col, &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	// Numbers read back from the collection are float64 to the derivation function, just like the inserted ones
+	id, _ := col.Insert(map[string]interface{}{"n": float64(5)})
+	if result := lookup(10); len(result) != 1 || !ensureMapHasKeys(result, id) {
+		t.Fatal(result)
+	}
+	if err = col.Update(id, map[string]interface{}{"n": float64(6)}); err != nil {
+		t.Fatal(err)
+	}
+	if result := lookup(12); len(result) != 1 || !ensureMapHasKeys(result, id) {
+		t.Fatal(result)
+	}
+	if result := lookup(10); len(result) != 0 {
+		t.Fatal(result)
+	}
+	if err = col.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if result := lookup(12); len(result) != 0 {
+		t.Fatal(result)
+	}
+}
@@ -3,29 +3,45 @@
 package db
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/HouzuoGuo/tiedot/dberr"
 	"github.com/HouzuoGuo/tiedot/tdlog"
 )
 
-// Resolve the attribute(s) in the document structure along the given path.
+const (
+	PATH_WILDCARD    = "**"    // Path segment that matches any number of nested levels, including none.
+	maxExactFloatInt = 1 << 53 // Integers up to this magnitude are exactly representable in float64.
+	maxWildcardDepth = 32      // Path wildcard does not descend deeper than this many nested levels.
+)
+
+// Resolve the attribute(s) in the document structure along the given path. Path segment "**" matches any number of
+// nested levels, e.g. ["config", "**", "enabled"] resolves both config.enabled and config.x.y.enabled.
 func GetIn(doc interface{}, path []string) (ret []interface{}) {
-	docMap, ok := doc.(map[string]interface{})
+	return getIn(doc, path, 0)
+}
+
+// Resolve the attribute(s) along the path, having descended depth levels by path wildcard.
+func getIn(doc interface{}, path []string, depth int) (ret []interface{}) {
+	docMap, ok := documentOf(doc)
 	if !ok {
 		return
 	}
 	var thing interface{} = docMap
 	// Get into each path segment
 	for i, seg := range path {
-		if aMap, ok := thing.(map[string]interface{}); ok {
+		if seg == PATH_WILDCARD {
+			return append(ret, getInWildcard(thing, path[i+1:], depth)...)
+		} else if aMap, ok := documentOf(thing); ok {
 			thing = aMap[seg]
 		} else if anArray, ok := thing.([]interface{}); ok {
-			for _, element := range anArray {
-				ret = append(ret, GetIn(element, path[i:])...)
-			}
-			return ret
+			return append(ret, getInArray(anArray, path[i:], depth)...)
 		} else {
 			return nil
 		}
@@ -38,6 +54,286 @@ func GetIn(doc interface{}, path []string) (ret []interface{}) {
 	}
 }
 
+// Resolve the attribute(s) along the path in every array element, descending into nested arrays.
+func getInArray(array []interface{}, path []string, depth int) (ret []interface{}) {
+	for _, element := range array {
+		if nested, ok := element.([]interface{}); ok {
+			ret = append(ret, getInArray(nested, path, depth)...)
+		} else {
+			ret = append(ret, getIn(element, path, depth)...)
+		}
+	}
+	return
+}
+
+// Resolve the attribute(s) along the rest of path after a path wildcard, at the wildcard position and at every nested
+// document and array element below it. A wildcard ending the path resolves all values below it that are not documents
+// or arrays. The depth limit stops the descent into a structure that refers to itself.
+func getInWildcard(thing interface{}, rest []string, depth int) (ret []interface{}) {
+	if depth > maxWildcardDepth {
+		return
+	}
+	if aMap, ok := documentOf(thing); ok {
+		thing = aMap
+	}
+	switch val := thing.(type) {
+	case map[string]interface{}:
+		if len(rest) > 0 {
+			ret = append(ret, getIn(val, rest, depth)...)
+		}
+		for _, attr := range val {
+			ret = append(ret, getInWildcard(attr, rest, depth+1)...)
+		}
+	case []interface{}:
+		for _, element := range val {
+			ret = append(ret, getInWildcard(element, rest, depth+1)...)
+		}
+	default:
+		if len(rest) == 0 {
+			ret = append(ret, val)
+		}
+	}
+	return
+}
+
+// Resolve the attribute(s) along the path like GetIn does, but tell apart an attribute that is absent from one that is
+// present with null value: the result has nil for each null value, and nothing for an absent attribute. A path is
+// therefore in one of three states in a document - absent (empty result), present with null (result has nil) or
+// present with value.
+func GetInPresent(doc interface{}, path []string) (ret []interface{}) {
+	last := len(path) - 1
+	if last < 0 || path[last] == PATH_WILDCARD {
+		// Trailing wildcard only resolves values that are present
+		return GetIn(doc, path)
+	}
+	parents := []interface{}{doc}
+	if last > 0 {
+		parents = GetIn(doc, path[:last])
+	}
+	for _, parent := range parents {
+		parentMap, isMap := documentOf(parent)
+		if !isMap {
+			continue
+		}
+		switch val := parentMap[path[last]].(type) {
+		case nil:
+			if _, present := parentMap[path[last]]; present {
+				ret = append(ret, nil)
+			}
+		case []interface{}:
+			ret = append(ret, val...)
+		default:
+			ret = append(ret, val)
+		}
+	}
+	return
+}
+
+// Return the value as a document. A map of non-string keys, such as a nested map decoded from YAML, is a document whose
+// attribute names are the string form of its keys.
+func documentOf(thing interface{}) (map[string]interface{}, bool) {
+	switch val := thing.(type) {
+	case map[string]interface{}:
+		return val, true
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{}, len(val))
+		for key, attr := range val {
+			ret[fmt.Sprint(key)] = attr
+		}
+		return ret, true
+	}
+	return nil, false
+}
+
+// Convert the maps of non-string keys nested in the document into documents, so that the document is stored and
+// indexed in the shape JSON decoding gives it back - attribute names are strings. The document is changed in place.
+func normalizeDoc(doc map[string]interface{}) {
+	for name, attr := range doc {
+		doc[name] = normalizeValue(attr)
+	}
+}
+
+// Return the value with the maps of non-string keys in it converted into documents.
+func normalizeValue(val interface{}) interface{} {
+	switch thing := val.(type) {
+	case map[string]interface{}:
+		normalizeDoc(thing)
+	case map[interface{}]interface{}:
+		doc, _ := documentOf(thing)
+		normalizeDoc(doc)
+		return doc
+	case []interface{}:
+		for i, element := range thing {
+			thing[i] = normalizeValue(element)
+		}
+	}
+	return val
+}
+
+// Return true if a segment of the path is path wildcard.
+func hasPathWildcard(path []string) bool {
+	for _, seg := range path {
+		if seg == PATH_WILDCARD {
+			return true
+		}
+	}
+	return false
+}
+
+// Attribute names of projected paths. A name without nested names projects the entire value of the attribute.
+type projection map[string]projection
+
+// Return a copy of the document having only the values along the paths. Nested documents keep their structure, and an
+// array along the path keeps its elements that have the value. Attributes missing from the document are absent.
+func Project(doc map[string]interface{}, paths [][]string) map[string]interface{} {
+	fields := make(projection)
+	for _, path := range paths {
+		node := fields
+		for i, seg := range path {
+			child, exists := node[seg]
+			if exists && child == nil {
+				// An enclosing attribute is already projected entirely
+				break
+			} else if i == len(path)-1 {
+				node[seg] = nil
+			} else if !exists {
+				child = make(projection)
+				node[seg] = child
+			}
+			node = child
+		}
+	}
+	ret := make(map[string]interface{})
+	for name, nested := range fields {
+		if val, exists := doc[name]; exists {
+			if projected, has := projectValue(val, nested); has {
+				ret[name] = projected
+			}
+		}
+	}
+	return ret
+}
+
+// Return the projected part of the value, or false if the value has none of the projected attributes.
+func projectValue(val interface{}, fields projection) (interface{}, bool) {
+	if fields == nil {
+		return val, true
+	}
+	switch thing := val.(type) {
+	case map[string]interface{}:
+		ret := make(map[string]interface{})
+		for name, nested := range fields {
+			if attr, exists := thing[name]; exists {
+				if projected, has := projectValue(attr, nested); has {
+					ret[name] = projected
+				}
+			}
+		}
+		return ret, len(ret) > 0
+	case []interface{}:
+		ret := make([]interface{}, 0, len(thing))
+		for _, element := range thing {
+			if projected, has := projectValue(element, fields); has {
+				ret = append(ret, projected)
+			}
+		}
+		return ret, len(ret) > 0
+	}
+	return nil, false
+}
+
+// Return the distinct non-nil values along the path in string form; a document has one index entry per value.
+func indexValues(doc interface{}, path []string) []string {
+	return distinctStrings(withNumericStrings(GetIn(doc, path)))
+}
+
+// Return the values with the number represented by each numeric string (e.g. "25", " 25.0", "2.5e1") added after the
+// string, so that a number stored as string is also indexed as the number itself.
+func withNumericStrings(vals []interface{}) []interface{} {
+	ret := vals
+	for _, val := range vals {
+		if str, isStr := val.(string); isStr {
+			if num, isNum := numericString(str); isNum {
+				if len(ret) == len(vals) {
+					ret = append(make([]interface{}, 0, len(vals)+1), vals...)
+				}
+				ret = append(ret, num)
+			}
+		}
+	}
+	return ret
+}
+
+// Return the decimal number represented by the string, ignoring surrounding white space. Hexadecimal, infinity and NaN
+// are not numbers.
+func numericString(str string) (json.Number, bool) {
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return "", false
+	}
+	for _, c := range str {
+		if (c < '0' || c > '9') && c != '.' && c != '+' && c != '-' && c != 'e' && c != 'E' {
+			return "", false
+		}
+	}
+	if _, err := strconv.ParseFloat(str, 64); err != nil {
+		return "", false
+	}
+	return json.Number(str), true
+}
+
+// Return the distinct non-nil values in string form.
+func distinctStrings(vals []interface{}) (ret []string) {
+	seen := make(map[string]struct{})
+	for _, idxVal := range vals {
+		if idxVal == nil {
+			continue
+		}
+		strVal := indexString(idxVal)
+		if _, dup := seen[strVal]; !dup {
+			seen[strVal] = struct{}{}
+			ret = append(ret, strVal)
+		}
+	}
+	return
+}
+
+// Return the string form of a value as it is hashed on index. Integers beyond float64 precision keep all of their
+// digits; other numbers are formatted as float64, so that lookups agree with documents decoded without json.Number.
+func indexString(val interface{}) string {
+	switch num := val.(type) {
+	case json.Number:
+		if intVal, err := num.Int64(); err == nil {
+			return intString(intVal)
+		} else if floatVal, err := num.Float64(); err == nil {
+			return fmt.Sprint(floatVal)
+		}
+	case int:
+		return intString(int64(num))
+	case int64:
+		return intString(num)
+	case int32:
+		return intString(int64(num))
+	}
+	return fmt.Sprint(val)
+}
+
+// Format an integer as float64 if it is exactly representable, or in full digits otherwise.
+func intString(intVal int64) string {
+	if intVal >= -maxExactFloatInt && intVal <= maxExactFloatInt {
+		return fmt.Sprint(float64(intVal))
+	}
+	return strconv.FormatInt(intVal, 10)
+}
+
+// Decode a document for index maintenance, numbers become json.Number to retain precision of large integers.
+func decodeDoc(docB []byte) (doc map[string]interface{}, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(docB))
+	decoder.UseNumber()
+	err = decoder.Decode(&doc)
+	return
+}
+
 // Hash a string using sdbm algorithm.
 func StrHash(str string) int {
 	var hash int
@@ -50,40 +346,65 @@ func StrHash(str string) int {
 	return hash
 }
 
-// Put a document on all user-created indexes.
+// Put a document on all user-created, derived, sorted and existence indexes, and the views it belongs to.
 func (col *Col) indexDoc(id int, doc map[string]interface{}) {
 	for idxName, idxPath := range col.indexPaths {
-		for _, idxVal := range GetIn(doc, idxPath) {
-			if idxVal != nil {
-				hashKey := StrHash(fmt.Sprint(idxVal))
-				partNum := hashKey % col.db.numParts
-				ht := col.hts[partNum][idxName]
-				ht.Lock.Lock()
-				ht.Put(hashKey, id)
-				ht.Lock.Unlock()
-			}
+		for _, idxVal := range col.indexedValues(idxName, id, doc, idxPath) {
+			hashKey := StrHash(idxVal)
+			partNum := hashKey % col.db.numParts
+			ht := col.hts[partNum][idxName]
+			ht.Lock.Lock()
+			ht.Put(hashKey, id)
+			ht.Lock.Unlock()
+			col.bloomAdd(idxName, hashKey)
 		}
 	}
+	for name, derive := range col.derived {
+		for _, idxVal := range derivedValues(derive, doc) {
+			hashKey := StrHash(idxVal)
+			ht := col.hts[hashKey%col.db.numParts][DERIVED_INDEX_PREFIX+name]
+			ht.Lock.Lock()
+			ht.Put(hashKey, id)
+			ht.Lock.Unlock()
+		}
+	}
+	col.sortedIndexDoc(id, doc)
+	col.existenceIndexDoc(id, doc)
+	col.viewDoc(id, doc)
 }
 
-// Remove a document from all user-created indexes.
+// Remove a document from all user-created, derived, sorted and existence indexes, and views.
 func (col *Col) unindexDoc(id int, doc map[string]interface{}) {
 	for idxName, idxPath := range col.indexPaths {
-		for _, idxVal := range GetIn(doc, idxPath) {
-			if idxVal != nil {
-				hashKey := StrHash(fmt.Sprint(idxVal))
-				partNum := hashKey % col.db.numParts
-				ht := col.hts[partNum][idxName]
-				ht.Lock.Lock()
-				ht.Remove(hashKey, id)
-				ht.Lock.Unlock()
-			}
+		for _, idxVal := range col.indexedValues(idxName, id, doc, idxPath) {
+			hashKey := StrHash(idxVal)
+			partNum := hashKey % col.db.numParts
+			ht := col.hts[partNum][idxName]
+			ht.Lock.Lock()
+			ht.Remove(hashKey, id)
+			ht.Lock.Unlock()
 		}
 	}
+	for name, derive := range col.derived {
+		for _, idxVal := range derivedValues(derive, doc) {
+			hashKey := StrHash(idxVal)
+			ht := col.hts[hashKey%col.db.numParts][DERIVED_INDEX_PREFIX+name]
+			ht.Lock.Lock()
+			ht.Remove(hashKey, id)
+			ht.Lock.Unlock()
+		}
+	}
+	col.sortedUnindexDoc(id, doc)
+	col.existenceUnindexDoc(id)
+	col.unviewDoc(id)
 }
 
 // Insert a document with the specified ID into the collection (incl. index). Does not place partition/schema lock.
 func (col *Col) InsertRecovery(id int, doc map[string]interface{}) (err error) {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	normalizeDoc(doc)
 	docJS, err := json.Marshal(doc)
 	if err != nil {
 		return
@@ -94,6 +415,7 @@ func (col *Col) InsertRecovery(id int, doc map[string]interface{}) (err error) {
 	if _, err = part.Insert(id, []byte(docJS)); err != nil {
 		return
 	}
+	col.cacheDocID(id, true)
 	// Index the document
 	col.indexDoc(id, doc)
 	return
@@ -101,6 +423,10 @@ func (col *Col) InsertRecovery(id int, doc map[string]interface{}) (err error) {
 
 // Insert a document into the collection.
 func (col *Col) Insert(doc map[string]interface{}) (id int, err error) {
+	if err := col.db.checkWritable(); err != nil {
+		return 0, err
+	}
+	normalizeDoc(doc)
 	docJS, err := json.Marshal(doc)
 	if err != nil {
 		return
@@ -110,6 +436,14 @@ func (col *Col) Insert(doc map[string]interface{}) (id int, err error) {
 	col.db.schemaLock.RLock()
 	part := col.parts[partNum]
 
+	if err = col.validate(docJS); err != nil {
+		col.db.schemaLock.RUnlock()
+		return
+	}
+	if err = col.db.wal.append(WAL_INSERT, col.name, id, docJS); err != nil {
+		col.db.schemaLock.RUnlock()
+		return
+	}
 	// Put document data into collection
 	part.DataLock.Lock()
 	_, err = part.Insert(id, []byte(docJS))
@@ -118,10 +452,13 @@ func (col *Col) Insert(doc map[string]interface{}) (id int, err error) {
 		col.db.schemaLock.RUnlock()
 		return
 	}
+	col.cacheDocID(id, true)
 
 	part.LockUpdate(id)
 	// Index the document
-	col.indexDoc(id, doc)
+	col.reindexDoc(id, nil, doc, docJS)
+	col.touch(id)
+	col.recordVersion(id, nil, docJS)
 	part.UnlockUpdate(id)
 
 	col.db.schemaLock.RUnlock()
@@ -151,31 +488,135 @@ func (col *Col) read(id int, placeSchemaLock bool) (doc map[string]interface{},
 	return
 }
 
-// Find and retrieve a document by ID.
+// Read a document for index maintenance and verification, numbers are decoded into json.Number. Does not place lock.
+func (col *Col) readForIndex(id int) (doc map[string]interface{}, err error) {
+	part := col.parts[id%col.db.numParts]
+	part.DataLock.RLock()
+	docB, err := part.Read(id)
+	part.DataLock.RUnlock()
+	if err != nil {
+		return
+	}
+	return decodeDoc(docB)
+}
+
+// Find and retrieve a document by ID. A soft-deleted document cannot be read.
 func (col *Col) Read(id int) (doc map[string]interface{}, err error) {
-	return col.read(id, true)
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.isDeleted(id) {
+		return nil, dberr.New(dberr.ErrorNoDoc, id)
+	}
+	return col.read(id, false)
+}
+
+// Read the documents of the IDs, e.g. to retrieve the documents of a query result. Documents of a partition are read
+// together in the order of their IDs, under a single lock acquisition. A document that cannot be read, e.g. it does
+// not exist or is soft-deleted, is absent from the returned map.
+func (col *Col) ReadMany(ids []int) map[int]map[string]interface{} {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	partIDs := make([][]int, col.db.numParts)
+	for _, id := range ids {
+		if id >= 0 {
+			partIDs[id%col.db.numParts] = append(partIDs[id%col.db.numParts], id)
+		}
+	}
+	docs := make(map[int]map[string]interface{}, len(ids))
+	docBs := make([][]byte, 0)
+	for i, part := range col.parts {
+		sort.Ints(partIDs[i])
+		docBs = docBs[:0]
+		part.DataLock.RLock()
+		for _, id := range partIDs[i] {
+			docB, _ := part.Read(id)
+			docBs = append(docBs, docB)
+		}
+		part.DataLock.RUnlock()
+		// Documents are decoded outside of the lock
+		for j, id := range partIDs[i] {
+			var doc map[string]interface{}
+			if docBs[j] == nil || col.isDeleted(id) || json.Unmarshal(docBs[j], &doc) != nil {
+				continue
+			}
+			docs[id] = doc
+		}
+	}
+	return docs
+}
+
+// Find the document having the value at the indexed path, and return its ID and content. If more than one document
+// has the value, the one of the lowest ID is returned along with error dberr.ErrorDuplicateKey.
+func (col *Col) GetByIndexedKey(path []string, value interface{}) (id int, doc map[string]interface{}, found bool, err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.closed {
+		return 0, nil, false, dberr.New(dberr.ErrorColClosed, col.name)
+	}
+	vecPath := make([]interface{}, len(path))
+	for i, seg := range path {
+		vecPath[i] = seg
+	}
+	result := make(map[int]struct{})
+	if err = Lookup(value, map[string]interface{}{"eq": value, "in": vecPath}, col, &result); err != nil {
+		return
+	}
+	ids := make([]int, 0, len(result))
+	for docID := range result {
+		ids = append(ids, docID)
+	}
+	sort.Ints(ids)
+	for i, docID := range ids {
+		if doc, err = col.read(docID, false); err != nil {
+			// The document is gone after lookup
+			continue
+		}
+		id, found = docID, true
+		if remaining := len(ids) - i; remaining > 1 {
+			err = dberr.New(dberr.ErrorDuplicateKey, remaining, value, path)
+		}
+		return
+	}
+	return 0, nil, false, nil
 }
 
 // Update a document.
 func (col *Col) Update(id int, doc map[string]interface{}) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
 	if doc == nil {
 		return fmt.Errorf("Updating %d: input doc may not be nil", id)
 	}
+	normalizeDoc(doc)
 	docJS, err := json.Marshal(doc)
 	if err != nil {
 		return err
 	}
 	col.db.schemaLock.RLock()
 	part := col.parts[id%col.db.numParts]
+	if err = col.validate(docJS); err != nil {
+		col.db.schemaLock.RUnlock()
+		return err
+	}
 
 	// Place lock, read back original document and update
 	part.DataLock.Lock()
 	originalB, err := part.Read(id)
+	if err == nil && col.isDeleted(id) {
+		// A soft-deleted document stays off the indexes until it is brought back
+		err = dberr.New(dberr.ErrorNoDoc, id)
+	}
 	if err != nil {
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
 		return err
 	}
+	if err = col.db.wal.appendReplacing(WAL_UPDATE, col.name, id, originalB, docJS); err != nil {
+		part.DataLock.Unlock()
+		col.db.schemaLock.RUnlock()
+		return err
+	}
 	err = part.Update(id, []byte(docJS))
 	part.DataLock.Unlock()
 	if err != nil {
@@ -184,15 +625,14 @@ func (col *Col) Update(id int, doc map[string]interface{}) error {
 	}
 
 	// Done with the collection data, next is to maintain indexed values
-	var original map[string]interface{}
-	json.Unmarshal(originalB, &original)
+	original, _ := decodeDoc(originalB)
 	part.LockUpdate(id)
-	if original != nil {
-		col.unindexDoc(id, original)
-	} else {
+	if original == nil {
 		tdlog.Noticef("Will not attempt to unindex document %d during update", id)
 	}
-	col.indexDoc(id, doc)
+	col.reindexDoc(id, original, doc, docJS)
+	col.touch(id)
+	col.recordVersion(id, originalB, docJS)
 	// Done with the index
 	part.UnlockUpdate(id)
 
@@ -206,27 +646,46 @@ func (col *Col) Update(id int, doc map[string]interface{}) error {
 // provided buffer could be modified (reused for returned value);
 // non-nil error will be propagated back and returned from UpdateBytesFunc.
 func (col *Col) UpdateBytesFunc(id int, update func(origDoc []byte) (newDoc []byte, err error)) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
 	col.db.schemaLock.RLock()
 	part := col.parts[id%col.db.numParts]
 
 	// Place lock, read back original document and update
 	part.DataLock.Lock()
 	originalB, err := part.Read(id)
+	if err == nil && col.isDeleted(id) {
+		// A soft-deleted document stays off the indexes until it is brought back
+		err = dberr.New(dberr.ErrorNoDoc, id)
+	}
 	if err != nil {
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
 		return err
 	}
-	var original map[string]interface{}
-	json.Unmarshal(originalB, &original) // Unmarshal originalB before passing it to update
+	original, _ := decodeDoc(originalB) // Decode originalB before passing it to update
+	var loggedB []byte
+	if col.db.wal != nil {
+		// update may reuse the buffer of originalB, keep the original for the log
+		loggedB = append([]byte(nil), originalB...)
+	}
 	docB, err := update(originalB)
 	if err != nil {
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
 		return err
 	}
-	var doc map[string]interface{} // check if docB are valid JSON before Update
-	if err = json.Unmarshal(docB, &doc); err != nil {
+	doc, err := decodeDoc(docB) // check if docB are valid JSON before Update
+	if err == nil {
+		err = col.validate(docB)
+	}
+	if err != nil {
+		part.DataLock.Unlock()
+		col.db.schemaLock.RUnlock()
+		return err
+	}
+	if err = col.db.wal.appendReplacing(WAL_UPDATE, col.name, id, loggedB, docB); err != nil {
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
 		return err
@@ -240,12 +699,12 @@ func (col *Col) UpdateBytesFunc(id int, update func(origDoc []byte) (newDoc []by
 
 	// Done with the collection data, next is to maintain indexed values
 	part.LockUpdate(id)
-	if original != nil {
-		col.unindexDoc(id, original)
-	} else {
+	if original == nil {
 		tdlog.Noticef("Will not attempt to unindex document %d during update", id)
 	}
-	col.indexDoc(id, doc)
+	col.reindexDoc(id, original, doc, docB)
+	col.touch(id)
+	col.recordVersion(id, originalB, docB)
 	// Done with the index
 	part.UnlockUpdate(id)
 
@@ -258,12 +717,19 @@ func (col *Col) UpdateBytesFunc(id int, update func(origDoc []byte) (newDoc []by
 // provided document should NOT be modified;
 // non-nil error will be propagated back and returned from UpdateFunc.
 func (col *Col) UpdateFunc(id int, update func(origDoc map[string]interface{}) (newDoc map[string]interface{}, err error)) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
 	col.db.schemaLock.RLock()
 	part := col.parts[id%col.db.numParts]
 
 	// Place lock, read back original document and update
 	part.DataLock.Lock()
 	originalB, err := part.Read(id)
+	if err == nil && col.isDeleted(id) {
+		// A soft-deleted document stays off the indexes until it is brought back
+		err = dberr.New(dberr.ErrorNoDoc, id)
+	}
 	if err != nil {
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
@@ -282,12 +748,21 @@ func (col *Col) UpdateFunc(id int, update func(origDoc map[string]interface{}) (
 		col.db.schemaLock.RUnlock()
 		return err
 	}
+	normalizeDoc(doc)
 	docJS, err := json.Marshal(doc)
+	if err == nil {
+		err = col.validate(docJS)
+	}
 	if err != nil {
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
 		return err
 	}
+	if err = col.db.wal.appendReplacing(WAL_UPDATE, col.name, id, originalB, docJS); err != nil {
+		part.DataLock.Unlock()
+		col.db.schemaLock.RUnlock()
+		return err
+	}
 	err = part.Update(id, []byte(docJS))
 	part.DataLock.Unlock()
 	if err != nil {
@@ -297,8 +772,10 @@ func (col *Col) UpdateFunc(id int, update func(origDoc map[string]interface{}) (
 
 	// Done with the collection data, next is to maintain indexed values
 	part.LockUpdate(id)
-	col.unindexDoc(id, original)
-	col.indexDoc(id, doc)
+	indexed, _ := decodeDoc(originalB)
+	col.reindexDoc(id, indexed, doc, docJS)
+	col.touch(id)
+	col.recordVersion(id, originalB, docJS)
 	// Done with the document
 	part.UnlockUpdate(id)
 
@@ -306,9 +783,21 @@ func (col *Col) UpdateFunc(id int, update func(origDoc map[string]interface{}) (
 	return nil
 }
 
-// Delete a document.
+// Delete a document. If soft-delete is enabled, put a tombstone on the document instead of removing it.
 func (col *Col) Delete(id int) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
 	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.db.Config.SoftDelete && col.tombs != nil {
+		return col.softDelete(id)
+	}
+	return col.delete(id)
+}
+
+// Remove a document from collection and indexes, along with its tombstone. Does not place schema lock.
+func (col *Col) delete(id int) error {
 	part := col.parts[id%col.db.numParts]
 
 	// Place lock, read back original document and delete document
@@ -316,27 +805,30 @@ func (col *Col) Delete(id int) error {
 	originalB, err := part.Read(id)
 	if err != nil {
 		part.DataLock.Unlock()
-		col.db.schemaLock.RUnlock()
+		return err
+	}
+	if err = col.db.wal.appendReplacing(WAL_DELETE, col.name, id, originalB, nil); err != nil {
+		part.DataLock.Unlock()
 		return err
 	}
 	err = part.Delete(id)
 	part.DataLock.Unlock()
 	if err != nil {
-		col.db.schemaLock.RUnlock()
 		return err
 	}
+	col.cacheDocID(id, false)
 
 	// Done with the collection data, next is to remove indexed values
-	var original map[string]interface{}
-	err = json.Unmarshal(originalB, &original)
+	original, err := decodeDoc(originalB)
 	if err == nil {
 		part.LockUpdate(id)
-		col.unindexDoc(id, original)
+		col.reindexDoc(id, original, nil, nil)
 		part.UnlockUpdate(id)
 	} else {
 		tdlog.Noticef("Will not attempt to unindex document %d during delete", id)
 	}
-
-	col.db.schemaLock.RUnlock()
+	col.untombstone(id)
+	col.forgetModTime(id)
+	col.forgetVersions(id)
 	return nil
 }
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -425,6 +426,135 @@ func TestGetInPathIsEpmty(t *testing.T) {
 		t.Error("Expected value is empty")
 	}
 }
+func TestGetInPresent(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{"a": null, "b": 1, "c": [1, null], "n": [{"a": null}, {"b": 2}, 3], "m": {"a": {"x": null}}}`), &doc)
+	for path, expected := range map[string][]interface{}{
+		"a":     {nil},
+		"b":     {1.0},
+		"c":     {1.0, nil},
+		"x":     nil,
+		"n,a":   {nil},
+		"n,b":   {2.0},
+		"n,x":   nil,
+		"x,a":   nil,
+		"m,**":  {nil},
+		"m,a,x": {nil},
+	} {
+		if vals := GetInPresent(doc, strings.Split(path, ",")); !reflect.DeepEqual(vals, expected) {
+			t.Fatal(path, vals, expected)
+		}
+	}
+	// GetIn does not tell absent from null
+	if vals := GetIn(doc, []string{"x"}); !reflect.DeepEqual(vals, []interface{}{nil}) {
+		t.Fatal(vals)
+	}
+}
+
+func TestNonStringKeys(t *testing.T) {
+	doc := map[string]interface{}{
+		"a": map[interface{}]interface{}{"b": map[interface{}]interface{}{1: "one", "c": 2}},
+		"l": []interface{}{map[interface{}]interface{}{"x": 3}, map[string]interface{}{"x": 4}},
+	}
+	for path, expected := range map[string][]interface{}{
+		"a,b,1":  {"one"},
+		"a,b,c":  {2},
+		"l,x":    {3, 4},
+		"l,**,x": {3, 4},
+		"a,**":   {2, "one"},
+	} {
+		vals := GetIn(doc, strings.Split(path, ","))
+		sort.Slice(vals, func(i, j int) bool { return fmt.Sprint(vals[i]) < fmt.Sprint(vals[j]) })
+		if !reflect.DeepEqual(vals, expected) {
+			t.Fatal(path, vals, expected)
+		}
+	}
+	// Documents are stored and indexed with string attribute names
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+	db, err := OpenDB(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a", "b", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readBack, err := col.Read(id); err != nil || GetIn(readBack, []string{"a", "b", "1"})[0] != "one" {
+		t.Fatal(readBack, err)
+	}
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": "one", "in": []interface{}{"a", "b", "1"}}, col, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	if err := col.Update(id, map[string]interface{}{"a": map[interface{}]interface{}{"b": map[interface{}]interface{}{1: "uno"}}}); err != nil {
+		t.Fatal(err)
+	}
+	result = make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": "uno", "in": []interface{}{"a", "b", "1"}}, col, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+}
+
+func TestGetInWildcard(t *testing.T) {
+	var doc map[string]interface{}
+	json.Unmarshal([]byte(`{"config": {"enabled": 1, "x": {"enabled": 2, "y": {"z": {"enabled": 3}}}, "list": [{"enabled": 4}, [{"enabled": 5}]], "n": {"other": 6}}}`), &doc)
+	for path, expected := range map[string][]float64{
+		`["config", "**", "enabled"]`:  {1, 2, 3, 4, 5},
+		`["**", "enabled"]`:            {1, 2, 3, 4, 5},
+		`["config", "x", "**"]`:        {2, 3},
+		`["config", "**", "other"]`:    {6},
+		`["config", "**", "missing"]`:  {},
+		`["missing", "**", "enabled"]`: {},
+	} {
+		var vecPath []string
+		json.Unmarshal([]byte(path), &vecPath)
+		found := make([]float64, 0)
+		for _, val := range GetIn(doc, vecPath) {
+			if num, isNum := val.(float64); isNum {
+				found = append(found, num)
+			}
+		}
+		sort.Float64s(found)
+		if !reflect.DeepEqual(found, expected) {
+			t.Fatal(path, found)
+		}
+	}
+	// Wildcard stops descending into a structure that refers to itself
+	cyclic := map[string]interface{}{"a": 1}
+	cyclic["self"] = cyclic
+	if vals := GetIn(cyclic, []string{"**", "a"}); len(vals) != maxWildcardDepth+1 {
+		t.Fatal(len(vals))
+	}
+}
+func TestProject(t *testing.T) {
+	var doc map[string]interface{}
+	json.Unmarshal([]byte(`{"a": 1, "b": {"c": 2, "d": 3}, "e": [{"f": 4, "g": 5}, {"g": 6}, 7], "h": null}`), &doc)
+	for paths, expected := range map[string]string{
+		`[["a"], ["b", "c"]]`:        `{"a": 1, "b": {"c": 2}}`,
+		`[["b", "c"], ["b"]]`:        `{"b": {"c": 2, "d": 3}}`,
+		`[["b"], ["b", "c"]]`:        `{"b": {"c": 2, "d": 3}}`,
+		`[["e", "f"]]`:               `{"e": [{"f": 4}]}`,
+		`[["h"], ["x"], ["a", "x"]]`: `{"h": null}`,
+		`[[]]`:                       `{}`,
+	} {
+		var vecPaths [][]string
+		var expectedDoc map[string]interface{}
+		json.Unmarshal([]byte(paths), &vecPaths)
+		json.Unmarshal([]byte(expected), &expectedDoc)
+		if projected := Project(doc, vecPaths); !reflect.DeepEqual(projected, expectedDoc) {
+			t.Fatal(paths, projected)
+		}
+	}
+}
 func TestColInsertRecoveryMarshalJsErr(t *testing.T) {
 	db, _ := OpenDB(tempDir)
 	defer os.RemoveAll(tempDir)
@@ -598,8 +728,8 @@ func TestUpdateBytesJsMarshalErr(t *testing.T) {
 	patchRead := monkey.PatchInstanceMethod(reflect.TypeOf(part), "Read", func(_ *data.Partition, id int) ([]byte, error) {
 		return nil, nil
 	})
-	patchMarshal := monkey.Patch(json.Unmarshal, func(data []byte, v interface{}) error {
-		return errors.New(errMessage)
+	patchMarshal := monkey.Patch(decodeDoc, func(docB []byte) (map[string]interface{}, error) {
+		return nil, errors.New(errMessage)
 	})
 	defer patchRead.Unpatch()
 	defer patchMarshal.Unpatch()
@@ -618,8 +748,8 @@ func TestUpdateBytesPartUpdateErr(t *testing.T) {
 	patchRead := monkey.PatchInstanceMethod(reflect.TypeOf(part), "Read", func(_ *data.Partition, id int) ([]byte, error) {
 		return nil, nil
 	})
-	patchMarshal := monkey.Patch(json.Unmarshal, func(data []byte, v interface{}) error {
-		return nil
+	patchMarshal := monkey.Patch(decodeDoc, func(docB []byte) (map[string]interface{}, error) {
+		return nil, nil
 	})
 	patchUpdate := monkey.PatchInstanceMethod(reflect.TypeOf(part), "Update", func(_ *data.Partition, id int, data []byte) (err error) {
 		return errors.New(errMessage)
@@ -648,9 +778,8 @@ func TestUpdateBytesFuncIsLog(t *testing.T) {
 	patchRead := monkey.PatchInstanceMethod(reflect.TypeOf(part), "Read", func(_ *data.Partition, id int) ([]byte, error) {
 		return nil, nil
 	})
-	patchMarshal := monkey.Patch(json.Unmarshal, func(data []byte, v interface{}) error {
-		v = nil
-		return nil
+	patchMarshal := monkey.Patch(decodeDoc, func(docB []byte) (map[string]interface{}, error) {
+		return nil, nil
 	})
 	patchUpdate := monkey.PatchInstanceMethod(reflect.TypeOf(part), "Update", func(_ *data.Partition, id int, data []byte) (err error) {
 		return nil
@@ -791,8 +920,8 @@ func TestDeleteMarshalJsError(t *testing.T) {
 	patchUpdate := monkey.PatchInstanceMethod(reflect.TypeOf(part), "Delete", func(_ *data.Partition, id int) (err error) {
 		return nil
 	})
-	patchMarshal := monkey.Patch(json.Unmarshal, func(data []byte, v interface{}) error {
-		return errors.New(errMessage)
+	patchMarshal := monkey.Patch(decodeDoc, func(docB []byte) (map[string]interface{}, error) {
+		return nil, errors.New(errMessage)
 	})
 	defer patchMarshal.Unpatch()
 	defer patchUpdate.Unpatch()
@@ -802,3 +931,253 @@ func TestDeleteMarshalJsError(t *testing.T) {
 		t.Error("Expected error: message log")
 	}
 }
+func TestIndexArrayOfObjects(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"items", "sku"}); err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	json.Unmarshal([]byte(`{"items": [{"sku": "A"}, {"sku": "B"}, {"sku": "A"}, [{"sku": "C"}], {"sku": null}]}`), &doc)
+	id, err := col.Insert(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One index entry per distinct value, including those in nested arrays
+	for _, sku := range []string{"A", "B", "C"} {
+		if err := idxHas(col, []string{"items", "sku"}, sku, id); err != nil {
+			t.Fatal(err)
+		}
+		if q, err := runQuery(`{"eq": "`+sku+`", "in": ["items", "sku"]}`, col); err != nil || !ensureMapHasKeys(q, id) {
+			t.Fatal(sku, q, err)
+		}
+	}
+	// Removing a repeated value leaves no stale index entry behind
+	json.Unmarshal([]byte(`{"items": [{"sku": "B"}]}`), &doc)
+	if err = col.Update(id, doc); err != nil {
+		t.Fatal(err)
+	}
+	hashKey := StrHash("A")
+	if vals := col.hts[hashKey%db.numParts]["items!sku"].Get(hashKey, 0); len(vals) != 0 {
+		t.Fatal(vals)
+	}
+	if q, err := runQuery(`{"eq": "A", "in": ["items", "sku"]}`, col); err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	}
+}
+
+func TestIndexLargeInteger(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	// The two 17-digit integers are the same in float64
+	exact, _ := col.Insert(map[string]interface{}{"id": int64(12345678901234567)})
+	col.Insert(map[string]interface{}{"id": int64(12345678901234568)})
+	// Index is built from documents read back from storage
+	if err = col.Index([]string{"id"}); err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(q interface{}) map[int]struct{} {
+		result := make(map[int]struct{})
+		if err := EvalQuery(q, col, &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	jsonQuery, err := decodeDoc([]byte(`{"eq": 12345678901234567, "in": ["id"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedQuery, err := ParseQuery(`id == 12345678901234567`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []interface{}{
+		jsonQuery,
+		parsedQuery,
+		map[string]interface{}{"eq": int64(12345678901234567), "in": []interface{}{"id"}},
+	} {
+		if result := lookup(q); len(result) != 1 || !ensureMapHasKeys(result, exact) {
+			t.Fatal(q, result)
+		}
+	}
+	// Integer range and set look up the same index values, on hash and sorted index alike
+	rangeQueries := []interface{}{
+		map[string]interface{}{"int-from": 12345678901234567, "int-to": 12345678901234567, "in": []interface{}{"id"}},
+		map[string]interface{}{"int-from": 12345678901234566, "int-to": 12345678901234567, "in": []interface{}{"id"}},
+		map[string]interface{}{"int-from": 12345678901234567, "int-to": 12345678901234566, "in": []interface{}{"id"}},
+		map[string]interface{}{"int-set": []interface{}{12345678901234567}, "in": []interface{}{"id"}},
+	}
+	for _, q := range rangeQueries {
+		if result := lookup(q); len(result) != 1 || !ensureMapHasKeys(result, exact) {
+			t.Fatal(q, result)
+		}
+	}
+	if err = col.IndexSorted([]string{"id"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range rangeQueries {
+		if result := lookup(q); len(result) != 1 || !ensureMapHasKeys(result, exact) {
+			t.Fatal(q, result)
+		}
+	}
+	// Document decoded with json.Number is indexed on insert and un-indexed on update
+	doc, _ := decodeDoc([]byte(`{"id": 12345678901234569}`))
+	decoded, _ := col.Insert(doc)
+	q := map[string]interface{}{"eq": json.Number("12345678901234569"), "in": []interface{}{"id"}}
+	if result := lookup(q); len(result) != 1 || !ensureMapHasKeys(result, decoded) {
+		t.Fatal(result)
+	}
+	if err = col.Update(decoded, map[string]interface{}{"id": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if result := lookup(q); len(result) != 0 {
+		t.Fatal(result)
+	}
+	// Small integer in any representation has the same index value
+	for _, q := range []interface{}{
+		map[string]interface{}{"eq": 1, "in": []interface{}{"id"}},
+		map[string]interface{}{"eq": float64(1), "in": []interface{}{"id"}},
+		map[string]interface{}{"eq": json.Number("1"), "in": []interface{}{"id"}},
+	} {
+		if result := lookup(q); len(result) != 1 || !ensureMapHasKeys(result, decoded) {
+			t.Fatal(q, result)
+		}
+	}
+}
+
+func TestGetByIndexedKey(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"user", "name"})
+	john, _ := col.Insert(map[string]interface{}{"user": map[string]interface{}{"name": "john"}, "age": 20})
+	if id, doc, found, err := col.GetByIndexedKey([]string{"user", "name"}, "john"); err != nil || !found || id != john || doc["age"].(float64) != 20 {
+		t.Fatal(id, doc, found, err)
+	}
+	if id, doc, found, err := col.GetByIndexedKey([]string{"user", "name"}, "jane"); err != nil || found || id != 0 || doc != nil {
+		t.Fatal(id, doc, found, err)
+	}
+	// The lowest ID is returned among duplicates
+	another, _ := col.Insert(map[string]interface{}{"user": map[string]interface{}{"name": "john"}})
+	lowest := john
+	if another < lowest {
+		lowest = another
+	}
+	if id, _, found, err := col.GetByIndexedKey([]string{"user", "name"}, "john"); dberr.Type(err) != dberr.ErrorDuplicateKey || !found || id != lowest {
+		t.Fatal(id, found, err)
+	}
+	if _, _, found, err := col.GetByIndexedKey([]string{"age"}, 20); dberr.Type(err) != dberr.ErrorNeedIndex || found {
+		t.Fatal(found, err)
+	}
+}
+
+func TestReadMany(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", []byte(`{"SoftDelete": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 20)
+	for i := range ids {
+		ids[i], _ = col.Insert(map[string]interface{}{"a": i})
+	}
+	if err = col.Delete(ids[3]); err != nil {
+		t.Fatal(err)
+	}
+	// Documents that cannot be read are left out
+	docs := col.ReadMany(append(ids, -1, 12345))
+	if len(docs) != 19 {
+		t.Fatal(len(docs))
+	}
+	for i, id := range ids {
+		if _, found := docs[id]; i == 3 && found {
+			t.Fatal("Read soft-deleted document")
+		} else if i != 3 && docs[id]["a"] != float64(i) {
+			t.Fatal(i, docs[id])
+		}
+	}
+	if docs := col.ReadMany(nil); len(docs) != 0 {
+		t.Fatal(docs)
+	}
+}
+
+// Prepare a collection of documents for read benchmarks, and return their IDs.
+func benchmarkReadCol(b *testing.B) (*DB, *Col, []int) {
+	os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		b.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 10000)
+	for i := range ids {
+		ids[i], _ = col.Insert(map[string]interface{}{"a": i, "b": strconv.Itoa(i)})
+	}
+	return db, col, ids
+}
+
+func BenchmarkReadMany(b *testing.B) {
+	db, col, ids := benchmarkReadCol(b)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	defer db.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		col.ReadMany(ids)
+	}
+}
+
+func BenchmarkReadEach(b *testing.B) {
+	db, col, ids := benchmarkReadCol(b)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	defer db.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		docs := make(map[int]map[string]interface{}, len(ids))
+		for _, id := range ids {
+			if doc, err := col.Read(id); err == nil {
+				docs[id] = doc
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Existence indexes.
+//
+// An existence index keeps the IDs of documents having a value along a path, so that path existence test enumerates
+// the documents directly instead of iterating over every bucket of the hash index, which pays off for a sparse path.
+// Like sorted index, the ID sets live in memory: index paths are saved in collection directory, and the sets are built
+// again from documents when the collection is opened.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	EXISTENCE_INDEX_FILE = "existence_indexes.json" // Name of existence index path file in collection directory.
+)
+
+// IDs of documents having a value along a path.
+type existenceIndex struct {
+	path []string
+	ids  map[int]struct{}
+	lock *sync.RWMutex
+}
+
+// Load existence index paths and build the indexes from documents. Does not place schema lock.
+func (col *Col) loadExistenceIndexes() error {
+	col.existence = make(map[string]*existenceIndex)
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, EXISTENCE_INDEX_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var paths [][]string
+	if err = json.Unmarshal(content, &paths); err != nil {
+		return err
+	}
+	for _, idxPath := range paths {
+		col.buildExistenceIndex(idxPath)
+	}
+	return nil
+}
+
+// Save existence index paths. Caller must place schema write lock.
+func (col *Col) saveExistenceIndexes() error {
+	paths := make([][]string, 0, len(col.existence))
+	for _, idx := range col.existence {
+		paths = append(paths, idx.path)
+	}
+	content, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(col.db.path, col.name, EXISTENCE_INDEX_FILE), content, 0600)
+}
+
+// Create an existence index and put all documents on it. Does not place schema lock.
+func (col *Col) buildExistenceIndex(idxPath []string) {
+	idx := &existenceIndex{path: idxPath, ids: make(map[int]struct{}), lock: new(sync.RWMutex)}
+	col.forEachDoc(func(id int, docB []byte) bool {
+		doc, err := decodeDoc(docB)
+		if err != nil {
+			// Skip corrupted document
+			return true
+		}
+		if len(indexValues(doc, idxPath)) > 0 {
+			idx.ids[id] = struct{}{}
+		}
+		return true
+	}, false)
+	col.existence[strings.Join(idxPath, INDEX_PATH_SEP)] = idx
+}
+
+// Create an existence index on the path, for efficient path existence test.
+func (col *Col) IndexExistence(idxPath []string) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, exists := col.existence[idxName]; exists {
+		return fmt.Errorf("Path %v already has an existence index", idxPath)
+	}
+	col.buildExistenceIndex(idxPath)
+	if err := col.saveExistenceIndexes(); err != nil {
+		delete(col.existence, idxName)
+		return err
+	}
+	return nil
+}
+
+// Remove the existence index on the path.
+func (col *Col) UnindexExistence(idxPath []string) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, exists := col.existence[idxName]; !exists {
+		return fmt.Errorf("Path %v does not have an existence index", idxPath)
+	}
+	delete(col.existence, idxName)
+	return col.saveExistenceIndexes()
+}
+
+// Return paths of all existence indexes.
+func (col *Col) AllExistenceIndexes() (ret [][]string) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	ret = make([][]string, 0, len(col.existence))
+	for _, idx := range col.existence {
+		ret = append(ret, idx.path)
+	}
+	return
+}
+
+// Put the document on existence indexes of the paths it has a value on.
+func (col *Col) existenceIndexDoc(id int, doc map[string]interface{}) {
+	for _, idx := range col.existence {
+		if len(indexValues(doc, idx.path)) > 0 {
+			idx.lock.Lock()
+			idx.ids[id] = struct{}{}
+			idx.lock.Unlock()
+		}
+	}
+}
+
+// Remove the document from all existence indexes.
+func (col *Col) existenceUnindexDoc(id int) {
+	for _, idx := range col.existence {
+		idx.lock.Lock()
+		delete(idx.ids, id)
+		idx.lock.Unlock()
+	}
+}
+
+// Remove all documents from all existence indexes. Caller must place schema write lock.
+func (col *Col) clearExistenceIndexes() {
+	for _, idx := range col.existence {
+		idx.ids = make(map[int]struct{})
+	}
+}
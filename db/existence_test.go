@@ -0,0 +1,97 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestIndexExistence(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", []byte(`{"SoftDelete": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	// The path is sparse: few documents have it
+	for i := 0; i < 100; i++ {
+		col.Insert(map[string]interface{}{"b": i})
+	}
+	withA, _ := col.Insert(map[string]interface{}{"a": 1})
+	nested, _ := col.Insert(map[string]interface{}{"a": []interface{}{nil, "x"}})
+	col.Insert(map[string]interface{}{"a": nil})
+	if _, err = runQuery(`{"has": ["a"]}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err = col.IndexExistence([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if col.IndexExistence([]string{"a"}) == nil {
+		t.Fatal("Did not error")
+	}
+	// Path existence test works on existence index alone
+	check := func(query string, expected ...int) {
+		result, err := runQuery(query, col)
+		if err != nil || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+	}
+	check(`{"has": ["a"]}`, withA, nested)
+	if result, err := runQuery(`{"has": ["a"], "limit": 1}`, col); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	if size := estimateResultSize(map[string]interface{}{"has": []interface{}{"a"}}, col, 103); size != 2 {
+		t.Fatal(size)
+	}
+	// Existence index follows document inserts, updates and deletes
+	inserted, _ := col.Insert(map[string]interface{}{"a": map[string]interface{}{"b": 1}})
+	if err = col.Update(withA, map[string]interface{}{"b": 1}); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"has": ["a"]}`, nested, inserted)
+	if err = col.Delete(nested); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"has": ["a"]}`, inserted)
+	check(`{"has": ["a"], "include-deleted": true}`, nested, inserted)
+	// Existence index survives reopen and scrub
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("col")
+	if paths := col.AllExistenceIndexes(); !reflect.DeepEqual(paths, [][]string{{"a"}}) {
+		t.Fatal(paths)
+	}
+	check(`{"has": ["a"]}`, inserted)
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	check(`{"has": ["a"], "include-deleted": true}`, nested, inserted)
+	if err = db.Truncate("col"); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"has": ["a"]}`)
+	if err = col.UnindexExistence([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if col.UnindexExistence([]string{"a"}) == nil {
+		t.Fatal("Did not error")
+	}
+	if paths := col.AllExistenceIndexes(); len(paths) != 0 {
+		t.Fatal(paths)
+	}
+}
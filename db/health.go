@@ -0,0 +1,239 @@
+// Index integrity verification.
+
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	HEALTH_CHECK_SAMPLE = 100 // Approximate number of documents checked in each collection by health check.
+	MAX_HEALTH_ISSUES   = 10  // Stop verification after finding this many issues.
+)
+
+// Quickly verify that values of a sample of documents in every collection are present on indexes.
+// Return an error describing the issues found, or nil if the indexes look healthy.
+func (db *DB) HealthCheck() error {
+	return db.verifyIndexes(HEALTH_CHECK_SAMPLE)
+}
+
+// Verify that values of all documents are present on indexes, and that all index entries refer to existing
+// documents that have the indexed value. Return an error describing the issues found, or nil if indexes are intact.
+func (db *DB) VerifyIndexes() error {
+	return db.verifyIndexes(0)
+}
+
+// Verify indexes of all collections using sample number of documents, or all documents and index entries if sample is 0.
+func (db *DB) verifyIndexes(sample int) error {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	issues := make([]string, 0)
+	for _, col := range db.cols {
+		col.verifyDocs(sample, &issues)
+		if sample == 0 {
+			col.verifyIndexEntries(&issues)
+		}
+		if len(issues) >= MAX_HEALTH_ISSUES {
+			break
+		}
+	}
+	if len(issues) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Index verification found issues: %s", strings.Join(issues, "; "))
+}
+
+// Look for index values of the documents that are missing from the index. Does not place schema lock.
+func (col *Col) verifyDocs(sample int, issues *[]string) {
+	// Sample one randomly chosen page, or go through all documents
+	page, totalPages := 0, 1
+	if docCount := col.approxDocCount(false); sample > 0 && docCount > sample {
+		totalPages = docCount / sample
+		page = rand.Intn(totalPages)
+	}
+	verify := func(id int, docB []byte) bool {
+		doc, err := decodeDoc(docB)
+		if err != nil {
+			// Corrupted document is not indexed
+			return true
+		}
+		for idxName, idxPath := range col.indexPaths {
+			for _, idxVal := range col.indexedValues(idxName, id, doc, idxPath) {
+				if !col.indexHas(idxName, StrHash(idxVal), id) {
+					*issues = append(*issues, fmt.Sprintf("collection %s document %d value '%s' is missing from index %v", col.name, id, idxVal, idxPath))
+				}
+			}
+		}
+		for name, derive := range col.derived {
+			for _, idxVal := range derivedValues(derive, doc) {
+				if !col.indexHas(DERIVED_INDEX_PREFIX+name, StrHash(idxVal), id) {
+					*issues = append(*issues, fmt.Sprintf("collection %s document %d value '%s' is missing from derived index %s", col.name, id, idxVal, name))
+				}
+			}
+		}
+		return len(*issues) < MAX_HEALTH_ISSUES
+	}
+	for iteratePart := 0; iteratePart < col.db.numParts; iteratePart++ {
+		part := col.parts[iteratePart]
+		part.DataLock.RLock()
+		moveOn := part.ForEachDoc(page, totalPages, verify)
+		part.DataLock.RUnlock()
+		if !moveOn {
+			return
+		}
+	}
+}
+
+// Return true if the index has the document on the hash key.
+func (col *Col) indexHas(idxName string, key, id int) bool {
+	ht := col.hts[key%col.db.numParts][idxName]
+	ht.Lock.RLock()
+	defer ht.Lock.RUnlock()
+	for _, val := range ht.Get(key, 0) {
+		if val == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Look for index entries referring to documents that do not exist or do not have the value. Does not place schema lock.
+func (col *Col) verifyIndexEntries(issues *[]string) {
+	for idxName, idxPath := range col.indexPaths {
+		idxName, idxPath := idxName, idxPath
+		if len(*issues) >= MAX_HEALTH_ISSUES {
+			return
+		}
+		col.forEachHashEntry(idxName, func(key int, docIDs []int) bool {
+			for _, id := range docIDs {
+				doc, err := col.readForIndex(id)
+				if err != nil {
+					*issues = append(*issues, fmt.Sprintf("collection %s index %v refers to document %d that cannot be read", col.name, idxPath, id))
+					continue
+				}
+				hasValue := false
+				for _, idxVal := range col.indexedValues(idxName, id, doc, idxPath) {
+					if StrHash(idxVal) == key {
+						hasValue = true
+						break
+					}
+				}
+				if !hasValue {
+					*issues = append(*issues, fmt.Sprintf("collection %s index %v has a stale entry of document %d", col.name, idxPath, id))
+				}
+			}
+			return len(*issues) < MAX_HEALTH_ISSUES
+		})
+	}
+}
+
+// An index entry found by index reconciliation.
+type IndexEntry struct {
+	Index string // Index path segments joined by INDEX_PATH_SEP, or DERIVED_INDEX_PREFIX followed by derived index name
+	Key   int    // Hash key of the value
+	DocID int    // Document ID
+	Value string // The indexed value, it is empty for an orphaned entry because the value cannot be found from hash key
+}
+
+// Outcome of index reconciliation.
+type IndexReport struct {
+	DocsScanned int          // Number of documents read
+	Missing     []IndexEntry // Values of documents that were missing from indexes
+	Orphaned    []IndexEntry // Index entries that did not belong to any document value, including duplicated entries
+	Repaired    bool         // Whether missing entries were put on index and orphaned entries were removed
+}
+
+// Scan every document and index entry of the collection, and report index entries that are missing or orphaned.
+func (col *Col) VerifyIndexes() (IndexReport, error) {
+	return col.reconcileIndexes(false)
+}
+
+// Scan every document and index entry of the collection, put missing entries on indexes and remove orphaned entries.
+// The report tells exactly which entries were changed. The collection is locked for the entire run.
+func (col *Col) VerifyAndRepairIndexes() (IndexReport, error) {
+	if err := col.db.checkWritable(); err != nil {
+		return IndexReport{}, err
+	}
+	return col.reconcileIndexes(true)
+}
+
+// Compare index entries against values calculated from documents, and optionally fix the differences.
+func (col *Col) reconcileIndexes(repair bool) (report IndexReport, err error) {
+	// Write lock makes sure that the collection is quiescent
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	if col.closed {
+		return report, dberr.New(dberr.ErrorColClosed, col.name)
+	}
+	report.Repaired = repair
+	type entry struct{ key, id int }
+	// Calculate index entries from documents
+	expected := make(map[string]map[entry]string)
+	derivations := make(map[string]func(id int, doc map[string]interface{}) []string)
+	for idxName, idxPath := range col.indexPaths {
+		idxName, idxPath := idxName, idxPath
+		derivations[idxName] = func(id int, doc map[string]interface{}) []string { return col.indexedValues(idxName, id, doc, idxPath) }
+	}
+	for name, derive := range col.derived {
+		derive := derive
+		derivations[DERIVED_INDEX_PREFIX+name] = func(_ int, doc map[string]interface{}) []string { return derivedValues(derive, doc) }
+	}
+	for idxName := range derivations {
+		expected[idxName] = make(map[entry]string)
+	}
+	col.forEachDoc(func(id int, docB []byte) bool {
+		report.DocsScanned++
+		doc, err := decodeDoc(docB)
+		if err != nil {
+			// Corrupted document is not indexed
+			return true
+		}
+		for idxName, values := range derivations {
+			for _, idxVal := range values(id, doc) {
+				expected[idxName][entry{StrHash(idxVal), id}] = idxVal
+			}
+		}
+		return true
+	}, false)
+	// Compare against index entries
+	for idxName := range derivations {
+		found := make(map[entry]struct{})
+		col.forEachHashEntry(idxName, func(key int, docIDs []int) bool {
+			for _, id := range docIDs {
+				e := entry{key, id}
+				_, dup := found[e]
+				if _, isExpected := expected[idxName][e]; dup || !isExpected {
+					report.Orphaned = append(report.Orphaned, IndexEntry{Index: idxName, Key: key, DocID: id})
+				}
+				found[e] = struct{}{}
+			}
+			return true
+		})
+		for e, idxVal := range expected[idxName] {
+			if _, isFound := found[e]; !isFound {
+				report.Missing = append(report.Missing, IndexEntry{Index: idxName, Key: e.key, DocID: e.id, Value: idxVal})
+			}
+		}
+	}
+	if !repair {
+		return
+	}
+	for _, orphan := range report.Orphaned {
+		ht := col.hts[orphan.Key%col.db.numParts][orphan.Index]
+		ht.Lock.Lock()
+		ht.Remove(orphan.Key, orphan.DocID)
+		ht.Lock.Unlock()
+	}
+	for _, missing := range report.Missing {
+		ht := col.hts[missing.Key%col.db.numParts][missing.Index]
+		ht.Lock.Lock()
+		ht.Put(missing.Key, missing.DocID)
+		ht.Lock.Unlock()
+		col.bloomAdd(missing.Index, missing.Key)
+	}
+	return
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHealthCheck(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	col.IndexDerived("double a", func(doc map[string]interface{}) []interface{} {
+		return []interface{}{doc["a"], doc["a"]}
+	})
+	var id int
+	for i := 0; i < 300; i++ {
+		id, _ = col.Insert(map[string]interface{}{"a": i})
+	}
+	if err = db.HealthCheck(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.VerifyIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	// Remove an index entry behind the collection's back
+	key := StrHash("299")
+	ht := col.hts[key%db.numParts]["a"]
+	ht.Remove(key, id)
+	if err = db.VerifyIndexes(); err == nil || !strings.Contains(err.Error(), "missing from index [a]") {
+		t.Fatal(err)
+	}
+	ht.Put(key, id)
+	// Put a stale index entry
+	key = StrHash("1000")
+	col.hts[key%db.numParts]["a"].Put(key, id)
+	if err = db.VerifyIndexes(); err == nil || !strings.Contains(err.Error(), "stale entry") {
+		t.Fatal(err)
+	}
+	col.hts[key%db.numParts]["a"].Remove(key, id)
+	// Derived index is verified too
+	key = StrHash("299")
+	col.hts[key%db.numParts][DERIVED_INDEX_PREFIX+"double a"].Remove(key, id)
+	if err = db.VerifyIndexes(); err == nil || !strings.Contains(err.Error(), "missing from derived index double a") {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyAndRepairIndexes(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a", "b"})
+	ids := make([]int, 10)
+	for i := range ids {
+		ids[i], _ = col.Insert(map[string]interface{}{"a": map[string]interface{}{"b": i}})
+	}
+	if report, err := col.VerifyAndRepairIndexes(); err != nil || report.DocsScanned != 10 || len(report.Missing) != 0 || len(report.Orphaned) != 0 {
+		t.Fatal(report, err)
+	}
+	// Damage the index: a missing entry, an orphaned entry and a duplicated entry
+	idxName := "a" + INDEX_PATH_SEP + "b"
+	missingKey, orphanKey, dupKey := StrHash("3"), StrHash("100"), StrHash("5")
+	col.hts[missingKey%db.numParts][idxName].Remove(missingKey, ids[3])
+	col.hts[orphanKey%db.numParts][idxName].Put(orphanKey, ids[4])
+	col.hts[dupKey%db.numParts][idxName].Put(dupKey, ids[5])
+	report, err := col.VerifyIndexes()
+	if err != nil || report.Repaired || len(report.Missing) != 1 || len(report.Orphaned) != 2 {
+		t.Fatal(report, err)
+	}
+	if missing := report.Missing[0]; missing != (IndexEntry{Index: idxName, Key: missingKey, DocID: ids[3], Value: "3"}) {
+		t.Fatal(missing)
+	}
+	// Verification alone does not change anything
+	if report, err = col.VerifyIndexes(); err != nil || len(report.Missing) != 1 || len(report.Orphaned) != 2 {
+		t.Fatal(report, err)
+	}
+	if report, err = col.VerifyAndRepairIndexes(); err != nil || !report.Repaired || len(report.Missing) != 1 || len(report.Orphaned) != 2 {
+		t.Fatal(report, err)
+	}
+	if report, err = col.VerifyIndexes(); err != nil || len(report.Missing) != 0 || len(report.Orphaned) != 0 {
+		t.Fatal(report, err)
+	}
+	if vals := col.hts[dupKey%db.numParts][idxName].Get(dupKey, 0); len(vals) != 1 {
+		t.Fatal(vals)
+	}
+	if result, err := runQuery(`{"eq": 3, "in": ["a", "b"]}`, col); err != nil || !ensureMapHasKeys(result, ids[3]) {
+		t.Fatal(result, err)
+	}
+}
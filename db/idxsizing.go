@@ -0,0 +1,100 @@
+// Per-index hash table sizing.
+//
+// By default every index partition is a hash table sized by the database configuration. An index created with its own
+// sizing saves the sizing in its directory, and its hash tables are opened with the database configuration overridden
+// by that sizing, so that a hot index may use more buckets while a rarely used one takes less space. The sizing must
+// not change once the index is created, hence it is kept along with the index for the rest of its life.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+const (
+	INDEX_SIZING_FILE   = "sizing.json" // Name of index sizing file in index directory.
+	MAX_INDEX_HASH_BITS = 24            // Largest number of hash key bits an index may use.
+)
+
+// Hash table sizing of an index, zero value of a field leaves it to the database configuration, e.g. the zero value of
+// IndexSizing sizes an index just like Index does.
+type IndexSizing struct {
+	HashBits     uint // Number of hash key bits, which determines the initial number of buckets (2^HashBits)
+	PerBucket    int  // Number of entries in each bucket before another bucket is chained to it
+	HTFileGrowth int  // Size (in bytes) to grow hash table file by when more buckets have to fit in
+}
+
+// Create an index on the path with its own hash table sizing.
+func (col *Col) IndexWithSizing(idxPath []string, sizing IndexSizing) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	} else if sizing.HashBits > MAX_INDEX_HASH_BITS || sizing.PerBucket < 0 || sizing.HTFileGrowth < 0 {
+		return fmt.Errorf("Invalid index sizing %+v", sizing)
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, exists := col.indexPaths[idxName]; exists {
+		return fmt.Errorf("Path %v is already indexed", idxPath)
+	}
+	idxDir := path.Join(col.db.path, col.name, idxName)
+	if err := os.MkdirAll(idxDir, 0700); err != nil {
+		return err
+	}
+	content, err := json.Marshal(sizing)
+	if err != nil {
+		return err
+	} else if err = ioutil.WriteFile(path.Join(idxDir, INDEX_SIZING_FILE), content, 0600); err != nil {
+		return err
+	}
+	return col.index(idxName, idxPath)
+}
+
+// Return the hash table sizing of an index.
+func (col *Col) IndexSizing(idxPath []string) (sizing IndexSizing, err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, exists := col.indexPaths[idxName]; !exists {
+		return sizing, fmt.Errorf("Path %v is not indexed", idxPath)
+	}
+	conf, err := col.indexConfig(idxName)
+	if err != nil {
+		return
+	}
+	return IndexSizing{HashBits: conf.HashBits, PerBucket: conf.PerBucket, HTFileGrowth: conf.HTFileGrowth}, nil
+}
+
+// Return the configuration to open hash tables of the index with, which is the database configuration overridden by
+// sizing of the index if it has any.
+func (col *Col) indexConfig(idxName string) (*data.Config, error) {
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, idxName, INDEX_SIZING_FILE))
+	if os.IsNotExist(err) {
+		return col.db.Config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var sizing IndexSizing
+	if err = json.Unmarshal(content, &sizing); err != nil {
+		return nil, err
+	}
+	conf := *col.db.Config
+	if sizing.HashBits > 0 {
+		conf.HashBits = sizing.HashBits
+	}
+	if sizing.PerBucket > 0 {
+		conf.PerBucket = sizing.PerBucket
+	}
+	if sizing.HTFileGrowth > 0 {
+		conf.HTFileGrowth = sizing.HTFileGrowth
+	}
+	conf.CalculateConfigConstants()
+	return &conf, nil
+}
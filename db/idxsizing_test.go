@@ -0,0 +1,64 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+func TestIndexWithSizing(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	sizing := IndexSizing{HashBits: 4, PerBucket: 2, HTFileGrowth: 4096}
+	if err = col.IndexWithSizing([]string{"a"}, sizing); err != nil {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if col.IndexWithSizing([]string{"a"}, sizing) == nil || col.IndexWithSizing([]string{"c"}, IndexSizing{HashBits: 64}) == nil {
+		t.Fatal("Did not error")
+	}
+	for i := 0; i < 100; i++ {
+		col.Insert(map[string]interface{}{"a": i % 10, "b": i})
+	}
+	// Small hash tables chain buckets to fit in more entries, and lookups work all the same
+	if ht := col.hts[0]["a"]; ht.HashBits != 4 || ht.Size >= db.Config.HTFileGrowth {
+		t.Fatal(ht.HashBits, ht.Size)
+	}
+	checkSizing := func(col *Col) {
+		if actual, err := col.IndexSizing([]string{"a"}); err != nil || actual != sizing {
+			t.Fatal(actual, err)
+		}
+		defaultSizing := IndexSizing{HashBits: db.Config.HashBits, PerBucket: db.Config.PerBucket, HTFileGrowth: db.Config.HTFileGrowth}
+		if actual, err := col.IndexSizing([]string{"b"}); err != nil || actual != defaultSizing {
+			t.Fatal(actual, err)
+		}
+		if result, err := runQuery(`{"eq": 3, "in": ["a"]}`, col); err != nil || len(result) != 10 {
+			t.Fatal(result, err)
+		}
+	}
+	checkSizing(col)
+	// Sizing survives reopen and scrub
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkSizing(db.Use("col"))
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	checkSizing(db.Use("col"))
+	if _, err = db.Use("col").IndexSizing([]string{"c"}); err == nil {
+		t.Fatal("Did not error")
+	}
+}
@@ -0,0 +1,166 @@
+// Document modification time.
+//
+// When TrackModTime is enabled in database configuration, the time of the latest insert, update, soft-delete and
+// undelete of each document is kept in one hash table file per partition, which maps document ID to the time in
+// nanoseconds since Unix epoch. A skip list of the times is built in memory when the collection is opened, so that
+// query {"modified-since": time} seeks to the time and scans documents modified afterwards, e.g. for incremental sync.
+
+package db
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// Modification time of collection documents.
+type modTimes struct {
+	hts    []*data.HashTable // Document ID to modification time, one hash table per partition
+	sorted *skipList         // Modification time and document ID in order of time
+	lock   *sync.RWMutex     // Protects the skip list
+}
+
+// Open modification time hash tables if modification time tracking is enabled or the collection already has them,
+// and build the skip list. Does not place schema lock.
+func (col *Col) loadModTimes() error {
+	if _, err := os.Stat(path.Join(col.db.path, col.name, DOC_MODTIME_FILE+"0")); os.IsNotExist(err) && (!col.db.Config.TrackModTime || col.db.Config.ReadOnly) {
+		return nil
+	}
+	return col.openModTimes()
+}
+
+// Open (or create) modification time hash tables and build the skip list from them. Does not place schema lock.
+func (col *Col) openModTimes() (err error) {
+	col.modTimes = &modTimes{hts: make([]*data.HashTable, col.db.numParts), sorted: newSkipList(), lock: new(sync.RWMutex)}
+	for i := 0; i < col.db.numParts; i++ {
+		if col.modTimes.hts[i], err = col.db.Config.OpenHashTable(
+			path.Join(col.db.path, col.name, DOC_MODTIME_FILE+strconv.Itoa(i))); err != nil {
+			return err
+		}
+		ids, times := col.modTimes.hts[i].GetPartition(0, 1)
+		for j, id := range ids {
+			col.modTimes.sorted.insert(sortedEntry{times[j], id})
+		}
+	}
+	return nil
+}
+
+// Return the modification time of the document in nanoseconds since Unix epoch, or false if it is unknown.
+func (col *Col) modTime(id int) (int, bool) {
+	if col.modTimes == nil {
+		return 0, false
+	}
+	ht := col.modTimes.hts[id%col.db.numParts]
+	ht.Lock.RLock()
+	defer ht.Lock.RUnlock()
+	if times := ht.Get(id, 1); len(times) > 0 {
+		return times[0], true
+	}
+	return 0, false
+}
+
+// Set modification time of the document. Does not place schema lock.
+func (col *Col) setModTime(id int, nanos int) {
+	if col.modTimes == nil {
+		return
+	}
+	col.forgetModTime(id)
+	ht := col.modTimes.hts[id%col.db.numParts]
+	ht.Lock.Lock()
+	ht.Put(id, nanos)
+	ht.Lock.Unlock()
+	col.modTimes.lock.Lock()
+	col.modTimes.sorted.insert(sortedEntry{nanos, id})
+	col.modTimes.lock.Unlock()
+}
+
+// Record that the document has been modified just now. Does not place schema lock.
+func (col *Col) touch(id int) {
+	col.setModTime(id, int(time.Now().UnixNano()))
+}
+
+// Remove modification time of the document. Does not place schema lock.
+func (col *Col) forgetModTime(id int) {
+	if col.modTimes == nil {
+		return
+	}
+	ht := col.modTimes.hts[id%col.db.numParts]
+	ht.Lock.Lock()
+	times := ht.Get(id, 0)
+	for _, nanos := range times {
+		ht.Remove(id, nanos)
+	}
+	ht.Lock.Unlock()
+	col.modTimes.lock.Lock()
+	for _, nanos := range times {
+		col.modTimes.sorted.remove(sortedEntry{nanos, id})
+	}
+	col.modTimes.lock.Unlock()
+}
+
+// Return the time of the latest insert, update, soft-delete or undelete of the document.
+func (col *Col) ModTime(id int) (time.Time, error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.modTimes == nil {
+		return time.Time{}, fmt.Errorf("Collection %s does not track document modification time", col.name)
+	}
+	nanos, known := col.modTime(id)
+	if !known {
+		return time.Time{}, dberr.New(dberr.ErrorNoDoc, id)
+	}
+	return time.Unix(0, int64(nanos)), nil
+}
+
+// Return documents modified after the time, given in RFC3339 format or as nanoseconds since Unix epoch.
+func ModifiedSince(since interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	if src.modTimes == nil {
+		return fmt.Errorf("Collection %s does not track document modification time", src.name)
+	}
+	var nanos int
+	if str, isStr := since.(string); isStr {
+		sinceTime, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			return fmt.Errorf("Expecting `modified-since` to be RFC3339 time or nanoseconds since Unix epoch, but %v given", since)
+		}
+		nanos = int(sinceTime.UnixNano())
+	} else if nanos, err = queryInt("modified-since", since); err != nil {
+		return
+	}
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("modified-since", nil, &candidates, result, len(*result), time.Now())
+	}
+	src.countQueryCost(0, 1, 0)
+	counter := 0
+	src.modTimes.lock.RLock()
+	defer src.modTimes.lock.RUnlock()
+	for node := src.modTimes.sorted.first(nanos + 1); node != nil; node = node.next[0] {
+		candidates++
+		if skip != nil && skip(node.entry.id) {
+			continue
+		}
+		(*result)[node.entry.id] = struct{}{}
+		if err = resultTooLarge(src, result); err != nil {
+			return
+		} else if counter++; counter == intLimit {
+			break
+		}
+	}
+	return
+}
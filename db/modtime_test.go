@@ -0,0 +1,108 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestModifiedSince(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", []byte(`{"TrackModTime": true, "SoftDelete": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	old, _ := col.Insert(map[string]interface{}{"a": 1})
+	updated, _ := col.Insert(map[string]interface{}{"a": 2})
+	deleted, _ := col.Insert(map[string]interface{}{"a": 3})
+	time.Sleep(time.Millisecond)
+	since := time.Now()
+	if err = col.Update(updated, map[string]interface{}{"a": 4}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(deleted); err != nil {
+		t.Fatal(err)
+	}
+	inserted, _ := col.Insert(map[string]interface{}{"a": 5})
+	if modTime, err := col.ModTime(updated); err != nil || !modTime.After(since) {
+		t.Fatal(modTime, err)
+	}
+	if modTime, err := col.ModTime(old); err != nil || modTime.After(since) {
+		t.Fatal(modTime, err)
+	}
+	check := func(query string, expected ...int) {
+		result, err := runQuery(query, col)
+		if err != nil || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+	}
+	sinceStr := `"` + since.Format(time.RFC3339Nano) + `"`
+	check(`{"modified-since": `+sinceStr+`}`, updated, inserted)
+	check(`{"modified-since": `+sinceStr+`, "include-deleted": true}`, updated, inserted, deleted)
+	check(`{"modified-since": 0}`, old, updated, inserted)
+	if result, err := runQuery(`{"modified-since": 0, "limit": 2}`, col); err != nil || len(result) != 2 {
+		t.Fatal(result, err)
+	}
+	if _, err = runQuery(`{"modified-since": "yesterday"}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+	// Modification time survives reopen and scrub, and it is gone with the document
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	check(`{"modified-since": `+sinceStr+`, "include-deleted": true}`, updated, inserted, deleted)
+	if purged, err := col.Purge(); err != nil || purged != 1 {
+		t.Fatal(purged, err)
+	}
+	if _, err := col.ModTime(deleted); err == nil {
+		t.Fatal("Did not error")
+	}
+	check(`{"modified-since": `+sinceStr+`, "include-deleted": true}`, updated, inserted)
+	if err = db.Truncate("col"); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"modified-since": 0}`)
+}
+
+func TestModifiedSinceUntracked(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	id, _ := col.Insert(map[string]interface{}{"a": 1})
+	if _, err = runQuery(`{"modified-since": 0}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+	if _, err = col.ModTime(id); err == nil {
+		t.Fatal("Did not error")
+	}
+	if _, err = matchDoc(map[string]interface{}{"modified-since": 0.0}, id, map[string]interface{}{}); err == nil {
+		t.Fatal("Did not error")
+	}
+}
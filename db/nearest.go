@@ -0,0 +1,118 @@
+// Numeric nearness query.
+//
+// A nearest query {"nearest": #, "in": [path], "limit": #} finds the documents whose numeric values on the path are
+// closest to the target, by absolute difference - numeric strings count as numbers, like they do in index. E.g. the 5 documents priced closest to 100. Documents are ranked by
+// their value nearest to the target, documents equally near are ranked by ascending ID, and "limit" (1 by default)
+// documents of the best rank are the result. Without a sorted index on the path every document is read; with one, the
+// index is walked outward from the target and only as many entries as the result needs are visited. Sorted index
+// keeps integer values only, so that documents of fractional values on an indexed path are not found.
+
+package db
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// A document and how near its value is to the target of nearest query.
+type nearEntry struct {
+	id   int
+	dist float64
+}
+
+// Put the documents of values nearest to the target into result.
+func Nearest(target interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	vecPath, err := queryPath(expr["in"])
+	if err != nil {
+		return
+	}
+	floatTarget, err := queryFloat("nearest", target)
+	if err != nil {
+		return
+	} else if math.IsNaN(floatTarget) || math.IsInf(floatTarget, 0) {
+		return fmt.Errorf("Expecting `nearest` as a finite number, but %v given", target)
+	}
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	} else if intLimit == 0 {
+		intLimit = 1
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("nearest", vecPath, &candidates, result, len(*result), time.Now())
+	}
+	htPath := strings.Join(vecPath, INDEX_PATH_SEP)
+	if sorted, sortedScan := src.sorted[htPath]; sortedScan {
+		// The first visit of a document is its value nearest to the target
+		src.traceNote("Scanned sorted index %s outward from %v", htPath, floatTarget)
+		src.countQueryCost(0, 1, 0)
+		found := make(map[int]struct{}, intLimit)
+		candidates = sorted.nearest(floatTarget, func(id int) bool {
+			if _, dup := found[id]; dup || skip != nil && skip(id) {
+				return true
+			}
+			found[id] = struct{}{}
+			(*result)[id] = struct{}{}
+			if err = resultTooLarge(src, result); err != nil {
+				return false
+			}
+			return len(found) < intLimit
+		})
+		return
+	}
+	forEachDoc, err := scanFunc(expr, src)
+	if err != nil {
+		return
+	}
+	tdlog.CritNoRepeat("Query %v scans all documents, which can be very inefficient", expr)
+	src.traceNote("Scanned all documents")
+	entries := make([]nearEntry, 0)
+	forEachDoc(func(id int, docB []byte) bool {
+		candidates++
+		if skip != nil && skip(id) {
+			return true
+		}
+		doc, decodeErr := decodeDoc(docB)
+		if decodeErr != nil {
+			return true
+		}
+		if dist, numeric := nearestDistance(doc, vecPath, floatTarget); numeric {
+			entries = append(entries, nearEntry{id: id, dist: dist})
+		}
+		return true
+	}, false)
+	src.countQueryCost(candidates, 0, 1)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].dist < entries[j].dist || entries[i].dist == entries[j].dist && entries[i].id < entries[j].id
+	})
+	if len(entries) > intLimit {
+		entries = entries[:intLimit]
+	}
+	for _, entry := range entries {
+		(*result)[entry.id] = struct{}{}
+	}
+	return resultTooLarge(src, result)
+}
+
+// Return the absolute difference between the target and the nearest number along the path, or false if the path has no
+// number. Numeric strings count as the numbers they represent, the same as in index.
+func nearestDistance(doc map[string]interface{}, vecPath []string, target float64) (dist float64, numeric bool) {
+	dist = math.Inf(1)
+	for _, strVal := range indexValues(doc, vecPath) {
+		if floatVal, err := strconv.ParseFloat(strVal, 64); err == nil {
+			dist, numeric = math.Min(dist, math.Abs(floatVal-target)), true
+		}
+	}
+	return
+}
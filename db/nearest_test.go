@@ -0,0 +1,101 @@
+package db
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestNearest(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	insert := func(doc map[string]interface{}) int {
+		id, err := col.Insert(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	p90 := insert(map[string]interface{}{"price": 90})
+	p97 := insert(map[string]interface{}{"price": 97})
+	p103 := insert(map[string]interface{}{"price": 103})
+	p104 := insert(map[string]interface{}{"price": []interface{}{250, 104}})
+	p120 := insert(map[string]interface{}{"price": 120})
+	p100 := insert(map[string]interface{}{"price": "100"})
+	insert(map[string]interface{}{"price": "cheap"})
+	insert(map[string]interface{}{"name": "free"})
+	nearest := func(target interface{}, limit int) []int {
+		q := map[string]interface{}{"nearest": target, "in": []interface{}{"price"}}
+		if limit > 0 {
+			q["limit"] = limit
+		}
+		result := make(map[int]struct{})
+		if err := EvalQuery(q, col, &result); err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]int, 0, len(result))
+		for id := range result {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		return ids
+	}
+	sorted := func(ids ...int) []int {
+		sort.Ints(ids)
+		return ids
+	}
+	for _, useIndex := range []bool{false, true} {
+		if useIndex {
+			if err = col.IndexSorted([]string{"price"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// p97 and p103 are equally near, the lower ID wins
+		lowerID := p97
+		if p103 < p97 {
+			lowerID = p103
+		}
+		for _, c := range []struct {
+			target   interface{}
+			limit    int
+			expected []int
+		}{
+			{100, 0, []int{p100}},
+			{100, 2, sorted(p100, lowerID)},
+			{99.5, 1, []int{p100}},
+			{100.5, 2, sorted(p100, p103)},
+			{103.5, 2, sorted(p103, p104)},
+			{-5, 100, sorted(p90, p97, p100, p103, p104, p120)},
+			{0, 2, sorted(p90, p97)},
+			{1000, 1, []int{p104}},
+		} {
+			if ids := nearest(c.target, c.limit); !reflect.DeepEqual(ids, c.expected) {
+				t.Fatal(useIndex, c, ids)
+			}
+		}
+	}
+	// Deleted documents are not found
+	if err = col.Delete(p97); err != nil {
+		t.Fatal(err)
+	} else if ids := nearest(96, 0); !reflect.DeepEqual(ids, []int{p100}) {
+		t.Fatal(ids)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"nearest": "x", "in": []interface{}{"price"}}, col, &result); err == nil {
+		t.Fatal("did not error")
+	} else if err = EvalQuery(map[string]interface{}{"nearest": 1}, col, &result); err == nil {
+		t.Fatal("did not error")
+	} else if _, err = EvalQueryOnDocs(map[string]interface{}{"nearest": 1, "in": []interface{}{"price"}}, map[int]map[string]interface{}{1: {"price": 1}}); err == nil {
+		t.Fatal("did not error")
+	}
+}
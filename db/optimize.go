@@ -0,0 +1,336 @@
+// Query optimizer.
+//
+// Before a query is evaluated, the query tree is normalized into an equivalent one that is cheaper to evaluate:
+// nested unions and intersections are flattened, and a sub-query common to every intersection in a union is factored
+// out of the union. Intersection evaluates its sub-queries in the order of estimated result size, so that the most
+// selective one runs first - once the intersection becomes empty, the remaining sub-queries are not evaluated at all.
+// Result size is estimated from index without reading documents.
+
+package db
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// Return the equivalent query that EvalQuery evaluates in place of the input query, without evaluating it. Intersection
+// runs its sub-queries in the order of EstimateSelectivity. The input query is not modified.
+func OptimizeQuery(q interface{}, src *Col) (interface{}, error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	if src.closed {
+		return nil, dberr.New(dberr.ErrorColClosed, src.name)
+	}
+	return optimizeQuery(q, src), nil
+}
+
+// Return an equivalent query that is cheaper to evaluate. The input query is not modified. Caller must place schema lock.
+func optimizeQuery(q interface{}, src *Col) interface{} {
+	if src.closed {
+		return q
+	}
+	// Optimization may leave out the option, and index estimates are more accurate with queued updates applied
+	waitForIndex(q, src)
+	switch expr := q.(type) {
+	case []interface{}:
+		return optimizeUnion(expr, src)
+	case map[string]interface{}:
+		if setOp, named := namedSetOp(expr); named {
+			return optimizeQuery(setOp, src)
+		} else if subExprs, intersect := intersectionOf(expr); intersect {
+			return optimizeIntersection(subExprs, src)
+		}
+		for _, setOp := range []string{"c", "min-match"} {
+			// Sub-queries are optimized individually, the set operation itself is left as it is
+			if subExprs, ok := expr[setOp].([]interface{}); ok {
+				optimized := make(map[string]interface{}, len(expr))
+				for key, val := range expr {
+					optimized[key] = val
+				}
+				optimizedSubExprs := make([]interface{}, len(subExprs))
+				for i, subExpr := range subExprs {
+					optimizedSubExprs[i] = optimizeQuery(subExpr, src)
+				}
+				optimized[setOp] = optimizedSubExprs
+				if universe, hasUniverse := expr["of"]; hasUniverse && setOp == "c" {
+					optimized["of"] = optimizeQuery(universe, src)
+				}
+				return optimized
+			}
+		}
+	}
+	return q
+}
+
+// Return sub-queries of an intersection that has no other query parameter.
+func intersectionOf(q interface{}) ([]interface{}, bool) {
+	expr, ok := q.(map[string]interface{})
+	if !ok || len(expr) != 1 {
+		return nil, false
+	}
+	subExprs, ok := expr["n"].([]interface{})
+	return subExprs, ok
+}
+
+// Flatten nested unions, and factor sub-queries common to all intersections out of the union.
+func optimizeUnion(exprs []interface{}, src *Col) interface{} {
+	flat := make([]interface{}, 0, len(exprs))
+	for _, subExpr := range exprs {
+		optimized := optimizeQuery(subExpr, src)
+		if union, isUnion := optimized.([]interface{}); isUnion {
+			flat = append(flat, union...)
+		} else {
+			flat = append(flat, optimized)
+		}
+	}
+	if len(flat) < 2 {
+		return flat
+	}
+	// Every union member must be an intersection to have a common factor
+	members := make([][]interface{}, len(flat))
+	for i, subExpr := range flat {
+		subExprs, intersect := intersectionOf(subExpr)
+		if !intersect || len(subExprs) == 0 {
+			return flat
+		}
+		members[i] = subExprs
+	}
+	var common []interface{}
+	for _, candidate := range members[0] {
+		inAll := true
+		for _, member := range members[1:] {
+			if indexOfQuery(member, candidate) == -1 {
+				inAll = false
+				break
+			}
+		}
+		if inAll && indexOfQuery(common, candidate) == -1 {
+			common = append(common, candidate)
+		}
+	}
+	if len(common) == 0 {
+		return flat
+	}
+	// (X n A) u (X n B) = X n (A u B), and X u (X n B) = X
+	remainders := make([]interface{}, 0, len(members))
+	for _, member := range members {
+		remainder := make([]interface{}, 0, len(member))
+		for _, subExpr := range member {
+			if indexOfQuery(common, subExpr) == -1 {
+				remainder = append(remainder, subExpr)
+			}
+		}
+		if len(remainder) == 0 {
+			return optimizeIntersection(common, src)
+		} else if len(remainder) == 1 {
+			remainders = append(remainders, remainder[0])
+		} else {
+			remainders = append(remainders, map[string]interface{}{"n": remainder})
+		}
+	}
+	return optimizeIntersection(append(common, optimizeUnion(remainders, src)), src)
+}
+
+// Return position of the query among the queries, or -1 if it is not there.
+func indexOfQuery(exprs []interface{}, q interface{}) int {
+	for i, expr := range exprs {
+		if reflect.DeepEqual(expr, q) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Flatten nested intersections. Intersect orders the sub-queries by their estimated result size on its own.
+func optimizeIntersection(exprs []interface{}, src *Col) interface{} {
+	flat := make([]interface{}, 0, len(exprs))
+	for _, subExpr := range exprs {
+		optimized := optimizeQuery(subExpr, src)
+		// An empty intersection has empty result, it cannot be flattened
+		if subExprs, intersect := intersectionOf(optimized); intersect && len(subExprs) > 0 {
+			flat = append(flat, subExprs...)
+		} else {
+			flat = append(flat, optimized)
+		}
+	}
+	return map[string]interface{}{"n": flat}
+}
+
+// Return the queries in the order of their estimated result size, smallest first.
+func orderBySelectivity(exprs []interface{}, src *Col) []interface{} {
+	if len(exprs) < 2 {
+		return exprs
+	}
+	docCount := src.approxDocCount(false)
+	sizes := make([]int, len(exprs))
+	for i, subExpr := range exprs {
+		sizes[i] = estimateResultSize(subExpr, src, docCount)
+	}
+	order := make([]int, len(exprs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return sizes[order[i]] < sizes[order[j]] })
+	ordered := make([]interface{}, len(exprs))
+	for i, pos := range order {
+		ordered[i] = exprs[pos]
+	}
+	return ordered
+}
+
+// Estimate the fraction of documents in the collection that the query matches, between 0 and 1, from index statistics
+// without reading documents or evaluating the query. The figure is an estimate, not an exact count: hash collisions
+// and documents of several values inflate it, and an operation that scans all documents is estimated to match them all.
+func EstimateSelectivity(q interface{}, src *Col) (float64, error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	if src.closed {
+		return 0, dberr.New(dberr.ErrorColClosed, src.name)
+	}
+	docCount := src.approxDocCount(false)
+	if docCount == 0 {
+		return 0, nil
+	}
+	return math.Min(1, float64(estimateResultSize(optimizeQuery(q, src), src, docCount))/float64(docCount)), nil
+}
+
+// Estimate the number of documents in query result without reading documents. A query that cannot be estimated,
+// such as a query in error, is estimated to match all documents.
+func estimateResultSize(q interface{}, src *Col, docCount int) (size int) {
+	switch expr := q.(type) {
+	case []interface{}:
+		for _, subExpr := range expr {
+			size += estimateResultSize(subExpr, src, docCount)
+		}
+		return
+	case string:
+		if expr == "all" {
+			return docCount
+		}
+		return 1
+	case map[string]interface{}:
+		size = docCount
+		if lookupValue, lookup := expr["eq"]; lookup {
+			size = estimateLookupSize(lookupValue, expr["in"], "", src, docCount)
+		} else if lookupValue, lookup := expr["eq-ci"]; lookup {
+			size = estimateLookupSize(lookupValue, expr["in"], CASE_NORMALIZED_INDEX_PREFIX, src, docCount)
+		} else if lookupValue, lookup := expr["eq-co"]; lookup {
+			size = estimateLookupSize(lookupValue, expr["in"], COLLATED_INDEX_PREFIX, src, docCount)
+		} else if hasPath, exist := expr["has"]; exist {
+			if paths, isUnion := unionOfPaths(hasPath); isUnion {
+				size = 0
+				for _, path := range paths {
+					size += estimateIndexSize(path, src, docCount)
+				}
+			} else {
+				size = estimateIndexSize(hasPath, src, docCount)
+			}
+		} else if intSet, ints := expr["int-set"]; ints {
+			size = estimateLookupSize(intSet, expr["in"], "", src, docCount)
+		} else if intFrom, htRange := expr["int-from"]; htRange {
+			size = estimateRangeSize(intFrom, expr["int-to"], expr["in"], src, docCount)
+		} else if intFrom, htRange := expr["int from"]; htRange {
+			size = estimateRangeSize(intFrom, expr["int to"], expr["in"], src, docCount)
+		} else if subExprs, intersect := expr["n"].([]interface{}); intersect {
+			// Intersection is no larger than its smallest sub-query, an empty intersection is empty
+			size = 0
+			for i, subExpr := range subExprs {
+				if subSize := estimateResultSize(subExpr, src, docCount); i == 0 || subSize < size {
+					size = subSize
+				}
+			}
+		} else if idList, idsAnd := expr["ids-and"].([]interface{}); idsAnd {
+			// Intersection is no larger than the given IDs
+			size = len(idList)
+		} else if subExprs, isVec := expr["c"].([]interface{}); isVec {
+			size = estimateResultSize(subExprs, src, docCount)
+		} else if subExprs, isVec := expr["min-match"].([]interface{}); isVec {
+			size = estimateResultSize(subExprs, src, docCount)
+		}
+		if limit, err := queryLimit(expr); err == nil && limit > 0 && limit < size {
+			size = limit
+		}
+	}
+	return
+}
+
+// Return the name of index on the path (derived index name for a derived path), or false if the path is not indexed.
+func indexNameOf(path interface{}, src *Col) (string, bool) {
+	vecPath, err := queryPath(path)
+	if err != nil {
+		return "", false
+	}
+	idxName := strings.Join(vecPath, INDEX_PATH_SEP)
+	if _, derived := src.derived[idxName]; derived {
+		return DERIVED_INDEX_PREFIX + idxName, true
+	}
+	return idxName, src.indexUsable(idxName)
+}
+
+// Estimate the number of documents having the value (or any of the values) by the number of index entries of its hash,
+// on the normalized index of the path of the normalization prefix if given.
+func estimateLookupSize(lookupValue, path interface{}, normalization string, src *Col, docCount int) (size int) {
+	idxName, indexed := indexNameOf(path, src)
+	if vecPath, err := queryPath(path); normalization != "" && err == nil {
+		idxName = normalization + strings.Join(vecPath, INDEX_PATH_SEP)
+		_, indexed = src.indexPaths[idxName]
+	}
+	if !indexed {
+		return docCount
+	}
+	lookupValues, isArray := lookupValue.([]interface{})
+	if !isArray {
+		lookupValues = []interface{}{lookupValue}
+	}
+	for _, val := range lookupValues {
+		// A corrupt index partition is left for evaluation to report
+		vals, _ := src.hashScan(idxName, StrHash(indexString(normalizeIndexValue(idxName, val))), 0)
+		size += len(vals)
+	}
+	return
+}
+
+// Estimate the number of documents within the integer range by the width of range, or by the size of index if the
+// index is smaller.
+func estimateRangeSize(intFrom, intTo, path interface{}, src *Col, docCount int) int {
+	size := estimateIndexSize(path, src, docCount)
+	from, err := queryInt("int-from", intFrom)
+	if err != nil {
+		return size
+	}
+	to, err := queryInt("int-to", intTo)
+	if err != nil {
+		return size
+	}
+	if width := to - from; width >= 0 && width < size {
+		size = width + 1
+	} else if width < 0 && -width < size {
+		size = -width + 1
+	}
+	return size
+}
+
+// Estimate the number of documents having a value on the path by the size of its existence index, or by the number of
+// entries on its hash index.
+func estimateIndexSize(path interface{}, src *Col, docCount int) int {
+	if vecPath, err := queryPath(path); err == nil {
+		if existence, hasExistence := src.existence[strings.Join(vecPath, INDEX_PATH_SEP)]; hasExistence {
+			existence.lock.RLock()
+			defer existence.lock.RUnlock()
+			return len(existence.ids)
+		}
+	}
+	idxName, indexed := indexNameOf(path, src)
+	if !indexed {
+		return docCount
+	}
+	// Values are distributed evenly among index partitions, the first one is representative
+	ht := src.hts[0][idxName]
+	ht.Lock.RLock()
+	defer ht.Lock.RUnlock()
+	return ht.ApproxEntryCount() * src.db.numParts
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestOptimizeQuery(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	col.Index([]string{"b"})
+	// Attribute "a" is far more selective than "b"
+	for i := 0; i < 200; i++ {
+		col.Insert(map[string]interface{}{"a": i, "b": i % 2})
+	}
+	parse := func(str string) (q interface{}) {
+		if err := json.Unmarshal([]byte(str), &q); err != nil {
+			t.Fatal(str, err)
+		}
+		return
+	}
+	for query, optimized := range map[string]string{
+		// Nested unions and intersections are flattened
+		`[["1", ["2"]], "3"]`: `["1", "2", "3"]`,
+		`{"n": [{"has": ["b"]}, {"n": [{"eq": 1, "in": ["b"]}, {"eq": 1, "in": ["a"]}]}]}`: `{"n": [{"has": ["b"]}, {"eq": 1, "in": ["b"]}, {"eq": 1, "in": ["a"]}]}`,
+		`{"n": [{"eq": 1, "in": ["b"]}, {"n": []}]}`:                                       `{"n": [{"eq": 1, "in": ["b"]}, {"n": []}]}`,
+		// Common sub-query is factored out of union of intersections
+		`[{"n": [{"eq": 1, "in": ["b"]}, {"eq": 1, "in": ["a"]}]}, {"n": [{"eq": 3, "in": ["a"]}, {"eq": 1, "in": ["b"]}]}]`: `{"n": [{"eq": 1, "in": ["b"]}, [{"eq": 1, "in": ["a"]}, {"eq": 3, "in": ["a"]}]]}`,
+		`[{"n": ["1", {"has": ["b"]}]}, {"n": [{"has": ["b"]}]}]`:                                                            `{"n": [{"has": ["b"]}]}`,
+		`[{"n": ["1", "2"]}, "3"]`: `[{"n": ["1", "2"]}, "3"]`,
+		// Sub-queries of other set operations are optimized individually
+		`{"c": [[["1"]], "2"]}`:            `{"c": [["1"], "2"]}`,
+		`{"min-match": [[["1"]]], "k": 1}`: `{"min-match": [["1"]], "k": 1}`,
+		`{"eq": [1, 2], "in": ["a"]}`:      `{"eq": [1, 2], "in": ["a"]}`,
+	} {
+		q := parse(query)
+		if result := optimizeQuery(q, col); !reflect.DeepEqual(result, parse(optimized)) {
+			out, _ := json.Marshal(result)
+			t.Fatal(query, string(out))
+		} else if !reflect.DeepEqual(q, parse(query)) {
+			t.Fatal("Input query is modified", query, q)
+		}
+	}
+	if result, err := OptimizeQuery(parse(`[["1", ["2"]], "3"]`), col); err != nil || !reflect.DeepEqual(result, parse(`["1", "2", "3"]`)) {
+		t.Fatal(result, err)
+	}
+	col.closed = true
+	if _, err = OptimizeQuery("all", col); err == nil {
+		t.Fatal("did not error")
+	}
+	col.closed = false
+	// Optimized query has the same result
+	for _, query := range []string{
+		`[{"n": [{"eq": 1, "in": ["b"]}, {"int-from": 0, "int-to": 10, "in": ["a"]}]}, {"n": [{"eq": 150, "in": ["a"]}, {"eq": 0, "in": ["b"]}]}]`,
+		`[{"n": [{"eq": 1, "in": ["b"]}, {"int-from": 0, "int-to": 10, "in": ["a"]}]}, {"n": [{"eq": 1, "in": ["b"]}]}]`,
+		`{"n": [{"has": ["b"]}, {"n": [{"eq": 0, "in": ["b"]}, {"int-from": 5, "int-to": 20, "in": ["a"]}]}]}`,
+		`{"n": [{"eq": 1, "in": ["b"]}, {"eq": 2, "in": ["a"]}, {"has": ["a"]}]}`,
+	} {
+		expected := make(map[int]struct{})
+		if err := evalQuery(parse(query), col, &expected, true); err != nil {
+			t.Fatal(err)
+		}
+		result, err := runQuery(query, col)
+		if err != nil || !reflect.DeepEqual(result, expected) {
+			t.Fatal(query, result, expected, err)
+		}
+	}
+	// Intersection runs the most selective sub-query first
+	for query, ordered := range map[string]string{
+		`[{"eq": [0, 1], "in": ["b"]}, {"eq": 1, "in": ["b"]}, {"eq": 1, "in": ["a"]}]`: `[{"eq": 1, "in": ["a"]}, {"eq": 1, "in": ["b"]}, {"eq": [0, 1], "in": ["b"]}]`,
+		`[{"eq": 1, "in": ["b"]}, {"n": []}]`:                                           `[{"n": []}, {"eq": 1, "in": ["b"]}]`,
+		`[{"has": ["b"]}, {"has": ["b"], "limit": 1}]`:                                  `[{"has": ["b"], "limit": 1}, {"has": ["b"]}]`,
+		`[{"eq": [0, 1], "in": ["b"]}, {"int-from": 10, "int-to": 0, "in": ["a"]}]`:     `[{"int-from": 10, "int-to": 0, "in": ["a"]}, {"eq": [0, 1], "in": ["b"]}]`,
+		`[{"eq": 1, "in": ["c"]}, "1"]`:                                                 `["1", {"eq": 1, "in": ["c"]}]`,
+	} {
+		if result := orderBySelectivity(parse(query).([]interface{}), col); !reflect.DeepEqual(result, parse(ordered)) {
+			out, _ := json.Marshal(result)
+			t.Fatal(query, string(out))
+		}
+	}
+	// Sub-queries after an empty intersection are not evaluated
+	if result, err := runQuery(`{"n": [{"eq": 2, "in": ["b"]}, {"eq": 1, "in": ["c"]}]}`, col); err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+}
+
+func TestEstimateSelectivity(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	col.Index([]string{"b"})
+	if sel, err := EstimateSelectivity(map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, col); err != nil || sel != 0 {
+		t.Fatal(sel, err)
+	}
+	for i := 0; i < 200; i++ {
+		col.Insert(map[string]interface{}{"a": i, "b": i % 2})
+	}
+	// Estimates are relative to the approximate number of documents, and do not go beyond all of them
+	docCount := float64(col.approxDocCount(false))
+	for query, expected := range map[string]float64{
+		`{"eq": 1, "in": ["a"]}`:                                  1 / docCount,
+		`{"eq": 1, "in": ["b"]}`:                                  100 / docCount,
+		`{"n": [{"eq": 1, "in": ["b"]}, {"eq": 1, "in": ["a"]}]}`: 1 / docCount,
+		`{"eq": 1, "in": ["b"], "limit": 2}`:                      2 / docCount,
+		// Scans are estimated to match all documents
+		`{"re-path": "^1", "in": ["a"]}`: 1,
+		`{"eq": 1, "in": ["c"]}`:         1,
+		`"all"`:                          1,
+	} {
+		var q interface{}
+		if err := json.Unmarshal([]byte(query), &q); err != nil {
+			t.Fatal(err)
+		}
+		if sel, err := EstimateSelectivity(q, col); err != nil || sel != math.Min(1, expected) {
+			t.Fatal(query, sel, err)
+		}
+	}
+	// Union adds up the estimates of its sub-queries
+	left, _ := EstimateSelectivity(map[string]interface{}{"eq": []interface{}{0, 1}, "in": []interface{}{"b"}}, col)
+	right, _ := EstimateSelectivity(map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, col)
+	union := []interface{}{map[string]interface{}{"eq": []interface{}{0, 1}, "in": []interface{}{"b"}}, map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}}
+	if sel, err := EstimateSelectivity(union, col); err != nil || left == 0 || math.Abs(sel-math.Min(1, left+right)) > 1e-9 {
+		t.Fatal(sel, left, right, err)
+	}
+	col.closed = true
+	if _, err = EstimateSelectivity("all", col); err == nil {
+		t.Fatal("did not error")
+	}
+	col.closed = false
+}
@@ -0,0 +1,120 @@
+// Partial indexes.
+//
+// A partial index is an ordinary index on a path that only has the documents matching its predicate, a query that is
+// matched against each document the same way as a view does. The predicate is saved in the index directory, and checked
+// whenever a document is put on or removed from the index, so that an index of the few documents a query is interested
+// in takes a fraction of the space. A partial index only answers a query that is provably within its predicate, that is
+// when the predicate is one of the sub-queries of an intersection the query is part of; a lookup outside of it scans
+// all documents, and other operations treat the path as not indexed.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	PARTIAL_INDEX_FILE = "partial.json" // Name of partial index predicate file in index directory.
+)
+
+// Create an index on the path that only has the documents matching the predicate, and put those documents on it.
+func (col *Col) IndexPartial(idxPath []string, predicate interface{}) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, exists := col.indexPaths[idxName]; exists {
+		return fmt.Errorf("Path %v is already indexed", idxPath)
+	}
+	// Numbers are compared as JSON numbers with queries later on, whether they are given as int or float
+	content, err := json.Marshal(predicate)
+	if err != nil {
+		return err
+	} else if err = json.Unmarshal(content, &predicate); err != nil {
+		return err
+	} else if _, err = matchDoc(predicate, 0, map[string]interface{}{}); err != nil {
+		return err
+	}
+	idxDir := path.Join(col.db.path, col.name, idxName)
+	if err = os.MkdirAll(idxDir, 0700); err != nil {
+		return err
+	} else if err = ioutil.WriteFile(path.Join(idxDir, PARTIAL_INDEX_FILE), content, 0600); err != nil {
+		return err
+	}
+	col.partial[idxName] = predicate
+	if err = col.index(idxName, idxPath); err != nil {
+		delete(col.partial, idxName)
+		return err
+	}
+	return nil
+}
+
+// Return the predicate of the partial index on the path, or false if the path has no partial index.
+func (col *Col) PartialIndexPredicate(idxPath []string) (predicate interface{}, partial bool) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	predicate, partial = col.partial[strings.Join(idxPath, INDEX_PATH_SEP)]
+	return
+}
+
+// Read the predicate of the index if it is a partial index. Does not place schema lock.
+func (col *Col) loadPartialIndex(idxName string) error {
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, idxName, PARTIAL_INDEX_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var predicate interface{}
+	if err = json.Unmarshal(content, &predicate); err != nil {
+		return fmt.Errorf("Partial index %s has malformed predicate: %v", idxName, err)
+	}
+	col.partial[idxName] = predicate
+	return nil
+}
+
+// Return the values of the document put on the index, which are none if the index is partial and the document does
+// not match its predicate.
+func (col *Col) indexedValues(idxName string, id int, doc map[string]interface{}, idxPath []string) []string {
+	if predicate, partial := col.partial[idxName]; partial {
+		if match, err := matchDoc(predicate, id, doc); err != nil || !match {
+			return nil
+		}
+	}
+	return pathIndexValues(idxName, doc, idxPath)
+}
+
+// Return true if the path index can answer queries evaluated on the collection handle: the index exists, and unless it
+// is a partial index, the query is within its predicate. Does not place schema lock.
+func (col *Col) indexUsable(idxName string) bool {
+	if _, indexed := col.indexPaths[idxName]; !indexed {
+		return false
+	}
+	predicate, partial := col.partial[idxName]
+	return !partial || col.inScope(predicate)
+}
+
+// Return true if the predicate is among the sub-queries of intersections that the query being evaluated is part of,
+// which means the query result only has documents matching the predicate.
+func (col *Col) inScope(predicate interface{}) bool {
+	for _, expr := range col.scope {
+		if sameQuery(expr, predicate) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if the two queries are the same when written in JSON.
+func sameQuery(q1, q2 interface{}) bool {
+	json1, err1 := json.Marshal(q1)
+	json2, err2 := json.Marshal(q2)
+	return err1 == nil && err2 == nil && string(json1) == string(json2)
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestIndexPartial(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"status"}); err != nil {
+		t.Fatal(err)
+	}
+	activeX, _ := col.Insert(map[string]interface{}{"status": "active", "name": "x"})
+	inactiveX, _ := col.Insert(map[string]interface{}{"status": "inactive", "name": "x"})
+	predicate := map[string]interface{}{"eq": "active", "in": []interface{}{"status"}}
+	if err = col.IndexPartial([]string{"name"}, predicate); err != nil {
+		t.Fatal(err)
+	} else if col.IndexPartial([]string{"name"}, predicate) == nil {
+		t.Fatal("Did not error")
+	} else if col.IndexPartial([]string{"other"}, map[string]interface{}{"duplicates": []interface{}{"name"}}) == nil {
+		t.Fatal("Did not error")
+	}
+	activeY, _ := col.Insert(map[string]interface{}{"status": "active", "name": "y"})
+	// Only documents matching the predicate are on the index, existing and new alike
+	if ids, err := col.IndexEntriesFor([]string{"name"}, "x"); err != nil || !reflect.DeepEqual(ids, []int{activeX}) {
+		t.Fatal(ids, err)
+	} else if ids, err := col.IndexEntriesFor([]string{"name"}, "y"); err != nil || !reflect.DeepEqual(ids, []int{activeY}) {
+		t.Fatal(ids, err)
+	}
+	check := func(query string, expected ...int) {
+		result, err := runQuery(query, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+	}
+	// Within the predicate, the index answers the query
+	check(`{"n": [{"eq": "active", "in": ["status"]}, {"eq": "x", "in": ["name"]}]}`, activeX)
+	check(`{"n": [{"eq": "active", "in": ["status"]}, {"has": ["name"]}]}`, activeX, activeY)
+	check(`{"n": [{"eq": "active", "in": ["status"]}, [{"eq": "x", "in": ["name"]}, {"eq": "y", "in": ["name"]}]]}`, activeX, activeY)
+	// Outside of the predicate, lookup scans all documents and other operations need an index
+	check(`{"eq": "x", "in": ["name"]}`, activeX, inactiveX)
+	check(`{"n": [{"eq": "inactive", "in": ["status"]}, {"eq": "x", "in": ["name"]}]}`, inactiveX)
+	if _, err = runQuery(`{"has": ["name"]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	if _, trace, err := EvalQueryWithTrace(map[string]interface{}{"eq": "x", "in": []interface{}{"name"}}, col); err != nil || len(trace.Notes) == 0 {
+		t.Fatal(trace, err)
+	}
+	// Documents move in and out of the index as they change
+	if err = col.Update(activeX, map[string]interface{}{"status": "inactive", "name": "x"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Update(inactiveX, map[string]interface{}{"status": "active", "name": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"n": [{"eq": "active", "in": ["status"]}, {"eq": "x", "in": ["name"]}]}`, inactiveX)
+	if err = col.Delete(inactiveX); err != nil {
+		t.Fatal(err)
+	} else if ids, err := col.IndexEntriesFor([]string{"name"}, "x"); err != nil || len(ids) != 0 {
+		t.Fatal(ids, err)
+	}
+	// The predicate survives reopen and scrub
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if saved, partial := col.PartialIndexPredicate([]string{"name"}); !partial || !sameQuery(saved, predicate) {
+		t.Fatal(saved, partial)
+	} else if _, partial := col.PartialIndexPredicate([]string{"status"}); partial {
+		t.Fatal("ordinary index is partial")
+	}
+	check(`{"n": [{"eq": "active", "in": ["status"]}, {"has": ["name"]}]}`, activeY)
+	if report, err := col.VerifyIndexes(); err != nil || len(report.Missing) != 0 || len(report.Orphaned) != 0 {
+		t.Fatal(report, err)
+	}
+	if err = col.Unindex([]string{"name"}); err != nil {
+		t.Fatal(err)
+	} else if _, partial := col.PartialIndexPredicate([]string{"name"}); partial {
+		t.Fatal("predicate is left behind")
+	}
+}
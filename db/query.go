@@ -3,15 +3,39 @@
 package db
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/HouzuoGuo/tiedot/data"
 	"github.com/HouzuoGuo/tiedot/dberr"
 	"github.com/HouzuoGuo/tiedot/tdlog"
 )
 
+const (
+	CONSISTENCY_EXACT = "exact" // Lookup verifies every hash match against document content (default).
+	CONSISTENCY_FAST  = "fast"  // Lookup returns hash matches directly, which may include false positives under hash collision.
+)
+
+// Lookup operations on normalized indexes by their normalization prefix.
+var normalizedLookupOps = map[string]string{CASE_NORMALIZED_INDEX_PREFIX: "eq-ci", COLLATED_INDEX_PREFIX: "eq-co"}
+
+// Return the normalization prefix and lookup value of an eq-ci or eq-co lookup, or false if the operation is neither.
+func normalizedLookupOf(expr map[string]interface{}) (normalization string, lookupValue interface{}, lookup bool) {
+	for normalization, op := range normalizedLookupOps {
+		if lookupValue, lookup = expr[op]; lookup {
+			return normalization, lookupValue, true
+		}
+	}
+	return "", nil, false
+}
+
 // Calculate union of sub-query results.
 func EvalUnion(exprs []interface{}, src *Col, result *map[int]struct{}) (err error) {
 	for _, subExpr := range exprs {
@@ -22,184 +46,2067 @@ func EvalUnion(exprs []interface{}, src *Col, result *map[int]struct{}) (err err
 	return
 }
 
-// Put all document IDs into result.
+// Calculate union of sub-query results, and count how many sub-queries match each document (document ID as map key).
+func EvalUnionCount(exprs []interface{}, src *Col, counts *map[int]int) (err error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	return evalUnionCount(exprs, src, counts)
+}
+
+// Count sub-query matches of each document. Does not place schema lock.
+func evalUnionCount(exprs []interface{}, src *Col, counts *map[int]int) (err error) {
+	for _, subExpr := range exprs {
+		subResult := make(map[int]struct{})
+		if err = evalQuery(subExpr, src, &subResult, false); err != nil {
+			return
+		}
+		for docID := range subResult {
+			(*counts)[docID]++
+		}
+	}
+	return
+}
+
+// Evaluate the sub-queries, typically lookups of field values, and return documents matching at least one of them
+// ranked by the number of sub-queries they match (as score), best first; documents of equal count are ordered by
+// ascending ID. Limit of 0 or less returns all of them.
+func EvalMostMatched(exprs []interface{}, src *Col, limit int) ([]ScoredDoc, error) {
+	counts := make(map[int]int)
+	if err := EvalUnionCount(exprs, src, &counts); err != nil {
+		return nil, err
+	}
+	ranked := make([]ScoredDoc, 0, len(counts))
+	for id, count := range counts {
+		ranked = append(ranked, ScoredDoc{ID: id, Score: float64(count)})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].ID < ranked[j].ID
+	})
+	if limit > 0 && len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked, nil
+}
+
+// Put all document IDs into result, except soft-deleted documents.
 func EvalAllIDs(src *Col, result *map[int]struct{}) (err error) {
-	src.forEachDoc(func(id int, _ []byte) bool {
+	if src.db.Config.CacheAllIDs {
+		return src.cachedAllIDs(result)
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("all", nil, &candidates, result, len(*result), time.Now())
+	}
+	put := src.skipDeleted(func(id int, _ []byte) bool {
 		(*result)[id] = struct{}{}
-		return true
+		err = resultTooLarge(src, result)
+		return err == nil
+	})
+	src.forEachDoc(func(id int, doc []byte) bool {
+		candidates++
+		return !src.pastDeadline() && put(id, doc)
 	}, false)
+	src.countQueryCost(candidates, 0, 1)
 	return
 }
 
 // Value equity check ("attribute == value") using hash lookup.
 func Lookup(lookupValue interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	return lookup(lookupValue, expr, src, result, "", nil)
+}
+
+// Value equity check like Lookup, and return the ID of each matching document along with the value along the path that
+// matched, e.g. the element of an array that equals the lookup value, or one of the lookup values given many. With
+// consistency "fast" the documents are not read, and the matched value is the lookup value as it was looked up.
+func LookupMatched(lookupValue interface{}, expr map[string]interface{}, src *Col) (map[int]string, error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	if src.closed {
+		return nil, dberr.New(dberr.ErrorColClosed, src.name)
+	}
+	result := make(map[int]struct{})
+	matched := make(map[int]string)
+	if err := lookup(lookupValue, expr, src, &result, "", matched); err != nil {
+		return nil, err
+	}
+	// Documents over the limit of lookup values were matched but left out of result
+	for id := range matched {
+		if _, inResult := result[id]; !inResult {
+			delete(matched, id)
+		}
+	}
+	return matched, nil
+}
+
+// Value equity check using hash lookup on the path index, or on the normalized index of the path of the normalization
+// prefix (case-normalized or collated). If matched is not nil, the value that matched is put into it for each matching
+// document.
+func lookup(lookupValue interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}, normalization string, matched map[int]string) (err error) {
 	// Figure out lookup path - JSON array "in"
 	path, hasPath := expr["in"]
 	if !hasPath {
 		return errors.New("Missing lookup path `in`")
 	}
-	vecPath := make([]string, 0)
-	if vecPathInterface, ok := path.([]interface{}); ok {
-		for _, v := range vecPathInterface {
-			vecPath = append(vecPath, fmt.Sprint(v))
-		}
-	} else {
+	vecPath, err := queryPath(path)
+	if err != nil {
 		return fmt.Errorf("Expecting vector lookup path `in`, but %v given", path)
 	}
 	// Figure out result number limit
-	intLimit := int(0)
-	if limit, hasLimit := expr["limit"]; hasLimit {
-		if floatLimit, ok := limit.(float64); ok {
-			intLimit = int(floatLimit)
-		} else if _, ok := limit.(int); ok {
-			intLimit = limit.(int)
-		} else {
-			return dberr.New(dberr.ErrorExpectingInt, "limit", limit)
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	// An array of lookup values matches any of the values
+	if lookupValues, isArray := lookupValue.([]interface{}); isArray {
+		matches := make(map[int]struct{})
+		for _, val := range lookupValues {
+			if err = lookup(val, expr, src, &matches, normalization, matched); err != nil {
+				return
+			} else if intLimit > 0 && len(matches) >= intLimit {
+				break
+			}
 		}
+		counter := 0
+		for id := range matches {
+			if intLimit > 0 && counter == intLimit {
+				break
+			}
+			(*result)[id] = struct{}{}
+			counter++
+		}
+		return resultTooLarge(src, result)
 	}
-	lookupStrValue := fmt.Sprint(lookupValue) // the value to look for
-	lookupValueHash := StrHash(lookupStrValue)
+	// Figure out read consistency - fast lookup skips verification of hash matches
+	consistency := CONSISTENCY_EXACT
+	if hint, hasHint := expr["consistency"]; hasHint {
+		if consistency, _ = hint.(string); consistency != CONSISTENCY_EXACT && consistency != CONSISTENCY_FAST {
+			return fmt.Errorf("Expecting `consistency` to be `%s` or `%s`, but %v given", CONSISTENCY_EXACT, CONSISTENCY_FAST, hint)
+		}
+	}
+	op := "eq"
 	scanPath := strings.Join(vecPath, INDEX_PATH_SEP)
-	if _, indexed := src.indexPaths[scanPath]; !indexed {
+	derive, derived := src.derived[scanPath]
+	if normalization != "" {
+		op, derived = normalizedLookupOps[normalization], false
+		scanPath = normalization + scanPath
+		lookupValue = normalizeIndexValue(scanPath, lookupValue)
+	}
+	lookupStrValue := indexString(lookupValue) // the value to look for
+	lookupValueHash := StrHash(lookupStrValue)
+	if derived {
+		scanPath = DERIVED_INDEX_PREFIX + scanPath
+	} else if _, indexed := src.indexPaths[scanPath]; !indexed && hasPathWildcard(vecPath) {
+		src.traceNote("Path %v has wildcard and is not indexed, scanned all documents", vecPath)
+		return scanLookup(op, lookupStrValue, scanPath, vecPath, expr, src, result, matched)
+	} else if _, virtual := src.virtual[scanPath]; !indexed && virtual {
+		src.traceNote("Virtual field %s is not indexed, scanned all documents", scanPath)
+		return scanLookup(op, lookupStrValue, scanPath, vecPath, expr, src, result, matched)
+	} else if !indexed {
 		return dberr.New(dberr.ErrorNeedIndex, scanPath, expr)
+	} else if !src.indexUsable(scanPath) {
+		src.traceNote("Query is not within the predicate of partial index %s, scanned all documents", scanPath)
+		return scanLookup(op, lookupStrValue, scanPath, vecPath, expr, src, result, matched)
 	}
-	num := lookupValueHash % src.db.numParts
-	ht := src.hts[num][scanPath]
-	ht.Lock.RLock()
-	vals := ht.Get(lookupValueHash, intLimit)
-	ht.Lock.RUnlock()
-	for _, match := range vals {
-		// Filter result to avoid hash collision
-		if doc, err := src.read(match, false); err == nil {
-			for _, v := range GetIn(doc, vecPath) {
-				if fmt.Sprint(v) == lookupStrValue {
-					(*result)[match] = struct{}{}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp(op, vecPath, &candidates, result, len(*result), time.Now())
+	}
+	// Limit counts distinct matching documents: hash entries of colliding values, and entries of a document having more
+	// than one value of the hash (or left over by update), are not counted. The first entries of the hash are fetched
+	// up to the limit, and the rest only if they fall short.
+	fetch := intLimit
+	if skip != nil {
+		// Soft-deleted documents do not count towards the limit
+		fetch = 0
+	}
+	if src.bloomRulesOut(scanPath, lookupValueHash) {
+		src.traceNote("Bloom filter of index %s rules out %s", scanPath, lookupStrValue)
+		return
+	}
+	vals, err := src.hashScan(scanPath, lookupValueHash, fetch)
+	if err != nil {
+		return
+	}
+	src.countQueryCost(0, 1, 0)
+	candidates = len(vals)
+	src.traceNote("Hash lookup of %s on index %s found %d candidates", lookupStrValue, scanPath, candidates)
+	_, single := src.singleValued[scanPath]
+	if consistency == CONSISTENCY_FAST {
+		src.traceNote("Candidates are not verified against documents (consistency %s)", CONSISTENCY_FAST)
+	} else if single && !derived && normalization == "" {
+		src.traceNote("Candidates are verified against the single value on path (single-valued index)")
+	}
+	counter := 0
+	visited := make(map[int]struct{}, len(vals))
+	verify := func(vals []int) error {
+		for _, match := range vals {
+			if intLimit > 0 && counter == intLimit {
+				break
+			} else if _, dup := visited[match]; dup {
+				continue
+			} else if src.pastDeadline() {
+				return nil
+			}
+			visited[match] = struct{}{}
+			if skip != nil && skip(match) {
+				continue
+			}
+			if consistency == CONSISTENCY_FAST {
+				(*result)[match] = struct{}{}
+				if matched != nil {
+					matched[match] = lookupStrValue
+				}
+				counter++
+				if err := resultTooLarge(src, result); err != nil {
+					return err
+				}
+				continue
+			}
+			// Filter result to avoid hash collision
+			src.countQueryCost(1, 0, 0)
+			if doc, err := src.readForIndex(match); err == nil {
+				var docVals []string
+				if derived {
+					docVals = derivedValues(derive, doc)
+				} else if single && normalization == "" {
+					docVals = singleIndexValues(doc, vecPath)
+				} else {
+					docVals = pathIndexValues(scanPath, doc, vecPath)
+				}
+				for _, v := range docVals {
+					if v == lookupStrValue {
+						(*result)[match] = struct{}{}
+						if matched != nil && derived {
+							matched[match] = v
+						} else if matched != nil {
+							matched[match] = matchedValue(scanPath, doc, vecPath, lookupStrValue)
+						}
+						counter++
+						break
+					}
+				}
+				if tooLarge := resultTooLarge(src, result); tooLarge != nil {
+					return tooLarge
 				}
 			}
 		}
+		return nil
 	}
+	if err = verify(vals); err != nil || fetch == 0 || counter == intLimit || len(vals) < fetch {
+		return
+	}
+	if vals, err = src.hashScan(scanPath, lookupValueHash, 0); err != nil {
+		return
+	}
+	src.countQueryCost(0, 1, 0)
+	candidates = len(vals)
+	src.traceNote("Hash lookup of %s on index %s found %d candidates without limit, as %d of %d matched", lookupStrValue, scanPath, candidates, counter, intLimit)
+	return verify(vals)
+}
+
+// Full document scan for documents having the value along a path that cannot be looked up on index, such as a path with
+// path wildcard that is not indexed, values are compared the same way as lookup on the index would.
+func scanLookup(op, lookupStrValue, idxName string, vecPath []string, expr map[string]interface{}, src *Col, result *map[int]struct{}, matched map[int]string) (err error) {
+	// Figure out result number limit
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	forEachDoc, err := scanFunc(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp(op, vecPath, &candidates, result, len(*result), time.Now())
+	}
+	tdlog.CritNoRepeat("Query %v scans all documents, which can be very inefficient", expr)
+	counter := 0
+	forEachDoc(func(id int, docB []byte) bool {
+		candidates++
+		if skip != nil && skip(id) {
+			return true
+		}
+		doc, decodeErr := decodeDoc(docB)
+		if decodeErr != nil {
+			return true
+		}
+		for _, v := range pathIndexValues(idxName, doc, vecPath) {
+			if v != lookupStrValue {
+				continue
+			}
+			(*result)[id] = struct{}{}
+			if matched != nil {
+				matched[id] = matchedValue(idxName, doc, vecPath, lookupStrValue)
+			}
+			counter++
+			if err = resultTooLarge(src, result); err != nil {
+				return false
+			}
+			return intLimit <= 0 || counter < intLimit
+		}
+		return true
+	}, false)
+	src.countQueryCost(candidates, 0, 1)
 	return
 }
 
-// Value existence check (value != nil) using hash lookup.
+// Return the value along the path of document that is put on the index as the looked up value.
+func matchedValue(idxName string, doc map[string]interface{}, vecPath []string, lookupStrValue string) string {
+	for _, val := range GetIn(doc, vecPath) {
+		idxVal := normalizeIndexValue(idxName, val)
+		for _, strVal := range distinctStrings(withNumericStrings([]interface{}{idxVal})) {
+			if strVal == lookupStrValue {
+				return fmt.Sprint(val)
+			}
+		}
+	}
+	return lookupStrValue
+}
+
+// Value existence check (value != nil) using existence index or hash lookup. An array of paths matches documents
+// having a value on any of the paths.
 func PathExistence(hasPath interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
 	// Figure out the path
-	vecPath := make([]string, 0)
-	if vecPathInterface, ok := hasPath.([]interface{}); ok {
-		for _, v := range vecPathInterface {
-			vecPath = append(vecPath, fmt.Sprint(v))
-		}
-	} else {
-		return errors.New(fmt.Sprintf("Expecting vector path, but %v given", hasPath))
+	vecPath, err := queryPath(hasPath)
+	if err != nil {
+		return
 	}
 	// Figure out result number limit
-	intLimit := 0
-	if limit, hasLimit := expr["limit"]; hasLimit {
-		if floatLimit, ok := limit.(float64); ok {
-			intLimit = int(floatLimit)
-		} else if _, ok := limit.(int); ok {
-			intLimit = limit.(int)
-		} else {
-			return dberr.New(dberr.ErrorExpectingInt, "limit", limit)
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	if ordered, err := queryBool(expr, "ordered"); err != nil {
+		return err
+	} else if ordered && intLimit > 0 {
+		candidates := make(map[int]struct{})
+		if err := PathExistence(hasPath, withoutLimit(expr), src, &candidates); err != nil {
+			return err
+		}
+		putLowestIDs(candidates, intLimit, result)
+		return resultTooLarge(src, result)
+	}
+	if paths, isUnion := unionOfPaths(hasPath); isUnion {
+		matches := make(map[int]struct{})
+		for _, path := range paths {
+			if err = PathExistence(path, expr, src, &matches); err != nil {
+				return
+			} else if intLimit > 0 && len(matches) >= intLimit {
+				break
+			}
+		}
+		// The limit applies to the union as a whole
+		counter := 0
+		for id := range matches {
+			if intLimit > 0 && counter == intLimit {
+				break
+			}
+			(*result)[id] = struct{}{}
+			counter++
 		}
+		return resultTooLarge(src, result)
 	}
 	jointPath := strings.Join(vecPath, INDEX_PATH_SEP)
-	if _, indexed := src.indexPaths[jointPath]; !indexed {
+	existence, hasExistence := src.existence[jointPath]
+	if _, virtual := src.virtual[jointPath]; virtual && !hasExistence {
+		src.traceNote("Virtual field %s is not indexed, scanned all documents", jointPath)
+		return scanPathExistence(vecPath, expr, src, result)
+	} else if !src.indexUsable(jointPath) && !hasExistence {
 		return dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
 	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("has", vecPath, &candidates, result, len(*result), time.Now())
+	}
+	src.countQueryCost(0, 1, 0)
 	counter := 0
+	if hasExistence {
+		// Existence index enumerates the documents having the path, instead of iterating over hash index buckets
+		src.traceNote("Enumerated existence index %s", jointPath)
+		existence.lock.RLock()
+		defer existence.lock.RUnlock()
+		for id := range existence.ids {
+			candidates++
+			if skip != nil && skip(id) {
+				continue
+			}
+			(*result)[id] = struct{}{}
+			counter++
+			if counter == intLimit {
+				return nil
+			} else if err = resultTooLarge(src, result); err != nil {
+				return
+			}
+		}
+		return nil
+	}
 	partDiv := src.approxDocCount(false) / src.db.numParts / 4000 // collect approx. 4k document IDs in each iteration
 	if partDiv == 0 {
 		partDiv++
+	} else if partDiv > src.db.Config.InitialBuckets {
+		// Every portion must have at least one bucket
+		partDiv = src.db.Config.InitialBuckets
 	}
+	src.traceNote("Scanned hash index %s in %d portions per partition", jointPath, partDiv)
 	for iteratePart := 0; iteratePart < src.db.numParts; iteratePart++ {
-		ht := src.hts[iteratePart][jointPath]
-		ht.Lock.RLock()
-		for i := 0; i < partDiv; i++ {
-			_, ids := ht.GetPartition(i, partDiv)
-			for _, id := range ids {
-				(*result)[id] = struct{}{}
-				counter++
-				if counter == intLimit {
-					ht.Lock.RUnlock()
-					return nil
+		done := false
+		if readErr := src.readIndexPartition(jointPath, iteratePart, func(ht *data.HashTable) {
+			// Portions 0 to partDiv-1 cover all buckets; the last portion also takes the buckets left over from division
+			for i := 0; i < partDiv; i++ {
+				_, ids := ht.GetPartition(i, partDiv)
+				for _, id := range ids {
+					candidates++
+					if skip != nil && skip(id) {
+						continue
+					}
+					(*result)[id] = struct{}{}
+					counter++
+					if counter == intLimit {
+						done = true
+						return
+					} else if err = resultTooLarge(src, result); err != nil {
+						done = true
+						return
+					}
 				}
 			}
+		}); readErr != nil {
+			return readErr
+		} else if done {
+			return
 		}
-		ht.Lock.RUnlock()
 	}
 	return nil
 }
 
-// Calculate intersection of sub-query results.
-func Intersect(subExprs interface{}, src *Col, result *map[int]struct{}) (err error) {
-	myResult := make(map[int]struct{})
-	if subExprVecs, ok := subExprs.([]interface{}); ok {
-		first := true
-		for _, subExpr := range subExprVecs {
-			subResult := make(map[int]struct{})
-			intersection := make(map[int]struct{})
-			if err = evalQuery(subExpr, src, &subResult, false); err != nil {
-				return
+// Put documents having a value along the path into the result by scanning all documents, for a path that is not on an
+// index, such as a virtual field.
+func scanPathExistence(vecPath []string, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	// Figure out result number limit
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	forEachDoc, err := scanFunc(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("has", vecPath, &candidates, result, len(*result), time.Now())
+	}
+	tdlog.CritNoRepeat("Query %v scans all documents, which can be very inefficient", expr)
+	counter := 0
+	forEachDoc(func(id int, docB []byte) bool {
+		candidates++
+		if skip != nil && skip(id) {
+			return true
+		}
+		doc, decodeErr := decodeDoc(docB)
+		if decodeErr != nil || len(indexValues(doc, vecPath)) == 0 {
+			return true
+		}
+		(*result)[id] = struct{}{}
+		counter++
+		if err = resultTooLarge(src, result); err != nil {
+			return false
+		}
+		return intLimit <= 0 || counter < intLimit
+	}, false)
+	src.countQueryCost(candidates, 0, 1)
+	return
+}
+
+// Return the paths of a path existence test on several paths, or false if the test is on a single path.
+func unionOfPaths(hasPath interface{}) ([]interface{}, bool) {
+	paths, isArray := hasPath.([]interface{})
+	if !isArray || len(paths) == 0 {
+		return nil, false
+	}
+	_, isUnion := paths[0].([]interface{})
+	return paths, isUnion
+}
+
+// Index scan for documents sharing a value along the indexed path with at least one other document. Documents under
+// the same hash key are read back to tell apart different values that collide on the key.
+func Duplicates(dupPath interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	vecPath, err := queryPath(dupPath)
+	if err != nil {
+		return
+	}
+	// Figure out result number limit
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	if ordered, err := queryBool(expr, "ordered"); err != nil {
+		return err
+	} else if ordered && intLimit > 0 {
+		candidates := make(map[int]struct{})
+		if err := Duplicates(dupPath, withoutLimit(expr), src, &candidates); err != nil {
+			return err
+		}
+		putLowestIDs(candidates, intLimit, result)
+		return resultTooLarge(src, result)
+	}
+	idxName := strings.Join(vecPath, INDEX_PATH_SEP)
+	if !src.indexUsable(idxName) {
+		return dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("duplicates", vecPath, &candidates, result, len(*result), time.Now())
+	}
+	src.traceNote("Scanned hash index %s for values shared by more than one document", idxName)
+	src.countQueryCost(0, 1, 0)
+	counter := 0
+	src.forEachHashEntry(idxName, func(key int, docIDs []int) bool {
+		if len(docIDs) < 2 {
+			return true
+		}
+		docsOfVal := make(map[string]map[int]struct{})
+		for _, id := range docIDs {
+			candidates++
+			if skip != nil && skip(id) {
+				continue
 			}
-			if first {
-				myResult = subResult
-				first = false
-			} else {
-				for k := range subResult {
-					if _, inBoth := myResult[k]; inBoth {
-						intersection[k] = struct{}{}
-					}
+			src.countQueryCost(1, 0, 0)
+			doc, err := src.readForIndex(id)
+			if err != nil {
+				continue
+			}
+			for _, idxVal := range indexValues(doc, vecPath) {
+				if StrHash(idxVal) != key {
+					continue
+				} else if docsOfVal[idxVal] == nil {
+					docsOfVal[idxVal] = make(map[int]struct{})
 				}
-				myResult = intersection
+				docsOfVal[idxVal][id] = struct{}{}
 			}
 		}
-		for docID := range myResult {
-			(*result)[docID] = struct{}{}
+		for _, ids := range docsOfVal {
+			if len(ids) < 2 {
+				continue
+			}
+			for id := range ids {
+				if _, found := (*result)[id]; found {
+					continue
+				}
+				(*result)[id] = struct{}{}
+				counter++
+				if counter == intLimit {
+					return false
+				} else if err = resultTooLarge(src, result); err != nil {
+					return false
+				}
+			}
 		}
-	} else {
-		return dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+		return true
+	})
+	return
+}
+
+// Full document scan for documents having the value anywhere - in any attribute, at any depth, or in any array.
+// Values are compared the same way as lookup, or with "substring": true, string values containing the string are matched.
+func ContainsAnywhere(value interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	match, err := anywhereMatcher(value, expr)
+	if err != nil {
+		return
+	}
+	// Figure out result number limit
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	// Ordered scan goes through documents in the order of ID, so that limited result is the lowest matching IDs
+	forEachDoc, err := scanFunc(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("contains-anywhere", nil, &candidates, result, len(*result), time.Now())
 	}
+	tdlog.CritNoRepeat("Query %v scans all documents, which can be very inefficient", expr)
+	src.traceNote("Scanned all documents")
+	counter := 0
+	forEachDoc(func(id int, docB []byte) bool {
+		candidates++
+		if skip != nil && skip(id) {
+			return true
+		}
+		doc, decodeErr := decodeDoc(docB)
+		if decodeErr != nil || !containsAnywhere(doc, match) {
+			return true
+		}
+		(*result)[id] = struct{}{}
+		counter++
+		if err = resultTooLarge(src, result); err != nil {
+			return false
+		}
+		return intLimit <= 0 || counter < intLimit
+	}, false)
+	src.countQueryCost(candidates, 0, 1)
 	return
 }
 
-// Calculate complement of sub-query results.
-func Complement(subExprs interface{}, src *Col, result *map[int]struct{}) (err error) {
-	myResult := make(map[int]struct{})
-	if subExprVecs, ok := subExprs.([]interface{}); ok {
-		for _, subExpr := range subExprVecs {
-			subResult := make(map[int]struct{})
-			complement := make(map[int]struct{})
-			if err = evalQuery(subExpr, src, &subResult, false); err != nil {
-				return
+// Full document scan for documents having a value along the path, whose string form (as it is put on index) matches the
+// regular expression.
+func RegexPath(pattern interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	re, vecPath, err := regexPathParams(pattern, expr)
+	if err != nil {
+		return
+	}
+	return scanRegexPath("re-path", re, vecPath, expr, src, result)
+}
+
+// Full document scan for documents having a value along the path that matches SQL LIKE pattern, in which "%" matches
+// any sequence of characters and "_" matches any single character, e.g. {"like": "abc%", "in": ["name"]}. The pattern
+// matches the entire string form of the value. Backslash escapes "%", "_" and itself to match them literally.
+func Like(pattern interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	re, vecPath, err := likeParams(pattern, expr)
+	if err != nil {
+		return
+	}
+	return scanRegexPath("like", re, vecPath, expr, src, result)
+}
+
+// Scan all documents for a value along the path matching the regular expression, on behalf of the query operation.
+func scanRegexPath(op string, re *regexp.Regexp, vecPath []string, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	// Figure out result number limit
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	forEachDoc, err := scanFunc(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp(op, vecPath, &candidates, result, len(*result), time.Now())
+	}
+	tdlog.CritNoRepeat("Query %v scans all documents, which can be very inefficient", expr)
+	src.traceNote("Scanned all documents")
+	counter := 0
+	forEachDoc(func(id int, docB []byte) bool {
+		candidates++
+		if skip != nil && skip(id) {
+			return true
+		}
+		doc, decodeErr := decodeDoc(docB)
+		if decodeErr != nil || !matchRegexPath(re, doc, vecPath) {
+			return true
+		}
+		(*result)[id] = struct{}{}
+		counter++
+		if err = resultTooLarge(src, result); err != nil {
+			return false
+		}
+		return intLimit <= 0 || counter < intLimit
+	}, false)
+	src.countQueryCost(candidates, 0, 1)
+	return
+}
+
+// Return the compiled regular expression and path of re-path query.
+func regexPathParams(pattern interface{}, expr map[string]interface{}) (*regexp.Regexp, []string, error) {
+	vecPath, err := queryPath(expr["in"])
+	if err != nil {
+		return nil, nil, err
+	}
+	strPattern, isStr := pattern.(string)
+	if !isStr {
+		return nil, nil, fmt.Errorf("Expecting `re-path` to be a regular expression string, but %v given", pattern)
+	}
+	re, err := regexp.Compile(strPattern)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid regular expression `re-path` %s: %v", strPattern, err)
+	}
+	return re, vecPath, nil
+}
+
+// Return the regular expression translated from the pattern of like query, and the path.
+func likeParams(pattern interface{}, expr map[string]interface{}) (*regexp.Regexp, []string, error) {
+	vecPath, err := queryPath(expr["in"])
+	if err != nil {
+		return nil, nil, err
+	}
+	strPattern, isStr := pattern.(string)
+	if !isStr {
+		return nil, nil, fmt.Errorf("Expecting `like` to be a pattern string, but %v given", pattern)
+	}
+	var reStr strings.Builder
+	reStr.WriteString("^(?s:")
+	for runes, i := []rune(strPattern), 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '%':
+			reStr.WriteString(".*")
+		case '_':
+			reStr.WriteString(".")
+		case '\\':
+			if i++; i == len(runes) {
+				return nil, nil, fmt.Errorf("Pattern `like` %s ends with an unfinished escape", strPattern)
 			}
-			for k := range subResult {
-				if _, inBoth := myResult[k]; !inBoth {
-					complement[k] = struct{}{}
-				}
+			reStr.WriteString(regexp.QuoteMeta(string(runes[i])))
+		default:
+			reStr.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+	reStr.WriteString(")$")
+	return regexp.MustCompile(reStr.String()), vecPath, nil
+}
+
+// Return true if any value along the path matches the regular expression in its string form. Nested documents do not
+// have a string form to match.
+func matchRegexPath(re *regexp.Regexp, doc map[string]interface{}, vecPath []string) bool {
+	for _, val := range GetIn(doc, vecPath) {
+		if _, isMap := val.(map[string]interface{}); val != nil && !isMap && re.MatchString(indexString(val)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Full document scan for documents having an attribute whose name matches the regular expression, e.g. {"key-re":
+// "^temp_"} finds documents with stray temporary attributes. Only top-level attribute names are matched, unless option
+// "nested" is true, in which case the names in nested documents (including those in arrays) are matched too.
+func KeyRegex(pattern interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	re, nested, err := keyRegexParams(pattern, expr)
+	if err != nil {
+		return
+	}
+	// Figure out result number limit
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	forEachDoc, err := scanFunc(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("key-re", nil, &candidates, result, len(*result), time.Now())
+	}
+	tdlog.CritNoRepeat("Query %v scans all documents, which can be very inefficient", expr)
+	src.traceNote("Scanned all documents")
+	counter := 0
+	forEachDoc(func(id int, docB []byte) bool {
+		candidates++
+		if skip != nil && skip(id) {
+			return true
+		}
+		doc, decodeErr := decodeDoc(docB)
+		if decodeErr != nil || !matchKeyRegex(re, doc, nested) {
+			return true
+		}
+		(*result)[id] = struct{}{}
+		counter++
+		if err = resultTooLarge(src, result); err != nil {
+			return false
+		}
+		return intLimit <= 0 || counter < intLimit
+	}, false)
+	src.countQueryCost(candidates, 0, 1)
+	return
+}
+
+// Return the compiled regular expression of key-re query, and whether it matches the names of nested attributes too.
+func keyRegexParams(pattern interface{}, expr map[string]interface{}) (*regexp.Regexp, bool, error) {
+	strPattern, isStr := pattern.(string)
+	if !isStr {
+		return nil, false, fmt.Errorf("Expecting `key-re` to be a regular expression string, but %v given", pattern)
+	}
+	re, err := regexp.Compile(strPattern)
+	if err != nil {
+		return nil, false, fmt.Errorf("Invalid regular expression `key-re` %s: %v", strPattern, err)
+	}
+	nested, err := queryBool(expr, "nested")
+	return re, nested, err
+}
+
+// Return true if the name of any attribute of the document matches the regular expression, descending into nested
+// documents and arrays if nested is true.
+func matchKeyRegex(re *regexp.Regexp, thing interface{}, nested bool) bool {
+	switch val := thing.(type) {
+	case map[string]interface{}:
+		for key, attr := range val {
+			if re.MatchString(key) || nested && matchKeyRegex(re, attr, nested) {
+				return true
 			}
-			for k := range myResult {
-				if _, inBoth := subResult[k]; !inBoth {
-					complement[k] = struct{}{}
+		}
+	case []interface{}:
+		for _, element := range val {
+			if nested && matchKeyRegex(re, element, nested) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Full document scan for documents having no value along the path equal to the value, or to any of the values given
+// an array. Documents without the path do not contain the value, hence they match.
+func NotContains(value interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	vecPath, excluded, err := notContainsParams(value, expr)
+	if err != nil {
+		return
+	}
+	// Figure out result number limit
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	forEachDoc, err := scanFunc(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("not-contains", vecPath, &candidates, result, len(*result), time.Now())
+	}
+	tdlog.CritNoRepeat("Query %v scans all documents, which can be very inefficient", expr)
+	src.traceNote("Scanned all documents")
+	counter := 0
+	forEachDoc(func(id int, docB []byte) bool {
+		candidates++
+		if skip != nil && skip(id) {
+			return true
+		}
+		doc, decodeErr := decodeDoc(docB)
+		if decodeErr != nil || !containsNone(doc, vecPath, excluded) {
+			return true
+		}
+		(*result)[id] = struct{}{}
+		counter++
+		if err = resultTooLarge(src, result); err != nil {
+			return false
+		}
+		return intLimit <= 0 || counter < intLimit
+	}, false)
+	src.countQueryCost(candidates, 0, 1)
+	return
+}
+
+// Return the path of not-contains query, and the values it excludes in their string form as they are put on index.
+func notContainsParams(value interface{}, expr map[string]interface{}) (vecPath []string, excluded []string, err error) {
+	if vecPath, err = queryPath(expr["in"]); err != nil {
+		return
+	}
+	values, isArray := value.([]interface{})
+	if !isArray {
+		values = []interface{}{value}
+	}
+	for _, val := range values {
+		excluded = append(excluded, indexString(val))
+	}
+	return
+}
+
+// Return true if none of the values along the path is one of the excluded values, in the same way as eq compares them.
+func containsNone(doc map[string]interface{}, vecPath []string, excluded []string) bool {
+	for _, docVal := range indexValues(doc, vecPath) {
+		for _, val := range excluded {
+			if docVal == val {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Full document scan for documents having equal values on two paths, e.g. {"fields-eq": ["created", "updated"]}.
+func FieldsEq(paths interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	pathA, pathB, err := fieldsEqParams(paths)
+	if err != nil {
+		return
+	}
+	// Figure out result number limit
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	forEachDoc, err := scanFunc(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("fields-eq", pathA, &candidates, result, len(*result), time.Now())
+	}
+	tdlog.CritNoRepeat("Query %v scans all documents, which can be very inefficient", expr)
+	src.traceNote("Scanned all documents")
+	counter := 0
+	forEachDoc(func(id int, docB []byte) bool {
+		candidates++
+		if skip != nil && skip(id) {
+			return true
+		}
+		doc, decodeErr := decodeDoc(docB)
+		if decodeErr != nil || !fieldsEqual(doc, pathA, pathB) {
+			return true
+		}
+		(*result)[id] = struct{}{}
+		counter++
+		if err = resultTooLarge(src, result); err != nil {
+			return false
+		}
+		return intLimit <= 0 || counter < intLimit
+	}, false)
+	src.countQueryCost(candidates, 0, 1)
+	return
+}
+
+// Return the two paths of fields-eq query, each given either as an array or as a dot-delimited string.
+func fieldsEqParams(paths interface{}) (pathA, pathB []string, err error) {
+	pair, isArray := paths.([]interface{})
+	if !isArray || len(pair) != 2 {
+		return nil, nil, fmt.Errorf("Expecting `fields-eq` as an array of two paths, but %v given", paths)
+	}
+	if pathA, err = queryPath(pair[0]); err != nil {
+		return
+	}
+	pathB, err = queryPath(pair[1])
+	return
+}
+
+// Return true if the document has values on both paths, and the values are the same in their string form as they are
+// put on index, e.g. number 1 and string "1" are equal. An array is equal to an array of the same elements in the same
+// order. Null is equal to null, but a path without value is not equal to anything.
+func fieldsEqual(doc map[string]interface{}, pathA, pathB []string) bool {
+	valsA, valsB := GetInPresent(doc, pathA), GetInPresent(doc, pathB)
+	if len(valsA) == 0 || len(valsA) != len(valsB) {
+		return false
+	}
+	for i, val := range valsA {
+		if indexString(val) != indexString(valsB[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Full document scan for documents having a value of the JSON type along the path, such as "string" or "null". An array
+// along the path is of type "array", and each of its elements counts as a value of its own type as well.
+func JSONType(typeName interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	vecPath, isType, err := jsonTypeParams(typeName, expr)
+	if err != nil {
+		return
+	}
+	// Figure out result number limit
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	forEachDoc, err := scanFunc(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("type", vecPath, &candidates, result, len(*result), time.Now())
+	}
+	tdlog.CritNoRepeat("Query %v scans all documents, which can be very inefficient", expr)
+	src.traceNote("Scanned all documents")
+	counter := 0
+	forEachDoc(func(id int, docB []byte) bool {
+		candidates++
+		if skip != nil && skip(id) {
+			return true
+		}
+		doc, decodeErr := decodeDoc(docB)
+		if decodeErr != nil || !hasValueOfType(doc, vecPath, isType) {
+			return true
+		}
+		(*result)[id] = struct{}{}
+		counter++
+		if err = resultTooLarge(src, result); err != nil {
+			return false
+		}
+		return intLimit <= 0 || counter < intLimit
+	}, false)
+	src.countQueryCost(candidates, 0, 1)
+	return
+}
+
+// Return the path of type query, and the function that tells whether a value is of the JSON type.
+func jsonTypeParams(typeName interface{}, expr map[string]interface{}) ([]string, func(val interface{}) bool, error) {
+	vecPath, err := queryPath(expr["in"])
+	if err != nil {
+		return nil, nil, err
+	}
+	var isType func(val interface{}) bool
+	switch typeName {
+	case "string":
+		isType = func(val interface{}) bool {
+			_, isStr := val.(string)
+			return isStr
+		}
+	case "number":
+		isType = func(val interface{}) bool {
+			_, err := queryFloat("", val)
+			return err == nil
+		}
+	case "bool", "boolean":
+		isType = func(val interface{}) bool {
+			_, isBool := val.(bool)
+			return isBool
+		}
+	case "array":
+		isType = func(val interface{}) bool {
+			_, isArray := val.([]interface{})
+			return isArray
+		}
+	case "object":
+		isType = func(val interface{}) bool {
+			_, isMap := val.(map[string]interface{})
+			return isMap
+		}
+	case "null":
+		isType = func(val interface{}) bool {
+			return val == nil
+		}
+	default:
+		return nil, nil, fmt.Errorf("Expecting `type` to be one of string, number, bool, array, object and null, but %v given", typeName)
+	}
+	return vecPath, isType, nil
+}
+
+// Return true if any value along the path is of the type. Unlike GetIn, an array along the path is a value by itself in
+// addition to its elements, and an attribute that is absent is not a null value.
+func hasValueOfType(doc map[string]interface{}, vecPath []string, isType func(val interface{}) bool) bool {
+	last := len(vecPath) - 1
+	if last < 0 || vecPath[last] == PATH_WILDCARD {
+		for _, val := range GetIn(doc, vecPath) {
+			if isType(val) {
+				return true
+			}
+		}
+		return false
+	}
+	parents := []interface{}{doc}
+	if last > 0 {
+		parents = GetIn(doc, vecPath[:last])
+	}
+	for _, parent := range parents {
+		parentMap, isMap := parent.(map[string]interface{})
+		if !isMap {
+			continue
+		}
+		val, hasVal := parentMap[vecPath[last]]
+		if !hasVal {
+			continue
+		} else if isType(val) {
+			return true
+		}
+		if array, isArray := val.([]interface{}); isArray {
+			for _, element := range array {
+				if isType(element) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Scan all documents for those having an array along the path whose length is within the bounds of the len query.
+func ArrayLength(bounds interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	vecPath, inBounds, err := arrayLengthParams(bounds, expr)
+	if err != nil {
+		return
+	}
+	// Figure out result number limit
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	forEachDoc, err := scanFunc(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("len", vecPath, &candidates, result, len(*result), time.Now())
+	}
+	tdlog.CritNoRepeat("Query %v scans all documents, which can be very inefficient", expr)
+	src.traceNote("Scanned all documents")
+	counter := 0
+	forEachDoc(func(id int, docB []byte) bool {
+		candidates++
+		if skip != nil && skip(id) {
+			return true
+		}
+		doc, decodeErr := decodeDoc(docB)
+		if decodeErr != nil || !hasLength(doc, vecPath, inBounds) {
+			return true
+		}
+		(*result)[id] = struct{}{}
+		counter++
+		if err = resultTooLarge(src, result); err != nil {
+			return false
+		}
+		return intLimit <= 0 || counter < intLimit
+	}, false)
+	src.countQueryCost(candidates, 0, 1)
+	return
+}
+
+// Return the path of len query, and the function that tells whether a length is within the bounds. The bounds are
+// given as an object of "min", "max" and "eq", each being optional.
+func arrayLengthParams(bounds interface{}, expr map[string]interface{}) ([]string, func(length int) bool, error) {
+	vecPath, err := queryPath(expr["in"])
+	if err != nil {
+		return nil, nil, err
+	} else if vecPath[len(vecPath)-1] == PATH_WILDCARD {
+		return nil, nil, fmt.Errorf("Expecting `in` of len query to end with an attribute name, but %v given", vecPath)
+	}
+	inBounds, err := lengthBounds("len", bounds)
+	return vecPath, inBounds, err
+}
+
+// Return the function that tells whether a length is within the bounds of a len or str-len query, given as an object
+// of "min", "max" and "eq", each being optional.
+func lengthBounds(op string, bounds interface{}) (func(length int) bool, error) {
+	boundsMap, isMap := bounds.(map[string]interface{})
+	if !isMap || len(boundsMap) == 0 {
+		return nil, fmt.Errorf("Expecting `%s` to be an object of min, max and eq, but %v given", op, bounds)
+	}
+	minLen, maxLen, hasMax := 0, 0, false
+	for name, bound := range boundsMap {
+		intBound, err := queryInt(name, bound)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "min":
+			minLen = intBound
+		case "max":
+			maxLen, hasMax = intBound, true
+		case "eq":
+			minLen, maxLen, hasMax = intBound, intBound, true
+			if len(boundsMap) > 1 {
+				return nil, fmt.Errorf("Expecting `eq` of %s query to be the only bound, but %v given", op, bounds)
+			}
+		default:
+			return nil, fmt.Errorf("Expecting `%s` to be an object of min, max and eq, but %v given", op, bounds)
+		}
+	}
+	return func(length int) bool {
+		return length >= minLen && (!hasMax || length <= maxLen)
+	}, nil
+}
+
+// Return true if the length of any value along the path is within the bounds. An array is as long as its number of
+// elements, a missing attribute or null has length 0, and any other value has length 1. Arrays along the path before
+// the last attribute are descended into like GetIn does.
+func hasLength(doc map[string]interface{}, vecPath []string, inBounds func(length int) bool) bool {
+	last := len(vecPath) - 1
+	parents := []interface{}{doc}
+	if last > 0 {
+		parents = GetIn(doc, vecPath[:last])
+	}
+	reached := false
+	for _, parent := range parents {
+		parentMap, isMap := parent.(map[string]interface{})
+		if !isMap {
+			continue
+		}
+		reached = true
+		length := 1
+		switch val := parentMap[vecPath[last]].(type) {
+		case nil:
+			length = 0
+		case []interface{}:
+			length = len(val)
+		}
+		if inBounds(length) {
+			return true
+		}
+	}
+	// The path leads nowhere
+	return !reached && inBounds(0)
+}
+
+// Scan all documents for those having a string along the path whose length in characters is within the bounds of the
+// str-len query.
+func StringLength(bounds interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	vecPath, inBounds, err := stringLengthParams(bounds, expr)
+	if err != nil {
+		return
+	}
+	// Figure out result number limit
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	forEachDoc, err := scanFunc(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("str-len", vecPath, &candidates, result, len(*result), time.Now())
+	}
+	tdlog.CritNoRepeat("Query %v scans all documents, which can be very inefficient", expr)
+	src.traceNote("Scanned all documents")
+	counter := 0
+	forEachDoc(func(id int, docB []byte) bool {
+		candidates++
+		if skip != nil && skip(id) {
+			return true
+		}
+		doc, decodeErr := decodeDoc(docB)
+		if decodeErr != nil || !hasStringLength(doc, vecPath, inBounds) {
+			return true
+		}
+		(*result)[id] = struct{}{}
+		counter++
+		if err = resultTooLarge(src, result); err != nil {
+			return false
+		}
+		return intLimit <= 0 || counter < intLimit
+	}, false)
+	src.countQueryCost(candidates, 0, 1)
+	return
+}
+
+// Return the path of str-len query, and the function that tells whether a string length is within the bounds.
+func stringLengthParams(bounds interface{}, expr map[string]interface{}) ([]string, func(length int) bool, error) {
+	vecPath, err := queryPath(expr["in"])
+	if err != nil {
+		return nil, nil, err
+	}
+	inBounds, err := lengthBounds("str-len", bounds)
+	return vecPath, inBounds, err
+}
+
+// Return true if any string value along the path has a length within the bounds. Length is the number of UTF-8
+// characters (runes) rather than bytes, and values other than strings are skipped.
+func hasStringLength(doc map[string]interface{}, vecPath []string, inBounds func(length int) bool) bool {
+	for _, val := range GetIn(doc, vecPath) {
+		if str, isStr := val.(string); isStr && inBounds(utf8.RuneCountInString(str)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Scan all documents for those having null value along the path, as opposed to having other values or not having the
+// path at all.
+func IsNull(nullPath interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	vecPath, err := queryPath(nullPath)
+	if err != nil {
+		return
+	}
+	// Figure out result number limit
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	forEachDoc, err := scanFunc(expr, src)
+	if err != nil {
+		return
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("is-null", vecPath, &candidates, result, len(*result), time.Now())
+	}
+	tdlog.CritNoRepeat("Query %v scans all documents, which can be very inefficient", expr)
+	src.traceNote("Scanned all documents")
+	counter := 0
+	forEachDoc(func(id int, docB []byte) bool {
+		candidates++
+		if skip != nil && skip(id) {
+			return true
+		}
+		doc, decodeErr := decodeDoc(docB)
+		if decodeErr != nil || !hasNull(doc, vecPath) {
+			return true
+		}
+		(*result)[id] = struct{}{}
+		counter++
+		if err = resultTooLarge(src, result); err != nil {
+			return false
+		}
+		return intLimit <= 0 || counter < intLimit
+	}, false)
+	src.countQueryCost(candidates, 0, 1)
+	return
+}
+
+// Return true if any value along the path is null.
+func hasNull(doc map[string]interface{}, vecPath []string) bool {
+	for _, val := range GetInPresent(doc, vecPath) {
+		if val == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Return a function that tells whether a value in document matches the value of contains-anywhere query.
+func anywhereMatcher(value interface{}, expr map[string]interface{}) (func(docVal interface{}) bool, error) {
+	substring, err := queryBool(expr, "substring")
+	if err != nil {
+		return nil, err
+	}
+	if substring {
+		str, isStr := value.(string)
+		if !isStr {
+			return nil, fmt.Errorf("Expecting a string to look for as substring, but %v given", value)
+		}
+		return func(docVal interface{}) bool {
+			docStr, isStr := docVal.(string)
+			return isStr && strings.Contains(docStr, str)
+		}, nil
+	}
+	strValue := indexString(value)
+	return func(docVal interface{}) bool {
+		return docVal != nil && indexString(docVal) == strValue
+	}, nil
+}
+
+// Return true if any value in the structure, at any depth, matches.
+func containsAnywhere(thing interface{}, match func(docVal interface{}) bool) bool {
+	switch val := thing.(type) {
+	case map[string]interface{}:
+		for _, attr := range val {
+			if containsAnywhere(attr, match) {
+				return true
+			}
+		}
+		return false
+	case []interface{}:
+		for _, element := range val {
+			if containsAnywhere(element, match) {
+				return true
+			}
+		}
+		return false
+	}
+	return match(thing)
+}
+
+// Calculate intersection of sub-query results, evaluating the sub-query of the smallest estimated result first.
+func Intersect(subExprs interface{}, src *Col, result *map[int]struct{}) (err error) {
+	myResult := make(map[int]struct{})
+	if subExprVecs, ok := subExprs.([]interface{}); ok {
+		// Sub-queries are evaluated within the scope of each other, which partial indexes may answer
+		scoped := *src
+		scoped.scope = append(append([]interface{}{}, src.scope...), subExprVecs...)
+		memoryLimit, docCount := src.db.Config.IntersectMemoryLimit, src.approxDocCount(false)
+		first := true
+		for i, subExpr := range orderBySelectivity(subExprVecs, &scoped) {
+			checked := false
+			intRange, scan := checkableIntRange(subExpr, src), checkableScan(subExpr, &scoped)
+			if !first && (memoryLimit > 0 || intRange || scan) {
+				size := estimateResultSize(subExpr, &scoped, docCount)
+				if scan {
+					// A scan passes over soft-deleted documents, which the candidates may still have
+					for id := range myResult {
+						if src.isDeleted(id) {
+							delete(myResult, id)
+						}
+					}
+				}
+				// The result of a large sub-query is not collected, an integer range takes an index lookup per integer,
+				// and a scan reads all documents - the intersection is checked against them document by document instead
+				checked = (memoryLimit > 0 && size > memoryLimit || intRange && len(myResult) < size || scan) &&
+					keepMatches(myResult, subExpr, src)
+			}
+			if !checked {
+				subResult := make(map[int]struct{})
+				if err = evalQuery(subExpr, &scoped, &subResult, false); err != nil {
+					return
+				}
+				if first {
+					myResult = subResult
+					first = false
+				} else {
+					// Intersect in place, so that the intersection does not take memory of its own
+					for k := range myResult {
+						if _, inBoth := subResult[k]; !inBoth {
+							delete(myResult, k)
+						}
+					}
+				}
+			}
+			if len(myResult) == 0 {
+				// Nothing is left to intersect, the remaining sub-queries are not evaluated
+				src.traceNote("Intersection became empty, %d remaining sub-queries are not evaluated", len(subExprVecs)-i-1)
+				break
+			}
+		}
+		for docID := range myResult {
+			(*result)[docID] = struct{}{}
+		}
+		err = resultTooLarge(src, result)
+	} else {
+		return dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+	}
+	return
+}
+
+// Remove the documents that do not match the query from the candidates, by reading each candidate and matching it
+// against the query, so that the query result is not collected in memory. Return false if the query cannot be matched
+// against a document, the candidates are then left for the query to be evaluated in full. Does not place schema lock.
+func keepMatches(candidates map[int]struct{}, q interface{}, src *Col) bool {
+	if _, err := matchDoc(q, 0, map[string]interface{}{}); err != nil {
+		return false
+	}
+	src.traceNote("Checking %d candidates against %v instead of evaluating it", len(candidates), q)
+	for id := range candidates {
+		src.countQueryCost(1, 0, 0)
+		doc, err := src.readForIndex(id)
+		if err != nil {
+			delete(candidates, id)
+			continue
+		}
+		src.addDerivedValues(doc)
+		src.addVirtualFields(doc)
+		if match, err := matchDoc(q, id, doc); err != nil {
+			return false
+		} else if !match {
+			delete(candidates, id)
+		}
+	}
+	return true
+}
+
+// Return true if the query is an integer range on an index without a limit, so that checking candidates against it
+// matches the same documents as evaluating it does. Does not place schema lock.
+func checkableIntRange(q interface{}, src *Col) bool {
+	expr, isMap := q.(map[string]interface{})
+	if !isMap {
+		return false
+	}
+	_, dashed := expr["int-from"]
+	_, spaced := expr["int from"]
+	if _, limited := expr["limit"]; limited || !dashed && !spaced {
+		return false
+	}
+	vecPath, err := queryPath(expr["in"])
+	if err != nil {
+		return false
+	}
+	htPath := strings.Join(vecPath, INDEX_PATH_SEP)
+	_, sorted := src.sorted[htPath]
+	return sorted || src.indexUsable(htPath)
+}
+
+// Leaf query operations that scan all documents.
+var scanOps = []string{"contains-anywhere", "re-path", "like", "key-re", "not-contains", "fields-eq", "type", "len", "str-len",
+	"is-null", "compute"}
+
+// Return true if the query scans all documents to be evaluated - a scanning operation, or lookup on a path without usable
+// index - and checking candidates against it matches the same documents as evaluating it does. Does not place schema
+// lock.
+func checkableScan(q interface{}, src *Col) bool {
+	expr, isMap := q.(map[string]interface{})
+	if !isMap {
+		return false
+	}
+	for _, option := range []string{"limit", "max-examined", "include-deleted"} {
+		if _, hasOption := expr[option]; hasOption {
+			return false
+		}
+	}
+	if _, lookup := expr["eq"]; lookup {
+		_, indexed := indexNameOf(expr["in"], src)
+		return !indexed
+	}
+	for _, op := range scanOps {
+		if _, isOp := expr[op]; isOp {
+			return true
+		}
+	}
+	return false
+}
+
+// Intersect the explicitly given document IDs with the result of sub-query "q", e.g. {"ids-and": ["123", 456], "q":
+// {"eq": "active", "in": ["status"]}} filters candidate IDs that a client already has. IDs may be given as strings or
+// numbers, an ID of no document is skipped. When there are fewer candidates than the sub-query is estimated to match,
+// each candidate is read and matched against the sub-query instead of evaluating it.
+func IDsAnd(idList interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) error {
+	candidates, err := queryDocIDs("ids-and", idList)
+	if err != nil {
+		return err
+	}
+	subExpr, hasSubExpr := expr["q"]
+	if !hasSubExpr {
+		return dberr.New(dberr.ErrorMissing, "q")
+	}
+	for id := range candidates {
+		if src.isDeleted(id) {
+			delete(candidates, id)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if len(candidates) >= estimateResultSize(subExpr, src, src.approxDocCount(false)) || !keepMatches(candidates, subExpr, src) {
+		subResult := make(map[int]struct{})
+		if err := evalQuery(subExpr, src, &subResult, false); err != nil {
+			return err
+		}
+		for id := range candidates {
+			if _, match := subResult[id]; !match {
+				delete(candidates, id)
+			}
+		}
+	}
+	for id := range candidates {
+		(*result)[id] = struct{}{}
+	}
+	return resultTooLarge(src, result)
+}
+
+// Return the set of document IDs of the query parameter, an array of IDs given as strings or numbers.
+func queryDocIDs(name string, val interface{}) (map[int]struct{}, error) {
+	list, err := queryDocIDList(name, val)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[int]struct{}, len(list))
+	for _, id := range list {
+		ids[id] = struct{}{}
+	}
+	return ids, nil
+}
+
+// Return the document IDs of the query parameter in the order they are given, repeats included.
+func queryDocIDList(name string, val interface{}) ([]int, error) {
+	vals, isVec := val.([]interface{})
+	if !isVec {
+		return nil, fmt.Errorf("Expecting `%s` to be an array of document IDs, but %v given", name, val)
+	}
+	ids := make([]int, 0, len(vals))
+	for _, idVal := range vals {
+		// Document IDs are too large for float64 to keep them exact, they are usually given as strings
+		var id int
+		var err error
+		if strID, isStr := idVal.(string); isStr {
+			if id, err = strconv.Atoi(strID); err != nil {
+				return nil, dberr.New(dberr.ErrorExpectingInt, name, strID)
+			}
+		} else if id, err = queryInt(name, idVal); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Calculate complement of sub-query results.
+func Complement(subExprs interface{}, src *Col, result *map[int]struct{}) (err error) {
+	myResult := make(map[int]struct{})
+	if subExprVecs, ok := subExprs.([]interface{}); ok {
+		for _, subExpr := range subExprVecs {
+			subResult := make(map[int]struct{})
+			complement := make(map[int]struct{})
+			if err = evalQuery(subExpr, src, &subResult, false); err != nil {
+				return
+			}
+			for k := range subResult {
+				if _, inBoth := myResult[k]; !inBoth {
+					complement[k] = struct{}{}
+				}
+			}
+			for k := range myResult {
+				if _, inBoth := subResult[k]; !inBoth {
+					complement[k] = struct{}{}
+				}
+			}
+			myResult = complement
+		}
+		for docID := range myResult {
+			(*result)[docID] = struct{}{}
+		}
+		err = resultTooLarge(src, result)
+	} else {
+		return dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+	}
+	return
+}
+
+// Return the query that a set operation spelt by name stands for: {"and": [...]} is intersection {"n": [...]},
+// {"or": [...]} is union [...], and {"not": [...]} matches the documents that match none of the sub-queries - it is
+// complement {"c": [...], "of": "all"}, or of the universe query given by "of". Sub-queries of a named set operation may
+// also be given as a single query. Return false if the query is not a named set operation.
+func namedSetOp(expr map[string]interface{}) (interface{}, bool) {
+	for _, name := range []string{"and", "or", "not"} {
+		subExprs, named := expr[name]
+		if !named {
+			continue
+		}
+		subExprVecs, isVec := subExprs.([]interface{})
+		if !isVec {
+			subExprVecs = []interface{}{subExprs}
+		}
+		switch name {
+		case "and":
+			return map[string]interface{}{"n": subExprVecs}, true
+		case "or":
+			return subExprVecs, true
+		default:
+			universe, hasUniverse := expr["of"]
+			if !hasUniverse {
+				universe = "all"
+			}
+			return map[string]interface{}{"c": subExprVecs, "of": universe}, true
+		}
+	}
+	return nil, false
+}
+
+// Calculate result of the universe query less the results of sub-queries.
+func ComplementOf(subExprs, universe interface{}, src *Col, result *map[int]struct{}) (err error) {
+	subExprVecs, ok := subExprs.([]interface{})
+	if !ok {
+		return dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+	}
+	myResult := make(map[int]struct{})
+	if err = evalQuery(universe, src, &myResult, false); err != nil {
+		return
+	}
+	for _, subExpr := range subExprVecs {
+		if len(myResult) == 0 {
+			// Nothing is left to exclude from
+			break
+		}
+		subResult := make(map[int]struct{})
+		if err = evalQuery(subExpr, src, &subResult, false); err != nil {
+			return
+		}
+		for k := range subResult {
+			delete(myResult, k)
+		}
+	}
+	for docID := range myResult {
+		(*result)[docID] = struct{}{}
+	}
+	return resultTooLarge(src, result)
+}
+
+// Return documents matching at least k of the sub-queries.
+func MinMatch(subExprs interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	subExprVecs, ok := subExprs.([]interface{})
+	if !ok {
+		return dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+	}
+	// Figure out the minimum number of matching sub-queries
+	minMatch, hasK := expr["k"]
+	if !hasK {
+		return dberr.New(dberr.ErrorMissing, "k")
+	}
+	k, err := queryInt("k", minMatch)
+	if err != nil {
+		return
+	}
+	if k < 1 {
+		return fmt.Errorf("Expecting `k` to be at least 1, but %d given", k)
+	}
+	// Figure out result number limit
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	if k > len(subExprVecs) {
+		// No document can match more sub-queries than there are
+		return
+	}
+	counts := make(map[int]int)
+	if err = evalUnionCount(subExprVecs, src, &counts); err != nil {
+		return
+	}
+	counter := 0
+	for docID, count := range counts {
+		if count >= k {
+			(*result)[docID] = struct{}{}
+			if counter++; counter == intLimit {
+				break
+			}
+		}
+	}
+	return resultTooLarge(src, result)
+}
+
+// A document and its score in weighted query result.
+type ScoredDoc struct {
+	ID    int
+	Score float64
+}
+
+// Return documents matching at least one of the weighted sub-queries, or the limit number of highest scored documents.
+func Weighted(subExprs interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	ranked, err := evalWeighted(subExprs, expr, src)
+	if err != nil {
+		return
+	}
+	for _, scored := range ranked {
+		(*result)[scored.ID] = struct{}{}
+	}
+	return resultTooLarge(src, result)
+}
+
+// Evaluate a weighted query {"weighted": [{"q": sub-query1, "w": weight1}, ...], "limit": #}, and score each document
+// by the sum of weights of the sub-queries it matches. Return documents matching at least one sub-query ranked by
+// descending score; documents of equal score are ordered by ascending ID.
+func EvalWeighted(q interface{}, src *Col) ([]ScoredDoc, error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	if src.closed {
+		return nil, dberr.New(dberr.ErrorColClosed, src.name)
+	}
+	expr, ok := q.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expecting a weighted query, but %v given", q)
+	}
+	subExprs, weighted := expr["weighted"]
+	if !weighted {
+		return nil, dberr.New(dberr.ErrorMissing, "weighted")
+	}
+	return evalWeighted(subExprs, expr, src)
+}
+
+// Calculate ranked document scores of a weighted query. Does not place schema lock.
+func evalWeighted(subExprs interface{}, expr map[string]interface{}, src *Col) (ranked []ScoredDoc, err error) {
+	exprs, weights, err := weightedSubQueries(subExprs)
+	if err != nil {
+		return
+	}
+	// Figure out result number limit
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	scores := make(map[int]float64)
+	if err = evalUnionScore(exprs, weights, src, &scores); err != nil {
+		return
+	}
+	ranked = make([]ScoredDoc, 0, len(scores))
+	for id, score := range scores {
+		ranked = append(ranked, ScoredDoc{ID: id, Score: score})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].ID < ranked[j].ID
+	})
+	if intLimit > 0 && len(ranked) > intLimit {
+		ranked = ranked[:intLimit]
+	}
+	return
+}
+
+// Return sub-queries and their weights of a weighted query.
+func weightedSubQueries(subExprs interface{}) (exprs []interface{}, weights []float64, err error) {
+	subExprVecs, ok := subExprs.([]interface{})
+	if !ok {
+		return nil, nil, dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+	}
+	for _, subExpr := range subExprVecs {
+		weighted, ok := subExpr.(map[string]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("Expecting a weighted sub-query {\"q\": sub-query, \"w\": weight}, but %v given", subExpr)
+		}
+		q, hasQuery := weighted["q"]
+		if !hasQuery {
+			return nil, nil, dberr.New(dberr.ErrorMissing, "q")
+		}
+		w, hasWeight := weighted["w"]
+		if !hasWeight {
+			return nil, nil, dberr.New(dberr.ErrorMissing, "w")
+		}
+		weight, err := queryFloat("w", w)
+		if err != nil {
+			return nil, nil, err
+		}
+		exprs = append(exprs, q)
+		weights = append(weights, weight)
+	}
+	return
+}
+
+// Sum up weights of the sub-queries matched by each document (document ID as map key). Does not place schema lock.
+func evalUnionScore(exprs []interface{}, weights []float64, src *Col, scores *map[int]float64) (err error) {
+	for i, subExpr := range exprs {
+		subResult := make(map[int]struct{})
+		if err = evalQuery(subExpr, src, &subResult, false); err != nil {
+			return
+		}
+		for docID := range subResult {
+			(*scores)[docID] += weights[i]
+		}
+	}
+	return
+}
+
+// Return integer value of a query parameter.
+func queryInt(name string, val interface{}) (int, error) {
+	switch num := val.(type) {
+	case float64:
+		return int(num), nil
+	case int:
+		return num, nil
+	case json.Number:
+		if intVal, err := num.Int64(); err == nil {
+			return int(intVal), nil
+		} else if floatVal, err := num.Float64(); err == nil {
+			return int(floatVal), nil
+		}
+	}
+	return 0, dberr.New(dberr.ErrorExpectingInt, name, val)
+}
+
+// Return the optional result number limit of a query. Limit of 0 or less, or no limit at all, means unlimited, and
+// is returned as 0.
+func queryLimit(expr map[string]interface{}) (int, error) {
+	limit, hasLimit := expr["limit"]
+	if !hasLimit {
+		return 0, nil
+	}
+	intLimit, err := queryInt("limit", limit)
+	if err != nil || intLimit < 0 {
+		return 0, err
+	}
+	return intLimit, nil
+}
+
+// Return floating point value of a query parameter.
+func queryFloat(name string, val interface{}) (float64, error) {
+	switch num := val.(type) {
+	case float64:
+		return num, nil
+	case int:
+		return float64(num), nil
+	case json.Number:
+		if floatVal, err := num.Float64(); err == nil {
+			return floatVal, nil
+		}
+	}
+	return 0, fmt.Errorf("Expecting `%s` as a number, but %v given", name, val)
+}
+
+// Return value of an optional boolean query parameter, which is false by default.
+// For example, "ordered": true asks for limited result to be the lowest document IDs.
+func queryBool(expr map[string]interface{}, name string) (bool, error) {
+	val, hasVal := expr[name]
+	if !hasVal {
+		return false, nil
+	}
+	if boolVal, ok := val.(bool); ok {
+		return boolVal, nil
+	}
+	return false, fmt.Errorf("Expecting `%s` to be true or false, but %v given", name, val)
+}
+
+// Return the function that scans documents for a full document scan operation: in the order of document ID if the
+// operation is "ordered", and stopping once "max-examined" documents have been examined if given. A scan stopped by the
+// budget leaves the operation with the matches among the documents examined so far, and is noted in query statistics.
+// The scan takes a slot of MaxConcurrentScans before returning, and frees it when the returned function is done; the
+// operation must call the function exactly once. The scan stops once the deadline of the query passes, and documents
+// come with the values of virtual fields.
+func scanFunc(expr map[string]interface{}, src *Col) (func(fun func(id int, doc []byte) bool, placeSchemaLock bool), error) {
+	forEachDoc, err := budgetedScanFunc(expr, src)
+	if err != nil {
+		return nil, err
+	}
+	release, err := src.db.acquireScan(src)
+	if err != nil {
+		return nil, err
+	}
+	return func(fun func(id int, doc []byte) bool, placeSchemaLock bool) {
+		defer release()
+		forEachDoc(func(id int, doc []byte) bool {
+			return !src.pastDeadline() && fun(id, src.withVirtualFields(doc))
+		}, placeSchemaLock)
+	}, nil
+}
+
+// Return the function that scans documents in the order and within the budget of the full document scan operation.
+func budgetedScanFunc(expr map[string]interface{}, src *Col) (func(fun func(id int, doc []byte) bool, placeSchemaLock bool), error) {
+	ordered, err := queryBool(expr, "ordered")
+	if err != nil {
+		return nil, err
+	}
+	forEachDoc := src.forEachDoc
+	if ordered {
+		forEachDoc = src.forEachDocInOrder
+	}
+	budget, hasBudget := expr["max-examined"]
+	if !hasBudget {
+		return forEachDoc, nil
+	}
+	maxExamined, err := queryInt("max-examined", budget)
+	if err != nil {
+		return nil, err
+	} else if maxExamined < 1 {
+		return nil, fmt.Errorf("Expecting `max-examined` to be a positive integer, but %v given", budget)
+	}
+	return func(fun func(id int, doc []byte) bool, placeSchemaLock bool) {
+		examined := 0
+		forEachDoc(func(id int, doc []byte) bool {
+			if examined == maxExamined {
+				src.traceNote("Stopped scan after examining %d documents (max-examined)", maxExamined)
+				if src.stats != nil {
+					src.stats.ScanBudgetHit = true
 				}
+				return false
 			}
-			myResult = complement
-		}
-		for docID := range myResult {
-			(*result)[docID] = struct{}{}
+			examined++
+			return fun(id, doc)
+		}, placeSchemaLock)
+	}, nil
+}
+
+// Adjust integer range boundaries according to optional "from-exclusive" and "to-exclusive", and tell whether the range
+// has become empty. Range may go either upward or downward.
+func exclusiveRange(from, to int, expr map[string]interface{}) (newFrom, newTo int, empty bool, err error) {
+	fromExclusive, err := queryBool(expr, "from-exclusive")
+	if err != nil {
+		return
+	}
+	toExclusive, err := queryBool(expr, "to-exclusive")
+	if err != nil {
+		return
+	}
+	step := 1
+	if from > to {
+		step = -1
+	}
+	if fromExclusive {
+		from += step
+	}
+	if toExclusive {
+		to -= step
+	}
+	return from, to, step == 1 && from > to || step == -1 && from < to, nil
+}
+
+// Return a copy of the query without result limit.
+func withoutLimit(expr map[string]interface{}) map[string]interface{} {
+	unlimited := make(map[string]interface{}, len(expr))
+	for key, val := range expr {
+		if key != "limit" {
+			unlimited[key] = val
 		}
-	} else {
-		return dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
 	}
+	return unlimited
+}
+
+// Put at most limit number of the lowest document IDs among candidates into result.
+func putLowestIDs(candidates map[int]struct{}, limit int, result *map[int]struct{}) {
+	ids := make([]int, 0, len(candidates))
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	for _, id := range ids {
+		(*result)[id] = struct{}{}
+	}
+}
+
+// Look up the document IDs of a hash key on the index, at most limit of them if limit is greater than 0. A key ruled out
+// by the Bloom filter of the index has no document. Does not place schema lock.
+func (col *Col) hashScan(idxName string, key, limit int) (vals []int, err error) {
+	if col.bloomRulesOut(idxName, key) {
+		return nil, nil
+	}
+	err = col.readIndexPartition(idxName, key%col.db.numParts, func(ht *data.HashTable) {
+		vals = ht.Get(key, limit)
+	})
 	return
 }
 
-func (col *Col) hashScan(idxName string, key, limit int) []int {
-	ht := col.hts[key%col.db.numParts][idxName]
+// Read an index partition by calling the function under read lock of the partition. Return dberr.ErrorIndexCorrupt if
+// the partition is missing, or if it is found corrupt - the function panics or a bad bucket chain turns up - so that a
+// query fails instead of giving a result that silently misses the entries out of reach. Does not place schema lock.
+func (col *Col) readIndexPartition(idxName string, partNum int, read func(ht *data.HashTable)) (err error) {
+	ht := col.hts[partNum][idxName]
+	if ht == nil {
+		tdlog.CritNoRepeat("Collection %s index %s partition %d is missing", col.name, idxName, partNum)
+		return dberr.New(dberr.ErrorIndexCorrupt, partNum, idxName)
+	}
 	ht.Lock.RLock()
-	vals := ht.Get(key, limit)
-	ht.Lock.RUnlock()
-	return vals
+	defer ht.Lock.RUnlock()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			tdlog.CritNoRepeat("Collection %s index %s partition %d is corrupt: %v", col.name, idxName, partNum, recovered)
+			err = dberr.New(dberr.ErrorIndexCorrupt, partNum, idxName)
+		} else if ht.Corrupt() {
+			tdlog.CritNoRepeat("Collection %s index %s partition %d has a bad bucket chain", col.name, idxName, partNum)
+			err = dberr.New(dberr.ErrorIndexCorrupt, partNum, idxName)
+		}
+	}()
+	read(ht)
+	return
 }
 
 // Look for indexed integer values within the specified integer range.
@@ -209,120 +2116,389 @@ func IntRange(intFrom interface{}, expr map[string]interface{}, src *Col, result
 		return errors.New("Missing path `in`")
 	}
 	// Figure out the path
-	vecPath := make([]string, 0)
-	if vecPathInterface, ok := path.([]interface{}); ok {
-		for _, v := range vecPathInterface {
-			vecPath = append(vecPath, fmt.Sprint(v))
-		}
-	} else {
+	vecPath, err := queryPath(path)
+	if err != nil {
 		return errors.New(fmt.Sprintf("Expecting vector path `in`, but %v given", path))
 	}
 	// Figure out result number limit
-	intLimit := int(0)
-	if limit, hasLimit := expr["limit"]; hasLimit {
-		if floatLimit, ok := limit.(float64); ok {
-			intLimit = int(floatLimit)
-		} else if _, ok := limit.(int); ok {
-			intLimit = limit.(int)
-		} else {
-			return dberr.New(dberr.ErrorExpectingInt, limit)
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	if ordered, err := queryBool(expr, "ordered"); err != nil {
+		return err
+	} else if ordered && intLimit > 0 {
+		candidates := make(map[int]struct{})
+		if err := IntRange(intFrom, withoutLimit(expr), src, &candidates); err != nil {
+			return err
 		}
+		putLowestIDs(candidates, intLimit, result)
+		return resultTooLarge(src, result)
 	}
 	// Figure out the range ("from" value & "to" value)
 	from, to := int(0), int(0)
-	if floatFrom, ok := intFrom.(float64); ok {
-		from = int(floatFrom)
-	} else if _, ok := intFrom.(int); ok {
-		from = intFrom.(int)
-	} else {
-		return dberr.New(dberr.ErrorExpectingInt, "int-from", from)
+	if from, err = queryInt("int-from", intFrom); err != nil {
+		return
 	}
 	if intTo, ok := expr["int-to"]; ok {
-		if floatTo, ok := intTo.(float64); ok {
-			to = int(floatTo)
-		} else if _, ok := intTo.(int); ok {
-			to = intTo.(int)
-		} else {
-			return dberr.New(dberr.ErrorExpectingInt, "int-to", to)
+		if to, err = queryInt("int-to", intTo); err != nil {
+			return
 		}
 	} else if intTo, ok := expr["int to"]; ok {
-		if floatTo, ok := intTo.(float64); ok {
-			to = int(floatTo)
-		} else if _, ok := intTo.(int); ok {
-			to = intTo.(int)
-		} else {
-			return dberr.New(dberr.ErrorExpectingInt, "int to", to)
+		if to, err = queryInt("int to", intTo); err != nil {
+			return
 		}
 	} else {
 		return dberr.New(dberr.ErrorMissing, "int-to")
 	}
-	if to > from && to-from > 1000 || from > to && from-to > 1000 {
-		tdlog.CritNoRepeat("Query %v involves index lookup on more than 1000 values, which can be very inefficient", expr)
+	// Exclusive bounds move the range boundaries towards each other
+	var empty bool
+	if from, to, empty, err = exclusiveRange(from, to, expr); err != nil || empty {
+		return
 	}
 	counter := int(0) // Number of results already collected
-	htPath := strings.Join(vecPath, ",")
-	if _, indexScan := src.indexPaths[htPath]; !indexScan {
+	htPath := strings.Join(vecPath, INDEX_PATH_SEP)
+	sorted, sortedScan := src.sorted[htPath]
+	if !src.indexUsable(htPath) && !sortedScan {
 		return dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
+	} else if !sortedScan && (to > from && to-from > 1000 || from > to && from-to > 1000) {
+		tdlog.CritNoRepeat("Query %v involves index lookup on more than 1000 values, which can be very inefficient", expr)
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	scanLimit := intLimit
+	if skip != nil {
+		// Soft-deleted documents do not count towards the limit
+		scanLimit = 0
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("int-range", vecPath, &candidates, result, len(*result), time.Now())
+	}
+	if sortedScan {
+		// Seek to the range on sorted index and scan values in order
+		src.traceNote("Scanned sorted index %s from %d to %d", htPath, from, to)
+		src.countQueryCost(0, 1, 0)
+		candidates = sorted.scan(from, to, func(docID int) bool {
+			if skip != nil && skip(docID) {
+				return true
+			}
+			counter++
+			(*result)[docID] = struct{}{}
+			if err = resultTooLarge(src, result); err != nil {
+				return false
+			}
+			return intLimit <= 0 || counter < intLimit
+		})
+		return
 	}
+	src.traceNote("Hash lookup of every integer from %d to %d on index %s", from, to, htPath)
 	if from < to {
 		// Forward scan - from low value to high value
 		for lookupValue := from; lookupValue <= to; lookupValue++ {
-			lookupStrValue := fmt.Sprint(float64(lookupValue))
+			lookupStrValue := intString(int64(lookupValue))
 			hashValue := StrHash(lookupStrValue)
-			vals := src.hashScan(htPath, hashValue, int(intLimit))
+			vals, scanErr := src.hashScan(htPath, hashValue, scanLimit)
+			if scanErr != nil {
+				return scanErr
+			}
+			src.countQueryCost(0, 1, 0)
+			candidates += len(vals)
 			for _, docID := range vals {
 				if intLimit > 0 && counter == intLimit {
 					break
+				} else if skip != nil && skip(docID) {
+					continue
 				}
 				counter++
 				(*result)[docID] = struct{}{}
+				if err = resultTooLarge(src, result); err != nil {
+					return
+				}
 			}
 		}
 	} else {
 		// Backward scan - from high value to low value
 		for lookupValue := from; lookupValue >= to; lookupValue-- {
-			lookupStrValue := fmt.Sprint(float64(lookupValue))
+			lookupStrValue := intString(int64(lookupValue))
 			hashValue := StrHash(lookupStrValue)
-			vals := src.hashScan(htPath, hashValue, int(intLimit))
+			vals, scanErr := src.hashScan(htPath, hashValue, scanLimit)
+			if scanErr != nil {
+				return scanErr
+			}
+			src.countQueryCost(0, 1, 0)
+			candidates += len(vals)
 			for _, docID := range vals {
 				if intLimit > 0 && counter == intLimit {
 					break
+				} else if skip != nil && skip(docID) {
+					continue
 				}
 				counter++
 				(*result)[docID] = struct{}{}
+				if err = resultTooLarge(src, result); err != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+// Look for documents having any of the integers of the set on the path by a hash lookup of each integer, e.g.
+// {"int-set": [1, 5, 9, 100], "in": ["x"]}. Unlike integer range, the integers do not have to be contiguous, only the
+// integers of the set are looked up.
+func IntSet(intSet interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	path, hasPath := expr["in"]
+	if !hasPath {
+		return errors.New("Missing path `in`")
+	}
+	vecPath, err := queryPath(path)
+	if err != nil {
+		return
+	}
+	ints, err := queryIntSet(intSet)
+	if err != nil {
+		return
+	}
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return
+	}
+	if ordered, err := queryBool(expr, "ordered"); err != nil {
+		return err
+	} else if ordered && intLimit > 0 {
+		candidates := make(map[int]struct{})
+		if err := IntSet(intSet, withoutLimit(expr), src, &candidates); err != nil {
+			return err
+		}
+		putLowestIDs(candidates, intLimit, result)
+		return resultTooLarge(src, result)
+	}
+	htPath := strings.Join(vecPath, INDEX_PATH_SEP)
+	hashed := src.indexUsable(htPath)
+	sorted, sortedScan := src.sorted[htPath]
+	if !hashed && !sortedScan {
+		return dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
+	}
+	skip, err := deletedFilter(expr, src)
+	if err != nil {
+		return
+	}
+	scanLimit := intLimit
+	if skip != nil {
+		// Soft-deleted documents do not count towards the limit
+		scanLimit = 0
+	}
+	candidates := 0
+	if tdlog.StructuredLog {
+		defer logQueryOp("int-set", vecPath, &candidates, result, len(*result), time.Now())
+	}
+	src.traceNote("Lookup of %d integers on index %s", len(ints), htPath)
+	counter := 0 // Number of results already collected
+	for _, intVal := range ints {
+		var vals []int
+		if hashed {
+			if vals, err = src.hashScan(htPath, StrHash(intString(int64(intVal))), scanLimit); err != nil {
+				return
+			}
+		} else {
+			sorted.scan(intVal, intVal, func(docID int) bool {
+				vals = append(vals, docID)
+				return true
+			})
+		}
+		src.countQueryCost(0, 1, 0)
+		candidates += len(vals)
+		for _, docID := range vals {
+			if intLimit > 0 && counter == intLimit {
+				return
+			} else if skip != nil && skip(docID) {
+				continue
+			} else if _, exists := (*result)[docID]; exists {
+				continue
+			}
+			counter++
+			(*result)[docID] = struct{}{}
+			if err = resultTooLarge(src, result); err != nil {
+				return
 			}
 		}
 	}
 	return
 }
 
+// Return the distinct integers of the int-set parameter in the order they are given.
+func queryIntSet(intSet interface{}) ([]int, error) {
+	vals, isVec := intSet.([]interface{})
+	if !isVec {
+		return nil, fmt.Errorf("Expecting `int-set` to be an array of integers, but %v given", intSet)
+	}
+	ints := make([]int, 0, len(vals))
+	seen := make(map[int]struct{}, len(vals))
+	for _, val := range vals {
+		intVal, err := queryInt("int-set", val)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := seen[intVal]; !dup {
+			seen[intVal] = struct{}{}
+			ints = append(ints, intVal)
+		}
+	}
+	return ints, nil
+}
+
+// Write a structured log entry of a leaf query operation, the result size counts the documents it newly put into result.
+func logQueryOp(op string, path []string, candidates *int, result *map[int]struct{}, sizeBefore int, start time.Time) {
+	tdlog.Structured("query", map[string]interface{}{
+		"op":          op,
+		"path":        path,
+		"candidates":  *candidates,
+		"results":     len(*result) - sizeBefore,
+		"duration_us": int64(time.Since(start) / time.Microsecond),
+	})
+}
+
+// Statistics of query evaluation.
+type QueryStats struct {
+	DocsExamined int           // Number of documents read from collection data
+	IndexLookups int           // Number of hash lookups and scans on indexes
+	FullScans    int           // Number of scans over all documents of the collection
+	Duration     time.Duration // Wall-clock time of the evaluation
+
+	ScanBudgetHit bool // A document scan stopped at its max-examined budget, so the result may be incomplete
+}
+
+// Add to query statistics the cost of a query operation, if the collection handle collects statistics.
+func (col *Col) countQueryCost(docsExamined, indexLookups, fullScans int) {
+	if col.stats != nil {
+		col.stats.DocsExamined += docsExamined
+		col.stats.IndexLookups += indexLookups
+		col.stats.FullScans += fullScans
+	}
+}
+
+// Return dberr.ErrorResultTooLarge if the result has more documents than the maximum result size of database
+// configuration allows.
+func resultTooLarge(src *Col, result *map[int]struct{}) error {
+	if maxSize := src.db.Config.MaxResultSize; maxSize > 0 && len(*result) > maxSize {
+		return dberr.New(dberr.ErrorResultTooLarge, maxSize)
+	}
+	return nil
+}
+
 func evalQuery(q interface{}, src *Col, result *map[int]struct{}, placeSchemaLock bool) (err error) {
 	if placeSchemaLock {
 		src.db.schemaLock.RLock()
 		defer src.db.schemaLock.RUnlock()
 	}
+	if src.closed {
+		return dberr.New(dberr.ErrorColClosed, src.name)
+	}
+	if src.trace != nil {
+		done := src.traceQuery(q, result)
+		defer func() { done(err) }()
+	}
+	if src.deadline != nil {
+		if err = src.deadlineErr(); err != nil {
+			return
+		}
+		// An operation stopped short by the deadline returns what it has found
+		defer func() {
+			if err == nil {
+				err = src.deadlineErr()
+			}
+		}()
+	}
+	waitForIndex(q, src)
 	switch expr := q.(type) {
 	case []interface{}: // [sub query 1, sub query 2, etc]
 		return EvalUnion(expr, src, result)
 	case string:
 		if expr == "all" {
 			return EvalAllIDs(src, result)
+		} else if expr == "" {
+			// Empty query matches no document
+			return nil
 		}
 		// Might be single document number
 		docID, err := strconv.ParseInt(expr, 10, 64)
 		if err != nil {
-			return dberr.New(dberr.ErrorExpectingInt, "Single Document ID", docID)
+			return dberr.New(dberr.ErrorExpectingInt, "Single Document ID", expr)
+		}
+		if !src.isDeleted(int(docID)) {
+			(*result)[int(docID)] = struct{}{}
+			return resultTooLarge(src, result)
 		}
-		(*result)[int(docID)] = struct{}{}
 	case map[string]interface{}:
-		if lookupValue, lookup := expr["eq"]; lookup { // eq - lookup
+		if src.db.Config.StrictPaths {
+			sizeBefore := len(*result)
+			defer func() {
+				if err == nil && len(*result) == sizeBefore {
+					err = unknownPath(expr, src)
+				}
+			}()
+		}
+		if len(expr) == 0 { // {} - empty query matches no document
+			return nil
+		} else if rate, sampled := expr["sample-rate"]; sampled { // sample-rate - a random portion of the operation's result
+			return Sample(rate, expr, src, result)
+		} else if lookupValue, lookup := expr["eq"]; lookup { // eq - lookup
 			return Lookup(lookupValue, expr, src, result)
+		} else if lookupValue, lookup := expr["eq-ci"]; lookup { // eq-ci - case-insensitive lookup
+			return LookupCaseInsensitive(lookupValue, expr, src, result)
+		} else if lookupValue, lookup := expr["eq-co"]; lookup { // eq-co - accent- and case-insensitive lookup
+			return LookupCollated(lookupValue, expr, src, result)
 		} else if hasPath, exist := expr["has"]; exist { // has - path existence test
 			return PathExistence(hasPath, expr, src, result)
+		} else if dupPath, duplicates := expr["duplicates"]; duplicates { // duplicates - documents sharing a value on indexed path
+			return Duplicates(dupPath, expr, src, result)
+		} else if target, nearest := expr["nearest"]; nearest { // nearest - documents of values closest to a number
+			return Nearest(target, expr, src, result)
+		} else if since, modified := expr["modified-since"]; modified { // modified-since - documents modified after the time
+			return ModifiedSince(since, expr, src, result)
+		} else if value, anywhere := expr["contains-anywhere"]; anywhere { // contains-anywhere - full document scan for a value
+			return ContainsAnywhere(value, expr, src, result)
+		} else if pattern, regex := expr["re-path"]; regex { // re-path - full document scan for a path value matching regex
+			return RegexPath(pattern, expr, src, result)
+		} else if pattern, like := expr["like"]; like { // like - full document scan for a path value matching SQL LIKE pattern
+			return Like(pattern, expr, src, result)
+		} else if pattern, regex := expr["key-re"]; regex { // key-re - full document scan for an attribute name matching regex
+			return KeyRegex(pattern, expr, src, result)
+		} else if value, notContains := expr["not-contains"]; notContains { // not-contains - full document scan for absence of a value
+			return NotContains(value, expr, src, result)
+		} else if paths, fieldsEq := expr["fields-eq"]; fieldsEq { // fields-eq - full document scan for equal values on two paths
+			return FieldsEq(paths, expr, src, result)
+		} else if typeName, typed := expr["type"]; typed { // type - full document scan for a value of the JSON type
+			return JSONType(typeName, expr, src, result)
+		} else if bounds, length := expr["len"]; length { // len - full document scan for an array length
+			return ArrayLength(bounds, expr, src, result)
+		} else if bounds, length := expr["str-len"]; length { // str-len - full document scan for a string length
+			return StringLength(bounds, expr, src, result)
+		} else if nullPath, null := expr["is-null"]; null { // is-null - full document scan for a null value
+			return IsNull(nullPath, expr, src, result)
+		} else if condition, computed := expr["compute"]; computed { // compute - full document scan for an arithmetic condition
+			return Compute(condition, expr, src, result)
+		} else if idList, idsAnd := expr["ids-and"]; idsAnd { // ids-and - intersection of given IDs and sub-query
+			return IDsAnd(idList, expr, src, result)
+		} else if setOp, named := namedSetOp(expr); named { // and, or, not - set operation by name
+			return evalQuery(setOp, src, result, false)
 		} else if subExprs, intersect := expr["n"]; intersect { // n - intersection
 			return Intersect(subExprs, src, result)
 		} else if subExprs, complement := expr["c"]; complement { // c - complement
+			if universe, hasUniverse := expr["of"]; hasUniverse { // c with "of" - universe minus sub-query results
+				return ComplementOf(subExprs, universe, src, result)
+			}
 			return Complement(subExprs, src, result)
+		} else if subExprs, minMatch := expr["min-match"]; minMatch { // min-match - match at least k sub-queries
+			return MinMatch(subExprs, expr, src, result)
+		} else if subExprs, weighted := expr["weighted"]; weighted { // weighted - match any sub-query, ranked by sum of weights
+			return Weighted(subExprs, expr, src, result)
+		} else if intSet, ints := expr["int-set"]; ints { // int-set - lookup of a set of integers
+			return IntSet(intSet, expr, src, result)
 		} else if intFrom, htRange := expr["int-from"]; htRange { // int-from, int-to - integer range query
 			return IntRange(intFrom, expr, src, result)
 		} else if intFrom, htRange := expr["int from"]; htRange { // "int from, "int to" - integer range query - same as above, just without dash
@@ -330,14 +2506,521 @@ func evalQuery(q interface{}, src *Col, result *map[int]struct{}, placeSchemaLoc
 		} else {
 			return errors.New(fmt.Sprintf("Query %v does not contain any operation (lookup/union/etc)", expr))
 		}
+	case nil: // null - empty query matches no document
+	default:
+		return fmt.Errorf("Query %v is neither an object, array nor string", q)
 	}
 	return nil
 }
 
-// Main entrance to query processor - evaluate a query and put result into result map (as map keys).
+// Main entrance to query processor - optimize and evaluate a query and put result into result map (as map keys).
 func EvalQuery(q interface{}, src *Col, result *map[int]struct{}) (err error) {
-	return evalQuery(q, src, result, true)
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	return evalQuery(optimizeQuery(q, src), src, result, false)
+}
+
+// Optimize and evaluate a query like EvalQuery does, and return the result along with statistics of the evaluation.
+func EvalQueryWithStats(q interface{}, src *Col) (result map[int]struct{}, stats QueryStats, err error) {
+	start := time.Now()
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	// The query is evaluated on a copy of collection handle that collects statistics, so that concurrent queries on the
+	// collection are not counted.
+	counted := *src
+	counted.stats = &stats
+	result = make(map[int]struct{})
+	err = evalQuery(optimizeQuery(q, &counted), &counted, &result, false)
+	stats.Duration = time.Since(start)
+	return
+}
+
+// Evaluate a query and copy the matching documents into the destination collection, where they are indexed and get new
+// document IDs. Documents are copied in the order of their IDs in the source collection, and a document deleted in
+// between evaluation and copying is skipped. Return the number of documents copied; if copying fails midway, the
+// documents copied so far remain in the destination collection.
+func EvalQueryInto(q interface{}, src *Col, dest *Col) (copied int, err error) {
+	if src == dest {
+		return 0, fmt.Errorf("Cannot copy query result of collection %s into itself", src.name)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(q, src, &result); err != nil {
+		return
+	}
+	ids := make([]int, 0, len(result))
+	for id := range result {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		doc, readErr := src.Read(id)
+		if readErr != nil {
+			continue
+		} else if _, err = dest.Insert(doc); err != nil {
+			return
+		}
+		copied++
+	}
+	return
+}
+
+// Evaluate a query to narrow down the candidates using indexes, then read each candidate document and keep only those
+// for which keep returns true. The predicate runs exactly once per candidate, in the order of document IDs, and it may
+// use the collection as no lock is held meanwhile; a candidate deleted in between evaluation and reading is skipped.
+func EvalQueryFilter(q interface{}, src *Col, keep func(doc map[string]interface{}) bool) (map[int]struct{}, error) {
+	candidates := make(map[int]struct{})
+	if err := EvalQuery(q, src, &candidates); err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(candidates))
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	result := make(map[int]struct{})
+	for _, id := range ids {
+		doc, err := src.Read(id)
+		if err != nil {
+			continue
+		} else if keep(doc) {
+			result[id] = struct{}{}
+		}
+	}
+	return result, nil
+}
+
+// Evaluate a query against in-memory documents by document ID, without a collection or indexes - every operation is
+// evaluated by examining each document, with the same outcome as an index-assisted evaluation on a collection of these
+// documents. Documents are converted into their JSON form before evaluation, just like those inserted into a collection
+// (maps of non-string keys nested in a document are converted in place). Operations that depend on the collection, such
+// as limit, modification time and duplicates, return an error.
+func EvalQueryOnDocs(q interface{}, docs map[int]map[string]interface{}) (map[int]struct{}, error) {
+	result := make(map[int]struct{})
+	for id, doc := range docs {
+		normalizeDoc(doc)
+		docJS, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		decoded, err := decodeDoc(docJS)
+		if err != nil {
+			return nil, err
+		}
+		if match, err := matchDoc(q, id, decoded); err != nil {
+			return nil, err
+		} else if match {
+			result[id] = struct{}{}
+		}
+	}
+	return result, nil
+}
+
+// Errors of queries that failed in a batch; an error is at the same position as its query, and is nil if the query succeeded.
+type QueryErrors []error
+
+func (errs QueryErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("query %d: %v", i, err))
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Evaluate the queries under a single schema lock, return their results in the same order.
+// If any query fails, its result is nil and the returned error is QueryErrors; the other queries still run.
+func EvalQueries(queries []interface{}, src *Col) ([]map[int]struct{}, error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	results := make([]map[int]struct{}, len(queries))
+	errs := make(QueryErrors, len(queries))
+	failed := false
+	for i, q := range queries {
+		result := make(map[int]struct{})
+		if err := evalQuery(optimizeQuery(q, src), src, &result, false); err != nil {
+			errs[i] = err
+			failed = true
+			continue
+		}
+		results[i] = result
+	}
+	if failed {
+		return results, errs
+	}
+	return results, nil
+}
+
+// Errors of collections that failed in a multi-collection query by collection name.
+type ColErrors map[string]error
+
+func (errs ColErrors) Error() string {
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("collection %s: %v", name, errs[name])
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Evaluate the query against each of the collections under a single schema lock, so that the results are consistent
+// with each other, and return the result of each collection by its name. If a collection does not exist or the query
+// fails on it, the collection has no result and the returned error is ColErrors; the other collections still run.
+func (db *DB) QueryMulti(cols []string, q interface{}) (map[string]map[int]struct{}, error) {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	return db.queryMulti(cols, q)
+}
+
+// Evaluate the query against each of the collections like QueryMulti does. Does not place schema lock.
+func (db *DB) queryMulti(cols []string, q interface{}) (map[string]map[int]struct{}, error) {
+	results := make(map[string]map[int]struct{}, len(cols))
+	errs := make(ColErrors)
+	for _, name := range cols {
+		col, exists := db.cols[name]
+		if !exists {
+			errs[name] = fmt.Errorf("Collection %s does not exist", name)
+			continue
+		}
+		result := make(map[int]struct{})
+		if err := evalQuery(optimizeQuery(q, col), col, &result, false); err != nil {
+			errs[name] = err
+			continue
+		}
+		results[name] = result
+	}
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
+
+// Leaf query operations that stop looking for documents once the result reaches the limit.
+var limitedOps = []string{"eq", "eq-ci", "eq-co", "has", "duplicates", "modified-since", "contains-anywhere", "re-path", "like",
+	"key-re", "not-contains", "fields-eq", "type", "len", "str-len", "is-null", "compute", "int-set", "int-from", "int from"}
+
+// Evaluate the query only as far as it takes to find a matching document, and return its ID, or false if no document
+// matches. Which of the matching documents is found first is not specified.
+func FirstMatch(q interface{}, src *Col) (id int, found bool, err error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	result := make(map[int]struct{})
+	if err = evalFirst(optimizeQuery(q, src), src, &result); err != nil {
+		return
+	}
+	for id = range result {
+		return id, true, nil
+	}
+	return 0, false, nil
+}
+
+// Evaluate the query until the result has a document, if any matches. Leaf operations run with limit 1, union stops at
+// the first sub-query that has a match, and intersection checks the result of its most selective sub-query against
+// the others document by document. Other queries are evaluated in full. Does not place schema lock.
+func evalFirst(q interface{}, src *Col, result *map[int]struct{}) (err error) {
+	if src.closed {
+		return dberr.New(dberr.ErrorColClosed, src.name)
+	}
+	switch expr := q.(type) {
+	case []interface{}:
+		for _, subExpr := range expr {
+			if err = evalFirst(subExpr, src, result); err != nil || len(*result) > 0 {
+				return
+			}
+		}
+		return nil
+	case string:
+		if expr == "all" {
+			src.forEachDoc(src.skipDeleted(func(id int, _ []byte) bool {
+				(*result)[id] = struct{}{}
+				return false
+			}), false)
+			src.countQueryCost(1, 0, 0)
+			return nil
+		}
+	case map[string]interface{}:
+		if subExprs, intersect := intersectionOf(expr); intersect && len(subExprs) > 1 {
+			if matched, err := firstOfIntersection(subExprs, src, result); matched || err != nil {
+				return err
+			}
+			// Some of the sub-queries cannot be matched against a document
+			return evalQuery(q, src, result, false)
+		}
+		for _, op := range limitedOps {
+			if _, isOp := expr[op]; isOp {
+				limited := withoutLimit(expr)
+				limited["limit"] = 1
+				return evalQuery(limited, src, result, false)
+			}
+		}
+	}
+	return evalQuery(q, src, result, false)
+}
+
+// Evaluate the most selective sub-query of an intersection, and put the first of its result documents that matches all
+// other sub-queries into result. Return false if a sub-query cannot be matched against a document. Does not place
+// schema lock.
+func firstOfIntersection(subExprs []interface{}, src *Col, result *map[int]struct{}) (matchable bool, err error) {
+	scoped := *src
+	scoped.scope = append(append([]interface{}{}, src.scope...), subExprs...)
+	ordered := orderBySelectivity(subExprs, &scoped)
+	candidates := make(map[int]struct{})
+	if err = evalQuery(ordered[0], &scoped, &candidates, false); err != nil {
+		return true, err
+	}
+	ids := make([]int, 0, len(candidates))
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	others := map[string]interface{}{"n": ordered[1:]}
+	for _, id := range ids {
+		src.countQueryCost(1, 0, 0)
+		doc, readErr := src.readForIndex(id)
+		if readErr != nil {
+			continue
+		}
+		match, matchErr := matchDoc(others, id, doc)
+		if matchErr != nil {
+			return false, nil
+		} else if match {
+			(*result)[id] = struct{}{}
+			return true, nil
+		}
+	}
+	src.traceNote("Checked %d candidates of the most selective sub-query against the others", len(ids))
+	return true, nil
+}
+
+// Evaluate both queries against the current documents under a single schema lock, and return the IDs of documents in
+// the result of q2 but not of q1 (added), and those in the result of q1 but not of q2 (removed). To compare a query
+// result with the result as of an earlier time, use DiffQueryAsOf.
+func DiffQueries(q1, q2 interface{}, src *Col) (added, removed map[int]struct{}, err error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	before := make(map[int]struct{})
+	if err = evalQuery(optimizeQuery(q1, src), src, &before, false); err != nil {
+		return
+	}
+	after := make(map[int]struct{})
+	if err = evalQuery(optimizeQuery(q2, src), src, &after, false); err != nil {
+		return
+	}
+	added, removed = diffResults(before, after)
+	return
+}
+
+// Return the document IDs in after but not in before (added), and those in before but not in after (removed).
+func diffResults(before, after map[int]struct{}) (added, removed map[int]struct{}) {
+	added, removed = make(map[int]struct{}), make(map[int]struct{})
+	for id := range after {
+		if _, inBefore := before[id]; !inBefore {
+			added[id] = struct{}{}
+		}
+	}
+	for id := range before {
+		if _, inAfter := after[id]; !inAfter {
+			removed[id] = struct{}{}
+		}
+	}
+	return
 }
 
 // TODO: How to bring back regex matcher?
 // TODO: How to bring back JSON parameterized query?
+
+// A query result document and its sort value.
+type sortEntry struct {
+	id     int
+	val    interface{}
+	hasVal bool
+}
+
+// Return true if the entry comes before the other: ordered by value according to less, entries without a value come
+// last, and entries of equal value are ordered by ID.
+func (entry sortEntry) before(other sortEntry, less func(a, b interface{}) bool) bool {
+	if entry.hasVal != other.hasVal {
+		return entry.hasVal
+	} else if entry.hasVal && less(entry.val, other.val) {
+		return true
+	} else if entry.hasVal && less(other.val, entry.val) {
+		return false
+	}
+	return entry.id < other.id
+}
+
+// Evaluate the query and read the sort value of each result document, the first one is used if there are many.
+// Does not place schema lock.
+func evalSortEntries(q interface{}, src *Col, sortPath []string) ([]sortEntry, error) {
+	result := make(map[int]struct{})
+	if err := evalQuery(q, src, &result, false); err != nil {
+		return nil, err
+	}
+	return sortEntriesOf(result, src, sortPath), nil
+}
+
+// Read the sort value of each document, the first one is used if there are many. Does not place schema lock.
+func sortEntriesOf(result map[int]struct{}, src *Col, sortPath []string) []sortEntry {
+	entries := make([]sortEntry, 0, len(result))
+	for id := range result {
+		doc, err := src.read(id, false)
+		if err != nil {
+			continue
+		}
+		entry := sortEntry{id: id}
+		if vals := GetIn(doc, sortPath); len(vals) > 0 && vals[0] != nil {
+			entry.val, entry.hasVal = vals[0], true
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Sort the entries and return at most limit number of their document IDs, or all of them if limit is 0.
+func sortedIDs(entries []sortEntry, less func(a, b interface{}) bool, limit int) []int {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].before(entries[j], less)
+	})
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	ids := make([]int, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.id
+	}
+	return ids
+}
+
+// Evaluate the query, and return result document IDs in the order the query lists them, keeping a document as many times
+// as it is referenced - e.g. to fetch documents by a list of IDs in the order of the list. A union lists the results of
+// its sub-queries one after another, a document ID gives the document, and ids-and gives its matching IDs in the order
+// of its list, repeats included. Other queries do not order their result, which is listed in ascending order of ID.
+// Soft-deleted documents are left out, the same as EvalQuery does.
+func EvalQueryIDOrder(q interface{}, src *Col) ([]int, error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	ids := make([]int, 0)
+	err := evalIDOrder(q, src, &ids)
+	return ids, err
+}
+
+// Append the result of the query to ids in the order the query lists them. Does not place schema lock.
+func evalIDOrder(q interface{}, src *Col, ids *[]int) error {
+	if subExprs, isUnion := q.([]interface{}); isUnion {
+		for _, subExpr := range subExprs {
+			if err := evalIDOrder(subExpr, src, ids); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	result := make(map[int]struct{})
+	if err := evalQuery(optimizeQuery(q, src), src, &result, false); err != nil {
+		return err
+	}
+	if expr, isMap := q.(map[string]interface{}); isMap && queryOpName(expr) == "ids-and" {
+		listed, err := queryDocIDList("ids-and", expr["ids-and"])
+		if err != nil {
+			return err
+		}
+		for _, id := range listed {
+			if _, match := result[id]; match {
+				*ids = append(*ids, id)
+			}
+		}
+		return nil
+	}
+	start := len(*ids)
+	for id := range result {
+		*ids = append(*ids, id)
+	}
+	sort.Ints((*ids)[start:])
+	return nil
+}
+
+// Evaluate the query, and return result document IDs ordered by the value at sortPath according to less.
+// Documents without a value at sortPath come last, and documents of equal value are ordered by ID.
+// If limit is greater than 0, return at most limit number of document IDs.
+func EvalQuerySortedBy(q interface{}, src *Col, sortPath []string, less func(a, b interface{}) bool, limit int) ([]int, error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	entries, err := evalSortEntries(q, src, sortPath)
+	if err != nil {
+		return nil, err
+	}
+	return sortedIDs(entries, less, limit), nil
+}
+
+// Evaluate the query, and return the page of at most limit number of result document IDs that come after the
+// position of value afterValue and document afterID, in the order of NaturalLess on the value at sortPath.
+// Give afterID -1 for the first page, and the value and ID of the last document on a page for the next page;
+// afterValue is nil after a document without value at sortPath, since those documents come last.
+func EvalQueryPage(q interface{}, src *Col, sortPath []string, afterValue interface{}, afterID int, limit int) ([]int, error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	entries, err := evalSortEntries(q, src, sortPath)
+	if err != nil {
+		return nil, err
+	}
+	if afterID >= 0 {
+		// Leave out documents up to the position, so that only the remaining ones are sorted
+		after := sortEntry{id: afterID, val: afterValue, hasVal: afterValue != nil}
+		remaining := entries[:0]
+		for _, entry := range entries {
+			if after.before(entry, NaturalLess) {
+				remaining = append(remaining, entry)
+			}
+		}
+		entries = remaining
+	}
+	return sortedIDs(entries, NaturalLess, limit), nil
+}
+
+// Evaluate the query once, and return the page of at most limit number of result document IDs starting from the
+// offset, in the order of NaturalLess on the value at sortPath like EvalQueryPage, along with the total number of
+// documents in the result. Limit 0 returns the total alone. The total is exact, so every result document is read and
+// sorted no matter how small the page is - the cost grows with the size of the whole result.
+func EvalQueryPaged(q interface{}, src *Col, sortPath []string, offset, limit int) (ids []int, total int, err error) {
+	if offset < 0 || limit < 0 {
+		return nil, 0, fmt.Errorf("Result page offset %d and limit %d may not be negative", offset, limit)
+	}
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	entries, err := evalSortEntries(q, src, sortPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	total = len(entries)
+	if offset >= total || limit == 0 {
+		return []int{}, total, nil
+	}
+	ids = sortedIDs(entries, NaturalLess, 0)[offset:]
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, total, nil
+}
+
+// Compare values in natural order: numbers by numeric value come first, then strings in lexical order, then other
+// values by their string form.
+func NaturalLess(a, b interface{}) bool {
+	aNum, aErr := queryFloat("a", a)
+	bNum, bErr := queryFloat("b", b)
+	if aErr == nil && bErr == nil {
+		return aNum < bNum
+	} else if (aErr == nil) != (bErr == nil) {
+		return aErr == nil
+	}
+	aStr, aIsStr := a.(string)
+	bStr, bIsStr := b.(string)
+	if aIsStr && bIsStr {
+		return aStr < bStr
+	} else if aIsStr != bIsStr {
+		return aIsStr
+	}
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
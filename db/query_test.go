@@ -1,13 +1,20 @@
 package db
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
 	"testing"
 
 	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
 	"github.com/bouk/monkey"
 	"github.com/pkg/errors"
 	"strings"
@@ -361,6 +368,268 @@ func TestIntersectSubExprsNotValidType(t *testing.T) {
 		t.Error("Expected error query")
 	}
 }
+func TestIntersectMemoryLimit(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, col := intersectCol(t, 100)
+	defer db.Close()
+	queries := []string{
+		`{"n": [{"eq": 3, "in": ["small"]}, {"has": ["large"]}]}`,
+		`{"n": [{"eq": 3, "in": ["small"]}, {"eq": 0, "in": ["large"]}]}`,
+		`{"n": [{"eq": 3, "in": ["small"]}, {"duplicates": ["large"]}]}`,
+		`{"n": [{"has": ["large"]}, {"eq": 0, "in": ["large"]}, {"eq": 3, "in": ["small"]}]}`,
+		`{"n": [{"eq": 3, "in": ["small"]}, {"eq": "even", "in": ["parity"]}]}`,
+	}
+	parity := func(doc map[string]interface{}) []interface{} {
+		if n, ok := doc["large"].(float64); ok && n == 0 {
+			return []interface{}{"even"}
+		}
+		return []interface{}{"odd"}
+	}
+	if err := col.IndexDerived("parity", parity); err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]map[int]struct{}, len(queries))
+	for i, query := range queries {
+		var err error
+		if expected[i], err = runQuery(query, col); err != nil || len(expected[i]) == 0 {
+			t.Fatal(query, expected[i], err)
+		}
+	}
+	db.Config.IntersectMemoryLimit = 10
+	for i, query := range queries {
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		result, trace, err := EvalQueryWithTrace(q, col)
+		if err != nil || !reflect.DeepEqual(result, expected[i]) {
+			t.Fatal(query, result, expected[i], err)
+		}
+		// Large sub-queries other than duplicates are checked document by document
+		checked := strings.Contains(fmt.Sprint(trace.Notes), "instead of evaluating")
+		if checked == strings.Contains(query, "duplicates") {
+			t.Fatal(query, trace.Notes)
+		}
+	}
+}
+
+// Create a collection of n documents, "large" is on every document and "small" on 10% of them.
+func intersectCol(tb testing.TB, n int) (*DB, *Col) {
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		tb.Fatal(err)
+	}
+	col := db.Use("col")
+	for _, path := range []string{"small", "large"} {
+		if err = col.Index([]string{path}); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		doc := map[string]interface{}{"large": i % 2}
+		if i%10 == 0 {
+			doc["small"] = i % 7
+		}
+		col.Insert(doc)
+	}
+	return db, col
+}
+
+func benchmarkIntersect(b *testing.B, memoryLimit int) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, col := intersectCol(b, 20000)
+	defer db.Close()
+	db.Config.IntersectMemoryLimit = memoryLimit
+	var q interface{}
+	json.Unmarshal([]byte(`{"n": [{"eq": 3, "in": ["small"]}, {"has": ["large"]}]}`), &q)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result := make(map[int]struct{})
+		if err := EvalQuery(q, col, &result); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Compare memory allocated by intersection that collects every sub-query result, and by intersection that checks
+// candidates against the large sub-query.
+func BenchmarkIntersect(b *testing.B) {
+	benchmarkIntersect(b, 0)
+}
+
+func BenchmarkIntersectMemoryLimit(b *testing.B) {
+	benchmarkIntersect(b, 1000)
+}
+
+func TestIntersectIntRange(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	for _, path := range []string{"category", "price"} {
+		if err = col.Index([]string{path}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := make(map[int]struct{})
+	for i := 0; i < 200; i++ {
+		doc := map[string]interface{}{"category": i % 20, "price": i}
+		if i%2 == 0 {
+			doc["price"] = fmt.Sprint(i) // strings of integers are on index as integers
+		}
+		id, _ := col.Insert(doc)
+		if i%20 == 3 && i >= 50 && i <= 150 {
+			expected[id] = struct{}{}
+		}
+	}
+	for query, checked := range map[string]bool{
+		// The few documents of the category are checked against the wide range
+		`{"n": [{"eq": 3, "in": ["category"]}, {"int-from": 50, "int-to": 150, "in": ["price"]}]}`: true,
+		`{"n": [{"int from": 150, "int to": 50, "in": ["price"]}, {"eq": 3, "in": ["category"]}]}`: true,
+		// Narrow range, or a range with limit, is evaluated
+		`{"n": [{"eq": 3, "in": ["category"]}, {"int-from": 63, "int-to": 63, "in": ["price"]}]}`:                false,
+		`{"n": [{"eq": 3, "in": ["category"]}, {"int-from": 50, "int-to": 150, "in": ["price"], "limit": 500}]}`: false,
+	} {
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		result, trace, err := EvalQueryWithTrace(q, col)
+		if err != nil {
+			t.Fatal(query, err)
+		} else if checked != strings.Contains(fmt.Sprint(trace.Notes), "instead of evaluating") {
+			t.Fatal(query, trace.Notes)
+		}
+		for id := range result {
+			doc, _ := col.Read(id)
+			if doc["category"] != float64(3) {
+				t.Fatal(query, doc)
+			}
+		}
+		if checked && !reflect.DeepEqual(result, expected) {
+			t.Fatal(query, result, expected)
+		} else if !checked && strings.Contains(query, "63") && len(result) != 1 {
+			t.Fatal(query, result)
+		}
+	}
+	// Range in error is still reported
+	if _, err = runQuery(`{"n": [{"eq": 3, "in": ["category"]}, {"int-from": 50, "in": ["price"]}]}`, col); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestIntersectScan(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Config.SoftDelete = true
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"category"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[int]struct{})
+	var deleted int
+	for i := 0; i < 200; i++ {
+		id, _ := col.Insert(map[string]interface{}{"category": i % 20, "name": fmt.Sprintf("n%d", i), "size": i % 3})
+		if i%20 == 3 && i%3 == 1 {
+			if deleted == 0 {
+				deleted = id
+			} else {
+				expected[id] = struct{}{}
+			}
+		}
+	}
+	if err = col.Delete(deleted); err != nil {
+		t.Fatal(err)
+	}
+	for query, checked := range map[string]bool{
+		// The documents of the category are checked against the scan, or the lookup on a path without index
+		`{"n": [{"eq": 3, "in": ["category"]}, {"like": "%3", "in": ["name"]}, {"eq": 1, "in": ["size"]}]}`:    true,
+		`{"n": [{"eq": 1, "in": ["size"]}, {"eq": 3, "in": ["category"]}]}`:                                    true,
+		`{"n": [{"re-path": "3$", "in": ["name"]}, {"eq": 3, "in": ["category"]}, {"eq": 1, "in": ["size"]}]}`: true,
+		// A scan with limit is evaluated
+		`{"n": [{"eq": 3, "in": ["category"]}, {"like": "%3", "in": ["name"], "limit": 500}]}`: false,
+	} {
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		result, trace, err := EvalQueryWithTrace(q, col)
+		if err != nil {
+			t.Fatal(query, err)
+		} else if checked != strings.Contains(fmt.Sprint(trace.Notes), "instead of evaluating") {
+			t.Fatal(query, trace.Notes)
+		} else if checked && !reflect.DeepEqual(result, expected) {
+			t.Fatal(query, result, expected)
+		}
+	}
+	// Lookup on a path without index is still an error by itself
+	if _, err = runQuery(`{"n": [{"eq": 1, "in": ["size"]}, {"eq": 2, "in": ["size"]}]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+}
+
+// Create a collection of n documents having one of 100 categories and a price between 0 and 9999.
+func eqRangeCol(b *testing.B, n int) (*DB, *Col) {
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		b.Fatal(err)
+	}
+	col := db.Use("col")
+	for _, path := range []string{"category", "price"} {
+		if err = col.Index([]string{path}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		col.Insert(map[string]interface{}{"category": i % 100, "price": rand.Intn(10000)})
+	}
+	return db, col
+}
+
+func benchmarkIntersectEqRange(b *testing.B, query string) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, col := eqRangeCol(b, 100000)
+	defer db.Close()
+	var q interface{}
+	json.Unmarshal([]byte(query), &q)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result := make(map[int]struct{})
+		if err := EvalQuery(q, col, &result); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Compare intersection of a selective lookup with a wide integer range, which checks the lookup result against the
+// range, and the same intersection with a limit on the range, which evaluates the range in full.
+func BenchmarkIntersectEqRange(b *testing.B) {
+	benchmarkIntersectEqRange(b, `{"n": [{"eq": 7, "in": ["category"]}, {"int-from": 1000, "int-to": 4999, "in": ["price"]}]}`)
+}
+
+func BenchmarkIntersectEqRangeEvaluated(b *testing.B) {
+	benchmarkIntersectEqRange(b, `{"n": [{"eq": 7, "in": ["category"]}, {"int-from": 1000, "int-to": 4999, "in": ["price"], "limit": 1000000}]}`)
+}
+
 func TestComplementEvalQueryErr(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
@@ -376,6 +645,250 @@ func TestComplementEvalQueryErr(t *testing.T) {
 		t.Error("Expected error query")
 	}
 }
+func TestComplementOf(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"active"})
+	col.Index([]string{"group"})
+	ids := make([]int, 6)
+	for i := range ids {
+		ids[i], _ = col.Insert(map[string]interface{}{"active": i < 4, "group": i % 3})
+	}
+	for query, expected := range map[string][]int{
+		// Active users not in group 0 or 1
+		`{"c": [{"eq": 0, "in": ["group"]}, {"eq": 1, "in": ["group"]}], "of": {"eq": true, "in": ["active"]}}`: {ids[2]},
+		`{"c": [{"eq": 0, "in": ["group"]}], "of": {"eq": true, "in": ["active"]}}`:                             {ids[1], ids[2]},
+		`{"c": [], "of": {"eq": false, "in": ["active"]}}`:                                                      {ids[4], ids[5]},
+		`{"c": [{"eq": 0, "in": ["group"]}], "of": {"eq": 9, "in": ["group"]}}`:                                 {},
+		// Without universe, complement stays the symmetric difference of sub-queries
+		`{"c": [{"eq": true, "in": ["active"]}, {"eq": 0, "in": ["group"]}]}`: {ids[1], ids[2]},
+	} {
+		result, err := runQuery(query, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+		// Views agree with the query
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		for i, id := range ids {
+			_, inResult := result[id]
+			if match, err := matchDoc(q, id, map[string]interface{}{"active": i < 4, "group": float64(i % 3)}); err != nil || match != inResult {
+				t.Fatal(query, i, match, err)
+			}
+		}
+	}
+	for _, query := range []string{`{"c": 1, "of": "all"}`, `{"c": [], "of": {"eq": 1, "in": ["x"]}}`} {
+		if _, err = runQuery(query, col); err == nil {
+			t.Fatal("Did not error", query)
+		}
+	}
+}
+func TestNamedSetOps(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"active"})
+	col.Index([]string{"group"})
+	ids := make([]int, 6)
+	for i := range ids {
+		ids[i], _ = col.Insert(map[string]interface{}{"active": i < 4, "group": i % 3})
+	}
+	for query, expected := range map[string][]int{
+		`{"and": [{"eq": true, "in": ["active"]}, {"eq": 0, "in": ["group"]}]}`:                       {ids[0], ids[3]},
+		`{"or": [{"eq": false, "in": ["active"]}, {"eq": 0, "in": ["group"]}]}`:                       {ids[0], ids[3], ids[4], ids[5]},
+		`{"not": [{"eq": true, "in": ["active"]}, {"eq": 1, "in": ["group"]}]}`:                       {ids[5]},
+		`{"not": {"eq": 0, "in": ["group"]}, "of": {"eq": true, "in": ["active"]}}`:                   {ids[1], ids[2]},
+		`{"and": [{"or": [{"eq": 1, "in": ["group"]}, {"eq": 2, "in": ["group"]}]}, {"not": "all"}]}`: {},
+		`{"and": {"eq": 2, "in": ["group"]}}`:                                                         {ids[2], ids[5]},
+	} {
+		result, err := runQuery(query, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+		// Views agree with the query
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		for i, id := range ids {
+			_, inResult := result[id]
+			if match, err := matchDoc(q, id, map[string]interface{}{"active": i < 4, "group": float64(i % 3)}); err != nil || match != inResult {
+				t.Fatal(query, i, match, err)
+			}
+		}
+	}
+}
+func TestIDsAnd(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	ids := make([]int, 10)
+	for i := range ids {
+		ids[i], _ = col.Insert(map[string]interface{}{"a": i % 2})
+	}
+	deleted, _ := col.Insert(map[string]interface{}{"a": 0})
+	col.Delete(deleted)
+	for _, test := range []struct {
+		idList   []interface{}
+		subExpr  interface{}
+		expected []int
+	}{
+		// Fewer candidates than the sub-query matches are checked one by one
+		{[]interface{}{strconv.Itoa(ids[0]), float64(ids[1]), "12345", strconv.Itoa(deleted)}, map[string]interface{}{"eq": 0, "in": []interface{}{"a"}}, []int{ids[0]}},
+		// More candidates than the sub-query matches are intersected with the evaluated sub-query
+		{[]interface{}{strconv.Itoa(ids[0]), strconv.Itoa(ids[1]), strconv.Itoa(ids[2]), strconv.Itoa(ids[3])}, strconv.Itoa(ids[2]), []int{ids[2]}},
+		{[]interface{}{strconv.Itoa(ids[0]), strconv.Itoa(ids[1])}, "all", []int{ids[0], ids[1]}},
+		{[]interface{}{}, "all", []int{}},
+	} {
+		q := map[string]interface{}{"ids-and": test.idList, "q": test.subExpr}
+		result := make(map[int]struct{})
+		if err = EvalQuery(q, col, &result); err != nil || len(result) != len(test.expected) || !ensureMapHasKeys(result, test.expected...) {
+			t.Fatal(q, result, err)
+		}
+		// Views agree with the query
+		for i, id := range ids {
+			_, inResult := result[id]
+			if match, err := matchDoc(q, id, map[string]interface{}{"a": float64(i % 2)}); err != nil || match != inResult {
+				t.Fatal(q, i, match, err)
+			}
+		}
+	}
+	for _, q := range []map[string]interface{}{
+		{"ids-and": []interface{}{"x"}, "q": "all"},
+		{"ids-and": []interface{}{true}, "q": "all"},
+		{"ids-and": "1", "q": "all"},
+		{"ids-and": []interface{}{"1"}},
+	} {
+		if err = EvalQuery(q, col, &map[int]struct{}{}); err == nil {
+			t.Fatal("Did not error", q)
+		}
+	}
+}
+func TestEvalQueryIDOrder(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	ids := make([]int, 4)
+	for i := range ids {
+		ids[i], _ = col.Insert(map[string]interface{}{"a": i % 2})
+	}
+	odd := []int{ids[1], ids[3]}
+	sort.Ints(odd)
+	str := func(id int) interface{} { return strconv.Itoa(id) }
+	for _, test := range []struct {
+		q        interface{}
+		expected []int
+	}{
+		// Document IDs keep their order and repeats
+		{[]interface{}{str(ids[2]), str(ids[0]), str(ids[2])}, []int{ids[2], ids[0], ids[2]}},
+		{[]interface{}{str(ids[3]), map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}}, append([]int{ids[3]}, odd...)},
+		{map[string]interface{}{"ids-and": []interface{}{str(ids[3]), str(ids[0]), str(ids[1]), str(ids[3])}, "q": map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}},
+			[]int{ids[3], ids[1], ids[3]}},
+		{map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, odd},
+		{[]interface{}{}, []int{}},
+	} {
+		if result, err := EvalQueryIDOrder(test.q, col); err != nil || !reflect.DeepEqual(result, test.expected) {
+			t.Fatal(test.q, result, err)
+		}
+	}
+	if _, err = EvalQueryIDOrder([]interface{}{str(ids[0]), "x"}, col); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+func TestIntSet(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	col.IndexSorted([]string{"b"})
+	ids := make([]int, 10)
+	for i := range ids {
+		ids[i], _ = col.Insert(map[string]interface{}{"a": i, "b": i, "c": i})
+	}
+	arrayID, _ := col.Insert(map[string]interface{}{"a": []interface{}{100, "5"}, "b": []interface{}{100, "5"}})
+	for _, path := range []string{"a", "b"} {
+		for query, expected := range map[string][]int{
+			`{"int-set": [1, 5, 9, 1000], "in": ["%s"]}`:                                   {ids[1], ids[5], ids[9], arrayID},
+			`{"int-set": [9, 9, 9], "in": ["%s"]}`:                                         {ids[9]},
+			`{"int-set": [], "in": ["%s"]}`:                                                {},
+			`{"int-set": [100], "in": ["%s"]}`:                                             {arrayID},
+			`{"int-set": [0, 2, 4, 6], "in": ["%s"], "limit": 2}`:                          nil,
+			`{"n": [{"int-set": [3, 4], "in": ["%s"]}, {"int-set": [4, 5], "in": ["a"]}]}`: {ids[4]},
+		} {
+			query = fmt.Sprintf(query, path)
+			result, err := runQuery(query, col)
+			if expected == nil {
+				if err != nil || len(result) != 2 {
+					t.Fatal(query, result, err)
+				}
+				continue
+			}
+			if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+				t.Fatal(query, result, err)
+			}
+			// Views agree with the query
+			var q interface{}
+			json.Unmarshal([]byte(query), &q)
+			for id := range result {
+				doc, _ := col.Read(id)
+				if match, err := matchDoc(q, id, doc); err != nil || !match {
+					t.Fatal(query, id, match, err)
+				}
+			}
+		}
+	}
+	for _, query := range []string{
+		`{"int-set": [1], "in": ["c"]}`,
+		`{"int-set": ["x"], "in": ["a"]}`,
+		`{"int-set": 1, "in": ["a"]}`,
+		`{"int-set": [1]}`,
+	} {
+		if _, err = runQuery(query, col); err == nil {
+			t.Fatal("Did not error", query)
+		}
+	}
+}
 func TestNameIntRange(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
@@ -394,7 +907,2135 @@ func TestNameIntExpInNotFormat(t *testing.T) {
 	col, _ := OpenCol(db, "test")
 
 	result := map[int]struct{}{0: struct{}{}}
-	if !strings.Contains(IntRange(nil, map[string]interface{}{"in": "error"}, col, &result).Error(), "Expecting vector path `in`, but ") {
+	if !strings.Contains(IntRange(nil, map[string]interface{}{"in": 1}, col, &result).Error(), "Expecting vector path `in`, but ") {
 		t.Error("Expected error")
 	}
 }
+func TestDotPath(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	for _, path := range [][]string{{"a", "b", "c"}, {"version.major"}, {"n"}} {
+		if err = col.Index(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nested, _ := col.Insert(map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": 1}}, "n": 5})
+	dotted, _ := col.Insert(map[string]interface{}{"version.major": 2, "n": 7})
+	for query, expected := range map[string][]int{
+		`{"eq": 1, "in": "a.b.c"}`:                    {nested},
+		`{"eq": 1, "in": ["a", "b", "c"]}`:            {nested},
+		`{"has": "a.b.c"}`:                            {nested},
+		`{"int-from": 0, "int-to": 3, "in": "a.b.c"}`: {nested},
+		`{"eq": 2, "in": "version\\.major"}`:          {dotted},
+		`{"has": "version\\.major"}`:                  {dotted},
+		`{"int-set": [5, 7], "in": "n"}`:              {nested, dotted},
+		`{"is-null": "a.b.c"}`:                        {},
+	} {
+		result, err := runQuery(query, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+	}
+	for str, expected := range map[string][]string{
+		"a":          {"a"},
+		"a.b":        {"a", "b"},
+		`a\.b.c`:     {"a.b", "c"},
+		`a\\.b`:      {`a\`, "b"},
+		"a..b":       {"a", "", "b"},
+		"tags.**.id": {"tags", "**", "id"},
+		`trailing\`:  {`trailing\`},
+	} {
+		if vecPath := splitDotPath(str); !reflect.DeepEqual(vecPath, expected) {
+			t.Fatal(str, vecPath, expected)
+		}
+	}
+	// Unescaped dot separates attributes
+	if _, err = runQuery(`{"eq": 2, "in": "version.major"}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	} else if _, err = runQuery(`{"eq": 1, "in": ""}`, col); err == nil {
+		t.Fatal("did not error")
+	}
+}
+func TestLookupConsistency(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	match, _ := col.Insert(map[string]interface{}{"a": 1})
+	other, _ := col.Insert(map[string]interface{}{"a": 2})
+	// Simulate a hash collision between value 1 and the other document
+	hashKey := StrHash("1")
+	col.hts[hashKey%db.numParts]["a"].Put(hashKey, other)
+	q, err := runQuery(`{"eq": 1, "in": ["a"]}`, col)
+	if err != nil || !ensureMapHasKeys(q, match) {
+		t.Fatal(q, err)
+	}
+	q, err = runQuery(`{"eq": 1, "in": ["a"], "consistency": "exact"}`, col)
+	if err != nil || !ensureMapHasKeys(q, match) {
+		t.Fatal(q, err)
+	}
+	q, err = runQuery(`{"eq": 1, "in": ["a"], "consistency": "fast"}`, col)
+	if err != nil || !ensureMapHasKeys(q, match, other) {
+		t.Fatal(q, err)
+	}
+	if _, err = runQuery(`{"eq": 1, "in": ["a"], "consistency": "eventual"}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+func TestLookupLimitDistinct(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	// The two values collide on hash
+	value, colliding := "bA", "a\U00010080"
+	if StrHash(value) != StrHash(colliding) {
+		t.Fatal("values do not collide")
+	}
+	insert := func(val interface{}) int {
+		id, err := col.Insert(map[string]interface{}{"a": val})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	// The multi-valued document has two entries of the hash, followed by colliding documents
+	multi := insert([]interface{}{colliding, value})
+	collision1 := insert(colliding)
+	insert(colliding)
+	match1 := insert(value)
+	match2 := insert(value)
+	for _, c := range []struct {
+		query    string
+		expected []int
+	}{
+		{`{"eq": "bA", "in": ["a"], "limit": 1}`, []int{multi}},
+		{`{"eq": "bA", "in": ["a"], "limit": 2}`, []int{multi, match1}},
+		{`{"eq": "bA", "in": ["a"], "limit": 3}`, []int{multi, match1, match2}},
+		{`{"eq": "bA", "in": ["a"], "limit": 4}`, []int{multi, match1, match2}},
+		{`{"eq": "bA", "in": ["a"]}`, []int{multi, match1, match2}},
+		{`{"eq": "bA", "in": ["a"], "limit": 2, "consistency": "fast"}`, []int{multi, collision1}},
+	} {
+		q, err := runQuery(c.query, col)
+		if err != nil || !ensureMapHasKeys(q, c.expected...) {
+			t.Fatal(c.query, q, err)
+		}
+	}
+}
+
+func TestPathExistenceUnion(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"email"})
+	col.Index([]string{"phone"})
+	email, _ := col.Insert(map[string]interface{}{"email": "a@b.c"})
+	phone, _ := col.Insert(map[string]interface{}{"phone": 123})
+	both, _ := col.Insert(map[string]interface{}{"email": "c@b.a", "phone": 321})
+	neither, _ := col.Insert(map[string]interface{}{"name": "x"})
+	if result, err := runQuery(`{"has": [["email"], ["phone"]]}`, col); err != nil || len(result) != 3 || !ensureMapHasKeys(result, email, phone, both) {
+		t.Fatal(result, err)
+	}
+	// A single limit applies to the whole union
+	if result, err := runQuery(`{"has": [["email"], ["phone"]], "limit": 2}`, col); err != nil || len(result) != 2 {
+		t.Fatal(result, err)
+	}
+	lowest := []int{email, phone, both}
+	sort.Ints(lowest)
+	if result, err := runQuery(`{"has": [["email"], ["phone"]], "limit": 2, "ordered": true}`, col); err != nil || len(result) != 2 || !ensureMapHasKeys(result, lowest[:2]...) {
+		t.Fatal(result, err)
+	}
+	if _, err := runQuery(`{"has": [["email"], ["name"]]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	doc, _ := col.Read(neither)
+	if match, err := matchDoc(map[string]interface{}{"has": []interface{}{[]interface{}{"email"}, []interface{}{"name"}}}, neither, doc); err != nil || !match {
+		t.Fatal(match, err)
+	}
+}
+
+func TestPathExistenceUnevenPartitions(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"h"}); err != nil {
+		t.Fatal(err)
+	}
+	// Large enough to iterate each partition in several portions, which do not divide evenly
+	total := 8000*2 + 4321
+	for i := 0; i < total; i++ {
+		if _, err := col.Insert(map[string]interface{}{"h": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if partDiv := col.approxDocCount(false) / db.numParts / 4000; partDiv < 2 {
+		t.Fatal("Collection is too small", partDiv)
+	}
+	q, err := runQuery(`{"has": ["h"]}`, col)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q) != total {
+		t.Fatal(len(q), total)
+	}
+	q, err = runQuery(`{"has": ["h"], "limit": 4321}`, col)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q) != 4321 {
+		t.Fatal(len(q))
+	}
+}
+func TestEvalUnionCount(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	col.Index([]string{"b"})
+	both, _ := col.Insert(map[string]interface{}{"a": 1, "b": 1})
+	onlyA, _ := col.Insert(map[string]interface{}{"a": 1, "b": 2})
+	col.Insert(map[string]interface{}{"a": 2, "b": 2})
+	var q []interface{}
+	json.Unmarshal([]byte(`[{"eq": 1, "in": ["a"]}, {"eq": 1, "in": ["b"]}, {"eq": 1, "in": ["a"]}]`), &q)
+	counts := make(map[int]int)
+	if err = EvalUnionCount(q, col, &counts); err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 || counts[both] != 3 || counts[onlyA] != 2 {
+		t.Fatal(counts)
+	}
+	if err = EvalUnionCount([]interface{}{map[string]interface{}{"eq": 1, "in": []interface{}{"c"}}}, col, &counts); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+}
+func TestEvalMostMatched(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"color"})
+	col.Index([]string{"size"})
+	col.Index([]string{"brand"})
+	ids := make([]int, 5)
+	for i, doc := range []map[string]interface{}{
+		{"color": "red", "size": "M", "brand": "x"},
+		{"color": "red", "size": "L", "brand": "x"},
+		{"color": "red", "size": "M", "brand": "y"},
+		{"color": "blue", "size": "M", "brand": "y"},
+		{"color": "blue", "size": "S", "brand": "y"},
+	} {
+		ids[i], _ = col.Insert(doc)
+	}
+	var q []interface{}
+	json.Unmarshal([]byte(`[{"eq": "red", "in": ["color"]}, {"eq": "M", "in": ["size"]}, {"eq": "x", "in": ["brand"]}]`), &q)
+	ranked, err := EvalMostMatched(q, col, 0)
+	if err != nil || len(ranked) != 4 || ranked[0] != (ScoredDoc{ids[0], 3}) || ranked[3] != (ScoredDoc{ids[3], 1}) {
+		t.Fatal(ranked, err)
+	}
+	// Documents of equal count are ordered by ID
+	if ranked[1].Score != 2 || ranked[2].Score != 2 || ranked[1].ID > ranked[2].ID {
+		t.Fatal(ranked)
+	}
+	if limited, err := EvalMostMatched(q, col, 2); err != nil || len(limited) != 2 || limited[1] != ranked[1] {
+		t.Fatal(limited, err)
+	}
+	if _, err = EvalMostMatched([]interface{}{map[string]interface{}{"eq": 1, "in": []interface{}{"c"}}}, col, 0); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+func TestMinMatch(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	col.Index([]string{"b"})
+	col.Index([]string{"c"})
+	all3, _ := col.Insert(map[string]interface{}{"a": 1, "b": 1, "c": 1})
+	two, _ := col.Insert(map[string]interface{}{"a": 1, "b": 1, "c": 2})
+	one, _ := col.Insert(map[string]interface{}{"a": 1, "b": 2, "c": 2})
+	conditions := `[{"eq": 1, "in": ["a"]}, {"eq": 1, "in": ["b"]}, {"eq": 1, "in": ["c"]}]`
+	q, err := runQuery(`{"min-match": `+conditions+`, "k": 2}`, col)
+	if err != nil || !ensureMapHasKeys(q, all3, two) {
+		t.Fatal(q, err)
+	}
+	q, err = runQuery(`{"min-match": `+conditions+`, "k": 1}`, col)
+	if err != nil || !ensureMapHasKeys(q, all3, two, one) {
+		t.Fatal(q, err)
+	}
+	q, err = runQuery(`{"min-match": `+conditions+`, "k": 1, "limit": 2}`, col)
+	if err != nil || len(q) != 2 {
+		t.Fatal(q, err)
+	}
+	q, err = runQuery(`{"min-match": `+conditions+`, "k": 4}`, col)
+	if err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	}
+	if _, err = runQuery(`{"min-match": `+conditions+`}`, col); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	}
+	if _, err = runQuery(`{"min-match": `+conditions+`, "k": "a"}`, col); dberr.Type(err) != dberr.ErrorExpectingInt {
+		t.Fatal(err)
+	}
+	if _, err = runQuery(`{"min-match": `+conditions+`, "k": 0}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+	if _, err = runQuery(`{"min-match": 1, "k": 1}`, col); dberr.Type(err) != dberr.ErrorExpectingSubQuery {
+		t.Fatal(err)
+	}
+}
+
+func TestContainsAnywhere(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	nested, _ := col.Insert(map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{1, "john smith"}}})
+	top, _ := col.Insert(map[string]interface{}{"c": "john"})
+	number, _ := col.Insert(map[string]interface{}{"d": []interface{}{[]interface{}{2}}, "e": 1})
+	col.Insert(map[string]interface{}{"john": "jane"})
+	check := func(query string, expected ...int) {
+		result, err := runQuery(query, col)
+		if err != nil || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+	}
+	// Exact mode compares values the same way as lookup, substring mode looks into strings
+	check(`{"contains-anywhere": "john"}`, top)
+	check(`{"contains-anywhere": "john", "substring": true}`, nested, top)
+	check(`{"contains-anywhere": 1}`, nested, number)
+	check(`{"contains-anywhere": 2}`, number)
+	check(`{"contains-anywhere": "1"}`, nested, number)
+	check(`{"contains-anywhere": "jane smith"}`)
+	if result, err := runQuery(`{"contains-anywhere": 1, "limit": 1}`, col); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	for _, str := range []string{`{"contains-anywhere": 1, "substring": true}`, `{"contains-anywhere": "a", "substring": 1}`} {
+		if _, err = runQuery(str, col); err == nil {
+			t.Fatal("Did not error", str)
+		}
+	}
+}
+
+func TestWildcardLookup(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	top, _ := col.Insert(map[string]interface{}{"config": map[string]interface{}{"enabled": true}})
+	nested, _ := col.Insert(map[string]interface{}{"config": map[string]interface{}{"x": map[string]interface{}{"y": map[string]interface{}{"enabled": "True"}}}})
+	col.Insert(map[string]interface{}{"config": map[string]interface{}{"x": map[string]interface{}{"enabled": false}}})
+	col.Insert(map[string]interface{}{"enabled": true})
+	query := `{"eq": true, "in": ["config", "**", "enabled"]}`
+	if result, err := runQuery(query, col); err != nil || !ensureMapHasKeys(result, top) {
+		t.Fatal(result, err)
+	}
+	if result, err := runQuery(`{"eq": "true", "in": ["config", "**", "enabled"]}`, col); err != nil || !ensureMapHasKeys(result, top) {
+		t.Fatal(result, err)
+	}
+	if result, err := runQuery(`{"eq": true, "in": ["config", "**", "enabled"], "limit": 1}`, col); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	if matched, err := LookupMatched("true", map[string]interface{}{"in": []interface{}{"config", "**", "enabled"}}, col); err != nil ||
+		len(matched) != 1 || matched[top] != "true" {
+		t.Fatal(matched, err)
+	}
+	// Other operations still need an index
+	if _, err = runQuery(`{"has": ["config", "**", "enabled"]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	// Indexed wildcard path is looked up on the index
+	if err = col.Index([]string{"config", "**", "enabled"}); err != nil {
+		t.Fatal(err)
+	}
+	if result, stats, err := EvalQueryWithStats(map[string]interface{}{"eq": true, "in": []interface{}{"config", "**", "enabled"}}, col); err != nil ||
+		!ensureMapHasKeys(result, top) || stats.FullScans != 0 {
+		t.Fatal(result, stats, err)
+	}
+	if err = col.IndexCaseNormalized([]string{"config", "**", "enabled"}); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := runQuery(`{"eq-ci": "TRUE", "in": ["config", "**", "enabled"]}`, col); err != nil || !ensureMapHasKeys(result, top, nested) {
+		t.Fatal(result, err)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"email"}); err != nil {
+		t.Fatal(err)
+	}
+	a1, _ := col.Insert(map[string]interface{}{"email": "a@example.com"})
+	a2, _ := col.Insert(map[string]interface{}{"email": []interface{}{"a@example.com", "c@example.com"}})
+	col.Insert(map[string]interface{}{"email": "b@example.com"})
+	// The same value twice within one document is not a duplicate
+	col.Insert(map[string]interface{}{"email": []interface{}{"d@example.com", "d@example.com"}})
+	num1, _ := col.Insert(map[string]interface{}{"email": 7})
+	num2, _ := col.Insert(map[string]interface{}{"email": "7"})
+	col.Insert(map[string]interface{}{"other": "a@example.com"})
+	if result, err := runQuery(`{"duplicates": ["email"]}`, col); err != nil || !ensureMapHasKeys(result, a1, a2, num1, num2) {
+		t.Fatal(result, err)
+	}
+	if result, err := runQuery(`{"duplicates": ["email"], "limit": 3}`, col); err != nil || len(result) != 3 {
+		t.Fatal(result, err)
+	}
+	lowest := []int{a1, a2, num1, num2}
+	sort.Ints(lowest)
+	if result, err := runQuery(`{"duplicates": ["email"], "limit": 2, "ordered": true}`, col); err != nil ||
+		!ensureMapHasKeys(result, lowest[:2]...) {
+		t.Fatal(result, err)
+	}
+	// A duplicate is no longer one when the other document is gone
+	if err = col.Delete(num2); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := runQuery(`{"duplicates": ["email"]}`, col); err != nil || !ensureMapHasKeys(result, a1, a2) {
+		t.Fatal(result, err)
+	}
+	if _, err = runQuery(`{"duplicates": ["other"]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	if err = col.CreateView("dup", map[string]interface{}{"duplicates": []interface{}{"email"}}); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestRegexPath(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	alice, _ := col.Insert(map[string]interface{}{"name": "Alice", "other": "Bob"})
+	aaron, _ := col.Insert(map[string]interface{}{"name": []interface{}{"Bob", "Aaron"}})
+	nested, _ := col.Insert(map[string]interface{}{"name": map[string]interface{}{"first": "Ann"}})
+	number, _ := col.Insert(map[string]interface{}{"name": 12345})
+	col.Insert(map[string]interface{}{"other": "Anna"})
+	for query, expected := range map[string][]int{
+		`{"re-path": "^A", "in": ["name"]}`:             {alice, aaron},
+		`{"re-path": "^B", "in": ["name"]}`:             {aaron},
+		`{"re-path": "^B", "in": ["other"]}`:            {alice},
+		`{"re-path": "^An+$", "in": ["name", "first"]}`: {nested},
+		`{"re-path": "^\\d+$", "in": ["name"]}`:         {number},
+		`{"re-path": "", "in": ["name"]}`:               {alice, aaron, number},
+		`{"re-path": "^Z", "in": ["name"]}`:             {},
+	} {
+		result, err := runQuery(query, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+		// Views agree with the scan
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		col.ForEachDoc(func(id int, docB []byte) bool {
+			var doc map[string]interface{}
+			json.Unmarshal(docB, &doc)
+			_, inResult := result[id]
+			if match, err := matchDoc(q, id, doc); err != nil || match != inResult {
+				t.Fatal(query, id, match, err)
+			}
+			return true
+		})
+	}
+	if result, err := runQuery(`{"re-path": "", "in": ["name"], "limit": 2}`, col); err != nil || len(result) != 2 {
+		t.Fatal(result, err)
+	}
+	for _, query := range []string{`{"re-path": "(", "in": ["name"]}`, `{"re-path": 1, "in": ["name"]}`, `{"re-path": "a"}`} {
+		if _, err = runQuery(query, col); err == nil {
+			t.Fatal("Did not error", query)
+		}
+	}
+}
+
+func TestLike(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	abc, _ := col.Insert(map[string]interface{}{"name": "abcdef"})
+	multi, _ := col.Insert(map[string]interface{}{"name": []interface{}{"xyz", "ab\nc"}})
+	percent, _ := col.Insert(map[string]interface{}{"name": "100% a_b"})
+	dotted, _ := col.Insert(map[string]interface{}{"name": "a.c"})
+	number, _ := col.Insert(map[string]interface{}{"name": 12345})
+	col.Insert(map[string]interface{}{"other": "abc"})
+	for query, expected := range map[string][]int{
+		`{"like": "abc%", "in": ["name"]}`:   {abc},
+		`{"like": "%c", "in": ["name"]}`:     {multi, dotted},
+		`{"like": "%b%", "in": ["name"]}`:    {abc, multi, percent},
+		`{"like": "a_c", "in": ["name"]}`:    {dotted},
+		`{"like": "ab_c", "in": ["name"]}`:   {multi},
+		`{"like": "%\\%%", "in": ["name"]}`:  {percent},
+		`{"like": "%a\\_b", "in": ["name"]}`: {percent},
+		`{"like": "12_45", "in": ["name"]}`:  {number},
+		`{"like": "%", "in": ["name"]}`:      {abc, multi, percent, dotted, number},
+		`{"like": "ABC%", "in": ["name"]}`:   {},
+		`{"like": "abc", "in": ["name"]}`:    {},
+	} {
+		result, err := runQuery(query, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+		// Views agree with the scan
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		col.ForEachDoc(func(id int, docB []byte) bool {
+			var doc map[string]interface{}
+			json.Unmarshal(docB, &doc)
+			_, inResult := result[id]
+			if match, err := matchDoc(q, id, doc); err != nil || match != inResult {
+				t.Fatal(query, id, match, err)
+			}
+			return true
+		})
+	}
+	if result, err := runQuery(`{"like": "%", "in": ["name"], "limit": 2}`, col); err != nil || len(result) != 2 {
+		t.Fatal(result, err)
+	}
+	for _, query := range []string{`{"like": "a\\", "in": ["name"]}`, `{"like": 1, "in": ["name"]}`, `{"like": "a"}`} {
+		if _, err = runQuery(query, col); err == nil {
+			t.Fatal("Did not error", query)
+		}
+	}
+}
+
+func TestKeyRegex(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	top, _ := col.Insert(map[string]interface{}{"temp_1": 1, "name": "a"})
+	nested, _ := col.Insert(map[string]interface{}{"sensor": map[string]interface{}{"temp_c": 20}})
+	inArray, _ := col.Insert(map[string]interface{}{"readings": []interface{}{map[string]interface{}{"temp_f": 68}}})
+	value, _ := col.Insert(map[string]interface{}{"name": "temp_x"})
+	for query, expected := range map[string][]int{
+		`{"key-re": "^temp_"}`:                 {top},
+		`{"key-re": "^temp_", "nested": true}`: {top, nested, inArray},
+		`{"key-re": "^name$"}`:                 {top, value},
+		`{"key-re": "^TEMP"}`:                  {},
+	} {
+		result, err := runQuery(query, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+		// Views agree with the scan
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		col.ForEachDoc(func(id int, docB []byte) bool {
+			var doc map[string]interface{}
+			json.Unmarshal(docB, &doc)
+			_, inResult := result[id]
+			if match, err := matchDoc(q, id, doc); err != nil || match != inResult {
+				t.Fatal(query, id, match, err)
+			}
+			return true
+		})
+	}
+	if result, err := runQuery(`{"key-re": "", "limit": 2}`, col); err != nil || len(result) != 2 {
+		t.Fatal(result, err)
+	}
+	for _, query := range []string{`{"key-re": "("}`, `{"key-re": 1}`, `{"key-re": "a", "nested": 1}`} {
+		if _, err = runQuery(query, col); err == nil {
+			t.Fatal("Did not error", query)
+		}
+	}
+}
+
+func TestNotContains(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	both, _ := col.Insert(map[string]interface{}{"tags": []interface{}{"red", "blue"}})
+	blue, _ := col.Insert(map[string]interface{}{"tags": []interface{}{"blue"}})
+	number, _ := col.Insert(map[string]interface{}{"tags": []interface{}{"7"}})
+	empty, _ := col.Insert(map[string]interface{}{"tags": []interface{}{}})
+	missing, _ := col.Insert(map[string]interface{}{"other": "red"})
+	for query, expected := range map[string][]int{
+		`{"not-contains": "red", "in": ["tags"]}`:             {blue, number, empty, missing},
+		`{"not-contains": "blue", "in": ["tags"]}`:            {number, empty, missing},
+		`{"not-contains": ["red", "blue"], "in": ["tags"]}`:   {number, empty, missing},
+		`{"not-contains": 7, "in": ["tags"]}`:                 {both, blue, empty, missing},
+		`{"not-contains": "green", "in": ["tags"]}`:           {both, blue, number, empty, missing},
+		`{"not-contains": "red", "in": ["other"]}`:            {both, blue, number, empty},
+		`{"not-contains": "red", "in": ["tags"], "limit": 2}`: nil,
+	} {
+		result, err := runQuery(query, col)
+		if expected == nil {
+			if err != nil || len(result) != 2 {
+				t.Fatal(query, result, err)
+			}
+			continue
+		} else if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+		// Views agree with the scan
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		col.ForEachDoc(func(id int, docB []byte) bool {
+			var doc map[string]interface{}
+			json.Unmarshal(docB, &doc)
+			_, inResult := result[id]
+			if match, err := matchDoc(q, id, doc); err != nil || match != inResult {
+				t.Fatal(query, id, match, err)
+			}
+			return true
+		})
+	}
+	lowest := []int{blue, number, empty, missing}
+	sort.Ints(lowest)
+	if result, err := runQuery(`{"not-contains": "red", "in": ["tags"], "limit": 2, "ordered": true}`, col); err != nil ||
+		!ensureMapHasKeys(result, lowest[:2]...) {
+		t.Fatal(result, err)
+	}
+	if _, err = runQuery(`{"not-contains": "red"}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestFieldsEq(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	same, _ := col.Insert(map[string]interface{}{"created": 100, "updated": 100})
+	numStr, _ := col.Insert(map[string]interface{}{"created": 100, "updated": "100"})
+	nested, _ := col.Insert(map[string]interface{}{"created": 5, "meta": map[string]interface{}{"updated": 5}})
+	arrays, _ := col.Insert(map[string]interface{}{"created": []interface{}{1, 2}, "updated": []interface{}{1, 2}})
+	nulls, _ := col.Insert(map[string]interface{}{"created": nil, "updated": nil})
+	col.Insert(map[string]interface{}{"created": 100, "updated": 200})
+	col.Insert(map[string]interface{}{"created": []interface{}{1, 2}, "updated": []interface{}{2, 1}})
+	col.Insert(map[string]interface{}{"created": nil})
+	col.Insert(map[string]interface{}{})
+	for query, expected := range map[string][]int{
+		`{"fields-eq": ["created", "updated"]}`:             {same, numStr, arrays, nulls},
+		`{"fields-eq": [["created"], ["meta", "updated"]]}`: {nested},
+		`{"fields-eq": ["created", "meta.updated"]}`:        {nested},
+	} {
+		result, err := runQuery(query, col)
+		if err != nil || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+		// Views agree with the scan
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		col.ForEachDoc(func(id int, docB []byte) bool {
+			var doc map[string]interface{}
+			json.Unmarshal(docB, &doc)
+			_, inResult := result[id]
+			if match, err := matchDoc(q, id, doc); err != nil || match != inResult {
+				t.Fatal(query, id, match, err)
+			}
+			return true
+		})
+	}
+	if result, err := runQuery(`{"fields-eq": ["created", "updated"], "limit": 2}`, col); err != nil || len(result) != 2 {
+		t.Fatal(result, err)
+	}
+	for _, query := range []string{`{"fields-eq": ["created"]}`, `{"fields-eq": "created"}`, `{"fields-eq": ["created", 1]}`} {
+		if _, err = runQuery(query, col); err == nil {
+			t.Fatal("Did not error", query)
+		}
+	}
+}
+
+func TestJSONType(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	str, _ := col.Insert(map[string]interface{}{"a": "30"})
+	num, _ := col.Insert(map[string]interface{}{"a": 30})
+	boolean, _ := col.Insert(map[string]interface{}{"a": true})
+	null, _ := col.Insert(map[string]interface{}{"a": nil})
+	object, _ := col.Insert(map[string]interface{}{"a": map[string]interface{}{"b": 1}})
+	mixed, _ := col.Insert(map[string]interface{}{"a": []interface{}{1, "x"}})
+	nested, _ := col.Insert(map[string]interface{}{"n": []interface{}{map[string]interface{}{"a": "y"}, map[string]interface{}{"a": nil}}})
+	col.Insert(map[string]interface{}{"other": 1})
+	for query, expected := range map[string][]int{
+		`{"type": "string", "in": ["a"]}`:      {str, mixed},
+		`{"type": "number", "in": ["a"]}`:      {num, mixed},
+		`{"type": "bool", "in": ["a"]}`:        {boolean},
+		`{"type": "boolean", "in": ["a"]}`:     {boolean},
+		`{"type": "null", "in": ["a"]}`:        {null},
+		`{"type": "object", "in": ["a"]}`:      {object},
+		`{"type": "array", "in": ["a"]}`:       {mixed},
+		`{"type": "string", "in": ["n", "a"]}`: {nested},
+		`{"type": "null", "in": ["n", "a"]}`:   {nested},
+	} {
+		result, err := runQuery(query, col)
+		if err != nil || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+		// Views agree with the scan
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		col.ForEachDoc(func(id int, docB []byte) bool {
+			doc, _ := decodeDoc(docB)
+			_, inResult := result[id]
+			if match, err := matchDoc(q, id, doc); err != nil || match != inResult {
+				t.Fatal(query, id, match, err)
+			}
+			return true
+		})
+	}
+	if result, err := runQuery(`{"type": "number", "in": ["a"], "limit": 1}`, col); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	if _, err = runQuery(`{"type": "integer", "in": ["a"]}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+	if _, err = runQuery(`{"type": "string"}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestArrayLength(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	empty, _ := col.Insert(map[string]interface{}{"tags": []interface{}{}})
+	two, _ := col.Insert(map[string]interface{}{"tags": []interface{}{"a", "b"}})
+	four, _ := col.Insert(map[string]interface{}{"tags": []interface{}{"a", "b", "c", "d"}})
+	scalar, _ := col.Insert(map[string]interface{}{"tags": "a"})
+	null, _ := col.Insert(map[string]interface{}{"tags": nil})
+	missing, _ := col.Insert(map[string]interface{}{"other": 1})
+	nested, _ := col.Insert(map[string]interface{}{"n": []interface{}{map[string]interface{}{"tags": []interface{}{1, 2, 3}}, "x"}})
+	for query, expected := range map[string][]int{
+		`{"len": {"min": 4}, "in": ["tags"]}`:           {four},
+		`{"len": {"min": 1, "max": 2}, "in": ["tags"]}`: {two, scalar},
+		`{"len": {"eq": 0}, "in": ["tags"]}`:            {empty, null, missing, nested},
+		`{"len": {"max": 0}, "in": ["tags"]}`:           {empty, null, missing, nested},
+		`{"len": {"eq": 3}, "in": ["n", "tags"]}`:       {nested},
+		`{"len": {"eq": 0}, "in": ["n", "tags"]}`:       {empty, two, four, scalar, null, missing},
+	} {
+		result, err := runQuery(query, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+		// Views agree with the scan
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		col.ForEachDoc(func(id int, docB []byte) bool {
+			doc, _ := decodeDoc(docB)
+			_, inResult := result[id]
+			if match, err := matchDoc(q, id, doc); err != nil || match != inResult {
+				t.Fatal(query, id, match, err)
+			}
+			return true
+		})
+	}
+	if result, err := runQuery(`{"len": {"max": 2}, "in": ["tags"], "limit": 2}`, col); err != nil || len(result) != 2 {
+		t.Fatal(result, err)
+	}
+	for _, query := range []string{
+		`{"len": 4, "in": ["tags"]}`,
+		`{"len": {}, "in": ["tags"]}`,
+		`{"len": {"least": 4}, "in": ["tags"]}`,
+		`{"len": {"eq": 1, "max": 2}, "in": ["tags"]}`,
+		`{"len": {"min": "a"}, "in": ["tags"]}`,
+		`{"len": {"min": 1}, "in": ["tags", "**"]}`,
+		`{"len": {"min": 1}}`,
+	} {
+		if _, err = runQuery(query, col); err == nil {
+			t.Fatal(query, "did not error")
+		}
+	}
+}
+
+func TestStringLength(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	empty, _ := col.Insert(map[string]interface{}{"desc": ""})
+	short, _ := col.Insert(map[string]interface{}{"desc": "abc"})
+	accented, _ := col.Insert(map[string]interface{}{"desc": "crème"}) // 5 characters, 6 bytes
+	long, _ := col.Insert(map[string]interface{}{"desc": strings.Repeat("x", 501)})
+	number, _ := col.Insert(map[string]interface{}{"desc": 12345})
+	array, _ := col.Insert(map[string]interface{}{"desc": []interface{}{"ab", "abcdefgh"}})
+	col.Insert(map[string]interface{}{"other": "abcde"})
+	for query, expected := range map[string][]int{
+		`{"str-len": {"min": 501}, "in": ["desc"]}`:         {long},
+		`{"str-len": {"eq": 5}, "in": ["desc"]}`:            {accented},
+		`{"str-len": {"eq": 6}, "in": ["desc"]}`:            {},
+		`{"str-len": {"max": 0}, "in": ["desc"]}`:           {empty},
+		`{"str-len": {"min": 2, "max": 3}, "in": ["desc"]}`: {short, array},
+		`{"str-len": {"min": 8}, "in": ["desc"]}`:           {long, array},
+	} {
+		result, err := runQuery(query, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+		// Views agree with the scan
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		col.ForEachDoc(func(id int, docB []byte) bool {
+			doc, _ := decodeDoc(docB)
+			_, inResult := result[id]
+			if match, err := matchDoc(q, id, doc); err != nil || match != inResult {
+				t.Fatal(query, id, match, err)
+			}
+			return true
+		})
+	}
+	if result, err := runQuery(`{"str-len": {"min": 5}, "in": ["desc"]}`, col); err != nil || len(result) != 3 {
+		t.Fatal(result, err)
+	} else if _, found := result[number]; found {
+		t.Fatal(result)
+	}
+	if result, err := runQuery(`{"str-len": {"min": 0}, "in": ["desc"], "limit": 2}`, col); err != nil || len(result) != 2 {
+		t.Fatal(result, err)
+	}
+	for _, query := range []string{
+		`{"str-len": 4, "in": ["desc"]}`,
+		`{"str-len": {}, "in": ["desc"]}`,
+		`{"str-len": {"eq": 1, "min": 0}, "in": ["desc"]}`,
+		`{"str-len": {"min": 1}}`,
+	} {
+		if _, err = runQuery(query, col); err == nil {
+			t.Fatal(query, "did not error")
+		}
+	}
+}
+
+func TestIsNull(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	null, _ := col.Insert(map[string]interface{}{"a": nil})
+	col.Insert(map[string]interface{}{"a": 1})
+	col.Insert(map[string]interface{}{"b": nil})
+	nullElement, _ := col.Insert(map[string]interface{}{"a": []interface{}{1, nil}})
+	nested, _ := col.Insert(map[string]interface{}{"n": []interface{}{map[string]interface{}{"a": nil}, map[string]interface{}{"b": 1}}})
+	col.Insert(map[string]interface{}{"n": []interface{}{map[string]interface{}{"b": 1}}})
+	for query, expected := range map[string][]int{
+		`{"is-null": ["a"]}`:      {null, nullElement},
+		`{"is-null": ["n", "a"]}`: {nested},
+		`{"is-null": ["c"]}`:      {},
+	} {
+		result, err := runQuery(query, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+		// Views agree with the scan
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		col.ForEachDoc(func(id int, docB []byte) bool {
+			doc, _ := decodeDoc(docB)
+			_, inResult := result[id]
+			if match, err := matchDoc(q, id, doc); err != nil || match != inResult {
+				t.Fatal(query, id, match, err)
+			}
+			return true
+		})
+	}
+	// Documents missing the path are the rest
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if result, err := runQuery(`{"c": [{"has": ["a"]}, {"is-null": ["a"]}], "of": "all"}`, col); err != nil || len(result) != 3 || ensureMapHasKeys(result, null) {
+		t.Fatal(result, err)
+	}
+	if result, err := runQuery(`{"is-null": ["a"], "limit": 1}`, col); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	} else if _, err = runQuery(`{"is-null": 1}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestQueryLimit(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	for i := 0; i < 5; i++ {
+		col.Insert(map[string]interface{}{"a": 1})
+	}
+	// Limit of 0 or less means unlimited in every operator
+	for _, op := range []string{
+		`"eq": 1, "in": ["a"]`,
+		`"has": ["a"]`,
+		`"int-from": 0, "int-to": 2, "in": ["a"]`,
+		`"min-match": [{"has": ["a"]}], "k": 1`,
+		`"weighted": [{"q": {"has": ["a"]}, "w": 1}]`,
+		`"contains-anywhere": 1`,
+	} {
+		for limit, expected := range map[string]int{`0`: 5, `-1`: 5, `-100`: 5, `3`: 3, `5`: 5, `10`: 5} {
+			query := `{` + op + `, "limit": ` + limit + `}`
+			if result, err := runQuery(query, col); err != nil || len(result) != expected {
+				t.Fatal(query, len(result), err)
+			}
+		}
+		if _, err := runQuery(`{`+op+`, "limit": "a"}`, col); dberr.Type(err) != dberr.ErrorExpectingInt {
+			t.Fatal(op, err)
+		}
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	col.Index([]string{"b"})
+	both, _ := col.Insert(map[string]interface{}{"a": 1, "b": 1})
+	onlyA, _ := col.Insert(map[string]interface{}{"a": 1})
+	onlyB1, _ := col.Insert(map[string]interface{}{"b": 1})
+	onlyB2, _ := col.Insert(map[string]interface{}{"b": 1})
+	col.Insert(map[string]interface{}{"a": 2})
+	conditions := `[{"q": {"eq": 1, "in": ["a"]}, "w": 2}, {"q": {"eq": 1, "in": ["b"]}, "w": 0.5}]`
+	var q interface{}
+	json.Unmarshal([]byte(`{"weighted": `+conditions+`}`), &q)
+	ranked, err := EvalWeighted(q, col)
+	if err != nil || len(ranked) != 4 {
+		t.Fatal(ranked, err)
+	}
+	// Documents of equal score are ordered by ascending ID
+	tied := []int{onlyB1, onlyB2}
+	sort.Ints(tied)
+	expected := []ScoredDoc{{both, 2.5}, {onlyA, 2}, {tied[0], 0.5}, {tied[1], 0.5}}
+	if !reflect.DeepEqual(ranked, expected) {
+		t.Fatal(ranked)
+	}
+	json.Unmarshal([]byte(`{"weighted": `+conditions+`, "limit": 3}`), &q)
+	if ranked, err = EvalWeighted(q, col); err != nil || !reflect.DeepEqual(ranked, expected[:3]) {
+		t.Fatal(ranked, err)
+	}
+	// As a query, weighted returns the documents matching any sub-query
+	result, err := runQuery(`{"weighted": `+conditions+`}`, col)
+	if err != nil || !ensureMapHasKeys(result, both, onlyA, onlyB1, onlyB2) {
+		t.Fatal(result, err)
+	}
+	result, err = runQuery(`{"weighted": `+conditions+`, "limit": 2}`, col)
+	if err != nil || !ensureMapHasKeys(result, both, onlyA) {
+		t.Fatal(result, err)
+	}
+	if _, err = runQuery(`{"weighted": 1}`, col); dberr.Type(err) != dberr.ErrorExpectingSubQuery {
+		t.Fatal(err)
+	}
+	if _, err = runQuery(`{"weighted": [{"w": 1}]}`, col); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	}
+	for _, str := range []string{`{"weighted": [1]}`, `{"weighted": [{"q": "all", "w": "a"}]}`, `{"weighted": [{"q": "all"}]}`} {
+		if _, err = runQuery(str, col); err == nil {
+			t.Fatal("Did not error", str)
+		}
+	}
+	if _, err = EvalWeighted("all", col); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestQueryLog(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	col.Insert(map[string]interface{}{"a": 1})
+	col.Insert(map[string]interface{}{"a": 2})
+	var out bytes.Buffer
+	tdlog.StructuredOutput = &out
+	tdlog.StructuredLog = true
+	defer func() {
+		tdlog.StructuredLog = false
+		tdlog.StructuredOutput = os.Stderr
+	}()
+	if _, err = runQuery(`[{"eq": 1, "in": ["a"]}, {"has": ["a"]}, {"int-from": 1, "int-to": 3, "in": ["a"]}, "all"]`, col); err != nil {
+		t.Fatal(err)
+	}
+	// Union accumulates result, an operation only counts the documents it newly finds
+	expected := []struct {
+		op                  string
+		candidates, results float64
+	}{{"eq", 1, 1}, {"has", 2, 1}, {"int-range", 2, 0}, {"all", 2, 0}}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatal(lines)
+	}
+	for i, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["event"] != "query" || entry["op"] != expected[i].op || entry["candidates"] != expected[i].candidates ||
+			entry["results"] != expected[i].results || entry["duration_us"] == nil {
+			t.Fatal(entry)
+		}
+	}
+}
+
+func TestDiffQueries(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	one, _ := col.Insert(map[string]interface{}{"a": 1})
+	two, _ := col.Insert(map[string]interface{}{"a": 2})
+	three, _ := col.Insert(map[string]interface{}{"a": 3})
+	var q1, q2 interface{}
+	json.Unmarshal([]byte(`{"int-from": 1, "int-to": 2, "in": ["a"]}`), &q1)
+	json.Unmarshal([]byte(`{"int-from": 2, "int-to": 3, "in": ["a"]}`), &q2)
+	added, removed, err := DiffQueries(q1, q2, col)
+	if err != nil || !ensureMapHasKeys(added, three) || !ensureMapHasKeys(removed, one) {
+		t.Fatal(added, removed, err)
+	}
+	if added, removed, err = DiffQueries(q1, q1, col); err != nil || len(added) != 0 || len(removed) != 0 {
+		t.Fatal(added, removed, err)
+	}
+	if added, removed, err = DiffQueries("", q1, col); err != nil || !ensureMapHasKeys(added, one, two) || len(removed) != 0 {
+		t.Fatal(added, removed, err)
+	}
+	if _, _, err = DiffQueries(q1, map[string]interface{}{"eq": 1.0, "in": []interface{}{"b"}}, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+}
+
+func TestFirstMatch(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	one, _ := col.Insert(map[string]interface{}{"a": 1, "b": "x"})
+	two, _ := col.Insert(map[string]interface{}{"a": 2, "b": "x"})
+	three, _ := col.Insert(map[string]interface{}{"a": 2, "b": "y"})
+	for query, expected := range map[string][]int{
+		`"all"`:                              {one, two, three},
+		`{"eq": 2, "in": ["a"]}`:             {two, three},
+		`{"eq": 2, "in": ["a"], "limit": 5}`: {two, three},
+		`[{"eq": 9, "in": ["a"]}, {"eq": "y", "in": ["b"]}]`:                                 {three},
+		`{"n": [{"eq": 2, "in": ["a"]}, {"eq": "x", "in": ["b"]}]}`:                          {two},
+		`{"n": [{"eq": 2, "in": ["a"]}, {"c": [{"has": ["b"]}, {"eq": "y", "in": ["b"]}]}]}`: {two},
+		`{"n": [{"eq": 2, "in": ["a"]}, {"duplicates": ["b"]}]}`:                             {two},
+		`{"c": [{"has": ["a"]}, {"eq": 1, "in": ["a"]}]}`:                                    {two, three},
+		`{"int-from": 1, "int-to": 2, "in": ["a"]}`:                                          {one, two, three},
+	} {
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		id, found, err := FirstMatch(q, col)
+		if err != nil || !found {
+			t.Fatal(query, id, found, err)
+		}
+		matches := false
+		for _, expectedID := range expected {
+			matches = matches || id == expectedID
+		}
+		if !matches {
+			t.Fatal(query, id, expected)
+		}
+	}
+	for _, query := range []string{`{"eq": 9, "in": ["a"]}`, `[{"eq": 9, "in": ["a"]}, ""]`, `{"n": [{"eq": 1, "in": ["a"]}, {"eq": "y", "in": ["b"]}]}`} {
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		if id, found, err := FirstMatch(q, col); err != nil || found {
+			t.Fatal(query, id, found, err)
+		}
+	}
+	if _, _, err = FirstMatch(map[string]interface{}{"eq": 1, "in": []interface{}{"c"}}, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+}
+
+func TestEvalQueries(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	one, _ := col.Insert(map[string]interface{}{"a": 1})
+	two, _ := col.Insert(map[string]interface{}{"a": 2})
+	var queries []interface{}
+	json.Unmarshal([]byte(`[{"eq": 1, "in": ["a"]}, {"eq": 1, "in": ["b"]}, "all"]`), &queries)
+	results, err := EvalQueries(queries, col)
+	if len(results) != 3 || len(results[0]) != 1 || !ensureMapHasKeys(results[0], one) ||
+		results[1] != nil || len(results[2]) != 2 || !ensureMapHasKeys(results[2], one, two) {
+		t.Fatal(results)
+	}
+	errs, ok := err.(QueryErrors)
+	if !ok || len(errs) != 3 || errs[0] != nil || dberr.Type(errs[1]) != dberr.ErrorNeedIndex || errs[2] != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(err.Error(), "query 1: ") {
+		t.Fatal(err)
+	}
+	if results, err = EvalQueries(queries[:1], col); err != nil || len(results) != 1 {
+		t.Fatal(results, err)
+	}
+}
+func TestQueryMulti(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, name := range []string{"users", "posts", "tags"} {
+		if err = db.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Use("users").Index([]string{"name"})
+	db.Use("posts").Index([]string{"name"})
+	user, _ := db.Use("users").Insert(map[string]interface{}{"name": "go"})
+	post, _ := db.Use("posts").Insert(map[string]interface{}{"name": "go"})
+	db.Use("posts").Insert(map[string]interface{}{"name": "rust"})
+	var q interface{}
+	json.Unmarshal([]byte(`{"eq": "go", "in": ["name"]}`), &q)
+	results, err := db.QueryMulti([]string{"users", "posts", "tags", "missing"}, q)
+	if len(results) != 2 || len(results["users"]) != 1 || !ensureMapHasKeys(results["users"], user) ||
+		len(results["posts"]) != 1 || !ensureMapHasKeys(results["posts"], post) {
+		t.Fatal(results)
+	}
+	errs, ok := err.(ColErrors)
+	if !ok || len(errs) != 2 || dberr.Type(errs["tags"]) != dberr.ErrorNeedIndex || errs["missing"] == nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(err.Error(), "collection missing: ") {
+		t.Fatal(err)
+	}
+	if results, err = db.QueryMulti([]string{"users", "posts"}, q); err != nil || len(results) != 2 {
+		t.Fatal(results, err)
+	}
+}
+
+func TestOrderedLimit(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	ids := make([]int, 0, 50)
+	for i := 0; i < 50; i++ {
+		id, _ := col.Insert(map[string]interface{}{"a": i % 5})
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, str := range []string{
+		`{"has": ["a"], "limit": 10, "ordered": true}`,
+		`{"int-from": 0, "int-to": 4, "in": ["a"], "limit": 10, "ordered": true}`,
+		`{"int-from": 4, "int-to": 0, "in": ["a"], "limit": 10, "ordered": true}`,
+	} {
+		result, err := runQuery(str, col)
+		if err != nil || len(result) != 10 || !ensureMapHasKeys(result, ids[:10]...) {
+			t.Fatal(str, result)
+		}
+	}
+	// Ordering has no effect without limit
+	if result, err := runQuery(`{"has": ["a"], "ordered": true}`, col); err != nil || len(result) != 50 {
+		t.Fatal(result)
+	}
+	if _, err = runQuery(`{"has": ["a"], "limit": 1, "ordered": "yes"}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+func TestLookupArray(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"status"})
+	active, _ := col.Insert(map[string]interface{}{"status": "active"})
+	trial, _ := col.Insert(map[string]interface{}{"status": "trial"})
+	both, _ := col.Insert(map[string]interface{}{"status": []interface{}{"active", "trial"}})
+	col.Insert(map[string]interface{}{"status": "closed"})
+	if result, err := runQuery(`{"eq": ["active", "trial", "nothing"], "in": ["status"]}`, col); err != nil ||
+		len(result) != 3 || !ensureMapHasKeys(result, active, trial, both) {
+		t.Fatal(result, err)
+	}
+	if result, err := runQuery(`{"eq": ["active", "trial"], "in": ["status"], "limit": 2}`, col); err != nil || len(result) != 2 {
+		t.Fatal(result, err)
+	}
+	if result, err := runQuery(`{"eq": [], "in": ["status"]}`, col); err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+}
+func TestQueryDuringSchemaChange(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	for i := 0; i < 200; i++ {
+		col.Insert(map[string]interface{}{"a": map[string]interface{}{"b": i % 20}})
+	}
+	done := make(chan struct{})
+	queryErrs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			col := db.Use("col")
+			for {
+				select {
+				case <-done:
+					queryErrs <- nil
+					return
+				default:
+				}
+				for _, q := range []string{
+					`{"eq": 1, "in": ["a", "b"]}`,
+					`{"has": ["a", "b"]}`,
+					`{"int-from": 2, "int-to": 5, "in": ["a", "b"]}`,
+				} {
+					_, err := runQuery(q, col)
+					switch dberr.Type(err) {
+					case dberr.ErrorNil, dberr.ErrorNeedIndex:
+					case dberr.ErrorColClosed:
+						// Scrubbed collection is replaced by a new one
+						col = db.Use("col")
+					default:
+						queryErrs <- err
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err = db.Use("col").Index([]string{"a", "b"}); err != nil {
+			t.Fatal(err)
+		}
+		if i%5 == 0 {
+			if err = db.Scrub("col"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = db.Use("col").Unindex([]string{"a", "b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	for i := 0; i < 4; i++ {
+		if err := <-queryErrs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Multi-segment path is found by integer range lookup
+	db.Use("col").Index([]string{"a", "b"})
+	if result, err := runQuery(`{"int-from": 2, "int-to": 5, "in": ["a", "b"]}`, db.Use("col")); err != nil || len(result) != 40 {
+		t.Fatal(result, err)
+	}
+}
+func TestIntRangeExclusive(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	ids := make([]int, 6)
+	for i := range ids {
+		ids[i], _ = col.Insert(map[string]interface{}{"a": i})
+	}
+	cases := map[string][]int{
+		`{"int-from": 1, "int-to": 4, "in": ["a"]}`:                                                 ids[1:5],
+		`{"int-from": 1, "int-to": 4, "in": ["a"], "from-exclusive": true}`:                         ids[2:5],
+		`{"int-from": 1, "int-to": 4, "in": ["a"], "to-exclusive": true}`:                           ids[1:4],
+		`{"int-from": 1, "int-to": 4, "in": ["a"], "from-exclusive": true, "to-exclusive": true}`:   ids[2:4],
+		`{"int-from": 4, "int-to": 1, "in": ["a"], "from-exclusive": true, "to-exclusive": true}`:   ids[2:4],
+		`{"int from": 4, "int to": 1, "in": ["a"], "from-exclusive": true}`:                         ids[1:4],
+		`{"int-from": 2, "int-to": 3, "in": ["a"], "from-exclusive": true, "to-exclusive": true}`:   {},
+		`{"int-from": 3, "int-to": 3, "in": ["a"], "from-exclusive": true}`:                         {},
+		`{"int-from": 3, "int-to": 3, "in": ["a"], "from-exclusive": false, "to-exclusive": false}`: ids[3:4],
+	}
+	for str, expected := range cases {
+		result, err := runQuery(str, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(str, result, err)
+		}
+		// Views agree with index lookup
+		var q interface{}
+		json.Unmarshal([]byte(str), &q)
+		for i, id := range ids {
+			doc := map[string]interface{}{"a": float64(i)}
+			_, inResult := result[id]
+			if match, err := matchDoc(q, id, doc); err != nil || match != inResult {
+				t.Fatal(str, i, match, err)
+			}
+		}
+	}
+	if _, err = runQuery(`{"int-from": 1, "int-to": 4, "in": ["a"], "to-exclusive": 1}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+func TestNumericStringRange(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	col.Index([]string{"b"})
+	if err = col.IndexSorted([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	// Numbers stored as strings are indexed as the numbers they represent
+	vals := []interface{}{25, "25", " 25.0", "+25", "2.5e1", 26, "26", "25 apples", "0x19", "Inf"}
+	ids := make([]int, len(vals))
+	for i, val := range vals {
+		ids[i], _ = col.Insert(map[string]interface{}{"a": val, "b": val})
+	}
+	for _, path := range []string{"a", "b"} {
+		for query, expected := range map[string][]int{
+			`{"int-from": 25, "int-to": 25, "in": ["` + path + `"]}`: ids[:5],
+			`{"int-from": 20, "int-to": 30, "in": ["` + path + `"]}`: ids[:7],
+			`{"eq": 25, "in": ["` + path + `"]}`:                     ids[:5],
+			`{"eq": "2.5e1", "in": ["` + path + `"]}`:                ids[4:5],
+		} {
+			result, err := runQuery(query, col)
+			if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+				t.Fatal(query, result, err)
+			}
+			// Views agree with index lookup
+			var q interface{}
+			json.Unmarshal([]byte(query), &q)
+			for i, id := range ids {
+				_, inResult := result[id]
+				if match, err := matchDoc(q, id, map[string]interface{}{path: vals[i]}); err != nil || match != inResult {
+					t.Fatal(query, vals[i], match, err)
+				}
+			}
+		}
+	}
+	// Index entries of a numeric string go away with the document
+	if err = col.Update(ids[1], map[string]interface{}{"a": "30", "b": "30"}); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := runQuery(`{"int-from": 25, "int-to": 25, "in": ["a"]}`, col); err != nil || len(result) != 4 {
+		t.Fatal(result, err)
+	}
+	if report, err := col.VerifyIndexes(); err != nil || len(report.Missing) != 0 || len(report.Orphaned) != 0 {
+		t.Fatal(report, err)
+	}
+}
+
+func TestEvalQuerySortedBy(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	// Order by number of characters, longest first
+	byLength := func(a, b interface{}) bool {
+		return len(fmt.Sprint(a)) > len(fmt.Sprint(b))
+	}
+	short, _ := col.Insert(map[string]interface{}{"v": "a"})
+	long, _ := col.Insert(map[string]interface{}{"v": "abc"})
+	middle1, _ := col.Insert(map[string]interface{}{"v": []interface{}{"ab", "abcd"}})
+	middle2, _ := col.Insert(map[string]interface{}{"v": "xy"})
+	none, _ := col.Insert(map[string]interface{}{"w": "abcdef"})
+	middle := []int{middle1, middle2}
+	sort.Ints(middle)
+	ids, err := EvalQuerySortedBy("all", col, []string{"v"}, byLength, 0)
+	if err != nil || !reflect.DeepEqual(ids, []int{long, middle[0], middle[1], short, none}) {
+		t.Fatal(ids, err)
+	}
+	if ids, err = EvalQuerySortedBy("all", col, []string{"v"}, byLength, 2); err != nil || !reflect.DeepEqual(ids, []int{long, middle[0]}) {
+		t.Fatal(ids, err)
+	}
+	if _, err = EvalQuerySortedBy(map[string]interface{}{"eq": 1, "in": []interface{}{"v"}}, col, []string{"v"}, byLength, 0); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+}
+
+func TestEvalQueryPage(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	// Numbers come before strings, documents without value come last
+	var expected []int
+	for _, v := range []interface{}{-1, 2, 2, 10, "10", "9", nil, nil} {
+		id, _ := col.Insert(map[string]interface{}{"v": v})
+		expected = append(expected, id)
+	}
+	for _, pair := range [][2]int{{1, 2}, {6, 7}} {
+		if expected[pair[0]] > expected[pair[1]] {
+			expected[pair[0]], expected[pair[1]] = expected[pair[1]], expected[pair[0]]
+		}
+	}
+	// Page through all documents three at a time
+	paged := make([]int, 0)
+	var afterValue interface{}
+	afterID := -1
+	for {
+		ids, err := EvalQueryPage("all", col, []string{"v"}, afterValue, afterID, 3)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(ids) == 0 {
+			break
+		}
+		paged = append(paged, ids...)
+		afterID = ids[len(ids)-1]
+		doc, _ := col.Read(afterID)
+		afterValue = doc["v"]
+	}
+	if !reflect.DeepEqual(paged, expected) {
+		t.Fatal(paged, expected)
+	}
+	// Resume from a position that is not a document
+	if ids, err := EvalQueryPage("all", col, []string{"v"}, 2, -1, 0); err != nil || len(ids) != len(expected) {
+		t.Fatal(ids, err)
+	}
+	if ids, err := EvalQueryPage("all", col, []string{"v"}, 5, 0, 2); err != nil || !reflect.DeepEqual(ids, expected[3:5]) {
+		t.Fatal(ids, err)
+	}
+	if _, err = EvalQueryPage(map[string]interface{}{"eq": 1}, col, []string{"v"}, nil, -1, 0); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestEvalQueryPaged(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	var expected []int
+	for _, v := range []interface{}{-1, 2, 10, "10", "9", nil} {
+		id, _ := col.Insert(map[string]interface{}{"v": v})
+		expected = append(expected, id)
+	}
+	for _, page := range []struct {
+		offset, limit int
+		expected      []int
+	}{
+		{0, 4, expected[:4]}, {4, 4, expected[4:]}, {2, 2, expected[2:4]}, {6, 2, []int{}}, {10, 2, []int{}}, {0, 0, []int{}},
+	} {
+		ids, total, err := EvalQueryPaged("all", col, []string{"v"}, page.offset, page.limit)
+		if err != nil || total != len(expected) || !reflect.DeepEqual(ids, page.expected) {
+			t.Fatal(page, ids, total, err)
+		}
+	}
+	if _, _, err = EvalQueryPaged("all", col, []string{"v"}, -1, 1); err == nil {
+		t.Fatal("Did not error")
+	} else if _, _, err = EvalQueryPaged(map[string]interface{}{"eq": 1}, col, []string{"v"}, 0, 1); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestNaturalLess(t *testing.T) {
+	ordered := []interface{}{-1.5, 1, json.Number("3"), 10.0, "10", "9", "a", true}
+	for i := range ordered {
+		for j := range ordered {
+			if NaturalLess(ordered[i], ordered[j]) != (i < j) {
+				t.Fatal(ordered[i], ordered[j])
+			}
+		}
+	}
+}
+
+func TestMaxResultSize(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	for i := 0; i < 5; i++ {
+		col.Insert(map[string]interface{}{"a": i, "b": "x"})
+	}
+	db.Config.MaxResultSize = 3
+	for query, tooLarge := range map[string]bool{
+		`"all"`:                                                               true,
+		`{"eq": [0, 1, 2, 3], "in": ["a"]}`:                                   true,
+		`{"eq": [0, 1, 2], "in": ["a"]}`:                                      false,
+		`{"eq": [0, 1, 2, 3], "in": ["a"], "limit": 3}`:                       false,
+		`{"has": ["a"]}`:                                                      true,
+		`{"has": ["a"], "limit": 3, "ordered": true}`:                         true, // All candidates are collected before sorting
+		`{"n": [{"has": ["a"]}, {"eq": 1, "in": ["a"]}]}`:                     true, // Sub-query result is held in memory too
+		`{"int-from": 0, "int-to": 4, "in": ["a"]}`:                           true,
+		`{"int-from": 0, "int-to": 2, "in": ["a"]}`:                           false,
+		`{"contains-anywhere": 1}`:                                            false,
+		`{"contains-anywhere": "x"}`:                                          true,
+		`{"fields-eq": ["b", "b"]}`:                                           true,
+		`{"key-re": "^b$"}`:                                                   true,
+		`{"not-contains": "y", "in": ["b"]}`:                                  true,
+		`{"re-path": "x", "in": ["b"]}`:                                       true,
+		`{"like": "x", "in": ["b"]}`:                                          true,
+		`[{"int-from": 0, "int-to": 2, "in": ["a"]}, "1"]`:                    true, // Document ID goes to result without reading the document
+		`[{"int-from": 0, "int-to": 2, "in": ["a"]}, {"eq": 3, "in": ["a"]}]`: true,
+		`{"c": [{"int-from": 0, "int-to": 1, "in": ["a"]}, {"int-from": 2, "int-to": 3, "in": ["a"]}]}`: true,
+		`{"min-match": [{"int-from": 0, "int-to": 2, "in": ["a"]}], "k": 1}`:                            false,
+	} {
+		result, err := runQuery(query, col)
+		if tooLarge && dberr.Type(err) != dberr.ErrorResultTooLarge || !tooLarge && (err != nil || len(result) > 3) {
+			t.Fatal(query, result, err)
+		}
+	}
+	// Unlimited by default
+	db.Config.MaxResultSize = 0
+	if result, err := runQuery(`"all"`, col); err != nil || len(result) != 5 {
+		t.Fatal(result, err)
+	}
+}
+
+func TestEmptyQuery(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	id, _ := col.Insert(map[string]interface{}{"a": 1})
+	// Empty query matches no document in a query and in a view alike
+	for _, query := range []string{`null`, `{}`, `""`, `[]`, `[null, {}]`, `{"n": [null, "all"]}`} {
+		if result, err := runQuery(query, col); err != nil || len(result) != 0 {
+			t.Fatal(query, result, err)
+		}
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		if match, err := matchDoc(q, id, map[string]interface{}{"a": 1}); err != nil || match {
+			t.Fatal(query, match, err)
+		}
+	}
+	// Malformed query is an error
+	for query, errMsg := range map[string]string{
+		`"abc"`:          "Expecting `Single Document ID` as an integer, but abc given.",
+		`{"a": 1}`:       "Query map[a:1] does not contain any operation (lookup/union/etc)",
+		`["all", "abc"]`: "Expecting `Single Document ID` as an integer, but abc given.",
+		`1`:              "Query 1 is neither an object, array nor string",
+		`1.5`:            "Query 1.5 is neither an object, array nor string",
+		`true`:           "Query true is neither an object, array nor string",
+		`["all", false]`: "Query false is neither an object, array nor string",
+	} {
+		if _, err := runQuery(query, col); err == nil || err.Error() != errMsg {
+			t.Fatal(query, err)
+		}
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		if _, err := matchDoc(q, id, map[string]interface{}{"a": 1}); err == nil {
+			t.Fatal(query, "Did not error")
+		}
+	}
+}
+
+func TestEvalQueryWithStats(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	ids := make([]int, 10)
+	for i := range ids {
+		ids[i], _ = col.Insert(map[string]interface{}{"a": i})
+	}
+	for query, expected := range map[string]QueryStats{
+		`{"eq": 1, "in": ["a"]}`:                        {DocsExamined: 1, IndexLookups: 1},
+		`{"eq": 1, "in": ["a"], "consistency": "fast"}`: {IndexLookups: 1},
+		`{"eq": [1, 2], "in": ["a"]}`:                   {DocsExamined: 2, IndexLookups: 2},
+		`{"has": ["a"]}`:                                {IndexLookups: 1},
+		`{"int-from": 0, "int-to": 2, "in": ["a"]}`:     {IndexLookups: 3},
+		`"all"`:                    {DocsExamined: 10, FullScans: 1},
+		`{"contains-anywhere": 1}`: {DocsExamined: 10, FullScans: 1},
+		`[{"eq": 1, "in": ["a"]}, {"contains-anywhere": 1}]`:                      {DocsExamined: 11, IndexLookups: 1, FullScans: 1},
+		`{"n": [{"eq": 1, "in": ["a"]}, {"eq": 2, "in": ["a"]}, {"has": ["a"]}]}`: {DocsExamined: 2, IndexLookups: 2},
+		`{"contains-anywhere": 1, "max-examined": 4}`:                             {DocsExamined: 4, FullScans: 1, ScanBudgetHit: true},
+		`{"contains-anywhere": 1, "max-examined": 10}`:                            {DocsExamined: 10, FullScans: 1},
+	} {
+		var q interface{}
+		if err := json.Unmarshal([]byte(query), &q); err != nil {
+			t.Fatal(err)
+		}
+		result, stats, err := EvalQueryWithStats(q, col)
+		if err != nil {
+			t.Fatal(query, err)
+		} else if expected.Duration = stats.Duration; stats != expected || stats.Duration <= 0 {
+			t.Fatal(query, stats)
+		} else if plain, err := runQuery(query, col); err != nil || !reflect.DeepEqual(result, plain) {
+			t.Fatal(query, result, plain, err)
+		}
+	}
+	// Statistics are not collected by other queries on the collection
+	if col.stats != nil {
+		t.Fatal(col.stats)
+	}
+	if _, _, err = EvalQueryWithStats(map[string]interface{}{"eq": 1.0, "in": []interface{}{"b"}}, col); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestMaxExamined(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 10)
+	for i := range ids {
+		ids[i], _ = col.Insert(map[string]interface{}{"a": i, "b": nil})
+	}
+	sort.Ints(ids)
+	// Every scan operation stops at the budget, an ordered scan examines the lowest document IDs
+	for _, query := range []string{
+		`{"contains-anywhere": "x", "max-examined": 3, "ordered": true}`,
+		`{"not-contains": "x", "in": ["a"], "max-examined": 3, "ordered": true}`,
+		`{"re-path": ".", "in": ["a"], "max-examined": 3, "ordered": true}`,
+		`{"type": "number", "in": ["a"], "max-examined": 3, "ordered": true}`,
+		`{"len": {"eq": 1}, "in": ["a"], "max-examined": 3, "ordered": true}`,
+		`{"is-null": ["b"], "max-examined": 3, "ordered": true}`,
+		`{"eq": 1, "in": ["**", "a"], "max-examined": 3, "ordered": true}`,
+	} {
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		result, stats, err := EvalQueryWithStats(q, col)
+		if err != nil || !stats.ScanBudgetHit || stats.DocsExamined != 3 {
+			t.Fatal(query, stats, err)
+		}
+		for id := range result {
+			if id > ids[2] {
+				t.Fatal(query, result, ids)
+			}
+		}
+	}
+	if result, err := runQuery(`{"not-contains": "x", "in": ["a"], "max-examined": 3, "ordered": true}`, col); err != nil || !ensureMapHasKeys(result, ids[:3]...) {
+		t.Fatal(result, err)
+	}
+	for _, query := range []string{`{"contains-anywhere": 1, "max-examined": 0}`, `{"contains-anywhere": 1, "max-examined": "x"}`} {
+		if _, err = runQuery(query, col); err == nil {
+			t.Fatal("Did not error", query)
+		}
+	}
+}
+
+func TestEvalQueryInto(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("src"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("dest"); err != nil {
+		t.Fatal(err)
+	}
+	src, dest := db.Use("src"), db.Use("dest")
+	src.Index([]string{"a"})
+	dest.Index([]string{"b"})
+	for i := 0; i < 10; i++ {
+		src.Insert(map[string]interface{}{"a": i, "b": i * 10})
+	}
+	var q interface{}
+	if err := json.Unmarshal([]byte(`{"int-from": 2, "int-to": 4, "in": ["a"]}`), &q); err != nil {
+		t.Fatal(err)
+	}
+	if copied, err := EvalQueryInto(q, src, dest); err != nil || copied != 3 {
+		t.Fatal(copied, err)
+	}
+	// Copies are indexed in destination, source is unchanged
+	if result, err := runQuery(`{"int-from": 0, "int-to": 100, "in": ["b"]}`, dest); err != nil || len(result) != 3 {
+		t.Fatal(result, err)
+	}
+	if id, doc, found, err := dest.GetByIndexedKey([]string{"b"}, 30); err != nil || !found || doc["a"].(float64) != 3 {
+		t.Fatal(id, doc, found, err)
+	}
+	if result, err := runQuery(`"all"`, src); err != nil || len(result) != 10 {
+		t.Fatal(result, err)
+	}
+	if _, err := EvalQueryInto(q, src, src); err == nil {
+		t.Fatal("Did not error")
+	}
+	if _, err := EvalQueryInto(map[string]interface{}{"eq": 1.0, "in": []interface{}{"c"}}, src, dest); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestEvalQueryFilter(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	ids := make([]int, 10)
+	for i := 0; i < 10; i++ {
+		ids[i], _ = col.Insert(map[string]interface{}{"a": i})
+	}
+	var q interface{}
+	json.Unmarshal([]byte(`{"int-from": 2, "int-to": 6, "in": ["a"]}`), &q)
+	// The predicate sees each candidate once in the order of IDs, it may use the collection, and a candidate deleted
+	// meanwhile is skipped
+	last := ids[2]
+	for _, id := range ids[3:7] {
+		if id > last {
+			last = id
+		}
+	}
+	var seen []int
+	result, err := EvalQueryFilter(q, col, func(doc map[string]interface{}) bool {
+		a, _ := queryInt("a", doc["a"])
+		if len(seen) == 0 {
+			col.Delete(last)
+		}
+		seen = append(seen, ids[a])
+		return a%2 == 0
+	})
+	if err != nil || len(seen) != 4 || !sort.IntsAreSorted(seen) {
+		t.Fatal(seen, err)
+	}
+	expected := make(map[int]struct{})
+	for _, a := range []int{2, 4, 6} {
+		if ids[a] != last {
+			expected[ids[a]] = struct{}{}
+		}
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatal(result, expected)
+	}
+	if _, err = EvalQueryFilter(map[string]interface{}{"eq": 1.0, "in": []interface{}{"c"}}, col,
+		func(map[string]interface{}) bool { return true }); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestEvalQueryOnDocs(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	col.Index([]string{"b", "c"})
+	docs := make(map[int]map[string]interface{})
+	for i := 0; i < 20; i++ {
+		doc := map[string]interface{}{"a": i, "b": map[string]interface{}{"c": []interface{}{i % 3, "x"}}}
+		if i%4 == 0 {
+			delete(doc, "b")
+		}
+		id, err := col.Insert(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs[id] = doc
+	}
+	// In-memory evaluation gives the same result as evaluation on the collection
+	for _, query := range []string{
+		`"all"`,
+		`{"eq": 2, "in": ["b", "c"]}`,
+		`{"eq": "x", "in": ["b", "c"]}`,
+		`{"int-from": 3, "int-to": 9, "in": ["a"]}`,
+		`{"int-set": [1, 5, 30], "in": ["a"]}`,
+		`{"has": ["b", "c"]}`,
+		`{"n": [{"eq": 1, "in": ["b", "c"]}, {"int-from": 0, "int-to": 10, "in": ["a"]}]}`,
+		`{"c": [{"eq": 1, "in": ["b", "c"]}], "of": "all"}`,
+		`[{"eq": 1, "in": ["a"]}, {"eq": 0, "in": ["b", "c"]}]`,
+	} {
+		var q interface{}
+		if err = json.Unmarshal([]byte(query), &q); err != nil {
+			t.Fatal(err)
+		}
+		expected := make(map[int]struct{})
+		if err = EvalQuery(q, col, &expected); err != nil {
+			t.Fatal(query, err)
+		}
+		if result, err := EvalQueryOnDocs(q, docs); err != nil || !reflect.DeepEqual(result, expected) {
+			t.Fatal(query, result, expected, err)
+		}
+	}
+	if result, err := EvalQueryOnDocs("all", nil); err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+	// Operations that depend on a collection cannot be evaluated
+	for _, q := range []interface{}{
+		map[string]interface{}{"eq": 1, "in": []interface{}{"a"}, "limit": 1},
+		map[string]interface{}{"duplicates": []interface{}{"a"}},
+		map[string]interface{}{"unknown": 1},
+	} {
+		if _, err = EvalQueryOnDocs(q, docs); err == nil {
+			t.Fatal("Did not error", q)
+		}
+	}
+}
+
+func TestCorruptIndexPartition(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	col.Index([]string{"b"})
+	for i := 0; i < 10; i++ {
+		col.Insert(map[string]interface{}{"a": i, "b": i})
+	}
+	// Fill the bucket of value 1 so that lookup follows its chain, then break the chain
+	key := StrHash(indexString(1))
+	ht := col.hts[key%db.numParts]["a"]
+	for i := 0; i <= ht.PerBucket; i++ {
+		ht.Put(key, -i-1)
+	}
+	bucketAddr := ht.HashKey(key) * ht.BucketSize
+	binary.PutVarint(ht.Buf[bucketAddr:bucketAddr+10], -1)
+	for _, query := range []string{
+		`{"eq": 1, "in": ["a"]}`,
+		`{"has": ["a"]}`,
+		`{"int-from": 0, "int-to": 2, "in": ["a"]}`,
+		`{"int-set": [1], "in": ["a"]}`,
+	} {
+		var q interface{}
+		json.Unmarshal([]byte(query), &q)
+		if err = EvalQuery(q, col, &map[int]struct{}{}); dberr.Type(err) != dberr.ErrorIndexCorrupt {
+			t.Fatal(query, err)
+		}
+	}
+	if _, err = col.IndexEntriesFor([]string{"a"}, 1); dberr.Type(err) != dberr.ErrorIndexCorrupt {
+		t.Fatal(err)
+	}
+	// Rebuilding indexes repairs the partition
+	if err = col.RebuildIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	// A missing partition fails the query as well
+	missing := col.hts[0]["b"]
+	delete(col.hts[0], "b")
+	defer func() { col.hts[0]["b"] = missing }()
+	if err = EvalQuery(map[string]interface{}{"has": []interface{}{"b"}}, col, &result); dberr.Type(err) != dberr.ErrorIndexCorrupt {
+		t.Fatal(err)
+	}
+}
+
+func TestLookupMatched(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"tags", "name"})
+	red, _ := col.Insert(map[string]interface{}{"tags": []interface{}{map[string]interface{}{"name": "red"}, map[string]interface{}{"name": "blue"}}})
+	green, _ := col.Insert(map[string]interface{}{"tags": []interface{}{map[string]interface{}{"name": "green"}, map[string]interface{}{"name": 7}}})
+	col.Insert(map[string]interface{}{"tags": []interface{}{map[string]interface{}{"name": "pink"}}})
+	// Each document comes with the one of its values that matched
+	matched, err := LookupMatched([]interface{}{"red", "green"}, map[string]interface{}{"in": []interface{}{"tags", "name"}}, col)
+	if err != nil || !reflect.DeepEqual(matched, map[int]string{red: "red", green: "green"}) {
+		t.Fatal(matched, err)
+	}
+	// A number stored as string matches the lookup number, and the stored value is returned
+	col.Update(red, map[string]interface{}{"tags": []interface{}{map[string]interface{}{"name": "07.0"}}})
+	matched, err = LookupMatched(7, map[string]interface{}{"in": []interface{}{"tags", "name"}}, col)
+	if err != nil || !reflect.DeepEqual(matched, map[int]string{red: "07.0", green: "7"}) {
+		t.Fatal(matched, err)
+	}
+	// Limit applies across lookup values
+	matched, err = LookupMatched([]interface{}{"pink", 7}, map[string]interface{}{"in": []interface{}{"tags", "name"}, "limit": 2}, col)
+	if err != nil || len(matched) != 2 {
+		t.Fatal(matched, err)
+	}
+	if _, err = LookupMatched("red", map[string]interface{}{"in": []interface{}{"tags"}}, col); err == nil {
+		t.Fatal("Did not error")
+	}
+}
@@ -0,0 +1,372 @@
+// String query parser - a front-end that turns compact query text into query structure consumed by EvalQuery.
+//
+// For example, `age >= 18 AND age <= 60 AND (status == "active" OR status == "trial")` becomes:
+// {"n": [{"int-from": 18, "int-to": 60, "in": ["age"]}, [{"eq": "active", "in": ["status"]}, {"eq": "trial", "in": ["status"]}]]}
+//
+// Grammar (keywords are case insensitive):
+//   expr       := and ("OR" and)*
+//   and        := unary ("AND" unary)*
+//   unary      := "(" expr ")" | "ALL" | "HAS" path | path op value
+//   op         := "==" | "!=" | ">" | ">=" | "<" | "<="
+//   path       := identifier ("." identifier)*
+//   value      := number | "quoted string" | true | false | null
+// Range comparisons (">", ">=", "<", "<=") on a path combined with AND into both a lower and an upper integer bound
+// become a single integer range lookup; a path bounded on one side only becomes a computed comparison, which scans all
+// documents.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+type queryTokenKind int
+
+const (
+	tokenEOF queryTokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+	tokenLParen
+	tokenRParen
+)
+
+// A lexical token and the column (starting from 1) where it begins.
+type queryToken struct {
+	kind queryTokenKind
+	text string
+	col  int
+}
+
+// Split query text into tokens.
+func tokenizeQuery(str string) (tokens []queryToken, err error) {
+	runes := []rune(str)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		col := i + 1
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, queryToken{tokenLParen, "(", col})
+			i++
+		case c == ')':
+			tokens = append(tokens, queryToken{tokenRParen, ")", col})
+			i++
+		case c == '"':
+			var str string
+			if str, i, err = readStringLiteral(runes, i); err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, queryToken{tokenString, str, col})
+		case strings.ContainsRune("=!<>", c):
+			op := string(c)
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				op += "="
+			}
+			if op == "=" || op == "!" {
+				return nil, dberr.New(dberr.ErrorQuerySyntax, col, fmt.Sprintf("unknown operator '%s'", op))
+			}
+			tokens = append(tokens, queryToken{tokenOp, op, col})
+			i += len(op)
+		case c == '-' || unicode.IsDigit(c):
+			start := i
+			for i++; i < len(runes) && (unicode.IsDigit(runes[i]) || strings.ContainsRune(".eE+-", runes[i])); i++ {
+			}
+			tokens = append(tokens, queryToken{tokenNumber, string(runes[start:i]), col})
+		case unicode.IsLetter(c) || c == '_' || c == '@':
+			start := i
+			for i++; i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || strings.ContainsRune("_@.", runes[i])); i++ {
+			}
+			tokens = append(tokens, queryToken{tokenIdent, string(runes[start:i]), col})
+		default:
+			return nil, dberr.New(dberr.ErrorQuerySyntax, col, fmt.Sprintf("unexpected character '%c'", c))
+		}
+	}
+	return append(tokens, queryToken{tokenEOF, "", len(runes) + 1}), nil
+}
+
+// Read the string literal that begins with the double quote at the position, in which backslash escapes the next
+// character. Return the string and the position following the closing quote.
+func readStringLiteral(runes []rune, i int) (string, int, error) {
+	col := i + 1
+	var buf []rune
+	for i++; ; i++ {
+		if i >= len(runes) {
+			return "", i, dberr.New(dberr.ErrorQuerySyntax, col, "unterminated string")
+		} else if runes[i] == '\\' && i+1 < len(runes) {
+			i++
+			buf = append(buf, runes[i])
+		} else if runes[i] == '"' {
+			return string(buf), i + 1, nil
+		} else {
+			buf = append(buf, runes[i])
+		}
+	}
+}
+
+// A range comparison waiting to be paired with its opposite bound.
+type queryRangeTerm struct {
+	path  []interface{}
+	op    string
+	value int
+	col   int
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// Return true if the next token is the (case insensitive) keyword.
+func (p *queryParser) isKeyword(keyword string) bool {
+	tok := p.peek()
+	return tok.kind == tokenIdent && strings.EqualFold(tok.text, keyword)
+}
+
+// Parse string query text into a query structure. Syntax error reports the column where it occurs.
+func ParseQuery(str string) (interface{}, error) {
+	tokens, err := tokenizeQuery(str)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, dberr.New(dberr.ErrorQuerySyntax, tok.col, fmt.Sprintf("unexpected '%s'", tok.text))
+	}
+	return q, nil
+}
+
+func (p *queryParser) parseOr() (interface{}, error) {
+	union := make([]interface{}, 0, 1)
+	for {
+		q, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		union = append(union, q)
+		if !p.isKeyword("OR") {
+			break
+		}
+		p.next()
+	}
+	if len(union) == 1 {
+		return union[0], nil
+	}
+	return union, nil
+}
+
+func (p *queryParser) parseAnd() (interface{}, error) {
+	intersect := make([]interface{}, 0, 1)
+	ranges := make([]queryRangeTerm, 0)
+	for {
+		q, rangeTerm, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if rangeTerm != nil {
+			ranges = append(ranges, *rangeTerm)
+		} else {
+			intersect = append(intersect, q)
+		}
+		if !p.isKeyword("AND") {
+			break
+		}
+		p.next()
+	}
+	rangeQueries, err := combineRanges(ranges)
+	if err != nil {
+		return nil, err
+	}
+	intersect = append(intersect, rangeQueries...)
+	if len(intersect) == 1 {
+		return intersect[0], nil
+	}
+	return map[string]interface{}{"n": intersect}, nil
+}
+
+// Pair up lower and upper bounds on the same path into integer range queries, and turn a bound on one side into a
+// computed comparison.
+func combineRanges(terms []queryRangeTerm) (queries []interface{}, err error) {
+	type bounds struct {
+		path           []interface{}
+		from, to       int
+		hasFrom, hasTo bool
+		col            int
+	}
+	order := make([]string, 0)
+	byPath := make(map[string]*bounds)
+	for _, term := range terms {
+		key := fmt.Sprint(term.path)
+		b, exists := byPath[key]
+		if !exists {
+			b = &bounds{path: term.path, col: term.col}
+			byPath[key] = b
+			order = append(order, key)
+		}
+		switch term.op {
+		case ">", ">=":
+			from := term.value
+			if term.op == ">" {
+				from++
+			}
+			if !b.hasFrom || from > b.from {
+				b.from = from
+			}
+			b.hasFrom = true
+		case "<", "<=":
+			to := term.value
+			if term.op == "<" {
+				to--
+			}
+			if !b.hasTo || to < b.to {
+				b.to = to
+			}
+			b.hasTo = true
+		}
+	}
+	for _, key := range order {
+		b := byPath[key]
+		if !b.hasFrom || !b.hasTo {
+			// Integer range lookup needs both bounds, a single bound is checked against every document
+			segments := make([]string, len(b.path))
+			for i, segment := range b.path {
+				segments[i] = fmt.Sprint(segment)
+			}
+			if b.hasFrom {
+				queries = append(queries, map[string]interface{}{"compute": fmt.Sprintf("%s >= %d", strings.Join(segments, "."), b.from)})
+			} else {
+				queries = append(queries, map[string]interface{}{"compute": fmt.Sprintf("%s <= %d", strings.Join(segments, "."), b.to)})
+			}
+		} else if b.from > b.to {
+			// Nothing can be in the range
+			queries = append(queries, map[string]interface{}{"n": []interface{}{}})
+		} else {
+			queries = append(queries, map[string]interface{}{"int-from": float64(b.from), "int-to": float64(b.to), "in": b.path})
+		}
+	}
+	return
+}
+
+// Parse a parenthesised expression or a single operation. Range comparison is returned as a range term.
+func (p *queryParser) parseUnary() (interface{}, *queryRangeTerm, error) {
+	tok := p.peek()
+	switch {
+	case tok.kind == tokenLParen:
+		p.next()
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, nil, dberr.New(dberr.ErrorQuerySyntax, closing.col, "expecting ')'")
+		}
+		return q, nil, nil
+	case p.isKeyword("ALL"):
+		p.next()
+		return "all", nil, nil
+	case p.isKeyword("HAS"):
+		p.next()
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, nil, err
+		}
+		return map[string]interface{}{"has": path}, nil, nil
+	}
+	path, err := p.parsePath()
+	if err != nil {
+		return nil, nil, err
+	}
+	opTok := p.next()
+	if opTok.kind != tokenOp {
+		return nil, nil, dberr.New(dberr.ErrorQuerySyntax, opTok.col, "expecting comparison operator")
+	}
+	value, valueTok, err := p.parseValue()
+	if err != nil {
+		return nil, nil, err
+	}
+	switch opTok.text {
+	case "==":
+		return map[string]interface{}{"eq": value, "in": path}, nil, nil
+	case "!=":
+		// Documents having the path, except for those having the value
+		return map[string]interface{}{"c": []interface{}{
+			map[string]interface{}{"has": path},
+			map[string]interface{}{"eq": value, "in": path}}}, nil, nil
+	default:
+		floatVal, isNum := value.(float64)
+		if !isNum || floatVal != math.Trunc(floatVal) {
+			return nil, nil, dberr.New(dberr.ErrorQuerySyntax, valueTok.col, "range comparison requires an integer")
+		}
+		return nil, &queryRangeTerm{path: path, op: opTok.text, value: int(floatVal), col: tok.col}, nil
+	}
+}
+
+// Parse a dot-separated path into a vector of path segments.
+func (p *queryParser) parsePath() ([]interface{}, error) {
+	tok := p.next()
+	if tok.kind != tokenIdent {
+		return nil, dberr.New(dberr.ErrorQuerySyntax, tok.col, "expecting a path")
+	}
+	path := make([]interface{}, 0)
+	for _, seg := range strings.Split(tok.text, ".") {
+		if seg == "" {
+			return nil, dberr.New(dberr.ErrorQuerySyntax, tok.col, fmt.Sprintf("empty segment in path '%s'", tok.text))
+		}
+		path = append(path, seg)
+	}
+	return path, nil
+}
+
+// Parse a literal value into its JSON equivalent.
+func (p *queryParser) parseValue() (interface{}, queryToken, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenString:
+		return tok.text, tok, nil
+	case tokenNumber:
+		num, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, tok, dberr.New(dberr.ErrorQuerySyntax, tok.col, fmt.Sprintf("malformed number '%s'", tok.text))
+		}
+		if intVal, err := strconv.ParseInt(tok.text, 10, 64); err == nil && (intVal > maxExactFloatInt || intVal < -maxExactFloatInt) {
+			// Keep all digits of an integer beyond float64 precision
+			return json.Number(tok.text), tok, nil
+		}
+		return num, tok, nil
+	case tokenIdent:
+		switch strings.ToLower(tok.text) {
+		case "true":
+			return true, tok, nil
+		case "false":
+			return false, tok, nil
+		case "null":
+			return nil, tok, nil
+		}
+	}
+	return nil, tok, dberr.New(dberr.ErrorQuerySyntax, tok.col, "expecting a value")
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestParseQuery(t *testing.T) {
+	cases := map[string]string{
+		`all`:                  `"all"`,
+		`a == 1`:               `{"eq": 1, "in": ["a"]}`,
+		`a.b == "x \"y\""`:     `{"eq": "x \"y\"", "in": ["a", "b"]}`,
+		`has a.b`:              `{"has": ["a", "b"]}`,
+		`a != true`:            `{"c": [{"has": ["a"]}, {"eq": true, "in": ["a"]}]}`,
+		`a == 1 OR a == 2`:     `[{"eq": 1, "in": ["a"]}, {"eq": 2, "in": ["a"]}]`,
+		`a > 1 AND a <= 5`:     `{"int-from": 2, "int-to": 5, "in": ["a"]}`,
+		`a >= 5 and a < 2`:     `{"n": []}`,
+		`a == null AND b == 1`: `{"n": [{"eq": null, "in": ["a"]}, {"eq": 1, "in": ["b"]}]}`,
+		`age >= 18 AND age <= 60 AND (status == "active" OR status == "trial")`: `{"n": [
+			[{"eq": "active", "in": ["status"]}, {"eq": "trial", "in": ["status"]}],
+			{"int-from": 18, "int-to": 60, "in": ["age"]}]}`,
+		`age >= 18 AND (status == "active" OR status == "trial")`: `{"n": [
+			[{"eq": "active", "in": ["status"]}, {"eq": "trial", "in": ["status"]}],
+			{"compute": "age >= 18"}]}`,
+		`a.b < 5`:          `{"compute": "a.b <= 4"}`,
+		`a > 1 AND b <= 2`: `{"n": [{"compute": "a >= 2"}, {"compute": "b <= 2"}]}`,
+	}
+	for str, expected := range cases {
+		var expectedQuery interface{}
+		if err := json.Unmarshal([]byte(expected), &expectedQuery); err != nil {
+			t.Fatal(err)
+		}
+		q, err := ParseQuery(str)
+		if err != nil {
+			t.Fatal(str, err)
+		}
+		// Compare in JSON form, as parser output uses Go slice/map types directly
+		qJS, _ := json.Marshal(q)
+		var actualQuery interface{}
+		json.Unmarshal(qJS, &actualQuery)
+		if !reflect.DeepEqual(actualQuery, expectedQuery) {
+			t.Fatal(str, string(qJS))
+		}
+	}
+}
+
+func TestParseQueryErr(t *testing.T) {
+	cases := map[string]string{
+		`a == `:          "column 6",
+		`(a == 1`:        "column 8",
+		`a = 1`:          "column 3",
+		`a == "1`:        "column 6",
+		`a == 1 b == 2`:  "column 8",
+		`a > 1.5 OR a`:   "column 5",
+		`a == 1 AND # 1`: "column 12",
+	}
+	for str, expected := range cases {
+		_, err := ParseQuery(str)
+		if dberr.Type(err) != dberr.ErrorQuerySyntax || !strings.Contains(err.Error(), expected) {
+			t.Fatal(str, err)
+		}
+	}
+}
+
+func TestParseAndEvalQuery(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"age"})
+	col.Index([]string{"status"})
+	adult, _ := col.Insert(map[string]interface{}{"age": 30, "status": "active"})
+	col.Insert(map[string]interface{}{"age": 10, "status": "active"})
+	col.Insert(map[string]interface{}{"age": 40, "status": "closed"})
+	q, err := ParseQuery(`age >= 18 AND age <= 120 AND (status == "active" OR status == "trial")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(q, col, &result); err != nil {
+		t.Fatal(err)
+	}
+	if !ensureMapHasKeys(result, adult) {
+		t.Fatal(result)
+	}
+	// A bound on one side only scans all documents
+	if q, err = ParseQuery(`age >= 18 AND (status == "active" OR status == "trial")`); err != nil {
+		t.Fatal(err)
+	}
+	result = make(map[int]struct{})
+	if err = EvalQuery(q, col, &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 || !ensureMapHasKeys(result, adult) {
+		t.Fatal(result)
+	}
+}
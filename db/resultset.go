@@ -0,0 +1,78 @@
+// Query result that is safe for concurrent writes.
+//
+// Query operations put document IDs into a plain map, which may not be written by several goroutines at once. A
+// result set shards document IDs among maps of their own lock, so that goroutines evaluating parts of a query in
+// parallel (e.g. one per partition) can put their matches into the same result without waiting for each other most
+// of the time. The result set is converted back to a plain map once the parallel evaluation is done, public functions
+// never expose it.
+
+package db
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	RESULT_SET_SHARDS = 32 // Number of shards of a concurrent result set.
+)
+
+// A set of document IDs that is safe for concurrent writes.
+type resultSet struct {
+	shards [RESULT_SET_SHARDS]resultShard
+	size   int64 // Number of document IDs in all shards, accessed atomically
+}
+
+// A portion of result set and its lock.
+type resultShard struct {
+	lock sync.Mutex
+	ids  map[int]struct{}
+}
+
+// Return a new empty result set.
+func newResultSet() *resultSet {
+	set := new(resultSet)
+	for i := range set.shards {
+		set.shards[i].ids = make(map[int]struct{})
+	}
+	return set
+}
+
+// Put a document ID into the set, and return the number of document IDs in the set afterwards.
+func (set *resultSet) put(id int) int {
+	shard := &set.shards[uint(id)%RESULT_SET_SHARDS]
+	shard.lock.Lock()
+	_, exists := shard.ids[id]
+	if !exists {
+		shard.ids[id] = struct{}{}
+	}
+	shard.lock.Unlock()
+	if exists {
+		return int(atomic.LoadInt64(&set.size))
+	}
+	return int(atomic.AddInt64(&set.size, 1))
+}
+
+// Put a document ID into the set, and return an error if the set has grown beyond the maximum result size.
+func (set *resultSet) putChecked(src *Col, id int) error {
+	if size := set.put(id); src.db.Config.MaxResultSize > 0 && size > src.db.Config.MaxResultSize {
+		return dberr.New(dberr.ErrorResultTooLarge, src.db.Config.MaxResultSize)
+	}
+	return nil
+}
+
+// Return the number of document IDs in the set.
+func (set *resultSet) len() int {
+	return int(atomic.LoadInt64(&set.size))
+}
+
+// Put all document IDs of the set into the plain result map. Caller must make sure that nobody writes to the set.
+func (set *resultSet) copyInto(result *map[int]struct{}) {
+	for i := range set.shards {
+		for id := range set.shards[i].ids {
+			(*result)[id] = struct{}{}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestResultSet(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	// Goroutines put overlapping document IDs concurrently
+	set := newResultSet()
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(offset int) {
+			defer wg.Done()
+			for id := offset * 500; id < offset*500+1000; id++ {
+				if err := set.putChecked(col, id); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if set.len() != 4500 {
+		t.Fatal(set.len())
+	}
+	result := map[int]struct{}{-1: {}}
+	set.copyInto(&result)
+	if len(result) != 4501 {
+		t.Fatal(len(result))
+	}
+	for _, id := range []int{-1, 0, 2250, 4499} {
+		if _, has := result[id]; !has {
+			t.Fatal(id)
+		}
+	}
+	if size := set.put(0); size != 4500 {
+		t.Fatal(size)
+	}
+	// Maximum result size applies as the set grows
+	db.Config.MaxResultSize = 4500
+	if err = set.putChecked(col, 0); err != nil {
+		t.Fatal(err)
+	} else if err = set.putChecked(col, 4500); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+// Single-threaded writes to result set should not be much slower than writes to a plain map.
+func BenchmarkResultSetPut(b *testing.B) {
+	set := newResultSet()
+	for i := 0; i < b.N; i++ {
+		set.put(i)
+	}
+}
+
+func BenchmarkResultMapPut(b *testing.B) {
+	result := make(map[int]struct{})
+	for i := 0; i < b.N; i++ {
+		result[i] = struct{}{}
+	}
+}
+
+func BenchmarkResultSetPutParallel(b *testing.B) {
+	set := newResultSet()
+	b.RunParallel(func(pb *testing.PB) {
+		for id := 0; pb.Next(); id++ {
+			set.put(id)
+		}
+	})
+}
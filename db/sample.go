@@ -0,0 +1,117 @@
+// Sampling of query result.
+//
+// A query operation carrying "sample-rate" puts each of its matches into result with the probability of the rate, so
+// that the size of sample grows with the size of result. Given "seed", a document is sampled or not by the seed and its
+// ID alone, hence the same documents are sampled every time; otherwise every evaluation draws a new sample.
+//
+// EvalQueryShuffled orders query result in a pseudo-random order that is determined by a seed the same way, so that
+// "N random results" vary from seed to seed but are reproducible for a seed.
+
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// Evaluate the query operation without its sample rate, and put each matching document into result with the
+// probability of the rate. Limit applies to the sample rather than to the matches.
+func Sample(rate interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) error {
+	floatRate, seed, seeded, err := sampleParams(rate, expr)
+	if err != nil {
+		return err
+	}
+	intLimit, err := queryLimit(expr)
+	if err != nil {
+		return err
+	}
+	ordered, err := queryBool(expr, "ordered")
+	if err != nil {
+		return err
+	}
+	matches := make(map[int]struct{})
+	if err = evalQuery(withoutSampleRate(expr), src, &matches, false); err != nil {
+		return err
+	}
+	sampled := make(map[int]struct{})
+	for id := range matches {
+		if seeded && sampleFraction(seed, id) < floatRate || !seeded && rand.Float64() < floatRate {
+			sampled[id] = struct{}{}
+		}
+	}
+	src.traceNote("Sampled %d of %d matches", len(sampled), len(matches))
+	if intLimit > 0 && ordered {
+		putLowestIDs(sampled, intLimit, result)
+		return resultTooLarge(src, result)
+	}
+	counter := 0
+	for id := range sampled {
+		if intLimit > 0 && counter == intLimit {
+			break
+		}
+		(*result)[id] = struct{}{}
+		counter++
+	}
+	return resultTooLarge(src, result)
+}
+
+// Evaluate the query, and return result document IDs in a pseudo-random order determined by the seed. If limit is
+// greater than 0, return at most limit number of document IDs. Each document takes its position by the seed and its ID
+// alone, so the same seed gives the same order across runs and processes, and a document inserted or deleted in between
+// does not move the others relative to each other.
+func EvalQueryShuffled(q interface{}, src *Col, seed int, limit int) ([]int, error) {
+	result := make(map[int]struct{})
+	if err := EvalQuery(q, src, &result); err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(result))
+	for id := range result {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if a, b := sampleFraction(seed, ids[i]), sampleFraction(seed, ids[j]); a != b {
+			return a < b
+		}
+		return ids[i] < ids[j]
+	})
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+// Return sample rate and the optional seed of a query operation.
+func sampleParams(rate interface{}, expr map[string]interface{}) (floatRate float64, seed int, seeded bool, err error) {
+	if floatRate, err = queryFloat("sample-rate", rate); err != nil {
+		return
+	} else if floatRate < 0 || floatRate > 1 {
+		err = fmt.Errorf("Expecting `sample-rate` between 0 and 1, but %v given", rate)
+		return
+	}
+	var seedVal interface{}
+	if seedVal, seeded = expr["seed"]; seeded {
+		seed, err = queryInt("seed", seedVal)
+	}
+	return
+}
+
+// Return a copy of the query operation without sample rate, seed and result limit.
+func withoutSampleRate(expr map[string]interface{}) map[string]interface{} {
+	unsampled := make(map[string]interface{}, len(expr))
+	for key, val := range expr {
+		if key != "sample-rate" && key != "seed" && key != "limit" {
+			unsampled[key] = val
+		}
+	}
+	return unsampled
+}
+
+// Return a number in [0, 1) determined by the seed and document ID alone, using the finalizer of SplitMix64.
+func sampleFraction(seed, id int) float64 {
+	x := uint64(seed)*0x9E3779B97F4A7C15 + uint64(id)
+	x = (x ^ x>>30) * 0xBF58476D1CE4E5B9
+	x = (x ^ x>>27) * 0x94D049BB133111EB
+	x ^= x >> 31
+	return float64(x>>11) / (1 << 53)
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSample(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	for i := 0; i < 2000; i++ {
+		col.Insert(map[string]interface{}{"a": i % 2})
+	}
+	// About 10% of the 1000 matches are sampled; the standard deviation is sqrt(1000 * 0.1 * 0.9) = 9.5
+	unseeded, err := runQuery(`{"eq": 0, "in": ["a"], "sample-rate": 0.1}`, col)
+	if err != nil || len(unseeded) < 50 || len(unseeded) > 150 {
+		t.Fatal(len(unseeded), err)
+	}
+	seeded, err := runQuery(`{"eq": 0, "in": ["a"], "sample-rate": 0.1, "seed": 7}`, col)
+	if err != nil || len(seeded) < 50 || len(seeded) > 150 {
+		t.Fatal(len(seeded), err)
+	}
+	for id := range seeded {
+		if doc, _ := col.Read(id); doc["a"].(float64) != 0 {
+			t.Fatal(id, doc)
+		}
+	}
+	// The same seed samples the same documents, also when matched against a single document
+	if again, err := runQuery(`{"eq": 0, "in": ["a"], "sample-rate": 0.1, "seed": 7}`, col); err != nil || !reflect.DeepEqual(again, seeded) {
+		t.Fatal(len(again), err)
+	}
+	var q interface{}
+	json.Unmarshal([]byte(`{"eq": 0, "in": ["a"], "sample-rate": 0.1, "seed": 7}`), &q)
+	col.ForEachDoc(func(id int, docB []byte) bool {
+		var doc map[string]interface{}
+		json.Unmarshal(docB, &doc)
+		_, inResult := seeded[id]
+		if match, err := matchDoc(q, id, doc); err != nil || match != inResult {
+			t.Fatal(id, match, err)
+		}
+		return true
+	})
+	if other, err := runQuery(`{"eq": 0, "in": ["a"], "sample-rate": 0.1, "seed": 8}`, col); err != nil || reflect.DeepEqual(other, seeded) {
+		t.Fatal(len(other), err)
+	}
+	// Limit applies to the sample
+	if result, err := runQuery(`{"has": ["a"], "sample-rate": 0.5, "limit": 10}`, col); err != nil || len(result) != 10 {
+		t.Fatal(len(result), err)
+	}
+	if result, err := runQuery(`{"has": ["a"], "sample-rate": 1}`, col); err != nil || len(result) != 2000 {
+		t.Fatal(len(result), err)
+	}
+	if result, err := runQuery(`{"has": ["a"], "sample-rate": 0}`, col); err != nil || len(result) != 0 {
+		t.Fatal(len(result), err)
+	}
+	for _, query := range []string{
+		`{"has": ["a"], "sample-rate": 1.5}`,
+		`{"has": ["a"], "sample-rate": "a"}`,
+		`{"has": ["a"], "sample-rate": 0.5, "seed": "a"}`,
+		`{"has": ["b"], "sample-rate": 0.5}`,
+	} {
+		if _, err := runQuery(query, col); err == nil {
+			t.Fatal("Did not error", query)
+		}
+	}
+	if _, err = matchDoc(map[string]interface{}{"has": []interface{}{"a"}, "sample-rate": 0.5}, 1, map[string]interface{}{}); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestEvalQueryShuffled(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	for i := 0; i < 100; i++ {
+		col.Insert(map[string]interface{}{"a": i % 2})
+	}
+	all, err := EvalQueryShuffled(map[string]interface{}{"eq": 0, "in": []interface{}{"a"}}, col, 7, 0)
+	if err != nil || len(all) != 50 {
+		t.Fatal(all, err)
+	}
+	sorted := append([]int{}, all...)
+	sort.Ints(sorted)
+	if reflect.DeepEqual(all, sorted) {
+		t.Fatal("not shuffled", all)
+	}
+	// The same seed gives the same order, and limit takes the leading documents of it
+	if again, err := EvalQueryShuffled(map[string]interface{}{"eq": 0, "in": []interface{}{"a"}}, col, 7, 0); err != nil || !reflect.DeepEqual(again, all) {
+		t.Fatal(again, all, err)
+	} else if first, err := EvalQueryShuffled(map[string]interface{}{"eq": 0, "in": []interface{}{"a"}}, col, 7, 10); err != nil || !reflect.DeepEqual(first, all[:10]) {
+		t.Fatal(first, all[:10], err)
+	} else if other, err := EvalQueryShuffled(map[string]interface{}{"eq": 0, "in": []interface{}{"a"}}, col, 8, 10); err != nil || reflect.DeepEqual(other, all[:10]) {
+		t.Fatal(other, err)
+	}
+	// Documents keep their relative order when the result changes
+	if err = col.Delete(all[0]); err != nil {
+		t.Fatal(err)
+	} else if remaining, err := EvalQueryShuffled(map[string]interface{}{"eq": 0, "in": []interface{}{"a"}}, col, 7, 0); err != nil || !reflect.DeepEqual(remaining, all[1:]) {
+		t.Fatal(remaining, err)
+	}
+	if _, err = EvalQueryShuffled(map[string]interface{}{"eq": 0}, col, 7, 0); err == nil {
+		t.Fatal("did not error")
+	}
+}
@@ -0,0 +1,78 @@
+// Schema introspection.
+
+package db
+
+import (
+	"sort"
+	"strings"
+)
+
+// An index of a collection and its size.
+type IndexStat struct {
+	Name      string      // Index name, e.g. the joint path of a hash index or the name of a derived index
+	Kind      string      // One of "hash", "case-normalized", "collated", "derived", "sorted" and "existence"
+	Path      []string    // Indexed path, nil for a derived index
+	Predicate interface{} // Predicate of a partial index, nil if the index covers all documents
+	Entries   int         // Number of index entries, approximate for hash indexes
+	FileBytes int         // Size of index files, 0 for the indexes kept in memory only
+}
+
+// Return every collection along with all of its indexes, ordered by kind and name.
+func (db *DB) Schema() map[string][]IndexStat {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	schema := make(map[string][]IndexStat, len(db.cols))
+	for name, col := range db.cols {
+		schema[name] = col.indexStats()
+	}
+	return schema
+}
+
+// Return all indexes of the collection, ordered by kind and name. Does not place schema lock.
+func (col *Col) indexStats() []IndexStat {
+	stats := make([]IndexStat, 0, len(col.hts[0])+len(col.sorted)+len(col.existence))
+	for idxName := range col.hts[0] {
+		stat := IndexStat{Name: idxName, Kind: "hash"}
+		switch {
+		case strings.HasPrefix(idxName, DERIVED_INDEX_PREFIX):
+			stat.Kind, stat.Name = "derived", strings.TrimPrefix(idxName, DERIVED_INDEX_PREFIX)
+		case strings.HasPrefix(idxName, CASE_NORMALIZED_INDEX_PREFIX):
+			stat.Kind, stat.Name = "case-normalized", strings.TrimPrefix(idxName, CASE_NORMALIZED_INDEX_PREFIX)
+		case strings.HasPrefix(idxName, COLLATED_INDEX_PREFIX):
+			stat.Kind, stat.Name = "collated", strings.TrimPrefix(idxName, COLLATED_INDEX_PREFIX)
+		}
+		if idxPath, indexed := col.indexPaths[idxName]; indexed {
+			stat.Path = append([]string{}, idxPath...)
+		}
+		stat.Predicate = col.partial[idxName]
+		for i := 0; i < col.db.numParts; i++ {
+			ht := col.hts[i][idxName]
+			ht.Lock.RLock()
+			stat.Entries += ht.ApproxEntryCount()
+			stat.FileBytes += ht.Size
+			ht.Lock.RUnlock()
+		}
+		stats = append(stats, stat)
+	}
+	for idxName, idx := range col.sorted {
+		stat := IndexStat{Name: idxName, Kind: "sorted", Path: append([]string{}, idx.path...)}
+		idx.lock.RLock()
+		for node := idx.list.head.next[0]; node != nil; node = node.next[0] {
+			stat.Entries++
+		}
+		idx.lock.RUnlock()
+		stats = append(stats, stat)
+	}
+	for idxName, idx := range col.existence {
+		idx.lock.RLock()
+		stats = append(stats, IndexStat{Name: idxName, Kind: "existence", Path: append([]string{}, idx.path...), Entries: len(idx.ids)})
+		idx.lock.RUnlock()
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Kind != stats[j].Kind {
+			return stats[i].Kind < stats[j].Kind
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
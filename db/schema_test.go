@@ -0,0 +1,62 @@
+package db
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("empty"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	for i := 0; i < 100; i++ {
+		col.Insert(map[string]interface{}{"a": i, "b": map[string]interface{}{"c": "x"}})
+	}
+	predicate := map[string]interface{}{"int-from": 0, "int-to": 10, "in": []interface{}{"a"}}
+	col.Index([]string{"a"})
+	col.IndexCaseNormalized([]string{"b", "c"})
+	col.IndexPartial([]string{"b", "c"}, predicate)
+	col.IndexSorted([]string{"a"})
+	col.IndexExistence([]string{"b"})
+	col.IndexDerived("half", func(doc map[string]interface{}) []interface{} { return []interface{}{doc["a"]} })
+	stored, _ := col.PartialIndexPredicate([]string{"b", "c"})
+	schema := db.Schema()
+	if len(schema) != 2 || len(schema["empty"]) != 0 {
+		t.Fatal(schema)
+	}
+	stats := schema["col"]
+	expected := []IndexStat{
+		{Name: "b!c", Kind: "case-normalized", Path: []string{"b", "c"}},
+		{Name: "half", Kind: "derived"},
+		{Name: "b", Kind: "existence", Path: []string{"b"}, Entries: 100},
+		{Name: "a", Kind: "hash", Path: []string{"a"}},
+		{Name: "b!c", Kind: "hash", Path: []string{"b", "c"}, Predicate: stored},
+		{Name: "a", Kind: "sorted", Path: []string{"a"}, Entries: 100},
+	}
+	if len(stats) != len(expected) {
+		t.Fatal(stats)
+	}
+	for i, stat := range stats {
+		if stat.Kind != "existence" && stat.Kind != "sorted" {
+			// Hash index sizes are approximate
+			if stat.FileBytes == 0 {
+				t.Fatal(stat)
+			}
+			stat.Entries, stat.FileBytes = 0, 0
+		}
+		if !reflect.DeepEqual(stat, expected[i]) {
+			t.Fatal(stat, expected[i])
+		}
+	}
+}
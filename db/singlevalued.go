@@ -0,0 +1,94 @@
+// Single-valued index hint.
+//
+// Lookup verifies every candidate of hash lookup by reading the document and comparing the lookup value with all values
+// along the path, which expands arrays and nested documents along the way and formats every value found. An index
+// hinted single-valued tells lookup that documents have one value on the path at most, so that lookup descends the
+// path and compares the value there alone. The hint is saved in index directory and is off by default. It does not
+// change query result: a document that turns out to have an array along the path is compared with all of its values.
+
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	SINGLE_VALUED_INDEX_FILE = "single_valued" // Name of the file in index directory that marks the index single-valued.
+)
+
+// Hint whether documents have one value at most on the indexed path, so that lookup compares only that value.
+func (col *Col) SetIndexSingleValued(idxPath []string, singleValued bool) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, exists := col.indexPaths[idxName]; !exists {
+		return fmt.Errorf("Path %v is not indexed", idxPath)
+	} else if hasPathWildcard(idxPath) {
+		return fmt.Errorf("Path %v has wildcard and cannot be single-valued", idxPath)
+	}
+	markerFile := path.Join(col.db.path, col.name, idxName, SINGLE_VALUED_INDEX_FILE)
+	if !singleValued {
+		delete(col.singleValued, idxName)
+		if err := os.Remove(markerFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := ioutil.WriteFile(markerFile, []byte{}, 0600); err != nil {
+		return err
+	}
+	col.singleValued[idxName] = struct{}{}
+	return nil
+}
+
+// Return true if the index on the path is hinted single-valued.
+func (col *Col) IndexSingleValued(idxPath []string) bool {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	_, single := col.singleValued[strings.Join(idxPath, INDEX_PATH_SEP)]
+	return single
+}
+
+// Read the single-valued hint of the index. Does not place schema lock.
+func (col *Col) loadSingleValued(idxName string) error {
+	if _, err := os.Stat(path.Join(col.db.path, col.name, idxName, SINGLE_VALUED_INDEX_FILE)); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	col.singleValued[idxName] = struct{}{}
+	return nil
+}
+
+// Return the index values of the value along the path, descending documents alone. If the path leads through or to an
+// array, return all index values along the path instead.
+func singleIndexValues(doc map[string]interface{}, vecPath []string) []string {
+	var thing interface{} = doc
+	for _, seg := range vecPath {
+		if docMap, isDoc := documentOf(thing); isDoc {
+			thing = docMap[seg]
+		} else if _, isArray := thing.([]interface{}); isArray {
+			return indexValues(doc, vecPath)
+		} else {
+			return nil
+		}
+	}
+	switch val := thing.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return indexValues(doc, vecPath)
+	case string:
+		if num, isNum := numericString(val); isNum {
+			return []string{val, indexString(num)}
+		}
+	}
+	return []string{indexString(thing)}
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+func TestIndexSingleValued(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.SetIndexSingleValued([]string{"c"}, true); err == nil {
+		t.Fatal("did not error")
+	} else if err = col.SetIndexSingleValued([]string{"a", "b"}, true); err != nil {
+		t.Fatal(err)
+	} else if !col.IndexSingleValued([]string{"a", "b"}) {
+		t.Fatal("not single-valued")
+	}
+	docs := []map[string]interface{}{
+		{"a": map[string]interface{}{"b": 1}},
+		{"a": map[string]interface{}{"b": " 1.0"}},
+		{"a": map[string]interface{}{"b": []interface{}{2, 1}}},
+		{"a": []interface{}{map[string]interface{}{"b": 3}, map[string]interface{}{"b": 1}}},
+		{"a": map[string]interface{}{"b": 2}},
+		{"a": 1},
+	}
+	for _, doc := range docs {
+		if _, err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lookup := func(val interface{}) int {
+		result := make(map[int]struct{})
+		if err := EvalQuery(map[string]interface{}{"eq": val, "in": []interface{}{"a", "b"}}, col, &result); err != nil {
+			t.Fatal(err)
+		}
+		return len(result)
+	}
+	// Documents having arrays along the path are still compared with all of their values
+	if n := lookup(1); n != 4 {
+		t.Fatal(n)
+	} else if n = lookup(2); n != 2 {
+		t.Fatal(n)
+	} else if n = lookup(" 1.0"); n != 1 {
+		t.Fatal(n)
+	}
+	// The hint survives reopen, and goes away with the index
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("col")
+	if !col.IndexSingleValued([]string{"a", "b"}) {
+		t.Fatal("hint is lost")
+	} else if n := lookup(1); n != 4 {
+		t.Fatal(n)
+	} else if err = col.SetIndexSingleValued([]string{"a", "b"}, false); err != nil {
+		t.Fatal(err)
+	} else if col.IndexSingleValued([]string{"a", "b"}) {
+		t.Fatal("still single-valued")
+	} else if err = col.SetIndexSingleValued([]string{"a", "b"}, true); err != nil {
+		t.Fatal(err)
+	} else if err = col.Unindex([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	} else if col.IndexSingleValued([]string{"a", "b"}) {
+		t.Fatal("still single-valued")
+	}
+}
@@ -0,0 +1,471 @@
+// Sorted integer indexes.
+//
+// A sorted index keeps the integer values along a path in a skip list, so that integer range query seeks to the
+// lower end of the range and scans values in order, instead of looking up every integer between the boundaries on a
+// hash index. The skip list lives in memory: index paths are saved in collection directory, and the lists are built
+// again from documents when the collection is opened.
+//
+// A sorted index also gives the order of query result by the value of its path, without reading and sorting result
+// documents, see EvalQueryIndexOrdered.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	SORTED_INDEX_FILE = "sorted_indexes.json" // Name of sorted index path file in collection directory.
+	skipListMaxLevel  = 32                    // Maximum number of skip list levels, enough for 4^32 entries.
+
+	maxInt = int(^uint(0) >> 1) // Upper end of a scan of the whole sorted index
+	minInt = -maxInt - 1        // Lower end of a scan of the whole sorted index
+)
+
+// A value and the ID of document that has the value, ordered by value and then by ID.
+type sortedEntry struct {
+	val, id int
+}
+
+func (entry sortedEntry) less(other sortedEntry) bool {
+	return entry.val < other.val || entry.val == other.val && entry.id < other.id
+}
+
+type skipNode struct {
+	entry sortedEntry
+	next  []*skipNode
+	prev  *skipNode // Previous node on the lowest level, nil for the first node
+}
+
+// Skip list of sorted entries.
+type skipList struct {
+	head  *skipNode // Sentinel node that does not carry an entry
+	level int
+}
+
+func newSkipList() *skipList {
+	return &skipList{head: &skipNode{next: make([]*skipNode, skipListMaxLevel)}, level: 1}
+}
+
+// Find the last node before entry on each level.
+func (list *skipList) predecessors(entry sortedEntry) []*skipNode {
+	update := make([]*skipNode, skipListMaxLevel)
+	node := list.head
+	for i := list.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].entry.less(entry) {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	return update
+}
+
+// Put an entry into the list, do nothing if it is already there.
+func (list *skipList) insert(entry sortedEntry) {
+	update := list.predecessors(entry)
+	if next := update[0].next[0]; next != nil && next.entry == entry {
+		return
+	}
+	level := 1
+	for level < skipListMaxLevel && rand.Intn(4) == 0 {
+		level++
+	}
+	for ; list.level < level; list.level++ {
+		update[list.level] = list.head
+	}
+	node := &skipNode{entry: entry, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	if update[0] != list.head {
+		node.prev = update[0]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node
+	}
+}
+
+// Take an entry out of the list, do nothing if it is not there.
+func (list *skipList) remove(entry sortedEntry) {
+	update := list.predecessors(entry)
+	node := update[0].next[0]
+	if node == nil || node.entry != entry {
+		return
+	}
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node.prev
+	}
+	for list.level > 1 && list.head.next[list.level-1] == nil {
+		list.level--
+	}
+}
+
+// Return the first node of value greater than or equal to val, or nil if there is none.
+func (list *skipList) first(val int) *skipNode {
+	node := list.head
+	for i := list.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].entry.val < val {
+			node = node.next[i]
+		}
+	}
+	return node.next[0]
+}
+
+// Return the last node of value less than or equal to val, or nil if there is none.
+func (list *skipList) last(val int) *skipNode {
+	node := list.head
+	for i := list.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].entry.val <= val {
+			node = node.next[i]
+		}
+	}
+	if node == list.head {
+		return nil
+	}
+	return node
+}
+
+// A sorted index of integer values along a path.
+type sortedIndex struct {
+	path []string
+	list *skipList
+	lock *sync.RWMutex
+}
+
+// Return the integer values along the index path of a document, using the same value representation as hash index.
+func (idx *sortedIndex) values(doc map[string]interface{}) (ret []int) {
+	for _, strVal := range indexValues(doc, idx.path) {
+		if intVal, isInt := indexedInt(strVal); isInt {
+			ret = append(ret, intVal)
+		}
+	}
+	return
+}
+
+// Call fun on IDs of documents of values within the range in the order of values, until fun returns false.
+// The range goes downward if from is greater than to. Return the number of entries visited.
+func (idx *sortedIndex) scan(from, to int, fun func(id int) bool) (visited int) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	if from <= to {
+		for node := idx.list.first(from); node != nil && node.entry.val <= to; node = node.next[0] {
+			visited++
+			if !fun(node.entry.id) {
+				return
+			}
+		}
+		return
+	}
+	// Documents of the same value are visited in ascending order of ID either way
+	for node := idx.list.last(from); node != nil && node.entry.val >= to; {
+		sameVal := node
+		for sameVal.prev != nil && sameVal.prev.entry.val == node.entry.val {
+			sameVal = sameVal.prev
+		}
+		for n := sameVal; n != node.next[0]; n = n.next[0] {
+			visited++
+			if !fun(n.entry.id) {
+				return
+			}
+		}
+		node = sameVal.prev
+	}
+	return
+}
+
+// Call fun on IDs of documents in the order of how near their values are to target, until fun returns false. Documents
+// of values equally near are visited in ascending order of ID, and a document of many values is visited once for each
+// value. Return the number of entries visited.
+func (idx *sortedIndex) nearest(target float64, fun func(id int) bool) (visited int) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	// Walk away from the target in both directions, below starts with the greatest value less than target
+	var below, above *skipNode
+	if target <= float64(maxInt) {
+		above = idx.list.first(int(math.Ceil(math.Max(target, float64(minInt)))))
+	}
+	if above != nil {
+		below = above.prev
+	} else {
+		below = idx.list.last(maxInt)
+	}
+	ids := make([]int, 0)
+	for below != nil || above != nil {
+		belowDist, aboveDist := math.Inf(1), math.Inf(1)
+		if below != nil {
+			belowDist = target - float64(below.entry.val)
+		}
+		if above != nil {
+			aboveDist = float64(above.entry.val) - target
+		}
+		ids = ids[:0]
+		if below != nil && belowDist <= aboveDist {
+			for val := below.entry.val; below != nil && below.entry.val == val; below = below.prev {
+				ids = append(ids, below.entry.id)
+			}
+		}
+		if above != nil && aboveDist <= belowDist {
+			for val := above.entry.val; above != nil && above.entry.val == val; above = above.next[0] {
+				ids = append(ids, above.entry.id)
+			}
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			visited++
+			if !fun(id) {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Return the integer represented by an indexed value string, and whether the value is an integer that integer range
+// query looks for.
+func indexedInt(strVal string) (int, bool) {
+	if intVal, err := strconv.ParseInt(strVal, 10, 64); err == nil {
+		return int(intVal), intString(intVal) == strVal
+	}
+	floatVal, err := strconv.ParseFloat(strVal, 64)
+	if err != nil {
+		return 0, false
+	}
+	intVal := int(floatVal)
+	return intVal, fmt.Sprint(float64(intVal)) == strVal
+}
+
+// Load sorted index paths and build the indexes from documents. Does not place schema lock.
+func (col *Col) loadSortedIndexes() error {
+	col.sorted = make(map[string]*sortedIndex)
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, SORTED_INDEX_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var paths [][]string
+	if err = json.Unmarshal(content, &paths); err != nil {
+		return err
+	}
+	for _, idxPath := range paths {
+		col.buildSortedIndex(idxPath)
+	}
+	return nil
+}
+
+// Save sorted index paths. Caller must place schema write lock.
+func (col *Col) saveSortedIndexes() error {
+	paths := make([][]string, 0, len(col.sorted))
+	for _, idx := range col.sorted {
+		paths = append(paths, idx.path)
+	}
+	content, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(col.db.path, col.name, SORTED_INDEX_FILE), content, 0600)
+}
+
+// Create a sorted index and put all documents on it. Does not place schema lock.
+func (col *Col) buildSortedIndex(idxPath []string) {
+	idx := &sortedIndex{path: idxPath, list: newSkipList(), lock: new(sync.RWMutex)}
+	col.forEachDoc(func(id int, docB []byte) bool {
+		doc, err := decodeDoc(docB)
+		if err != nil {
+			// Skip corrupted document
+			return true
+		}
+		for _, val := range idx.values(doc) {
+			idx.list.insert(sortedEntry{val, id})
+		}
+		return true
+	}, false)
+	col.sorted[strings.Join(idxPath, INDEX_PATH_SEP)] = idx
+}
+
+// Create a sorted index of integer values on the path, for efficient integer range queries.
+func (col *Col) IndexSorted(idxPath []string) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, exists := col.sorted[idxName]; exists {
+		return fmt.Errorf("Path %v already has a sorted index", idxPath)
+	}
+	col.buildSortedIndex(idxPath)
+	if err := col.saveSortedIndexes(); err != nil {
+		delete(col.sorted, idxName)
+		return err
+	}
+	return nil
+}
+
+// Remove the sorted index on the path.
+func (col *Col) UnindexSorted(idxPath []string) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, exists := col.sorted[idxName]; !exists {
+		return fmt.Errorf("Path %v does not have a sorted index", idxPath)
+	}
+	delete(col.sorted, idxName)
+	return col.saveSortedIndexes()
+}
+
+// Return paths of all sorted indexes.
+func (col *Col) AllSortedIndexes() (ret [][]string) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	ret = make([][]string, 0, len(col.sorted))
+	for _, idx := range col.sorted {
+		ret = append(ret, idx.path)
+	}
+	return
+}
+
+// Put integer values of the document on sorted indexes.
+func (col *Col) sortedIndexDoc(id int, doc map[string]interface{}) {
+	for _, idx := range col.sorted {
+		idx.lock.Lock()
+		for _, val := range idx.values(doc) {
+			idx.list.insert(sortedEntry{val, id})
+		}
+		idx.lock.Unlock()
+	}
+}
+
+// Remove integer values of the document from sorted indexes.
+func (col *Col) sortedUnindexDoc(id int, doc map[string]interface{}) {
+	for _, idx := range col.sorted {
+		idx.lock.Lock()
+		for _, val := range idx.values(doc) {
+			idx.list.remove(sortedEntry{val, id})
+		}
+		idx.lock.Unlock()
+	}
+}
+
+// Remove all values from all sorted indexes. Caller must place schema write lock.
+func (col *Col) clearSortedIndexes() {
+	for _, idx := range col.sorted {
+		idx.list = newSkipList()
+	}
+}
+
+// Evaluate the query, and return result document IDs in the order of integer values at sortPath, descending if desc is
+// true, and documents of equal value in the order of IDs. If limit is greater than 0, return at most limit number of
+// document IDs. With a sorted index on sortPath, the order is read off the index instead of reading and sorting result
+// documents, and a query that is an integer range on sortPath alone is answered by scanning the index in order, only as
+// far as limit. A document of many values takes the position of its lowest value (highest if descending), and documents
+// without an integer value come last, ordered like EvalQuerySortedBy with NaturalLess. Without a sorted index, the
+// result is read and ordered like EvalQuerySortedBy with NaturalLess.
+func EvalQueryIndexOrdered(q interface{}, src *Col, sortPath []string, desc bool, limit int) ([]int, error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	less := NaturalLess
+	if desc {
+		less = func(a, b interface{}) bool { return NaturalLess(b, a) }
+	}
+	idxName := strings.Join(sortPath, INDEX_PATH_SEP)
+	idx, indexed := src.sorted[idxName]
+	if !indexed {
+		src.traceNote("No sorted index on %s, result documents are read and sorted", idxName)
+		entries, err := evalSortEntries(q, src, sortPath)
+		if err != nil {
+			return nil, err
+		}
+		return sortedIDs(entries, less, limit), nil
+	}
+	ids := make([]int, 0)
+	placed := make(map[int]struct{})
+	place := func(id int) bool {
+		if _, dup := placed[id]; !dup {
+			placed[id] = struct{}{}
+			ids = append(ids, id)
+		}
+		return limit <= 0 || len(ids) < limit
+	}
+	if from, to, ownRange := sortedRangeOf(q, sortPath); ownRange {
+		if desc {
+			from, to = to, from
+		}
+		src.traceNote("Scanned sorted index %s from %d to %d for result in order", idxName, from, to)
+		idx.scan(from, to, func(id int) bool {
+			return src.isDeleted(id) || place(id)
+		})
+		return ids, nil
+	}
+	result := make(map[int]struct{})
+	if err := evalQuery(q, src, &result, false); err != nil {
+		return nil, err
+	}
+	from, to := minInt, maxInt
+	if desc {
+		from, to = to, from
+	}
+	src.traceNote("Ordered %d documents by sorted index %s", len(result), idxName)
+	idx.scan(from, to, func(id int) bool {
+		if _, inResult := result[id]; inResult {
+			return place(id) && len(placed) < len(result)
+		}
+		return true
+	})
+	if limit > 0 && len(ids) >= limit || len(placed) == len(result) {
+		return ids, nil
+	}
+	// Documents without an integer value on the index come last
+	unplaced := make(map[int]struct{}, len(result)-len(placed))
+	for id := range result {
+		if _, isPlaced := placed[id]; !isPlaced {
+			unplaced[id] = struct{}{}
+		}
+	}
+	restLimit := 0
+	if limit > 0 {
+		restLimit = limit - len(ids)
+	}
+	return append(ids, sortedIDs(sortEntriesOf(unplaced, src, sortPath), less, restLimit)...), nil
+}
+
+// Return the ascending bounds of the query if it is an integer range on the path and nothing else.
+func sortedRangeOf(q interface{}, sortPath []string) (from, to int, isRange bool) {
+	expr, isMap := q.(map[string]interface{})
+	if !isMap || len(expr) != 3 {
+		return
+	}
+	intFrom, dashed := expr["int-from"]
+	intTo := expr["int-to"]
+	if !dashed {
+		intFrom, intTo = expr["int from"], expr["int to"]
+	}
+	vecPath, err := queryPath(expr["in"])
+	if err != nil || strings.Join(vecPath, INDEX_PATH_SEP) != strings.Join(sortPath, INDEX_PATH_SEP) {
+		return
+	} else if from, err = queryInt("int-from", intFrom); err != nil {
+		return
+	} else if to, err = queryInt("int-to", intTo); err != nil {
+		return
+	} else if from > to {
+		from, to = to, from
+	}
+	return from, to, true
+}
@@ -0,0 +1,226 @@
+package db
+
+import (
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSkipList(t *testing.T) {
+	list := newSkipList()
+	expected := make(map[sortedEntry]struct{})
+	for i := 0; i < 2000; i++ {
+		entry := sortedEntry{rand.Intn(100), rand.Intn(10)}
+		if rand.Intn(3) == 0 {
+			list.remove(entry)
+			delete(expected, entry)
+		} else {
+			list.insert(entry)
+			expected[entry] = struct{}{}
+		}
+	}
+	sortedEntries := make([]sortedEntry, 0, len(expected))
+	for entry := range expected {
+		sortedEntries = append(sortedEntries, entry)
+	}
+	sort.Slice(sortedEntries, func(i, j int) bool { return sortedEntries[i].less(sortedEntries[j]) })
+	// Walk forward and backward on the lowest level
+	forward := make([]sortedEntry, 0)
+	var lastNode *skipNode
+	for node := list.head.next[0]; node != nil; node = node.next[0] {
+		forward = append(forward, node.entry)
+		lastNode = node
+	}
+	if !reflect.DeepEqual(forward, sortedEntries) {
+		t.Fatal(forward, sortedEntries)
+	}
+	backward := make([]sortedEntry, 0)
+	for node := lastNode; node != nil; node = node.prev {
+		backward = append([]sortedEntry{node.entry}, backward...)
+	}
+	if !reflect.DeepEqual(backward, sortedEntries) {
+		t.Fatal(backward, sortedEntries)
+	}
+	if node := list.first(50); node == nil || node.entry.val < 50 || node.prev != nil && node.prev.entry.val >= 50 {
+		t.Fatal(node)
+	}
+	if node := list.last(50); node == nil || node.entry.val > 50 || node.next[0] != nil && node.next[0].entry.val <= 50 {
+		t.Fatal(node)
+	}
+	if node := list.first(100); node != nil {
+		t.Fatal(node)
+	}
+	if node := list.last(-1); node != nil {
+		t.Fatal(node)
+	}
+}
+
+func TestIndexSorted(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 10)
+	for i := range ids {
+		ids[i], _ = col.Insert(map[string]interface{}{"a": i * 1000})
+	}
+	col.Insert(map[string]interface{}{"a": 1.5})
+	// A string of integer is found by range query, the same way as on hash index
+	str, _ := col.Insert(map[string]interface{}{"a": "2000"})
+	if _, err = runQuery(`{"int-from": 0, "int-to": 9000, "in": ["a"]}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err = col.IndexSorted([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if col.IndexSorted([]string{"a"}) == nil {
+		t.Fatal("Did not error")
+	}
+	// Range query works on sorted index alone, and across a wide range of values
+	check := func(query string, expected ...int) {
+		result, err := runQuery(query, col)
+		if err != nil || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, result, err)
+		}
+	}
+	check(`{"int-from": 0, "int-to": 9000, "in": ["a"]}`, append(ids, str)...)
+	check(`{"int-from": 1500, "int-to": 3000, "in": ["a"]}`, ids[2], ids[3], str)
+	check(`{"int-from": 3000, "int-to": 4000, "in": ["a"], "to-exclusive": true}`, ids[3])
+	check(`{"int-from": 9000, "int-to": -5, "in": ["a"], "limit": 2}`, ids[9], ids[8])
+	check(`{"int-from": -5, "int-to": 9000, "in": ["a"], "limit": 2}`, ids[0], ids[1])
+	check(`{"int-from": 9001, "int-to": 100000, "in": ["a"]}`)
+	// Sorted index follows document updates and deletes
+	if err = col.Update(ids[1], map[string]interface{}{"a": 50000}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"int-from": 0, "int-to": 3000, "in": ["a"]}`, ids[0], ids[3], str)
+	check(`{"int-from": 40000, "int-to": 60000, "in": ["a"]}`, ids[1])
+	// Sorted index survives reopen and scrub
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("col")
+	if paths := col.AllSortedIndexes(); !reflect.DeepEqual(paths, [][]string{{"a"}}) {
+		t.Fatal(paths)
+	}
+	check(`{"int-from": 40000, "int-to": 60000, "in": ["a"]}`, ids[1])
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	check(`{"int-from": 0, "int-to": 3000, "in": ["a"]}`, ids[0], ids[3], str)
+	if err = db.Truncate("col"); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"int-from": 0, "int-to": 60000, "in": ["a"]}`)
+	if err = col.UnindexSorted([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if col.UnindexSorted([]string{"a"}) == nil {
+		t.Fatal("Did not error")
+	}
+	if paths := col.AllSortedIndexes(); len(paths) != 0 {
+		t.Fatal(paths)
+	}
+}
+
+func TestEvalQueryIndexOrdered(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"kind"}); err != nil {
+		t.Fatal(err)
+	}
+	insert := func(doc map[string]interface{}) int {
+		id, err := col.Insert(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	p30 := insert(map[string]interface{}{"kind": "a", "price": 30})
+	p10 := insert(map[string]interface{}{"kind": "a", "price": 10})
+	p20 := insert(map[string]interface{}{"kind": "a", "price": []interface{}{40, 20}})
+	insert(map[string]interface{}{"kind": "b", "price": 15})
+	text := insert(map[string]interface{}{"kind": "a", "price": "cheap"})
+	none := insert(map[string]interface{}{"kind": "a"})
+	kindA := map[string]interface{}{"eq": "a", "in": []interface{}{"kind"}}
+	// Without a sorted index the result is read and sorted, by the first value of a document
+	if ids, err := EvalQueryIndexOrdered(kindA, col, []string{"price"}, false, 0); err != nil || !reflect.DeepEqual(ids, []int{p10, p30, p20, text, none}) {
+		t.Fatal(ids, err)
+	}
+	if err = col.IndexSorted([]string{"price"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		q        interface{}
+		desc     bool
+		limit    int
+		expected []int
+		note     string
+	}{
+		{kindA, false, 0, []int{p10, p20, p30, text, none}, "Ordered"},
+		{kindA, true, 0, []int{p20, p30, p10, text, none}, "Ordered"},
+		{kindA, false, 2, []int{p10, p20}, "Ordered"},
+		{kindA, false, 4, []int{p10, p20, p30, text}, "Ordered"},
+		{map[string]interface{}{"int-from": 10.0, "int-to": 30.0, "in": []interface{}{"price"}}, false, 0, []int{p10, 0, p20, p30}, "Scanned"},
+		{map[string]interface{}{"int-from": 30.0, "int-to": 10.0, "in": "price"}, true, 2, []int{p30, p20}, "Scanned"},
+	} {
+		ids, trace, err := evalIndexOrderedWithTrace(c.q, col, c.desc, c.limit)
+		if err != nil {
+			t.Fatal(c, err)
+		}
+		// Document of kind b is in the range result too
+		if len(c.expected) > 1 && c.expected[1] == 0 {
+			c.expected[1] = ids[1]
+		}
+		if !reflect.DeepEqual(ids, c.expected) || len(trace.Notes) == 0 || !strings.HasPrefix(trace.Notes[0], c.note) {
+			t.Fatal(c, ids, trace.Notes)
+		}
+	}
+	// The order follows document updates and deletes
+	if err = col.Update(p30, map[string]interface{}{"kind": "a", "price": 5}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(p10); err != nil {
+		t.Fatal(err)
+	} else if ids, err := EvalQueryIndexOrdered(kindA, col, []string{"price"}, false, 0); err != nil || !reflect.DeepEqual(ids, []int{p30, p20, text, none}) {
+		t.Fatal(ids, err)
+	} else if ids, err := EvalQueryIndexOrdered(map[string]interface{}{"int-from": 0.0, "int-to": 12.0, "in": []interface{}{"price"}}, col, []string{"price"}, false, 0); err != nil || !reflect.DeepEqual(ids, []int{p30}) {
+		t.Fatal(ids, err)
+	}
+	if _, err = EvalQueryIndexOrdered(map[string]interface{}{"eq": "a"}, col, []string{"price"}, false, 0); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+// Order the result by price on a copy of collection handle that traces, and return the trace root.
+func evalIndexOrderedWithTrace(q interface{}, col *Col, desc bool, limit int) ([]int, QueryTrace, error) {
+	traced := *col
+	traced.trace = new(queryTracer)
+	traced.trace.current = &traced.trace.root
+	ids, err := EvalQueryIndexOrdered(q, &traced, []string{"price"}, desc, limit)
+	return ids, traced.trace.root, err
+}
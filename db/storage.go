@@ -0,0 +1,93 @@
+// Pluggable document storage.
+//
+// Collection documents are kept in partitions, and the query engine and document functions reach them only through
+// interface DocStore. By default a partition is a pair of files in the collection directory (data.Partition); a
+// database opened by OpenDBWithStorage keeps documents in the partitions given by its own storage function instead,
+// e.g. in memory or in a remote store. Indexes, tombstones, modification times and versions stay in collection
+// directory whichever storage is used.
+
+package db
+
+import (
+	"math/rand"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+// DocStore keeps the documents of a collection partition by document ID, as JSON text. Collection places the data lock
+// of the partition around reading and writing documents - a read lock for Read, ForEachDoc, AllIDs, ApproxDocCount and
+// SpaceUsage, and a write lock for Insert, Update, Delete and Close. LockUpdate and UnlockUpdate are called without
+// the data lock, and must be safe for concurrent use.
+type DocStore interface {
+	// Store a new document, and return its physical location (any number meaningful to the storage).
+	Insert(id int, doc []byte) (physID int, err error)
+	// Return the document, or error dberr.ErrorNoDoc if the partition does not have it.
+	Read(id int) ([]byte, error)
+	// Overwrite the document, or return error dberr.ErrorNoDoc if the partition does not have it.
+	Update(id int, doc []byte) error
+	// Remove the document, or return error dberr.ErrorNoDoc if the partition does not have it.
+	Delete(id int) error
+	// Wait until no other caller holds the document for update, then hold it.
+	LockUpdate(id int)
+	// Release the document held by LockUpdate.
+	UnlockUpdate(id int)
+	// Call fun on every document of page partNum out of totalPart pages of the partition, until fun returns false.
+	// Return false if iteration was stopped by fun.
+	ForEachDoc(partNum, totalPart int, fun func(id int, doc []byte) bool) (moveOn bool)
+	// Return the ID of every document.
+	AllIDs() []int
+	// Return the number of documents, which may be approximate.
+	ApproxDocCount() int
+	// Return the space taken by documents, fields not applicable to the storage are left 0.
+	SpaceUsage() data.SpaceUsage
+	// Remove all documents.
+	Clear() error
+	// Flush documents to durable storage.
+	Sync() error
+	// Release the partition, it is not used afterwards.
+	Close() error
+}
+
+// Open the document storage of a partition of the collection whose directory is colDir. The collection directory
+// is created before the call, and a collection that is renamed is opened again under its new directory.
+type DocStorage func(colDir string, partNum int) (DocStore, error)
+
+// A document partition of a collection, along with the lock that collection places around its use.
+type colPart struct {
+	DocStore
+	DataLock *sync.RWMutex
+}
+
+// Open (create if necessary) a database like OpenDB does, and keep collection documents in the partitions opened by
+// storage instead of data files.
+func OpenDBWithStorage(dbPath string, storage DocStorage) (*DB, error) {
+	rand.Seed(time.Now().UnixNano()) // document ID generation relies on this RNG
+	d, err := data.CreateOrReadConfig(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{Config: d, path: dbPath, schemaLock: new(sync.RWMutex), storage: storage}
+	db.Config.CalculateConfigConstants()
+	return db, db.load()
+}
+
+// Open a document partition of the collection, from data files in collection directory unless the database has its
+// own storage.
+func (db *DB) openPart(colName string, partNum int) (colPart, error) {
+	colDir := path.Join(db.path, colName)
+	if db.storage != nil {
+		store, err := db.storage(colDir, partNum)
+		return colPart{DocStore: store, DataLock: new(sync.RWMutex)}, err
+	}
+	part, err := db.Config.OpenPartition(
+		path.Join(colDir, DOC_DATA_FILE+strconv.Itoa(partNum)),
+		path.Join(colDir, DOC_LOOKUP_FILE+strconv.Itoa(partNum)))
+	if err != nil {
+		return colPart{}, err
+	}
+	return colPart{DocStore: part, DataLock: part.DataLock}, nil
+}
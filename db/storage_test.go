@@ -0,0 +1,200 @@
+package db
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// Documents of a partition kept in a map, for testing pluggable storage.
+type memDocStore struct {
+	docs       map[int][]byte
+	closed     bool
+	updateLock sync.Mutex
+	updating   map[int]chan struct{}
+}
+
+func (store *memDocStore) Insert(id int, doc []byte) (int, error) {
+	store.docs[id] = append([]byte{}, doc...)
+	return id, nil
+}
+
+func (store *memDocStore) Read(id int) ([]byte, error) {
+	if doc, exists := store.docs[id]; exists {
+		return doc, nil
+	}
+	return nil, dberr.New(dberr.ErrorNoDoc, id)
+}
+
+func (store *memDocStore) Update(id int, doc []byte) error {
+	if _, exists := store.docs[id]; !exists {
+		return dberr.New(dberr.ErrorNoDoc, id)
+	}
+	store.docs[id] = append([]byte{}, doc...)
+	return nil
+}
+
+func (store *memDocStore) Delete(id int) error {
+	if _, exists := store.docs[id]; !exists {
+		return dberr.New(dberr.ErrorNoDoc, id)
+	}
+	delete(store.docs, id)
+	return nil
+}
+
+func (store *memDocStore) LockUpdate(id int) {
+	for {
+		store.updateLock.Lock()
+		ch, held := store.updating[id]
+		if !held {
+			store.updating[id] = make(chan struct{})
+		}
+		store.updateLock.Unlock()
+		if !held {
+			return
+		}
+		<-ch
+	}
+}
+
+func (store *memDocStore) UnlockUpdate(id int) {
+	store.updateLock.Lock()
+	close(store.updating[id])
+	delete(store.updating, id)
+	store.updateLock.Unlock()
+}
+
+func (store *memDocStore) ForEachDoc(partNum, totalPart int, fun func(id int, doc []byte) bool) bool {
+	for _, id := range store.AllIDs() {
+		if id%totalPart == partNum && !fun(id, store.docs[id]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (store *memDocStore) AllIDs() []int {
+	ids := make([]int, 0, len(store.docs))
+	for id := range store.docs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (store *memDocStore) ApproxDocCount() int {
+	return len(store.docs)
+}
+
+func (store *memDocStore) SpaceUsage() (usage data.SpaceUsage) {
+	for _, doc := range store.docs {
+		usage.Docs++
+		usage.DocBytes += len(doc)
+		usage.TextBytes += len(doc)
+	}
+	return
+}
+
+func (store *memDocStore) Clear() error {
+	store.docs = make(map[int][]byte)
+	return nil
+}
+
+func (store *memDocStore) Sync() error {
+	return nil
+}
+
+func (store *memDocStore) Close() error {
+	store.closed = true
+	return nil
+}
+
+func TestOpenDBWithStorage(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	stores := make(map[string]*memDocStore)
+	storage := func(colDir string, partNum int) (DocStore, error) {
+		key := colDir + "/" + strconv.Itoa(partNum)
+		if stores[key] == nil {
+			stores[key] = &memDocStore{docs: make(map[int][]byte), updating: make(map[int]chan struct{})}
+		}
+		stores[key].closed = false
+		return stores[key], nil
+	}
+	db, err := OpenDBWithStorage(TEST_DATA_DIR, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 0)
+	for i := 0; i < 10; i++ {
+		id, err := col.Insert(map[string]interface{}{"a": i % 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err = col.Update(ids[0], map[string]interface{}{"a": 5}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	} else if doc, err := col.Read(ids[0]); err != nil || doc["a"].(float64) != 5 {
+		t.Fatal(doc, err)
+	} else if _, err := col.Read(ids[1]); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	// Documents are in the storage, not in data files
+	total := 0
+	for _, store := range stores {
+		total += len(store.docs)
+	}
+	if _, err := os.Stat(path.Join(TEST_DATA_DIR, "col", DOC_DATA_FILE+"0")); err == nil {
+		t.Fatal("data file created")
+	} else if total != 9 || col.ApproxDocCount() != 9 {
+		t.Fatal(total, col.ApproxDocCount())
+	}
+	// Query engine works the same way
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 2 {
+		t.Fatal(result, err)
+	}
+	result = make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"int-from": 0, "int-to": 10, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 9 {
+		t.Fatal(result, err)
+	}
+	// Close releases the partitions, and documents are found in the storage after reopening
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, store := range stores {
+		if !store.closed {
+			t.Fatal("storage not closed")
+		}
+	}
+	if db, err = OpenDBWithStorage(TEST_DATA_DIR, storage); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("col")
+	result = make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": 2, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 3 {
+		t.Fatal(result, err)
+	}
+	if err = db.Truncate("col"); err != nil {
+		t.Fatal(err)
+	} else if count := db.Use("col").ApproxDocCount(); count != 0 {
+		t.Fatal(count)
+	}
+}
@@ -0,0 +1,169 @@
+// Stored query result sets.
+//
+// Paging through a large query result by running the query for every page costs a full evaluation per page, and the
+// pages may skip or repeat documents as the collection changes in between. CreateResultSet evaluates a query once and
+// stores the document IDs of its result, in ascending order, under a random token; FetchResultPage then returns any page
+// of the stored IDs without evaluating the query again, so that all pages come from the same snapshot. Result sets are
+// stored in memory only, and expire after ResultSetTTLSec seconds of not being used. MaxResultSets and MaxResultSetIDs
+// cap the number of stored result sets and the document IDs in all of them - when storing another result set would
+// exceed either, the least recently used result sets are removed to make room.
+//
+// A query cursor is a stored result set that remembers how far it has been read: NextQueryBatch returns the next batch
+// of IDs on every call, and releases the result set along with the last batch.
+
+package db
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// Document IDs of a stored query result.
+type storedResult struct {
+	col      string    // Name of the queried collection
+	ids      []int     // Document IDs of the result in ascending order
+	lastUsed time.Time // Time of storing the result set or fetching its latest page
+	next     int       // Position of the next batch of cursor
+}
+
+// Evaluate a query and store the document IDs of its result under a new token, so that FetchResultPage returns the
+// result page by page. Return the token and the number of documents in the result.
+func CreateResultSet(q interface{}, src *Col) (token string, total int, err error) {
+	result := make(map[int]struct{})
+	if err = EvalQuery(q, src, &result); err != nil {
+		return
+	}
+	ids := make([]int, 0, len(result))
+	for id := range result {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	if maxIDs := src.db.Config.MaxResultSetIDs; maxIDs > 0 && len(ids) > maxIDs {
+		return "", 0, dberr.New(dberr.ErrorResultTooLarge, maxIDs)
+	}
+	tokenBytes := make([]byte, 16)
+	if _, err = cryptorand.Read(tokenBytes); err != nil {
+		return
+	}
+	token = hex.EncodeToString(tokenBytes)
+	db := src.db
+	db.resultSetLock.Lock()
+	defer db.resultSetLock.Unlock()
+	now := time.Now()
+	db.expireResultSets(now)
+	db.makeRoomForResultSet(len(ids))
+	if db.resultSets == nil {
+		db.resultSets = make(map[string]*storedResult)
+	}
+	db.resultSets[token] = &storedResult{col: src.name, ids: ids, lastUsed: now}
+	db.resultSetIDs += len(ids)
+	return token, len(ids), nil
+}
+
+// Return a page of the result set stored under the token - at most limit document IDs starting from the offset - and
+// the number of documents in the result set. Fetching a page keeps the result set from expiring for another
+// ResultSetTTLSec seconds. Document IDs are those of the query result at the time it was stored, a document deleted
+// since then is still among them.
+func (col *Col) FetchResultPage(token string, offset, limit int) (ids []int, total int, err error) {
+	if offset < 0 || limit < 0 {
+		return nil, 0, fmt.Errorf("Result page offset %d and limit %d may not be negative", offset, limit)
+	}
+	db := col.db
+	db.resultSetLock.Lock()
+	defer db.resultSetLock.Unlock()
+	now := time.Now()
+	db.expireResultSets(now)
+	stored, exists := db.resultSets[token]
+	if !exists || stored.col != col.name {
+		return nil, 0, dberr.New(dberr.ErrorNoResultSet, token)
+	}
+	stored.lastUsed = now
+	total = len(stored.ids)
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit < total-offset {
+		end = offset + limit
+	}
+	return append([]int{}, stored.ids[offset:end]...), total, nil
+}
+
+// Evaluate a query once and open a cursor over the document IDs of its result, so that NextQueryBatch returns them batch
+// by batch in ascending order. Return the cursor token. The cursor is a stored result set, hence it expires after
+// ResultSetTTLSec seconds of inactivity and counts toward MaxResultSets and MaxResultSetIDs.
+func OpenQueryCursor(q interface{}, src *Col) (token string, err error) {
+	token, _, err = CreateResultSet(q, src)
+	return
+}
+
+// Return the next batch of at most size document IDs of the cursor, and true along with the last batch. The cursor is
+// released along with the last batch; reading it after that, or after it expires, returns dberr.ErrorNoResultSet.
+func (col *Col) NextQueryBatch(token string, size int) (ids []int, done bool, err error) {
+	if size <= 0 {
+		return nil, false, fmt.Errorf("Cursor batch size %d must be positive", size)
+	}
+	db := col.db
+	db.resultSetLock.Lock()
+	defer db.resultSetLock.Unlock()
+	now := time.Now()
+	db.expireResultSets(now)
+	stored, exists := db.resultSets[token]
+	if !exists || stored.col != col.name {
+		return nil, false, dberr.New(dberr.ErrorNoResultSet, token)
+	}
+	stored.lastUsed = now
+	end := len(stored.ids)
+	if size < end-stored.next {
+		end = stored.next + size
+	}
+	ids = append([]int{}, stored.ids[stored.next:end]...)
+	if stored.next = end; end == len(stored.ids) {
+		db.removeResultSet(token)
+		done = true
+	}
+	return
+}
+
+// Remove the result sets that have not been used for ResultSetTTLSec seconds. Caller must place result set lock.
+func (db *DB) expireResultSets(now time.Time) {
+	if db.Config.ResultSetTTLSec <= 0 {
+		return
+	}
+	ttl := time.Duration(db.Config.ResultSetTTLSec) * time.Second
+	for token, stored := range db.resultSets {
+		if now.Sub(stored.lastUsed) > ttl {
+			db.removeResultSet(token)
+		}
+	}
+}
+
+// Remove the least recently used result sets until another result set of the size fits within MaxResultSets and
+// MaxResultSetIDs. Caller must place result set lock.
+func (db *DB) makeRoomForResultSet(size int) {
+	for len(db.resultSets) > 0 &&
+		(db.Config.MaxResultSets > 0 && len(db.resultSets) >= db.Config.MaxResultSets ||
+			db.Config.MaxResultSetIDs > 0 && db.resultSetIDs+size > db.Config.MaxResultSetIDs) {
+		var oldestToken string
+		var oldest *storedResult
+		for token, stored := range db.resultSets {
+			if oldest == nil || stored.lastUsed.Before(oldest.lastUsed) {
+				oldestToken, oldest = token, stored
+			}
+		}
+		db.removeResultSet(oldestToken)
+	}
+}
+
+// Remove a stored result set. Caller must place result set lock.
+func (db *DB) removeResultSet(token string) {
+	if stored, exists := db.resultSets[token]; exists {
+		db.resultSetIDs -= len(stored.ids)
+		delete(db.resultSets, token)
+	}
+}
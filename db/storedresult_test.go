@@ -0,0 +1,189 @@
+package db
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestStoredResultSet(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("other"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	ids := make([]int, 0, 10)
+	for i := 0; i < 10; i++ {
+		id, _ := col.Insert(map[string]interface{}{"a": i % 2})
+		if i%2 == 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	token, total, err := CreateResultSet(map[string]interface{}{"eq": 0, "in": []interface{}{"a"}}, col)
+	if err != nil || total != 5 || token == "" {
+		t.Fatal(token, total, err)
+	}
+	// Pages come from the stored result, even after the documents have changed
+	for _, id := range ids {
+		if err = col.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, page := range []struct {
+		offset, limit int
+		expected      []int
+	}{
+		{0, 2, ids[:2]}, {2, 2, ids[2:4]}, {4, 2, ids[4:]}, {5, 2, []int{}}, {9, 2, []int{}}, {0, 100, ids}, {1, 0, []int{}},
+	} {
+		pageIDs, total, err := col.FetchResultPage(token, page.offset, page.limit)
+		if err != nil || total != 5 || !reflect.DeepEqual(pageIDs, page.expected) {
+			t.Fatal(page, pageIDs, total, err)
+		}
+	}
+	if _, _, err = col.FetchResultPage(token, -1, 1); err == nil {
+		t.Fatal("Did not error")
+	}
+	// Token is only good for the queried collection
+	if _, _, err = db.Use("other").FetchResultPage(token, 0, 1); dberr.Type(err) != dberr.ErrorNoResultSet {
+		t.Fatal(err)
+	}
+	if _, _, err = col.FetchResultPage("nonexistent", 0, 1); dberr.Type(err) != dberr.ErrorNoResultSet {
+		t.Fatal(err)
+	}
+	if _, _, err = CreateResultSet(map[string]interface{}{"eq": 0, "in": []interface{}{"b"}}, col); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestStoredResultSetLimits(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	for i := 0; i < 5; i++ {
+		col.Insert(map[string]interface{}{"a": i})
+	}
+	// The least recently used result set makes room for a new one
+	db.Config.MaxResultSets = 2
+	first, _, _ := CreateResultSet("all", col)
+	second, _, _ := CreateResultSet("all", col)
+	if _, _, err = col.FetchResultPage(first, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	third, _, _ := CreateResultSet("all", col)
+	for token, kept := range map[string]bool{first: true, second: false, third: true} {
+		if _, _, err = col.FetchResultPage(token, 0, 1); (err == nil) != kept {
+			t.Fatal(token, kept, err)
+		}
+	}
+	// Document IDs of all result sets are capped
+	db.Config.MaxResultSets = 0
+	db.Config.MaxResultSetIDs = 10
+	col.FetchResultPage(first, 0, 1)
+	fourth, _, _ := CreateResultSet("all", col)
+	if _, _, err = col.FetchResultPage(first, 0, 1); err != nil {
+		t.Fatal(err)
+	} else if _, _, err = col.FetchResultPage(third, 0, 1); err == nil {
+		t.Fatal("Did not remove result set")
+	} else if _, _, err = col.FetchResultPage(fourth, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	db.Config.MaxResultSetIDs = 4
+	if _, _, err = CreateResultSet("all", col); dberr.Type(err) != dberr.ErrorResultTooLarge {
+		t.Fatal(err)
+	}
+	// Result sets expire when they are not used
+	db.Config.MaxResultSetIDs = 0
+	db.Config.ResultSetTTLSec = 1
+	db.resultSetLock.Lock()
+	db.resultSets[fourth].lastUsed = time.Now().Add(-2 * time.Second)
+	db.resultSetLock.Unlock()
+	if _, _, err = col.FetchResultPage(fourth, 0, 1); dberr.Type(err) != dberr.ErrorNoResultSet {
+		t.Fatal(err)
+	} else if _, _, err = col.FetchResultPage(first, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if db.resultSetIDs != 5 {
+		t.Fatal(db.resultSetIDs)
+	}
+}
+
+func TestQueryCursor(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 0, 5)
+	for i := 0; i < 5; i++ {
+		id, _ := col.Insert(map[string]interface{}{"a": i})
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	token, err := OpenQueryCursor("all", col)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Documents inserted after opening the cursor are not among the result
+	col.Insert(map[string]interface{}{"a": 5})
+	if _, _, err = col.NextQueryBatch(token, 0); err == nil {
+		t.Fatal("did not error")
+	}
+	for _, batch := range []struct {
+		expected []int
+		done     bool
+	}{
+		{ids[:2], false}, {ids[2:4], false}, {ids[4:], true},
+	} {
+		if batchIDs, done, err := col.NextQueryBatch(token, 2); err != nil || done != batch.done || !reflect.DeepEqual(batchIDs, batch.expected) {
+			t.Fatal(batch, batchIDs, done, err)
+		}
+	}
+	// The cursor is gone after the last batch
+	if _, _, err = col.NextQueryBatch(token, 2); dberr.Type(err) != dberr.ErrorNoResultSet {
+		t.Fatal(err)
+	}
+	// A cursor over an empty result is done at once
+	if token, err = OpenQueryCursor([]interface{}{}, col); err != nil {
+		t.Fatal(err)
+	} else if batchIDs, done, err := col.NextQueryBatch(token, 2); err != nil || !done || len(batchIDs) != 0 {
+		t.Fatal(batchIDs, done, err)
+	}
+	// An idle cursor expires
+	db.Config.ResultSetTTLSec = 1
+	if token, err = OpenQueryCursor("all", col); err != nil {
+		t.Fatal(err)
+	}
+	db.resultSets[token].lastUsed = time.Now().Add(-2 * time.Second)
+	if _, _, err = col.NextQueryBatch(token, 2); dberr.Type(err) != dberr.ErrorNoResultSet {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,89 @@
+// Strict query paths.
+//
+// A query operation on a path that no document has matches nothing, just like an operation that finds no match on a
+// path that documents do have, so that a misspelled attribute name goes unnoticed. With StrictPaths enabled in database
+// configuration, an index-assisted operation that matches nothing finds out whether any document has a value on its
+// path, and fails with dberr.ErrorUnknownPath if none does.
+
+package db
+
+import (
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	strictPathSampleSize = 1000 // Number of documents a strict path check reads at most when the path has no index.
+)
+
+// Return dberr.ErrorUnknownPath if no document has a value on the path of the query operation. Operations other than
+// lookup, path existence test, integer set, integer range and duplicates are not checked. Does not place schema lock.
+func unknownPath(expr map[string]interface{}, src *Col) error {
+	var path interface{}
+	if _, lookup := expr["eq"]; lookup {
+		path = expr["in"]
+	} else if _, lookup := expr["eq-ci"]; lookup {
+		path = expr["in"]
+	} else if _, lookup := expr["eq-co"]; lookup {
+		path = expr["in"]
+	} else if hasPath, exist := expr["has"]; exist {
+		if _, isUnion := unionOfPaths(hasPath); isUnion {
+			return nil
+		}
+		path = hasPath
+	} else if dupPath, duplicates := expr["duplicates"]; duplicates {
+		path = dupPath
+	} else if _, intSet := expr["int-set"]; intSet {
+		path = expr["in"]
+	} else if _, htRange := expr["int-from"]; htRange {
+		path = expr["in"]
+	} else if _, htRange := expr["int from"]; htRange {
+		path = expr["in"]
+	} else {
+		return nil
+	}
+	vecPath, err := queryPath(path)
+	if err != nil || src.pathPresent(vecPath) {
+		return nil
+	}
+	src.traceNote("No document has a value on path %v", vecPath)
+	return dberr.New(dberr.ErrorUnknownPath, vecPath, expr)
+}
+
+// Return true if a document has a value on the path, according to the existence index or a hash index of the path. A
+// path without either index is looked for in the first documents of the collection, up to strictPathSampleSize of them.
+// Does not place schema lock.
+func (col *Col) pathPresent(vecPath []string) bool {
+	idxName := strings.Join(vecPath, INDEX_PATH_SEP)
+	if _, derived := col.derived[idxName]; derived {
+		// Derived values are not on a document path
+		return true
+	} else if existence, hasExistence := col.existence[idxName]; hasExistence {
+		existence.lock.RLock()
+		defer existence.lock.RUnlock()
+		return len(existence.ids) > 0
+	}
+	for _, name := range []string{idxName, CASE_NORMALIZED_INDEX_PREFIX + idxName, COLLATED_INDEX_PREFIX + idxName} {
+		if _, partial := col.partial[name]; partial {
+			// Documents outside of the predicate are not on the index
+			continue
+		} else if _, indexed := col.indexPaths[name]; indexed {
+			present := false
+			col.forEachHashEntry(name, func(int, []int) bool {
+				present = true
+				return false
+			})
+			return present
+		}
+	}
+	present, sampled := false, 0
+	col.forEachDoc(func(id int, docB []byte) bool {
+		sampled++
+		if doc, err := decodeDoc(docB); err == nil && len(indexValues(doc, vecPath)) > 0 {
+			present = true
+		}
+		return !present && sampled < strictPathSampleSize
+	}, false)
+	return present
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestStrictPaths(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	for _, path := range [][]string{{"name"}, {"nmae"}, {"age"}} {
+		if err = col.Index(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = col.IndexExistence([]string{"email"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.IndexSorted([]string{"score"}); err != nil {
+		t.Fatal(err)
+	}
+	col.Insert(map[string]interface{}{"name": "a", "age": 1, "email": "a@example.com", "score": 5})
+	// Without strict paths, a misspelled path matches nothing
+	if result, err := runQuery(`{"eq": "a", "in": ["nmae"]}`, col); err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+	db.Config.StrictPaths = true
+	for query, unknown := range map[string]bool{
+		`{"eq": "a", "in": ["name"]}`:                             false,
+		`{"eq": "b", "in": ["name"]}`:                             false,
+		`{"eq": "a", "in": ["nmae"]}`:                             true,
+		`{"has": ["nmae"]}`:                                       true,
+		`{"has": ["email"]}`:                                      false,
+		`{"int-from": 2, "int-to": 3, "in": ["age"]}`:             false,
+		`{"int-from": 2, "int-to": 3, "in": ["nmae"]}`:            true,
+		`{"int-from": 6, "int-to": 9, "in": ["score"]}`:           false,
+		`{"duplicates": ["nmae"]}`:                                true,
+		`{"n": [{"eq": "a", "in": ["name"]}, {"has": ["nmae"]}]}`: true,
+		`[{"eq": "a", "in": ["name"]}, {"has": ["nmae"]}]`:        true,
+		`{"not-contains": "a", "in": ["nmae"]}`:                   false,
+	} {
+		if _, err := runQuery(query, col); unknown != (dberr.Type(err) == dberr.ErrorUnknownPath) {
+			t.Fatal(query, err)
+		}
+	}
+	// Removing the only document having the path makes it unknown
+	db.Config.StrictPaths = false
+	result, _ := runQuery(`"all"`, col)
+	for id := range result {
+		col.Delete(id)
+	}
+	db.Config.StrictPaths = true
+	for _, query := range []string{`{"has": ["email"]}`, `{"eq": "a", "in": ["name"]}`, `{"int-from": 0, "int-to": 9, "in": ["score"]}`} {
+		if _, err := runQuery(query, col); dberr.Type(err) != dberr.ErrorUnknownPath {
+			t.Fatal(query, err)
+		}
+	}
+}
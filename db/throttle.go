@@ -0,0 +1,73 @@
+// Full document scan throttling.
+//
+// A query operation that cannot use an index reads every document of the collection, and a few of them running at the
+// same time can take the disk and CPU away from the queries that look up index. With MaxConcurrentScans configured, at
+// most that many scans run at a time: a scan waits up to ScanWaitMS for another to finish, and then fails with
+// dberr.ErrorTooBusy. Index lookups, and index scans such as integer range and path existence, are never throttled.
+
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// Full document scans running at the same time.
+type scanSlots struct {
+	lock    sync.Mutex
+	running int           // Number of scans running
+	freed   chan struct{} // Closed when a scan finishes, nil if no scan is waiting
+}
+
+// Take a scan slot, waiting for one to be freed if MaxConcurrentScans are running. Return the function that frees the
+// slot once the scan is done.
+func (db *DB) acquireScan(src *Col) (release func(), err error) {
+	maxScans := db.Config.MaxConcurrentScans
+	if maxScans <= 0 {
+		return func() {}, nil
+	}
+	slots := &db.scans
+	start := time.Now()
+	deadline := start.Add(time.Duration(db.Config.ScanWaitMS) * time.Millisecond)
+	for {
+		slots.lock.Lock()
+		if slots.running < maxScans {
+			slots.running++
+			slots.lock.Unlock()
+			if waited := time.Since(start); waited > time.Millisecond {
+				src.traceNote("Waited %v for another scan to finish", waited)
+			}
+			return db.releaseScan, nil
+		}
+		if slots.freed == nil {
+			slots.freed = make(chan struct{})
+		}
+		freed := slots.freed
+		slots.lock.Unlock()
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			src.traceNote("Rejected the scan as %d scans are running", maxScans)
+			return nil, dberr.New(dberr.ErrorTooBusy, maxScans)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-freed:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Free a scan slot, and wake up the scans waiting for one.
+func (db *DB) releaseScan() {
+	slots := &db.scans
+	slots.lock.Lock()
+	slots.running--
+	if slots.freed != nil {
+		close(slots.freed)
+		slots.freed = nil
+	}
+	slots.lock.Unlock()
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestMaxConcurrentScans(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err = col.Insert(map[string]interface{}{"a": i, "b": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Config.MaxConcurrentScans = 1
+	scan := map[string]interface{}{"not-contains": 1, "in": []interface{}{"b"}}
+	lookup := map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}
+	// Hold the only scan slot
+	held, err := scanFunc(map[string]interface{}{}, col)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(scan, col, &result); dberr.Type(err) != dberr.ErrorTooBusy {
+		t.Fatal(err)
+	}
+	// Index lookup is not throttled
+	result = make(map[int]struct{})
+	if err = EvalQuery(lookup, col, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	// A scan waits for the slot to be freed
+	db.Config.ScanWaitMS = 10000
+	done := make(chan error)
+	go func() {
+		result := make(map[int]struct{})
+		err := EvalQuery(scan, col, &result)
+		if err == nil && len(result) != 9 {
+			t.Error(result)
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		t.Fatal("did not wait", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	held(func(int, []byte) bool { return false }, false)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	// Waiting gives up after ScanWaitMS
+	db.Config.ScanWaitMS = 50
+	if held, err = scanFunc(map[string]interface{}{}, col); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err = EvalQuery(scan, col, &result); dberr.Type(err) != dberr.ErrorTooBusy {
+		t.Fatal(err)
+	} else if took := time.Since(start); took < 50*time.Millisecond {
+		t.Fatal(took)
+	}
+	held(func(int, []byte) bool { return false }, false)
+	// No limit by default
+	db.Config.MaxConcurrentScans = 0
+	for i := 0; i < 3; i++ {
+		if _, err = scanFunc(map[string]interface{}{}, col); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = EvalQuery(scan, col, &result); err != nil {
+		t.Fatal(err)
+	}
+}
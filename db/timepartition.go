@@ -0,0 +1,65 @@
+// Queries across time-partitioned collections.
+//
+// Time-series documents are often split into one collection per period, such as a collection per day. The collections
+// of a series are named by a pattern that has a Go time layout in braces, e.g. "logs-{2006-01-02}" names collections
+// "logs-2024-01-01", "logs-2024-01-02" and so on, and "metrics-{2006-01}" names a collection per month. A collection
+// belongs to the series if its name is the text around the braces with a time in the layout in between, and the time
+// is when its period begins.
+
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Evaluate the query against every collection of the time-partitioned series whose period overlaps the time range from
+// and to (both inclusive), under a single schema lock, and return the result of each collection by its name. Period of
+// a collection is as long as the precision of the layout, e.g. the collection of a day matches a range beginning in the
+// middle of that day. Times in collection names are in the location of from. If the query fails on a collection, the
+// collection has no result and the returned error is ColErrors; the other collections still run.
+func (db *DB) QueryTimePartitions(pattern string, from, to time.Time, q interface{}) (map[string]map[int]struct{}, error) {
+	prefix, layout, suffix, err := timePartitionPattern(pattern)
+	if err != nil {
+		return nil, err
+	} else if from.After(to) {
+		return nil, fmt.Errorf("Time range from %v to %v is empty", from, to)
+	}
+	// The period that from falls in begins at from, truncated to the precision of the layout
+	periodStart, err := time.ParseInLocation(layout, from.Format(layout), from.Location())
+	if err != nil {
+		return nil, err
+	}
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	cols := make([]string, 0)
+	for name := range db.cols {
+		if start, inSeries := timePartitionOf(name, prefix, layout, suffix, from.Location()); inSeries &&
+			!start.Before(periodStart) && !start.After(to) {
+			cols = append(cols, name)
+		}
+	}
+	sort.Strings(cols)
+	return db.queryMulti(cols, q)
+}
+
+// Return the text around the braces of a time-partitioned collection name pattern, and the time layout in between.
+func timePartitionPattern(pattern string) (prefix, layout, suffix string, err error) {
+	lbrace, rbrace := strings.Index(pattern, "{"), strings.Index(pattern, "}")
+	if lbrace < 0 || rbrace < lbrace+2 || strings.Count(pattern, "{") != 1 || strings.Count(pattern, "}") != 1 {
+		return "", "", "", fmt.Errorf("Expecting collection name pattern to have a time layout in braces, e.g. logs-{2006-01-02}, but %s given", pattern)
+	}
+	return pattern[:lbrace], pattern[lbrace+1 : rbrace], pattern[rbrace+1:], nil
+}
+
+// Return the time when the period of the time-partitioned collection begins, or false if the collection does not
+// belong to the series.
+func timePartitionOf(name, prefix, layout, suffix string, loc *time.Location) (time.Time, bool) {
+	if len(name) < len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return time.Time{}, false
+	}
+	start, err := time.ParseInLocation(layout, name[len(prefix):len(name)-len(suffix)], loc)
+	return start, err == nil
+}
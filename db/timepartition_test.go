@@ -0,0 +1,72 @@
+package db
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestQueryTimePartitions(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, name := range []string{"logs-2024-01-01", "logs-2024-01-02", "logs-2024-01-03", "logs-2024-01-05", "logs-archive", "other-2024-01-02"} {
+		if err = db.Create(name); err != nil {
+			t.Fatal(err)
+		}
+		db.Use(name).Insert(map[string]interface{}{"day": name})
+	}
+	day := func(d, h int) time.Time { return time.Date(2024, 1, d, h, 0, 0, 0, time.UTC) }
+	for _, test := range []struct {
+		from, to time.Time
+		expected []string
+	}{
+		{day(1, 0), day(3, 0), []string{"logs-2024-01-01", "logs-2024-01-02", "logs-2024-01-03"}},
+		// A range beginning in the middle of a day covers that day
+		{day(2, 12), day(4, 0), []string{"logs-2024-01-02", "logs-2024-01-03"}},
+		{day(2, 12), day(2, 13), []string{"logs-2024-01-02"}},
+		{day(4, 0), day(4, 23), []string{}},
+		{day(3, 1), day(31, 0), []string{"logs-2024-01-03", "logs-2024-01-05"}},
+	} {
+		results, err := db.QueryTimePartitions("logs-{2006-01-02}", test.from, test.to, "all")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0, len(results))
+		for name, result := range results {
+			if len(result) != 1 {
+				t.Fatal(name, result)
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Fatal(test.from, test.to, names)
+		}
+	}
+	// Text after the layout and a coarser layout
+	if err = db.Create("2024-02.metrics"); err != nil {
+		t.Fatal(err)
+	}
+	if results, err := db.QueryTimePartitions("{2006-01}.metrics", day(31, 0), day(31, 0).AddDate(0, 1, 0), "all"); err != nil || len(results) != 1 {
+		t.Fatal(results, err)
+	}
+	// A failed query is reported by collection
+	if _, err = db.QueryTimePartitions("logs-{2006-01-02}", day(1, 0), day(2, 0), map[string]interface{}{"eq": 1, "in": []interface{}{"day"}}); len(err.(ColErrors)) != 2 {
+		t.Fatal(err)
+	}
+	for _, pattern := range []string{"logs", "logs-{}", "logs-{2006}-{01}", "logs-}2006{"} {
+		if _, err = db.QueryTimePartitions(pattern, day(1, 0), day(2, 0), "all"); err == nil {
+			t.Fatal("Did not error", pattern)
+		}
+	}
+	if _, err = db.QueryTimePartitions("logs-{2006-01-02}", day(2, 0), day(1, 0), "all"); err == nil {
+		t.Fatal("Did not error")
+	}
+}
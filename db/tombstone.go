@@ -0,0 +1,191 @@
+// Soft-delete of documents.
+//
+// When SoftDelete is enabled in database configuration, deleting a document puts a tombstone on it instead of removing
+// it. A tombstoned document stays in collection data and on indexes, but it cannot be read, it is left out of views and
+// document iteration, and query leaf operations leave it out of their result unless the query asks for it with
+// "include-deleted": true, e.g. {"eq": 1, "in": ["a"], "include-deleted": true}. A tombstoned document may be brought
+// back by Undelete, or removed for good by Purge.
+//
+// Tombstones are kept in one hash table file per partition. The files are created when a collection is opened with
+// SoftDelete enabled, and they are kept afterwards so that existing tombstones remain effective.
+
+package db
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// Open tombstone hash tables if soft-delete is enabled or the collection already has them. Does not place schema lock.
+func (col *Col) loadTombstones() error {
+	if _, err := os.Stat(path.Join(col.db.path, col.name, DOC_TOMBSTONE_FILE+"0")); os.IsNotExist(err) && (!col.db.Config.SoftDelete || col.db.Config.ReadOnly) {
+		return nil
+	}
+	return col.openTombstones()
+}
+
+// Open (or create) tombstone hash tables. Does not place schema lock.
+func (col *Col) openTombstones() (err error) {
+	col.tombs = make([]*data.HashTable, col.db.numParts)
+	for i := 0; i < col.db.numParts; i++ {
+		if col.tombs[i], err = col.db.Config.OpenHashTable(
+			path.Join(col.db.path, col.name, DOC_TOMBSTONE_FILE+strconv.Itoa(i))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return true if the document has a tombstone.
+func (col *Col) isDeleted(id int) bool {
+	if col.tombs == nil {
+		return false
+	}
+	ht := col.tombs[id%col.db.numParts]
+	ht.Lock.RLock()
+	defer ht.Lock.RUnlock()
+	return len(ht.Get(id, 1)) > 0
+}
+
+// Put a tombstone on the document and take it out of views. Does not place schema lock.
+func (col *Col) tombstone(id int) {
+	ht := col.tombs[id%col.db.numParts]
+	ht.Lock.Lock()
+	if len(ht.Get(id, 1)) == 0 {
+		ht.Put(id, id)
+	}
+	ht.Lock.Unlock()
+	col.cacheDocID(id, false)
+	col.unviewDoc(id)
+}
+
+// Remove tombstone of the document, and put the document back into views if it still exists. Does not place schema lock.
+func (col *Col) untombstone(id int) {
+	if !col.isDeleted(id) {
+		return
+	}
+	ht := col.tombs[id%col.db.numParts]
+	ht.Lock.Lock()
+	ht.Remove(id, id)
+	ht.Lock.Unlock()
+	if doc, err := col.readForIndex(id); err == nil {
+		col.viewDoc(id, doc)
+	}
+}
+
+// Put a tombstone on an existing document. Does not place schema lock.
+func (col *Col) softDelete(id int) error {
+	part := col.parts[id%col.db.numParts]
+	part.DataLock.Lock()
+	defer part.DataLock.Unlock()
+	docB, err := part.Read(id)
+	if err != nil {
+		return err
+	} else if col.isDeleted(id) {
+		return dberr.New(dberr.ErrorNoDoc, id)
+	}
+	if err := col.db.wal.append(WAL_TOMBSTONE, col.name, id, nil); err != nil {
+		return err
+	}
+	col.tombstone(id)
+	col.touch(id)
+	col.recordVersion(id, docB, nil)
+	return nil
+}
+
+// Bring back a soft-deleted document.
+func (col *Col) Undelete(id int) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if !col.isDeleted(id) {
+		return fmt.Errorf("Document %d is not deleted", id)
+	}
+	part := col.parts[id%col.db.numParts]
+	part.LockUpdate(id)
+	defer part.UnlockUpdate(id)
+	if err := col.db.wal.append(WAL_UNDELETE, col.name, id, nil); err != nil {
+		return err
+	}
+	col.untombstone(id)
+	col.cacheDocID(id, true)
+	col.touch(id)
+	col.recordUndelete(id)
+	return nil
+}
+
+// Record a version of the document brought back from soft-delete. Does not place schema lock.
+func (col *Col) recordUndelete(id int) {
+	part := col.parts[id%col.db.numParts]
+	part.DataLock.RLock()
+	docB, err := part.Read(id)
+	part.DataLock.RUnlock()
+	if err == nil {
+		col.recordVersion(id, nil, docB)
+	}
+}
+
+// Physically remove all soft-deleted documents from the collection and indexes, return the number of documents removed.
+func (col *Col) Purge() (purged int, err error) {
+	if err := col.db.checkWritable(); err != nil {
+		return 0, err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	if col.closed {
+		return 0, dberr.New(dberr.ErrorColClosed, col.name)
+	} else if col.tombs == nil {
+		return 0, nil
+	}
+	for i := 0; i < col.db.numParts; i++ {
+		ht := col.tombs[i]
+		ht.Lock.RLock()
+		_, ids := ht.GetPartition(0, 1)
+		ht.Lock.RUnlock()
+		for _, id := range ids {
+			if err = col.delete(id); err != nil {
+				if dberr.Type(err) != dberr.ErrorNoDoc {
+					return
+				}
+				// The document is gone already, the tombstone is useless
+				tdlog.Noticef("Purge %s: document %d no longer exists", col.name, id)
+				col.untombstone(id)
+				err = nil
+				continue
+			}
+			purged++
+		}
+	}
+	return
+}
+
+// Return a function that tells whether a document should be left out of query leaf result, or nil if no document
+// should be left out. Tombstoned documents are left out unless the query has "include-deleted": true.
+func deletedFilter(expr map[string]interface{}, src *Col) (func(id int) bool, error) {
+	includeDeleted, err := queryBool(expr, "include-deleted")
+	if err != nil || includeDeleted || src.tombs == nil {
+		return nil, err
+	}
+	return src.isDeleted, nil
+}
+
+// Return a document iteration function that passes over tombstoned documents and does fun on the others.
+func (col *Col) skipDeleted(fun func(id int, doc []byte) bool) func(id int, doc []byte) bool {
+	if col.tombs == nil {
+		return fun
+	}
+	return func(id int, doc []byte) bool {
+		if col.isDeleted(id) {
+			return true
+		}
+		return fun(id, doc)
+	}
+}
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestSoftDelete(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", []byte(`{"SoftDelete": true, "WALSync": "os"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	kept, _ := col.Insert(map[string]interface{}{"a": 1})
+	deleted, _ := col.Insert(map[string]interface{}{"a": 1})
+	var q interface{}
+	json.Unmarshal([]byte(`{"eq": 1, "in": ["a"]}`), &q)
+	if err = col.CreateView("ones", q); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.Delete(deleted); err != nil {
+		t.Fatal(err)
+	}
+	if col.Delete(deleted) == nil {
+		t.Fatal("Did not error")
+	}
+	if _, err = col.Read(deleted); err == nil {
+		t.Fatal("Did not error")
+	}
+	if ids := col.View("ones"); !reflect.DeepEqual(ids, []int{kept}) {
+		t.Fatal(ids)
+	}
+	// The deleted document cannot be updated back into the indexes
+	if err = col.Update(deleted, map[string]interface{}{"a": 2}); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	if err = col.UpdateFunc(deleted, func(doc map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"a": 2}, nil
+	}); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	if err = col.UpdateBytesFunc(deleted, func(doc []byte) ([]byte, error) {
+		return []byte(`{"a": 2}`), nil
+	}); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	if result, err := runQuery(`{"eq": 2, "in": ["a"], "include-deleted": true}`, col); err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+	// Leaf operations leave out the deleted document unless they ask for it
+	for str, expected := range map[string][]int{
+		`{"eq": 1, "in": ["a"]}`:                                {kept},
+		`{"eq": 1, "in": ["a"], "limit": 1}`:                    {kept},
+		`{"eq": 1, "in": ["a"], "consistency": "fast"}`:         {kept},
+		`{"has": ["a"]}`:                                        {kept},
+		`{"int-from": 0, "int-to": 2, "in": ["a"], "limit": 1}`: {kept},
+		`"all"`: {kept},
+		`{"eq": 1, "in": ["a"], "include-deleted": true}`:                    {kept, deleted},
+		`{"has": ["a"], "include-deleted": true}`:                            {kept, deleted},
+		`{"int-from": 0, "int-to": 2, "in": ["a"], "include-deleted": true}`: {kept, deleted},
+	} {
+		result, err := runQuery(str, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(str, result, err)
+		}
+	}
+	if _, err = runQuery(`{"has": ["a"], "include-deleted": 1}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+	docs := 0
+	col.ForEachDoc(func(id int, _ []byte) bool {
+		docs++
+		return true
+	})
+	if docs != 1 {
+		t.Fatal(docs)
+	}
+	// Tombstone survives scrub and WAL replay
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if _, err = col.Read(deleted); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err = col.Undelete(deleted); err != nil {
+		t.Fatal(err)
+	}
+	if col.Undelete(deleted) == nil {
+		t.Fatal("Did not error")
+	}
+	if doc, err := col.Read(deleted); err != nil || doc["a"].(float64) != 1 {
+		t.Fatal(doc, err)
+	}
+	if ids := col.View("ones"); len(ids) != 2 {
+		t.Fatal(ids)
+	}
+	// Log a soft-delete that never reaches the tombstone, then "crash" without a checkpoint
+	if err = db.wal.append(WAL_TOMBSTONE, "col", deleted, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, col := range db.cols {
+		col.close()
+	}
+	db.wal.close()
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if _, err = col.Read(deleted); err == nil {
+		t.Fatal("Did not error")
+	}
+	// Purge removes the deleted document for good
+	if purged, err := col.Purge(); err != nil || purged != 1 {
+		t.Fatal(purged, err)
+	}
+	if result, err := runQuery(`{"eq": 1, "in": ["a"], "include-deleted": true}`, col); err != nil || len(result) != 1 || !ensureMapHasKeys(result, kept) {
+		t.Fatal(result, err)
+	}
+	if purged, err := col.Purge(); err != nil || purged != 0 {
+		t.Fatal(purged, err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHardDeleteClearsTombstone(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	// Without soft-delete the collection has no tombstone
+	if _, err := os.Stat(TEST_DATA_DIR + "/col/" + DOC_TOMBSTONE_FILE + "0"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	id, _ := col.Insert(map[string]interface{}{"a": 1})
+	if err = col.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if purged, err := col.Purge(); err != nil || purged != 0 {
+		t.Fatal(purged, err)
+	}
+	// Existing tombstones remain effective when soft-delete is disabled, hard delete removes them
+	if err = col.openTombstones(); err != nil {
+		t.Fatal(err)
+	}
+	id, _ = col.Insert(map[string]interface{}{"a": 1})
+	col.tombstone(id)
+	if _, err = col.Read(id); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err = col.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if col.isDeleted(id) {
+		t.Fatal("Tombstone is left behind")
+	}
+}
@@ -0,0 +1,96 @@
+// Query tracing.
+//
+// A traced query is evaluated on a copy of collection handle that carries a tracer, in the same way as query
+// statistics are collected. As evalQuery recurses, every (sub-)query it enters becomes a node of the trace tree, and
+// query operations note down the indexes they consult and the decisions they take along the way. A collection handle
+// without tracer skips all of that, so queries that are not traced do not pay for tracing.
+
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Evaluation of a (sub-)query as it happened.
+type QueryTrace struct {
+	Op       string        // Query operation, e.g. "eq", "has", "n", "union", "all" or "id" for document ID
+	Query    interface{}   // The (sub-)query
+	Notes    []string      // Indexes consulted, decisions and fallbacks taken, in the order they happened
+	Added    int           // Number of documents the evaluation added to the result
+	Err      error         // Error of the evaluation, if any
+	Duration time.Duration // Wall-clock time of the evaluation, including that of sub-queries
+	Children []*QueryTrace // Sub-queries in the order of evaluation
+}
+
+// Collect trace tree of a query evaluation.
+type queryTracer struct {
+	root    QueryTrace
+	current *QueryTrace
+}
+
+// Start tracing the evaluation of a (sub-)query, and return the function that completes the trace when the evaluation
+// is done. The collection handle must trace.
+func (col *Col) traceQuery(q interface{}, result *map[int]struct{}) func(err error) {
+	node := &QueryTrace{Op: queryOpName(q), Query: q}
+	parent := col.trace.current
+	parent.Children = append(parent.Children, node)
+	col.trace.current = node
+	start, sizeBefore := time.Now(), len(*result)
+	return func(err error) {
+		node.Added, node.Err, node.Duration = len(*result)-sizeBefore, err, time.Since(start)
+		col.trace.current = parent
+	}
+}
+
+// Note down a decision of the query operation being evaluated, if the collection handle traces.
+func (col *Col) traceNote(format string, args ...interface{}) {
+	if col.trace != nil {
+		col.trace.current.Notes = append(col.trace.current.Notes, fmt.Sprintf(format, args...))
+	}
+}
+
+// Return the name of query operation, following the order in which evalQuery recognizes them.
+func queryOpName(q interface{}) string {
+	switch expr := q.(type) {
+	case []interface{}:
+		return "union"
+	case string:
+		if expr == "all" {
+			return "all"
+		}
+		return "id"
+	case map[string]interface{}:
+		for _, op := range []string{"sample-rate", "eq", "eq-ci", "eq-co", "has", "duplicates", "nearest", "modified-since", "contains-anywhere", "re-path", "like", "key-re",
+			"not-contains", "fields-eq", "type", "len", "str-len", "is-null", "compute", "ids-and", "and", "or", "not", "n", "c", "min-match", "weighted", "int-set", "int-from", "int from"} {
+			if _, isOp := expr[op]; isOp {
+				return op
+			}
+		}
+	}
+	return "none"
+}
+
+// Optimize and evaluate a query like EvalQuery does, and return the result along with the trace of evaluation. The
+// root of trace is the optimized query, and it notes down the original query if optimization has changed it.
+func EvalQueryWithTrace(q interface{}, src *Col) (result map[int]struct{}, trace *QueryTrace, err error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	// The query is evaluated on a copy of collection handle that traces, so that concurrent queries are not traced
+	traced := *src
+	traced.trace = new(queryTracer)
+	traced.trace.current = &traced.trace.root
+	result = make(map[int]struct{})
+	optimized := optimizeQuery(q, &traced)
+	err = evalQuery(optimized, &traced, &result, false)
+	if len(traced.trace.root.Children) == 0 {
+		// Closed collection ends evaluation before the query is traced
+		return result, nil, err
+	}
+	trace = traced.trace.root.Children[0]
+	if !reflect.DeepEqual(optimized, q) {
+		trace.Notes = append([]string{fmt.Sprintf("Optimized from %v", q)}, trace.Notes...)
+	}
+	return
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEvalQueryWithTrace(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	col.Index([]string{"b"})
+	if err = col.IndexSorted([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		col.Insert(map[string]interface{}{"a": i, "b": i})
+	}
+	var q interface{}
+	json.Unmarshal([]byte(`{"n": [{"n": [{"int-from": 0, "int-to": 5, "in": ["b"]}, {"eq": 3, "in": ["a"]}]}, {"eq": 20, "in": ["a"]}, {"has": ["c"]}]}`), &q)
+	result, trace, err := EvalQueryWithTrace(q, col)
+	if err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+	expected := make(map[int]struct{})
+	if err = EvalQuery(q, col, &expected); err != nil || !reflect.DeepEqual(result, expected) {
+		t.Fatal(result, expected, err)
+	}
+	// The nested intersection is flattened by optimizer, intersection evaluates the most selective sub-query first and
+	// stops once it becomes empty
+	if trace.Op != "n" || len(trace.Notes) != 2 || !strings.HasPrefix(trace.Notes[0], "Optimized from") ||
+		!strings.Contains(trace.Notes[1], "3 remaining sub-queries are not evaluated") || len(trace.Children) != 1 {
+		t.Fatal(trace.Op, trace.Notes, trace.Children)
+	}
+	if lookup := trace.Children[0]; lookup.Op != "eq" || lookup.Added != 0 || len(lookup.Notes) != 1 ||
+		!strings.Contains(lookup.Notes[0], "on index a found 0 candidates") {
+		t.Fatal(lookup)
+	}
+	// Union traces each sub-query and the documents it adds, range query notes the index it scans
+	json.Unmarshal([]byte(`[{"int-from": 0, "int-to": 2, "in": ["b"]}, {"eq": 1, "in": ["a"], "consistency": "fast"}]`), &q)
+	if result, trace, err = EvalQueryWithTrace(q, col); err != nil || len(result) != 3 {
+		t.Fatal(result, err)
+	}
+	if trace.Op != "union" || trace.Added != 3 || len(trace.Notes) != 0 || len(trace.Children) != 2 {
+		t.Fatal(trace)
+	}
+	if rangeScan := trace.Children[0]; rangeScan.Op != "int-from" || rangeScan.Added != 3 ||
+		!reflect.DeepEqual(rangeScan.Notes, []string{"Scanned sorted index b from 0 to 2"}) {
+		t.Fatal(rangeScan)
+	}
+	if lookup := trace.Children[1]; lookup.Op != "eq" || lookup.Added != 0 || len(lookup.Notes) != 2 {
+		t.Fatal(lookup)
+	}
+	// Errors are traced where they happen
+	json.Unmarshal([]byte(`["all", {"has": ["c"]}]`), &q)
+	if _, trace, err = EvalQueryWithTrace(q, col); err == nil || trace.Err == nil || trace.Children[0].Added != 10 ||
+		trace.Children[1].Err == nil {
+		t.Fatal(trace, err)
+	}
+	// Queries evaluated otherwise are not traced
+	if col.trace != nil {
+		t.Fatal("Collection handle traces")
+	}
+}
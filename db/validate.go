@@ -0,0 +1,87 @@
+// Document validation.
+//
+// A validator is a Go function that checks every document written into a collection by insert and update, and rejects
+// the write by returning an error; e.g. a required attribute is missing, or a value has the wrong type or is out of
+// range. Documents are checked before they are logged or written, so that a rejected document is neither stored nor
+// indexed, and the write fails with dberr.ErrorInvalidDoc. Documents restored by crash recovery and scrub were checked
+// when they were first written, and are not checked again. A validator runs while the collection is locked for the
+// write, hence it must not use the database; e.g. there are no unique constraints in tiedot, and a validator cannot
+// look for another document of the same value.
+// Validation functions cannot be saved, therefore a validator lives only as long as the opened database, and has to be
+// registered again after the database is re-opened.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// Check a document before it is written, and return an error to reject it. The document is decoded the same way as
+// Read returns it, and must not be modified.
+type ValidateFunc func(doc map[string]interface{}) error
+
+// Register a validator to check all documents inserted and updated from now on. Documents already in the collection
+// are not checked.
+func (col *Col) AddValidator(name string, validate ValidateFunc) error {
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	if name == "" {
+		return fmt.Errorf("Validator name may not be empty")
+	} else if validate == nil {
+		return fmt.Errorf("Validator %s must have a validation function", name)
+	} else if _, exists := col.validators[name]; exists {
+		return fmt.Errorf("Validator %s already exists", name)
+	}
+	col.validators[name] = validate
+	return nil
+}
+
+// Unregister a validator.
+func (col *Col) RemoveValidator(name string) error {
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	if _, exists := col.validators[name]; !exists {
+		return fmt.Errorf("Validator %s does not exist", name)
+	}
+	delete(col.validators, name)
+	return nil
+}
+
+// Return names of all validators, in alphabetical order.
+func (col *Col) Validators() []string {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	names := make([]string, 0, len(col.validators))
+	for name := range col.validators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run all validators on the serialized document in the alphabetical order of their names, and return the error of the
+// first validator rejecting it. Does not place schema lock.
+func (col *Col) validate(docJS []byte) error {
+	if len(col.validators) == 0 {
+		return nil
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(docJS, &doc); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(col.validators))
+	for name := range col.validators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := col.validators[name](doc); err != nil {
+			return dberr.New(dberr.ErrorInvalidDoc, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestValidator(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"name"}); err != nil {
+		t.Fatal(err)
+	}
+	requireName := func(doc map[string]interface{}) error {
+		if _, isStr := doc["name"].(string); !isStr {
+			return fmt.Errorf("name is missing")
+		}
+		return nil
+	}
+	positiveAge := func(doc map[string]interface{}) error {
+		if age, isNum := doc["age"].(float64); isNum && age < 0 {
+			return fmt.Errorf("age is negative")
+		}
+		return nil
+	}
+	if err = col.AddValidator("name", requireName); err != nil {
+		t.Fatal(err)
+	} else if err = col.AddValidator("age", positiveAge); err != nil {
+		t.Fatal(err)
+	} else if err = col.AddValidator("age", positiveAge); err == nil {
+		t.Fatal("did not error")
+	} else if err = col.AddValidator("nil", nil); err == nil {
+		t.Fatal("did not error")
+	} else if names := col.Validators(); !reflect.DeepEqual(names, []string{"age", "name"}) {
+		t.Fatal(names)
+	}
+	// Rejected documents are neither stored nor indexed
+	if _, err = col.Insert(map[string]interface{}{"age": 1}); dberr.Type(err) != dberr.ErrorInvalidDoc {
+		t.Fatal(err)
+	} else if _, err = col.Insert(map[string]interface{}{"name": "a", "age": -1}); dberr.Type(err) != dberr.ErrorInvalidDoc {
+		t.Fatal(err)
+	} else if col.ApproxDocCount() != 0 {
+		t.Fatal(col.ApproxDocCount())
+	}
+	id, err := col.Insert(map[string]interface{}{"name": "a", "age": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = col.Update(id, map[string]interface{}{"name": "b", "age": -2}); dberr.Type(err) != dberr.ErrorInvalidDoc {
+		t.Fatal(err)
+	} else if err = col.UpdateFunc(id, func(doc map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"age": 2}, nil
+	}); dberr.Type(err) != dberr.ErrorInvalidDoc {
+		t.Fatal(err)
+	} else if err = col.UpdateBytesFunc(id, func([]byte) ([]byte, error) {
+		return []byte(`{"name": 1}`), nil
+	}); dberr.Type(err) != dberr.ErrorInvalidDoc {
+		t.Fatal(err)
+	} else if doc, err := col.Read(id); err != nil || doc["name"] != "a" {
+		t.Fatal(doc, err)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": "b", "in": []interface{}{"name"}}, col, &result); err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+	if err = col.UpdateBytesFunc(id, func([]byte) ([]byte, error) {
+		return []byte(`{"name": "c", "age": 3}`), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Validators stay with the collection renamed, and go away when removed
+	if err = db.Rename("col", "col2"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col2")
+	if _, err = col.Insert(map[string]interface{}{}); dberr.Type(err) != dberr.ErrorInvalidDoc {
+		t.Fatal(err)
+	} else if err = col.RemoveValidator("name"); err != nil {
+		t.Fatal(err)
+	} else if err = col.RemoveValidator("name"); err == nil {
+		t.Fatal("did not error")
+	} else if _, err = col.Insert(map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+}
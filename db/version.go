@@ -0,0 +1,319 @@
+// Document versioning.
+//
+// When Versioning is enabled in database configuration, every insert, update, soft-delete and undelete of a document
+// appends a version record to the version file of its partition, and a hash table maps document ID to the location of
+// its version records. Collection data keeps serving the latest version, so reads and queries are not affected.
+// A soft-delete is recorded as a version without content. Retention policy KeepVersions and KeepVersionDays bounds the
+// number and age of versions kept for each document; the latest version is always kept.
+//
+// The files are created when a collection is opened with Versioning enabled, and they are kept afterwards so that
+// history remains complete.
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// A version of document.
+type Version struct {
+	Version int                    // Version number, starting from 1 and increasing by 1 with every write
+	Time    time.Time              // Time of the write that made this version
+	Doc     map[string]interface{} // Document content, nil if the document was soft-deleted by this write
+}
+
+// Version record as it is saved in version file.
+type versionRecord struct {
+	Version int             `json:"v"`
+	Time    int64           `json:"t"`
+	Doc     json.RawMessage `json:"d"`
+}
+
+// A version record and its location in version file.
+type versionLoc struct {
+	versionRecord
+	loc int
+}
+
+// Document versions of a collection.
+type versions struct {
+	cols []*data.Collection // Version records, one file per partition
+	hts  []*data.HashTable  // Document ID to location of its version records, the lock also protects version file
+}
+
+// Open version files if versioning is enabled or the collection already has them. Does not place schema lock.
+func (col *Col) loadVersions() error {
+	if _, err := os.Stat(path.Join(col.db.path, col.name, DOC_VERSION_FILE+"0")); os.IsNotExist(err) && (!col.db.Config.Versioning || col.db.Config.ReadOnly) {
+		return nil
+	}
+	return col.openVersions()
+}
+
+// Open (or create) version files and their hash tables. Does not place schema lock.
+func (col *Col) openVersions() (err error) {
+	col.versions = &versions{cols: make([]*data.Collection, col.db.numParts), hts: make([]*data.HashTable, col.db.numParts)}
+	for i := 0; i < col.db.numParts; i++ {
+		if col.versions.cols[i], err = col.db.Config.OpenCollection(
+			path.Join(col.db.path, col.name, DOC_VERSION_FILE+strconv.Itoa(i))); err != nil {
+			return err
+		} else if col.versions.hts[i], err = col.db.Config.OpenHashTable(
+			path.Join(col.db.path, col.name, DOC_VERSION_LOOKUP_FILE+strconv.Itoa(i))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return version records of the document in the order of version number. Caller must lock the version hash table.
+func (col *Col) versionRecords(id int) (records []versionLoc) {
+	partNum := id % col.db.numParts
+	for _, loc := range col.versions.hts[partNum].Get(id, 0) {
+		var record versionLoc
+		if err := json.Unmarshal(col.versions.cols[partNum].Read(loc), &record.versionRecord); err != nil {
+			// Skip corrupted version
+			continue
+		}
+		record.loc = loc
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Version < records[j].Version })
+	return
+}
+
+// Append a version of the document content, or a soft-delete if the content is nil. If the document does not have a
+// version yet, its previous content (if any) is recorded first. A write that leaves the content unchanged, such as
+// WAL replay of a write that has been done, does not make a new version. Does not place schema lock.
+func (col *Col) recordVersion(id int, previous, current []byte) {
+	if col.versions == nil {
+		return
+	}
+	partNum := id % col.db.numParts
+	ht, verCol := col.versions.hts[partNum], col.versions.cols[partNum]
+	ht.Lock.Lock()
+	defer ht.Lock.Unlock()
+	records := col.versionRecords(id)
+	if len(records) == 0 && previous != nil {
+		// The document was written before versioning, its modification time is the best guess of version time
+		nanos, _ := col.modTime(id)
+		records = col.appendVersion(id, records, versionRecord{Version: 1, Time: int64(nanos), Doc: previous})
+	}
+	next := versionRecord{Version: 1, Time: time.Now().UnixNano(), Doc: current}
+	if len(records) > 0 {
+		latest := records[len(records)-1]
+		if sameContent(latest.Doc, current) {
+			return
+		}
+		next.Version = latest.Version + 1
+	}
+	records = col.appendVersion(id, records, next)
+	// Apply retention policy to past versions
+	expire := int64(0)
+	if col.db.Config.KeepVersionDays > 0 {
+		expire = time.Now().Add(-time.Duration(col.db.Config.KeepVersionDays) * 24 * time.Hour).UnixNano()
+	}
+	for i, record := range records[:len(records)-1] {
+		if col.db.Config.KeepVersions > 0 && len(records)-i > col.db.Config.KeepVersions || record.Time < expire {
+			ht.Remove(id, record.loc)
+			verCol.Delete(record.loc)
+		}
+	}
+}
+
+// Save a version record and return the records with it appended. Caller must lock the version hash table.
+func (col *Col) appendVersion(id int, records []versionLoc, record versionRecord) []versionLoc {
+	partNum := id % col.db.numParts
+	if record.Doc == nil {
+		record.Doc = json.RawMessage("null")
+	}
+	recordJS, err := json.Marshal(record)
+	if err != nil {
+		return records
+	}
+	loc, err := col.versions.cols[partNum].Insert(recordJS)
+	if err != nil {
+		return records
+	}
+	col.versions.hts[partNum].Put(id, loc)
+	return append(records, versionLoc{record, loc})
+}
+
+// Return true if both are the same document content (or both are soft-delete), regardless of white space.
+func sameContent(a, b []byte) bool {
+	var compactA, compactB bytes.Buffer
+	if a == nil || bytes.Equal(bytes.TrimSpace(a), []byte("null")) {
+		return b == nil
+	} else if b == nil {
+		return false
+	}
+	return json.Compact(&compactA, a) == nil && json.Compact(&compactB, b) == nil && bytes.Equal(compactA.Bytes(), compactB.Bytes())
+}
+
+// Remove all versions of the document. Does not place schema lock.
+func (col *Col) forgetVersions(id int) {
+	if col.versions == nil {
+		return
+	}
+	partNum := id % col.db.numParts
+	ht := col.versions.hts[partNum]
+	ht.Lock.Lock()
+	for _, loc := range ht.Get(id, 0) {
+		ht.Remove(id, loc)
+		col.versions.cols[partNum].Delete(loc)
+	}
+	ht.Lock.Unlock()
+}
+
+// Return the retained versions of a document, oldest first. The last version is the latest content of the document.
+func (col *Col) History(id int) ([]Version, error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.versions == nil {
+		return nil, fmt.Errorf("Collection %s does not keep document versions", col.name)
+	}
+	ht := col.versions.hts[id%col.db.numParts]
+	ht.Lock.RLock()
+	records := col.versionRecords(id)
+	ht.Lock.RUnlock()
+	if len(records) == 0 {
+		return nil, dberr.New(dberr.ErrorNoDoc, id)
+	}
+	ret := make([]Version, len(records))
+	for i, record := range records {
+		ret[i] = Version{Version: record.Version, Time: time.Unix(0, record.Time)}
+		if err := json.Unmarshal(record.Doc, &ret[i].Doc); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Roll back a document to the content of an earlier version. The rollback is an update that makes a new version.
+func (col *Col) Revert(id int, version int) error {
+	history, err := col.History(id)
+	if err != nil {
+		return err
+	}
+	for _, ver := range history {
+		if ver.Version != version {
+			continue
+		} else if ver.Doc == nil {
+			return fmt.Errorf("Version %d of document %d is a soft-delete", version, id)
+		}
+		col.db.schemaLock.RLock()
+		deleted := col.isDeleted(id)
+		col.db.schemaLock.RUnlock()
+		if deleted {
+			return dberr.New(dberr.ErrorNoDoc, id)
+		}
+		return col.Update(id, ver.Doc)
+	}
+	return fmt.Errorf("Document %d does not have version %d", id, version)
+}
+
+// Return the latest of version records (in the order of version number) written at or before the time, or nil if
+// there is none. Version time may go backward with system clock, the version number decides which one is latest.
+func versionAsOf(records []versionLoc, asOf int64) *versionLoc {
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Time <= asOf {
+			return &records[i]
+		}
+	}
+	return nil
+}
+
+// Return the content of a document as it was at the time. A document that did not exist (or was soft-deleted) at the
+// time, or whose versions of that time are no longer retained, is dberr.ErrorNoDoc.
+func (col *Col) ReadAsOf(id int, asOf time.Time) (doc map[string]interface{}, err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.versions == nil {
+		return nil, fmt.Errorf("Collection %s does not keep document versions", col.name)
+	}
+	ht := col.versions.hts[id%col.db.numParts]
+	ht.Lock.RLock()
+	version := versionAsOf(col.versionRecords(id), asOf.UnixNano())
+	ht.Lock.RUnlock()
+	if version != nil {
+		err = json.Unmarshal(version.Doc, &doc)
+	}
+	if err == nil && doc == nil {
+		err = dberr.New(dberr.ErrorNoDoc, id)
+	}
+	return
+}
+
+// Evaluate a query against documents as they were at the time, and put the IDs of matching documents into result.
+// Every version of every document is read and matched against the query without using index; query may not have limit.
+func EvalQueryAsOf(q interface{}, src *Col, asOf time.Time, result *map[int]struct{}) error {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	return evalQueryAsOf(q, src, asOf, result)
+}
+
+// Evaluate a query against documents as they were at the time. Does not place schema lock.
+func evalQueryAsOf(q interface{}, src *Col, asOf time.Time, result *map[int]struct{}) error {
+	if src.closed {
+		return dberr.New(dberr.ErrorColClosed, src.name)
+	} else if src.versions == nil {
+		return fmt.Errorf("Collection %s does not keep document versions", src.name)
+	}
+	asOfNanos := asOf.UnixNano()
+	for _, ht := range src.versions.hts {
+		ht.Lock.RLock()
+		ids, _ := ht.GetPartition(0, 1)
+		docs := make(map[int]map[string]interface{})
+		for _, id := range ids {
+			if _, seen := docs[id]; seen {
+				continue
+			}
+			docs[id] = nil
+			if version := versionAsOf(src.versionRecords(id), asOfNanos); version != nil {
+				docs[id], _ = decodeDoc(version.Doc)
+			}
+		}
+		ht.Lock.RUnlock()
+		for id, doc := range docs {
+			if doc == nil {
+				continue
+			}
+			match, err := matchDoc(q, id, doc)
+			if err != nil {
+				return err
+			} else if match {
+				(*result)[id] = struct{}{}
+				if err = resultTooLarge(src, result); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Evaluate a query against documents as they were at the time and as they are now, and return the IDs of documents that
+// have come to match the query since then (added), and those that no longer match (removed). The past result is
+// evaluated like EvalQueryAsOf, hence the query may not have limit.
+func DiffQueryAsOf(q interface{}, src *Col, asOf time.Time) (added, removed map[int]struct{}, err error) {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	before := make(map[int]struct{})
+	if err = evalQueryAsOf(q, src, asOf, &before); err != nil {
+		return
+	}
+	after := make(map[int]struct{})
+	if err = evalQuery(optimizeQuery(q, src), src, &after, false); err != nil {
+		return
+	}
+	added, removed = diffResults(before, after)
+	return
+}
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Return the version numbers and values of attribute "a" in document history, -1 for a soft-delete.
+func historyOf(col *Col, id int) (versions []int, vals []float64, err error) {
+	history, err := col.History(id)
+	for _, ver := range history {
+		versions = append(versions, ver.Version)
+		if ver.Doc == nil {
+			vals = append(vals, -1)
+		} else {
+			vals = append(vals, ver.Doc["a"].(float64))
+		}
+	}
+	return
+}
+
+func TestVersioning(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", []byte(`{"Versioning": true, "KeepVersions": 4, "SoftDelete": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	id, _ := col.Insert(map[string]interface{}{"a": 1})
+	if err = col.Update(id, map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	}
+	// Unchanged content does not make a version
+	if err = col.Update(id, map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if versions, vals, err := historyOf(col, id); err != nil || len(versions) != 2 ||
+		versions[0] != 1 || vals[0] != 1 || versions[1] != 2 || vals[1] != 2 {
+		t.Fatal(versions, vals, err)
+	}
+	// Revert is an update that makes a new version, queries see the latest version
+	if err = col.Revert(id, 1); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := col.Read(id); err != nil || doc["a"].(float64) != 1 {
+		t.Fatal(doc, err)
+	}
+	if result, err := runQuery(`{"eq": 1, "in": ["a"]}`, col); err != nil || !ensureMapHasKeys(result, id) {
+		t.Fatal(result, err)
+	}
+	if col.Revert(id, 10) == nil {
+		t.Fatal("Did not error")
+	}
+	// Soft-delete and undelete are versions too, retention keeps the latest 4
+	if err = col.Delete(id); err != nil {
+		t.Fatal(err)
+	} else if col.Revert(id, 2) == nil {
+		t.Fatal("Did not error")
+	} else if err = col.Undelete(id); err != nil {
+		t.Fatal(err)
+	}
+	if versions, vals, err := historyOf(col, id); err != nil || len(versions) != 4 ||
+		versions[0] != 2 || vals[0] != 2 || versions[2] != 4 || vals[2] != -1 || versions[3] != 5 || vals[3] != 1 {
+		t.Fatal(versions, vals, err)
+	}
+	// History survives reopen and scrub, and it is gone with the document
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if versions, _, err := historyOf(col, id); err != nil || len(versions) != 4 || versions[3] != 5 {
+		t.Fatal(versions, err)
+	}
+	if err = col.Revert(id, 2); err != nil {
+		t.Fatal(err)
+	}
+	if versions, vals, err := historyOf(col, id); err != nil || len(versions) != 4 || versions[3] != 6 || vals[3] != 2 {
+		t.Fatal(versions, vals, err)
+	}
+	if err = col.Delete(id); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = col.History(id); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestVersioningOfExistingDoc(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	id, _ := col.Insert(map[string]interface{}{"a": 1})
+	if _, err = col.History(id); err == nil {
+		t.Fatal("Did not error")
+	}
+	// The content written before versioning becomes the first version
+	if err = col.openVersions(); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.Update(id, map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if versions, vals, err := historyOf(col, id); err != nil || len(versions) != 2 || vals[0] != 1 || vals[1] != 2 {
+		t.Fatal(versions, vals, err)
+	}
+}
+
+func TestEvalQueryAsOf(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", []byte(`{"Versioning": true, "SoftDelete": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	// Take the time in between writes
+	instant := func() time.Time {
+		time.Sleep(time.Millisecond)
+		defer time.Sleep(time.Millisecond)
+		return time.Now()
+	}
+	beforeAll := instant()
+	updated, _ := col.Insert(map[string]interface{}{"a": 1})
+	deleted, _ := col.Insert(map[string]interface{}{"a": 1})
+	afterInsert := instant()
+	if err = col.Update(updated, map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(deleted); err != nil {
+		t.Fatal(err)
+	}
+	inserted, _ := col.Insert(map[string]interface{}{"a": 1})
+	afterAll := instant()
+	check := func(query string, asOf time.Time, expected ...int) {
+		var q interface{}
+		if err := json.Unmarshal([]byte(query), &q); err != nil {
+			t.Fatal(err)
+		}
+		result := make(map[int]struct{})
+		if err := EvalQueryAsOf(q, col, asOf, &result); err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(query, asOf, result, err)
+		}
+	}
+	check(`"all"`, beforeAll)
+	check(`{"eq": 1, "in": ["a"]}`, afterInsert, updated, deleted)
+	check(`{"eq": 1, "in": ["a"]}`, afterAll, inserted)
+	check(`{"n": [{"has": ["a"]}, {"int-from": 0, "int-to": 5, "in": ["a"]}]}`, afterAll, updated, inserted)
+	if err = EvalQueryAsOf(map[string]interface{}{"has": []interface{}{"a"}, "limit": 1.0}, col, afterAll, &map[int]struct{}{}); err == nil {
+		t.Fatal("Did not error")
+	}
+	if doc, err := col.ReadAsOf(updated, afterInsert); err != nil || doc["a"].(float64) != 1 {
+		t.Fatal(doc, err)
+	}
+	if _, err := col.ReadAsOf(deleted, afterAll); err == nil {
+		t.Fatal("Did not error")
+	}
+	if _, err := col.ReadAsOf(inserted, afterInsert); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestDiffQueryAsOf(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", []byte(`{"Versioning": true, "SoftDelete": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	unchanged, _ := col.Insert(map[string]interface{}{"a": 1})
+	updated, _ := col.Insert(map[string]interface{}{"a": 2})
+	deleted, _ := col.Insert(map[string]interface{}{"a": 1})
+	time.Sleep(time.Millisecond)
+	asOf := time.Now()
+	time.Sleep(time.Millisecond)
+	if err = col.Update(updated, map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(deleted); err != nil {
+		t.Fatal(err)
+	}
+	inserted, _ := col.Insert(map[string]interface{}{"a": 1})
+	added, removed, err := DiffQueryAsOf(map[string]interface{}{"eq": 1.0, "in": []interface{}{"a"}}, col, asOf)
+	if err != nil || !ensureMapHasKeys(added, updated, inserted) || !ensureMapHasKeys(removed, deleted) {
+		t.Fatal(added, removed, err)
+	}
+	if _, inAdded := added[unchanged]; inAdded {
+		t.Fatal(added)
+	}
+	if _, _, err = DiffQueryAsOf(map[string]interface{}{"has": []interface{}{"a"}, "limit": 1.0}, col, asOf); err == nil {
+		t.Fatal("Did not error")
+	}
+}
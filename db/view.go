@@ -0,0 +1,527 @@
+// Materialized query views.
+//
+// A view is a named query whose result document IDs are kept in memory. The
+// result is maintained incrementally as documents are inserted, updated and
+// deleted: index maintenance re-evaluates the query against that single
+// document. View definitions are saved in collection directory, and results
+// are re-calculated when the collection is opened.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	VIEW_FILE = "views.json" // Name of view definition file in collection directory.
+)
+
+// A view query and its materialized result.
+type view struct {
+	query interface{}
+	ids   map[int]struct{}
+}
+
+// Collection views and their lock.
+type colViews struct {
+	views map[string]*view
+	lock  *sync.RWMutex
+}
+
+// Load view definitions and calculate their results. Does not place schema lock.
+func (col *Col) loadViews() error {
+	col.views = colViews{views: make(map[string]*view), lock: new(sync.RWMutex)}
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, VIEW_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var defs map[string]interface{}
+	if err = json.Unmarshal(content, &defs); err != nil {
+		return err
+	}
+	for name, q := range defs {
+		result := make(map[int]struct{})
+		if err := evalQuery(q, col, &result, false); err != nil {
+			tdlog.Noticef("View %s of collection %s is no longer usable and will not be loaded - %v", name, col.name, err)
+			continue
+		}
+		col.views.views[name] = &view{query: q, ids: result}
+	}
+	return nil
+}
+
+// Save view definitions. Caller must place view lock.
+func (col *Col) saveViews() error {
+	defs := make(map[string]interface{}, len(col.views.views))
+	for name, v := range col.views.views {
+		defs[name] = v.query
+	}
+	content, err := json.Marshal(defs)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(col.db.path, col.name, VIEW_FILE), content, 0600)
+}
+
+// Create a view and materialize its result. The query may not use "limit", as limited results cannot be maintained.
+func (col *Col) CreateView(name string, q interface{}) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	col.views.lock.Lock()
+	defer col.views.lock.Unlock()
+	if _, exists := col.views.views[name]; exists {
+		return fmt.Errorf("View %s already exists", name)
+	}
+	// Make sure the query can be evaluated on a single document
+	if _, err := matchDoc(q, 0, map[string]interface{}{}); err != nil {
+		return err
+	}
+	result := make(map[int]struct{})
+	if err := evalQuery(q, col, &result, false); err != nil {
+		return err
+	}
+	col.views.views[name] = &view{query: q, ids: result}
+	if err := col.saveViews(); err != nil {
+		delete(col.views.views, name)
+		return err
+	}
+	return nil
+}
+
+// Return IDs of documents in the view in ascending order, or nil if the view does not exist.
+func (col *Col) View(name string) []int {
+	col.views.lock.RLock()
+	defer col.views.lock.RUnlock()
+	v, exists := col.views.views[name]
+	if !exists {
+		return nil
+	}
+	ids := make([]int, 0, len(v.ids))
+	for id := range v.ids {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Remove a view.
+func (col *Col) DropView(name string) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.views.lock.Lock()
+	defer col.views.lock.Unlock()
+	if _, exists := col.views.views[name]; !exists {
+		return fmt.Errorf("View %s does not exist", name)
+	}
+	delete(col.views.views, name)
+	return col.saveViews()
+}
+
+// Put the document into views it belongs to. Soft-deleted document does not belong to any view.
+func (col *Col) viewDoc(id int, doc map[string]interface{}) {
+	if col.isDeleted(id) {
+		return
+	}
+	col.views.lock.Lock()
+	defer col.views.lock.Unlock()
+	if len(col.views.views) == 0 {
+		return
+	}
+	if len(col.derived) > 0 || len(col.virtual) > 0 {
+		// Lookups on derived indexes and virtual fields match the calculated values, which go into a copy of the document
+		withValues := make(map[string]interface{}, len(doc)+len(col.derived)+len(col.virtual))
+		for key, val := range doc {
+			withValues[key] = val
+		}
+		col.addDerivedValues(withValues)
+		col.addVirtualFields(withValues)
+		doc = withValues
+	}
+	for name, v := range col.views.views {
+		if match, err := matchDoc(v.query, id, doc); err != nil {
+			tdlog.CritNoRepeat("Failed to maintain view %s of collection %s - %v", name, col.name, err)
+		} else if match {
+			v.ids[id] = struct{}{}
+		}
+	}
+}
+
+// Remove the document from all views.
+func (col *Col) unviewDoc(id int) {
+	col.views.lock.Lock()
+	defer col.views.lock.Unlock()
+	for _, v := range col.views.views {
+		delete(v.ids, id)
+	}
+}
+
+// Remove all documents from all views.
+func (col *Col) clearViews() {
+	col.views.lock.Lock()
+	defer col.views.lock.Unlock()
+	for _, v := range col.views.views {
+		v.ids = make(map[int]struct{})
+	}
+}
+
+// Return vector path of a path parameter, given either as an array of attribute names or as a dot-delimited string.
+func queryPath(path interface{}) ([]string, error) {
+	if str, isStr := path.(string); isStr && str != "" {
+		return splitDotPath(str), nil
+	}
+	vecPathInterface, ok := path.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expecting vector path, but %v given", path)
+	}
+	vecPath := make([]string, 0, len(vecPathInterface))
+	for _, v := range vecPathInterface {
+		vecPath = append(vecPath, fmt.Sprint(v))
+	}
+	return vecPath, nil
+}
+
+// Split a dot-delimited path such as "a.b.c" into attribute names. Backslash escapes a literal dot or backslash in an
+// attribute name, e.g. "version\.major.minor" is the path ["version.major", "minor"].
+func splitDotPath(str string) []string {
+	vecPath := make([]string, 0, strings.Count(str, ".")+1)
+	var name strings.Builder
+	for i := 0; i < len(str); i++ {
+		switch c := str[i]; {
+		case c == '\\' && i+1 < len(str):
+			i++
+			name.WriteByte(str[i])
+		case c == '.':
+			vecPath = append(vecPath, name.String())
+			name.Reset()
+		default:
+			name.WriteByte(c)
+		}
+	}
+	return append(vecPath, name.String())
+}
+
+// Evaluate the query against a single document, return true if the query result would contain the document.
+func matchDoc(q interface{}, id int, doc map[string]interface{}) (bool, error) {
+	switch expr := q.(type) {
+	case []interface{}: // union
+		match := false
+		for _, subExpr := range expr {
+			subMatch, err := matchDoc(subExpr, id, doc)
+			if err != nil {
+				return false, err
+			}
+			match = match || subMatch
+		}
+		return match, nil
+	case string:
+		if expr == "all" {
+			return true, nil
+		} else if expr == "" {
+			return false, nil
+		}
+		docID, err := strconv.ParseInt(expr, 10, 64)
+		if err != nil {
+			return false, dberr.New(dberr.ErrorExpectingInt, "Single Document ID", expr)
+		}
+		return int(docID) == id, nil
+	case map[string]interface{}:
+		if len(expr) == 0 {
+			return false, nil
+		} else if _, hasLimit := expr["limit"]; hasLimit {
+			return false, fmt.Errorf("Query %v has a limit and cannot be matched against a single document", expr)
+		} else if rate, sampled := expr["sample-rate"]; sampled {
+			floatRate, seed, seeded, err := sampleParams(rate, expr)
+			if err != nil {
+				return false, err
+			} else if !seeded {
+				return false, fmt.Errorf("Query %v samples without a seed and cannot be matched against a single document", expr)
+			}
+			match, err := matchDoc(withoutSampleRate(expr), id, doc)
+			return match && sampleFraction(seed, id) < floatRate, err
+		}
+		if _, modified := expr["modified-since"]; modified {
+			return false, fmt.Errorf("Query %v depends on modification time and cannot be matched against a single document", expr)
+		} else if _, duplicates := expr["duplicates"]; duplicates {
+			return false, fmt.Errorf("Query %v compares documents with each other and cannot be matched against a single document", expr)
+		} else if _, nearest := expr["nearest"]; nearest {
+			return false, fmt.Errorf("Query %v compares documents with each other and cannot be matched against a single document", expr)
+		}
+		if lookupValue, lookup := expr["eq"]; lookup {
+			vecPath, err := queryPath(expr["in"])
+			if err != nil {
+				return false, err
+			}
+			lookupValues, isArray := lookupValue.([]interface{})
+			if !isArray {
+				lookupValues = []interface{}{lookupValue}
+			}
+			for _, val := range lookupValues {
+				lookupStrValue := indexString(val)
+				for _, v := range indexValues(doc, vecPath) {
+					if v == lookupStrValue {
+						return true, nil
+					}
+				}
+			}
+			return false, nil
+		} else if normalization, lookupValue, lookup := normalizedLookupOf(expr); lookup {
+			vecPath, err := queryPath(expr["in"])
+			if err != nil {
+				return false, err
+			}
+			lookupValues, isArray := lookupValue.([]interface{})
+			if !isArray {
+				lookupValues = []interface{}{lookupValue}
+			}
+			docVals := pathIndexValues(normalization, doc, vecPath)
+			for _, val := range lookupValues {
+				lookupStrValue := indexString(normalizeIndexValue(normalization, val))
+				for _, v := range docVals {
+					if v == lookupStrValue {
+						return true, nil
+					}
+				}
+			}
+			return false, nil
+		} else if hasPath, exist := expr["has"]; exist {
+			if paths, isUnion := unionOfPaths(hasPath); isUnion {
+				for _, path := range paths {
+					if match, err := matchDoc(map[string]interface{}{"has": path}, id, doc); err != nil || match {
+						return match, err
+					}
+				}
+				return false, nil
+			}
+			vecPath, err := queryPath(hasPath)
+			if err != nil {
+				return false, err
+			}
+			return len(indexValues(doc, vecPath)) > 0, nil
+		} else if value, anywhere := expr["contains-anywhere"]; anywhere {
+			match, err := anywhereMatcher(value, expr)
+			if err != nil {
+				return false, err
+			}
+			return containsAnywhere(doc, match), nil
+		} else if pattern, regex := expr["re-path"]; regex {
+			re, vecPath, err := regexPathParams(pattern, expr)
+			if err != nil {
+				return false, err
+			}
+			return matchRegexPath(re, doc, vecPath), nil
+		} else if pattern, like := expr["like"]; like {
+			re, vecPath, err := likeParams(pattern, expr)
+			if err != nil {
+				return false, err
+			}
+			return matchRegexPath(re, doc, vecPath), nil
+		} else if pattern, regex := expr["key-re"]; regex {
+			re, nested, err := keyRegexParams(pattern, expr)
+			if err != nil {
+				return false, err
+			}
+			return matchKeyRegex(re, doc, nested), nil
+		} else if value, notContains := expr["not-contains"]; notContains {
+			vecPath, excluded, err := notContainsParams(value, expr)
+			if err != nil {
+				return false, err
+			}
+			return containsNone(doc, vecPath, excluded), nil
+		} else if paths, fieldsEq := expr["fields-eq"]; fieldsEq {
+			pathA, pathB, err := fieldsEqParams(paths)
+			if err != nil {
+				return false, err
+			}
+			return fieldsEqual(doc, pathA, pathB), nil
+		} else if typeName, typed := expr["type"]; typed {
+			vecPath, isType, err := jsonTypeParams(typeName, expr)
+			if err != nil {
+				return false, err
+			}
+			return hasValueOfType(doc, vecPath, isType), nil
+		} else if bounds, length := expr["len"]; length {
+			vecPath, inBounds, err := arrayLengthParams(bounds, expr)
+			if err != nil {
+				return false, err
+			}
+			return hasLength(doc, vecPath, inBounds), nil
+		} else if bounds, length := expr["str-len"]; length {
+			vecPath, inBounds, err := stringLengthParams(bounds, expr)
+			if err != nil {
+				return false, err
+			}
+			return hasStringLength(doc, vecPath, inBounds), nil
+		} else if nullPath, null := expr["is-null"]; null {
+			vecPath, err := queryPath(nullPath)
+			if err != nil {
+				return false, err
+			}
+			return hasNull(doc, vecPath), nil
+		} else if condition, computed := expr["compute"]; computed {
+			satisfies, err := computeParams(condition)
+			if err != nil {
+				return false, err
+			}
+			return satisfies(doc), nil
+		} else if idList, idsAnd := expr["ids-and"]; idsAnd {
+			ids, err := queryDocIDs("ids-and", idList)
+			if err != nil {
+				return false, err
+			}
+			subExpr, hasSubExpr := expr["q"]
+			if !hasSubExpr {
+				return false, dberr.New(dberr.ErrorMissing, "q")
+			} else if _, listed := ids[id]; !listed {
+				return false, nil
+			}
+			return matchDoc(subExpr, id, doc)
+		} else if setOp, named := namedSetOp(expr); named {
+			return matchDoc(setOp, id, doc)
+		} else if subExprs, intersect := expr["n"]; intersect {
+			subExprVecs, ok := subExprs.([]interface{})
+			if !ok {
+				return false, dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+			}
+			match := len(subExprVecs) > 0
+			for _, subExpr := range subExprVecs {
+				subMatch, err := matchDoc(subExpr, id, doc)
+				if err != nil {
+					return false, err
+				}
+				match = match && subMatch
+			}
+			return match, nil
+		} else if subExprs, complement := expr["c"]; complement {
+			// Complement is the symmetric difference - the document must match an odd number of sub-queries
+			subExprVecs, ok := subExprs.([]interface{})
+			if !ok {
+				return false, dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+			}
+			if universe, hasUniverse := expr["of"]; hasUniverse {
+				// With a universe, the document must match the universe and none of the sub-queries
+				if match, err := matchDoc(universe, id, doc); err != nil || !match {
+					return false, err
+				}
+				for _, subExpr := range subExprVecs {
+					if subMatch, err := matchDoc(subExpr, id, doc); err != nil || subMatch {
+						return false, err
+					}
+				}
+				return true, nil
+			}
+			match := false
+			for _, subExpr := range subExprVecs {
+				subMatch, err := matchDoc(subExpr, id, doc)
+				if err != nil {
+					return false, err
+				}
+				match = match != subMatch
+			}
+			return match, nil
+		} else if subExprs, minMatch := expr["min-match"]; minMatch {
+			subExprVecs, ok := subExprs.([]interface{})
+			if !ok {
+				return false, dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+			}
+			k, err := queryInt("k", expr["k"])
+			if err != nil {
+				return false, err
+			}
+			count := 0
+			for _, subExpr := range subExprVecs {
+				subMatch, err := matchDoc(subExpr, id, doc)
+				if err != nil {
+					return false, err
+				}
+				if subMatch {
+					count++
+				}
+			}
+			return k >= 1 && count >= k, nil
+		} else if subExprs, weighted := expr["weighted"]; weighted {
+			exprs, _, err := weightedSubQueries(subExprs)
+			if err != nil {
+				return false, err
+			}
+			return matchDoc(exprs, id, doc)
+		} else if intSet, ints := expr["int-set"]; ints {
+			return matchIntSet(intSet, expr, doc)
+		} else if intFrom, htRange := expr["int-from"]; htRange {
+			return matchIntRange(intFrom, expr["int-to"], expr, doc)
+		} else if intFrom, htRange := expr["int from"]; htRange {
+			return matchIntRange(intFrom, expr["int to"], expr, doc)
+		}
+		return false, fmt.Errorf("Query %v does not contain any operation (lookup/union/etc)", expr)
+	case nil:
+		return false, nil
+	}
+	return false, fmt.Errorf("Query %v is neither an object, array nor string", q)
+}
+
+// Return true if the document has an integer value of the set, using the same value representation as index.
+func matchIntSet(intSet interface{}, expr map[string]interface{}, doc map[string]interface{}) (bool, error) {
+	vecPath, err := queryPath(expr["in"])
+	if err != nil {
+		return false, err
+	}
+	ints, err := queryIntSet(intSet)
+	if err != nil {
+		return false, err
+	}
+	for _, strVal := range indexValues(doc, vecPath) {
+		if intVal, isInt := indexedInt(strVal); isInt {
+			for _, setVal := range ints {
+				if intVal == setVal {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// Return true if the document has an integer value within the range, using the same value representation as index.
+func matchIntRange(intFrom, intTo interface{}, expr map[string]interface{}, doc map[string]interface{}) (bool, error) {
+	vecPath, err := queryPath(expr["in"])
+	if err != nil {
+		return false, err
+	}
+	from, err := queryInt("int-from", intFrom)
+	if err != nil {
+		return false, err
+	}
+	to, err := queryInt("int-to", intTo)
+	if err != nil {
+		return false, err
+	}
+	var empty bool
+	if from, to, empty, err = exclusiveRange(from, to, expr); err != nil || empty {
+		return false, err
+	}
+	if from > to {
+		from, to = to, from
+	}
+	for _, strVal := range indexValues(doc, vecPath) {
+		if intVal, isInt := indexedInt(strVal); isInt && intVal >= from && intVal <= to {
+			return true, nil
+		}
+	}
+	return false, nil
+}
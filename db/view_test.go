@@ -0,0 +1,192 @@
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestViewMaintenance(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"status"})
+	col.Index([]string{"age"})
+	active, _ := col.Insert(map[string]interface{}{"status": "active", "age": 20})
+	col.Insert(map[string]interface{}{"status": "closed", "age": 20})
+	var q interface{}
+	json.Unmarshal([]byte(`{"n": [{"eq": "active", "in": ["status"]}, {"int-from": 18, "int-to": 30, "in": ["age"]}]}`), &q)
+	if err = col.CreateView("young active", q); err != nil {
+		t.Fatal(err)
+	}
+	if col.CreateView("young active", q) == nil {
+		t.Fatal("Did not error")
+	}
+	if ids := col.View("young active"); !reflect.DeepEqual(ids, []int{active}) {
+		t.Fatal(ids)
+	}
+	// Insert, update and delete maintain the view
+	inserted, _ := col.Insert(map[string]interface{}{"status": "active", "age": 25})
+	expected := []int{active, inserted}
+	sort.Ints(expected)
+	if ids := col.View("young active"); !reflect.DeepEqual(ids, expected) {
+		t.Fatal(ids)
+	}
+	if err = col.Update(active, map[string]interface{}{"status": "active", "age": 40}); err != nil {
+		t.Fatal(err)
+	}
+	if ids := col.View("young active"); !reflect.DeepEqual(ids, []int{inserted}) {
+		t.Fatal(ids)
+	}
+	if err = col.Delete(inserted); err != nil {
+		t.Fatal(err)
+	}
+	if ids := col.View("young active"); len(ids) != 0 {
+		t.Fatal(ids)
+	}
+	col.Insert(map[string]interface{}{"status": "active", "age": 18})
+	// View definition survives reopen, and result is re-calculated
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("col")
+	if ids := col.View("young active"); len(ids) != 1 {
+		t.Fatal(ids)
+	}
+	// Scrub keeps the view, truncate empties it
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if ids := col.View("young active"); len(ids) != 1 {
+		t.Fatal(ids)
+	}
+	if err = db.Truncate("col"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := col.View("young active"); ids == nil || len(ids) != 0 {
+		t.Fatal(ids)
+	}
+	if err = col.DropView("young active"); err != nil {
+		t.Fatal(err)
+	}
+	if col.DropView("young active") == nil {
+		t.Fatal("Did not error")
+	}
+	if ids := col.View("young active"); ids != nil {
+		t.Fatal(ids)
+	}
+}
+
+func TestViewDerived(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.IndexDerived("lower name", lowerName); err != nil {
+		t.Fatal(err)
+	}
+	existing, _ := col.Insert(map[string]interface{}{"name": "Bob"})
+	var q interface{}
+	json.Unmarshal([]byte(`{"eq": "bob", "in": ["lower name"]}`), &q)
+	if err = col.CreateView("bob", q); err != nil {
+		t.Fatal(err)
+	}
+	// Documents inserted and updated later are matched by their derived values
+	inserted, _ := col.Insert(map[string]interface{}{"name": "BOB"})
+	col.Insert(map[string]interface{}{"name": "Alice"})
+	expected := []int{existing, inserted}
+	sort.Ints(expected)
+	if ids := col.View("bob"); !reflect.DeepEqual(ids, expected) {
+		t.Fatal(ids)
+	}
+	if err = col.Update(existing, map[string]interface{}{"name": "Carol"}); err != nil {
+		t.Fatal(err)
+	}
+	if ids := col.View("bob"); !reflect.DeepEqual(ids, []int{inserted}) {
+		t.Fatal(ids)
+	}
+}
+
+func TestViewQueryErr(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	for _, str := range []string{
+		`{"eq": 1, "in": ["a"], "limit": 1}`,
+		`{"eq": 1}`,
+		`{"eq": 1, "in": ["not indexed"]}`,
+		`{"n": 1}`,
+		`{"nothing": 1}`,
+	} {
+		var q interface{}
+		json.Unmarshal([]byte(str), &q)
+		if col.CreateView("v", q) == nil {
+			t.Fatal("Did not error", str)
+		}
+	}
+}
+
+func TestMatchDoc(t *testing.T) {
+	var doc map[string]interface{}
+	json.Unmarshal([]byte(`{"a": [{"b": 1}, {"b": "x"}], "c": 5, "d": "5"}`), &doc)
+	cases := map[string]bool{
+		`"all"`:                              true,
+		`"12"`:                               true,
+		`"13"`:                               false,
+		`{"eq": "x", "in": ["a", "b"]}`:      true,
+		`{"eq": 2, "in": ["a", "b"]}`:        false,
+		`{"eq": [2, "x"], "in": ["a", "b"]}`: true,
+		`{"eq": [2, 3], "in": ["a", "b"]}`:   false,
+		`{"has": ["c"]}`:                     true,
+		`{"has": ["e"]}`:                     false,
+		`{"int-from": 6, "int-to": 4, "in": ["c"]}`:      true,
+		`{"int from": 4, "int to": 5, "in": ["d"]}`:      true,
+		`{"int-from": 6, "int-to": 9, "in": ["c"]}`:      false,
+		`[{"has": ["e"]}, {"has": ["c"]}]`:               true,
+		`{"n": [{"has": ["e"]}, {"has": ["c"]}]}`:        false,
+		`{"c": [{"has": ["c"]}, {"has": ["d"]}]}`:        false,
+		`{"c": [{"has": ["c"]}, {"has": ["e"]}]}`:        true,
+		`{"min-match": [{"has": ["c"]}, "all"], "k": 2}`: true,
+		`{"weighted": [{"q": {"has": ["e"]}, "w": 1}]}`:  false,
+		`{"contains-anywhere": 5}`:                       true,
+		`{"contains-anywhere": "y"}`:                     false,
+		`{"weighted": [{"q": {"has": ["c"]}, "w": 1}]}`:  true,
+	}
+	for str, expected := range cases {
+		var q interface{}
+		json.Unmarshal([]byte(str), &q)
+		if match, err := matchDoc(q, 12, doc); err != nil || match != expected {
+			t.Fatal(str, match, err)
+		}
+	}
+}
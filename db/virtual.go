@@ -0,0 +1,276 @@
+// Virtual fields.
+//
+// A virtual field is an attribute calculated from the other attributes of a document by an expression, such as
+// `first + " " + last`, rather than stored in the document. Queries refer to a virtual field by its name as a path, e.g.
+// {"eq": "John Smith", "in": ["full_name"]}, and every operation that scans documents finds the field in them as if it
+// were stored. A virtual field is either computed on scan, so that lookup on it scans all documents, or index-backed,
+// in which case its values are kept on a derived index of the same name, and lookup uses the index.
+//
+// The expression is made of numbers, string literals in double quotes, document paths, "+", "-", "*", "/", unary minus
+// and parentheses:
+//   sum      := product (("+" | "-") product)*
+//   product  := operand (("*" | "/") operand)*
+//   operand  := "-" operand | "(" sum ")" | number | string | path
+//   path     := identifier ("." identifier)*
+// "+" adds two numbers, and joins the string forms of its operands otherwise; the other operators take numbers only. A
+// path must lead to a single string or number in the document, otherwise (e.g. the value is missing or an array) the
+// document does not have the virtual field, and neither does it when dividing by zero.
+// Virtual fields live only as long as the opened database, and have to be added again after the database is re-opened.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// Value of a virtual field expression on a document - a number or a string - false if the document has no value for it.
+type virtualFunc func(doc map[string]interface{}) (interface{}, bool)
+
+// A virtual field and how it is calculated.
+type virtualField struct {
+	expression string
+	value      virtualFunc
+	indexed    bool // Values are kept on the derived index of the same name
+}
+
+// Add a virtual field calculated by the expression. An index-backed virtual field puts all documents on a derived index
+// of the same name, so that lookup uses the index rather than scanning all documents.
+func (col *Col) AddVirtualField(name, expression string, indexed bool) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	if name == "" || strings.Contains(name, INDEX_PATH_SEP) {
+		return fmt.Errorf("Virtual field name %s may not be empty or contain %s", name, INDEX_PATH_SEP)
+	} else if _, exists := col.virtual[name]; exists {
+		return fmt.Errorf("Virtual field %s already exists", name)
+	} else if _, indexed := col.indexPaths[name]; indexed {
+		return fmt.Errorf("Virtual field %s would hide the index of the same path", name)
+	} else if _, derived := col.derived[name]; derived {
+		return fmt.Errorf("Virtual field %s would hide the derived index of the same name", name)
+	}
+	value, err := parseVirtualExpression(expression)
+	if err != nil {
+		return err
+	}
+	if indexed {
+		if err = col.indexDerived(name, virtualDeriveFunc(value)); err != nil {
+			return err
+		}
+	}
+	col.virtual[name] = &virtualField{expression: expression, value: value, indexed: indexed}
+	return nil
+}
+
+// Remove a virtual field, along with its derived index if it is index-backed.
+func (col *Col) RemoveVirtualField(name string) error {
+	if err := col.db.checkWritable(); err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.schemaLock.Unlock()
+	field, exists := col.virtual[name]
+	if !exists {
+		return fmt.Errorf("Virtual field %s does not exist", name)
+	}
+	delete(col.virtual, name)
+	if _, derived := col.derived[name]; field.indexed && derived {
+		return col.unindexDerived(name)
+	}
+	return nil
+}
+
+// Return the expressions of all virtual fields by field name.
+func (col *Col) VirtualFields() map[string]string {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	fields := make(map[string]string, len(col.virtual))
+	for name, field := range col.virtual {
+		fields[name] = field.expression
+	}
+	return fields
+}
+
+// Put the values of virtual fields into the document, in place of stored attributes of the same name. Does not place
+// schema lock.
+func (col *Col) addVirtualFields(doc map[string]interface{}) {
+	for name, field := range col.virtual {
+		if val, hasVal := field.value(doc); hasVal {
+			doc[name] = val
+		} else {
+			delete(doc, name)
+		}
+	}
+}
+
+// Return the serialized document with the values of virtual fields, or the document itself if the collection has no
+// virtual field or the document cannot be decoded. Does not place schema lock.
+func (col *Col) withVirtualFields(docB []byte) []byte {
+	if len(col.virtual) == 0 {
+		return docB
+	}
+	doc, err := decodeDoc(docB)
+	if err != nil {
+		return docB
+	}
+	col.addVirtualFields(doc)
+	if withFields, err := json.Marshal(doc); err == nil {
+		return withFields
+	}
+	return docB
+}
+
+// Return the derivation function that puts the value of virtual field on derived index.
+func virtualDeriveFunc(value virtualFunc) DeriveFunc {
+	return func(doc map[string]interface{}) []interface{} {
+		if val, hasVal := value(doc); hasVal {
+			return []interface{}{val}
+		}
+		return nil
+	}
+}
+
+// Parse the expression of virtual field, and return the function that calculates its value. Syntax error reports the
+// column where it occurs.
+func parseVirtualExpression(expression string) (virtualFunc, error) {
+	tokens, err := tokenizeComputation(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	value, err := p.parseVirtualSum()
+	if err != nil {
+		return nil, err
+	} else if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, dberr.New(dberr.ErrorQuerySyntax, tok.col, fmt.Sprintf("unexpected '%s'", tok.text))
+	}
+	return value, nil
+}
+
+// sum := product (("+" | "-") product)*
+func (p *queryParser) parseVirtualSum() (virtualFunc, error) {
+	left, err := p.parseVirtualProduct()
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok.kind == tokenOp && (tok.text == "+" || tok.text == "-"); tok = p.peek() {
+		p.next()
+		right, err := p.parseVirtualProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = virtualArithmetic(tok.text, left, right)
+	}
+	return left, nil
+}
+
+// product := operand (("*" | "/") operand)*
+func (p *queryParser) parseVirtualProduct() (virtualFunc, error) {
+	left, err := p.parseVirtualOperand()
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok.kind == tokenOp && (tok.text == "*" || tok.text == "/"); tok = p.peek() {
+		p.next()
+		right, err := p.parseVirtualOperand()
+		if err != nil {
+			return nil, err
+		}
+		left = virtualArithmetic(tok.text, left, right)
+	}
+	return left, nil
+}
+
+// operand := "-" operand | "(" sum ")" | number | string | path
+func (p *queryParser) parseVirtualOperand() (virtualFunc, error) {
+	tok := p.next()
+	switch {
+	case tok.kind == tokenOp && tok.text == "-":
+		operand, err := p.parseVirtualOperand()
+		if err != nil {
+			return nil, err
+		}
+		return virtualArithmetic("-", func(map[string]interface{}) (interface{}, bool) { return float64(0), true }, operand), nil
+	case tok.kind == tokenLParen:
+		inner, err := p.parseVirtualSum()
+		if err != nil {
+			return nil, err
+		} else if closing := p.next(); closing.kind != tokenRParen {
+			return nil, dberr.New(dberr.ErrorQuerySyntax, closing.col, "expecting ')'")
+		}
+		return inner, nil
+	case tok.kind == tokenNumber:
+		num, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, dberr.New(dberr.ErrorQuerySyntax, tok.col, fmt.Sprintf("invalid number '%s'", tok.text))
+		}
+		return func(map[string]interface{}) (interface{}, bool) {
+			return num, true
+		}, nil
+	case tok.kind == tokenString:
+		return func(map[string]interface{}) (interface{}, bool) {
+			return tok.text, true
+		}, nil
+	case tok.kind == tokenIdent:
+		vecPath := strings.Split(tok.text, ".")
+		return func(doc map[string]interface{}) (interface{}, bool) {
+			vals := GetIn(doc, vecPath)
+			if len(vals) != 1 {
+				return nil, false
+			} else if str, isStr := vals[0].(string); isStr {
+				return str, true
+			}
+			num, err := queryFloat(tok.text, vals[0])
+			return num, err == nil
+		}, nil
+	case tok.kind == tokenEOF:
+		return nil, dberr.New(dberr.ErrorQuerySyntax, tok.col, "unexpected end of expression")
+	}
+	return nil, dberr.New(dberr.ErrorQuerySyntax, tok.col, fmt.Sprintf("unexpected '%s'", tok.text))
+}
+
+// Return the function that applies the operator to the values of both operands. "+" joins the string forms of operands
+// unless both are numbers.
+func virtualArithmetic(op string, left, right virtualFunc) virtualFunc {
+	return func(doc map[string]interface{}) (interface{}, bool) {
+		leftVal, hasLeft := left(doc)
+		if !hasLeft {
+			return nil, false
+		}
+		rightVal, hasRight := right(doc)
+		if !hasRight {
+			return nil, false
+		}
+		leftNum, leftIsNum := leftVal.(float64)
+		rightNum, rightIsNum := rightVal.(float64)
+		if !leftIsNum || !rightIsNum {
+			if op != "+" {
+				return nil, false
+			}
+			return virtualString(leftVal) + virtualString(rightVal), true
+		}
+		switch op {
+		case "+":
+			return leftNum + rightNum, true
+		case "-":
+			return leftNum - rightNum, true
+		case "*":
+			return leftNum * rightNum, true
+		}
+		return leftNum / rightNum, rightNum != 0
+	}
+}
+
+// Return the string form of a virtual field value.
+func virtualString(val interface{}) string {
+	if num, isNum := val.(float64); isNum {
+		return strconv.FormatFloat(num, 'f', -1, 64)
+	}
+	return val.(string)
+}
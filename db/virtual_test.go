@@ -0,0 +1,162 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestVirtualField(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"kind"}); err != nil {
+		t.Fatal(err)
+	}
+	john, _ := col.Insert(map[string]interface{}{"first": "John", "last": "Smith", "price": 10, "qty": 3, "kind": "a"})
+	jane, _ := col.Insert(map[string]interface{}{"first": "Jane", "last": "Doe", "price": 2.5, "qty": 2, "kind": "b"})
+	col.Insert(map[string]interface{}{"first": "Ann", "price": "free", "kind": "a"})
+	if err = col.AddVirtualField("full_name", `first + " " + last`, false); err != nil {
+		t.Fatal(err)
+	} else if err = col.AddVirtualField("total", "(price * qty) + 0", true); err != nil {
+		t.Fatal(err)
+	} else if fields := col.VirtualFields(); !reflect.DeepEqual(fields, map[string]string{"full_name": `first + " " + last`, "total": "(price * qty) + 0"}) {
+		t.Fatal(fields)
+	}
+	query := func(q string) []int {
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(q), &parsed); err != nil {
+			t.Fatal(err)
+		}
+		result := make(map[int]struct{})
+		if err := EvalQuery(parsed, col, &result); err != nil {
+			t.Fatal(q, err)
+		}
+		ids := make([]int, 0, len(result))
+		for id := range result {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		return ids
+	}
+	sorted := func(ids ...int) []int {
+		sort.Ints(ids)
+		return ids
+	}
+	for q, expected := range map[string][]int{
+		// Computed on scan
+		`{"eq": "John Smith", "in": ["full_name"]}`:                                        {john},
+		`{"like": "J%", "in": ["full_name"]}`:                                              sorted(john, jane),
+		`{"n": [{"eq": "a", "in": ["kind"]}, {"re-path": "Smith$", "in": ["full_name"]}]}`: {john},
+		`{"n": [{"eq": "b", "in": ["kind"]}, {"eq": "Jane Doe", "in": ["full_name"]}]}`:    {jane},
+		`{"has": ["full_name"]}`:                                                           sorted(john, jane),
+		// Index-backed
+		`{"eq": 30, "in": ["total"]}`:         {john},
+		`{"compute": "total < 6"}`:            {jane},
+		`{"type": "number", "in": ["total"]}`: sorted(john, jane),
+		`{"has": ["total"]}`:                  sorted(john, jane),
+	} {
+		if ids := query(q); !reflect.DeepEqual(ids, expected) {
+			t.Fatal(q, ids, expected)
+		}
+	}
+	db.Config.MaxResultSize = 1
+	if _, err := runQuery(`{"has": ["full_name"]}`, col); dberr.Type(err) != dberr.ErrorResultTooLarge {
+		t.Fatal(err)
+	}
+	db.Config.MaxResultSize = 0
+	var q interface{}
+	json.Unmarshal([]byte(`{"eq": "John Smith", "in": ["full_name"]}`), &q)
+	if _, trace, err := EvalQueryWithTrace(q, col); err != nil || !strings.Contains(fmt.Sprint(trace.Notes), "Virtual field full_name is not indexed") {
+		t.Fatal(trace, err)
+	}
+	for name, view := range map[string]string{"bobs": `{"eq": "Bob 1", "in": ["full_name"]}`, "thirty": `{"eq": 30, "in": ["total"]}`} {
+		json.Unmarshal([]byte(view), &q)
+		if err = col.CreateView(name, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Stored documents do not change, the index and views follow new documents
+	if doc, err := col.Read(john); err != nil || doc["full_name"] != nil {
+		t.Fatal(doc, err)
+	}
+	bob, _ := col.Insert(map[string]interface{}{"first": "Bob", "last": 1, "price": 15, "qty": 2})
+	if ids := query(`{"eq": 30, "in": ["total"]}`); !reflect.DeepEqual(ids, sorted(john, bob)) {
+		t.Fatal(ids)
+	} else if ids = query(`{"eq": "Bob 1", "in": ["full_name"]}`); !reflect.DeepEqual(ids, []int{bob}) {
+		t.Fatal(ids)
+	} else if ids = col.View("bobs"); !reflect.DeepEqual(ids, []int{bob}) {
+		t.Fatal(ids)
+	} else if ids = col.View("thirty"); !reflect.DeepEqual(ids, sorted(john, bob)) {
+		t.Fatal(ids)
+	}
+	// Virtual fields survive scrub
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if ids := query(`{"eq": "Jane Doe", "in": ["full_name"]}`); !reflect.DeepEqual(ids, []int{jane}) {
+		t.Fatal(ids)
+	} else if ids = query(`{"eq": 5, "in": ["total"]}`); !reflect.DeepEqual(ids, []int{jane}) {
+		t.Fatal(ids)
+	}
+	for _, c := range []struct{ name, expression string }{
+		{"full_name", "first"}, {"kind", "first"}, {"", "first"}, {"a!b", "first"}, {"x", "first +"}, {"x", "first == last"}, {"x", `"open`},
+	} {
+		if err = col.AddVirtualField(c.name, c.expression, false); err == nil {
+			t.Fatal("did not error", c)
+		}
+	}
+	// Removing the fields removes the derived index
+	if err = col.RemoveVirtualField("full_name"); err != nil {
+		t.Fatal(err)
+	} else if err = col.RemoveVirtualField("total"); err != nil {
+		t.Fatal(err)
+	} else if err = col.RemoveVirtualField("total"); err == nil {
+		t.Fatal("did not error")
+	} else if derived := col.AllDerivedIndexes(); len(derived) != 0 {
+		t.Fatal(derived)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": "John Smith", "in": []interface{}{"full_name"}}, col, &result); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+}
+
+func TestParseVirtualExpression(t *testing.T) {
+	doc := map[string]interface{}{"a": "x", "b": 2, "c": map[string]interface{}{"d": 3.5}, "e": []interface{}{1, 2}, "z": 0}
+	for expression, expected := range map[string]interface{}{
+		`a + "-" + b`:    "x-2",
+		`b + c.d`:        5.5,
+		`b + c.d + a`:    "5.5x",
+		`-(b * c.d) / 7`: float64(-1),
+		`"q\"" + 1`:      `q"1`,
+		`b - a`:          nil,
+		`b / z`:          nil,
+		`e + 1`:          nil,
+		`missing + "x"`:  nil,
+	} {
+		value, err := parseVirtualExpression(expression)
+		if err != nil {
+			t.Fatal(expression, err)
+		}
+		val, hasVal := value(doc)
+		if expected == nil && hasVal || expected != nil && val != expected {
+			t.Fatal(expression, val, hasVal)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Write-ahead log of document writes.
+//
+// Every document insert/update/delete is appended to the log before it is
+// applied to collection data and indexes. Updates and deletes also carry the
+// document they replace. Upon opening a database, entries left in the log are
+// replayed so that interrupted writes and the index updates derived from them
+// are carried out in full, and values of the replaced document are taken off
+// the indexes even if the crash came between the data write and index update.
+//
+// The log is emptied (checkpoint) after all data files are flushed to storage
+// device, which happens on DB close, before every collection schema change, and
+// in the background once the log grows beyond the configured size.
+
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	WAL_FILE = "wal.log" // Write-ahead log file name, located in database directory.
+
+	WAL_INSERT = "insert" // Log entry of document insert
+	WAL_UPDATE = "update" // Log entry of document update
+	WAL_DELETE = "delete" // Log entry of document delete
+
+	WAL_TOMBSTONE = "tombstone" // Log entry of document soft-delete
+	WAL_UNDELETE  = "undelete"  // Log entry of bringing back a soft-deleted document
+)
+
+// A single write-ahead log entry.
+type walEntry struct {
+	Op  string          `json:"op"`
+	Col string          `json:"col"`
+	ID  int             `json:"id"`
+	Doc json.RawMessage `json:"doc,omitempty"`
+	Old json.RawMessage `json:"old,omitempty"` // document replaced by update/delete
+}
+
+// Write-ahead log file. A nil *wal indicates that the log is disabled.
+type wal struct {
+	path   string
+	policy string
+	fh     *os.File
+	dirty  bool   // log has been written since the last flush
+	size   int64  // size of log file
+	limit  int64  // size above which the log asks for a checkpoint, 0 means no limit
+	full   func() // called once the log grows beyond the limit, until the log is emptied
+	isFull bool   // full has been called since the log was last emptied
+	lock   *sync.Mutex
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// Open (or create) the log file and start periodic flush if the policy calls for it.
+func openWAL(path string, conf *data.Config) (*wal, error) {
+	switch conf.WALSync {
+	case data.WALSyncOS, data.WALSyncInterval, data.WALSyncAlways:
+	default:
+		return nil, fmt.Errorf("Unknown WAL sync policy '%s'", conf.WALSync)
+	}
+	fh, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	log := &wal{path: path, policy: conf.WALSync, fh: fh, limit: int64(conf.WALCheckpointBytes), lock: new(sync.Mutex)}
+	if log.policy == data.WALSyncInterval {
+		interval := time.Duration(conf.WALIntervalMS) * time.Millisecond
+		if interval <= 0 {
+			return nil, fmt.Errorf("WAL flush interval must be positive, but %d given", conf.WALIntervalMS)
+		}
+		log.stop = make(chan struct{})
+		log.done = make(chan struct{})
+		go log.flushPeriodically(interval)
+	}
+	return log, nil
+}
+
+// Flush the log file every interval until the log is closed.
+func (log *wal) flushPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(log.done)
+	for {
+		select {
+		case <-log.stop:
+			return
+		case <-ticker.C:
+			log.lock.Lock()
+			if log.dirty {
+				if err := log.fh.Sync(); err != nil {
+					tdlog.CritNoRepeat("Failed to flush %s: %v", log.path, err)
+				} else {
+					log.dirty = false
+				}
+			}
+			log.lock.Unlock()
+		}
+	}
+}
+
+// Append an entry to the log, the entry is durable according to sync policy when the function returns.
+func (log *wal) append(op, colName string, id int, doc []byte) error {
+	return log.appendReplacing(op, colName, id, nil, doc)
+}
+
+// Append an update/delete entry that also carries the replaced document. The replaced document is left out if it is
+// not valid JSON, in which case replay cannot unindex it (like the interrupted write could not either).
+func (log *wal) appendReplacing(op, colName string, id int, old, doc []byte) error {
+	if log == nil {
+		return nil
+	}
+	if !json.Valid(old) {
+		old = nil
+	}
+	entry, err := json.Marshal(walEntry{Op: op, Col: colName, ID: id, Doc: doc, Old: old})
+	if err != nil {
+		return err
+	}
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	written, err := log.fh.Write(append(entry, '\n'))
+	log.size += int64(written)
+	if err != nil {
+		return err
+	}
+	if log.limit > 0 && log.size > log.limit && !log.isFull && log.full != nil {
+		log.isFull = true
+		log.full()
+	}
+	if log.policy == data.WALSyncAlways {
+		return log.fh.Sync()
+	}
+	log.dirty = true
+	return nil
+}
+
+// Read all complete entries from the log. A torn entry at the end of log (e.g. from a crash) is ignored.
+func readWAL(path string) (entries []walEntry, err error) {
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	reader := bufio.NewReader(fh)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// The last line is incomplete if it is not terminated by new-line
+			return entries, nil
+		}
+		var entry walEntry
+		if err := json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil {
+			tdlog.Noticef("Stop reading %s at a corrupted entry: %v", path, err)
+			return entries, nil
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// Empty the log. Caller must make sure that all logged writes have been flushed to storage device.
+func (log *wal) reset() error {
+	if log == nil {
+		return nil
+	}
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	// Another checkpoint may be asked for even if this one fails
+	log.isFull = false
+	if err := log.fh.Truncate(0); err != nil {
+		return err
+	}
+	log.dirty, log.size = false, 0
+	return log.fh.Sync()
+}
+
+// Stop periodic flush, flush and close the log file.
+func (log *wal) close() error {
+	if log == nil {
+		return nil
+	}
+	if log.stop != nil {
+		close(log.stop)
+		<-log.done
+	}
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if err := log.fh.Sync(); err != nil {
+		return err
+	}
+	return log.fh.Close()
+}
+
+// Re-apply logged document writes to their collections. Does not place schema lock.
+func (db *DB) replayWAL(entries []walEntry) {
+	for _, entry := range entries {
+		col, exists := db.cols[entry.Col]
+		if !exists {
+			tdlog.Noticef("Replay WAL: skip %s of document %d in collection %s that no longer exists", entry.Op, entry.ID, entry.Col)
+			continue
+		}
+		// The crash may have come after the data write but before the index update, leaving the replaced document's
+		// values on the indexes. Indexes no longer hold them after a complete write, and removing them again is harmless.
+		if len(entry.Old) > 0 {
+			if old, err := decodeDoc(entry.Old); err == nil {
+				col.unindexDoc(entry.ID, old)
+			}
+		}
+		switch entry.Op {
+		case WAL_INSERT, WAL_UPDATE:
+			doc, err := decodeDoc(entry.Doc)
+			if err != nil {
+				tdlog.Noticef("Replay WAL: skip %s of document %d with corrupted content", entry.Op, entry.ID)
+				continue
+			}
+			if _, readErr := col.read(entry.ID, false); readErr == nil {
+				err = col.Update(entry.ID, doc)
+			} else {
+				if err = col.InsertRecovery(entry.ID, doc); err == nil {
+					col.touch(entry.ID)
+					col.recordVersion(entry.ID, nil, entry.Doc)
+				}
+			}
+			if err != nil {
+				tdlog.Noticef("Replay WAL: failed to %s document %d in %s - %v", entry.Op, entry.ID, entry.Col, err)
+			}
+		case WAL_DELETE:
+			// The document may have been deleted before the crash
+			col.delete(entry.ID)
+		case WAL_TOMBSTONE:
+			docB, readErr := col.parts[entry.ID%col.db.numParts].Read(entry.ID)
+			if readErr != nil {
+				// The document may have been purged before the crash
+				continue
+			} else if col.tombs == nil {
+				if err := col.openTombstones(); err != nil {
+					tdlog.Noticef("Replay WAL: failed to soft-delete document %d in %s - %v", entry.ID, entry.Col, err)
+					continue
+				}
+			}
+			col.tombstone(entry.ID)
+			col.touch(entry.ID)
+			col.recordVersion(entry.ID, docB, nil)
+		case WAL_UNDELETE:
+			col.untombstone(entry.ID)
+			col.touch(entry.ID)
+			col.recordUndelete(entry.ID)
+		}
+	}
+}
+
+// Flush all collection data and indexes to storage device, then empty the write-ahead log.
+// Caller must place schema lock.
+func (db *DB) checkpoint() error {
+	if db.wal == nil {
+		return nil
+	}
+	for _, col := range db.cols {
+		if err := col.sync(); err != nil {
+			return err
+		}
+	}
+	return db.wal.reset()
+}
+
+// Checkpoint in the background, so that the write which grew the log beyond WALCheckpointBytes does not wait for data
+// files to be flushed.
+func (db *DB) checkpointInBackground() {
+	go func() {
+		db.lockSchema()
+		defer db.schemaLock.Unlock()
+		if db.wal == nil {
+			// The database has been closed meanwhile
+			return
+		}
+		if err := db.checkpoint(); err != nil {
+			tdlog.CritNoRepeat("Failed to checkpoint write-ahead log %s: %v", db.wal.path, err)
+		}
+	}()
+}
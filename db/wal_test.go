@@ -0,0 +1,239 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func openWALTestDB(t *testing.T, policy string) *DB {
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", []byte(`{"WALSync": "`+policy+`", "WALIntervalMS": 10}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestWALReplay(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db := openWALTestDB(t, "always")
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := col.Insert(map[string]interface{}{"a": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Log writes that never reach collection files, then "crash" without a checkpoint
+	if err := db.wal.append(WAL_INSERT, "col", 12345, []byte(`{"a": 3}`)); err != nil {
+		t.Fatal(err)
+	} else if err := db.wal.append(WAL_UPDATE, "col", updated, []byte(`{"a": 4}`)); err != nil {
+		t.Fatal(err)
+	} else if err := db.wal.append(WAL_DELETE, "col", deleted, nil); err != nil {
+		t.Fatal(err)
+	} else if err := db.wal.append(WAL_INSERT, "does not exist", 1, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	for _, col := range db.cols {
+		col.close()
+	}
+	db.wal.close()
+	// Torn entry at the end of log is ignored
+	fh, err := os.OpenFile(path.Join(TEST_DATA_DIR, WAL_FILE), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Write([]byte(`{"op": "insert", "col": "col", "id": 1`))
+	fh.Close()
+
+	db = openWALTestDB(t, "interval")
+	defer db.Close()
+	col = db.Use("col")
+	if doc, err := col.Read(12345); err != nil || doc["a"].(float64) != 3 {
+		t.Fatal(doc, err)
+	}
+	if doc, err := col.Read(updated); err != nil || doc["a"].(float64) != 4 {
+		t.Fatal(doc, err)
+	}
+	if _, err := col.Read(deleted); err == nil {
+		t.Fatal("Did not replay delete")
+	}
+	if _, err := col.Read(1); err == nil {
+		t.Fatal("Replayed torn entry")
+	}
+	// Replayed documents are indexed
+	q, err := runQuery(`[{"eq": 3, "in": ["a"]}, {"eq": 4, "in": ["a"]}, {"eq": 2, "in": ["a"]}]`, col)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ensureMapHasKeys(q, 12345, updated) {
+		t.Fatal(q)
+	}
+	// The log is emptied after recovery
+	if entries, err := readWAL(path.Join(TEST_DATA_DIR, WAL_FILE)); err != nil || len(entries) != 0 {
+		t.Fatal(entries, err)
+	}
+}
+
+func TestWALReplayInterruptedIndexUpdate(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db := openWALTestDB(t, "always")
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := col.Insert(map[string]interface{}{"a": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Log and write collection data, then "crash" before the indexes are updated
+	if err := db.wal.appendReplacing(WAL_UPDATE, "col", updated, []byte(`{"a": 2}`), []byte(`{"a": 4}`)); err != nil {
+		t.Fatal(err)
+	} else if err := col.parts[updated%db.numParts].Update(updated, []byte(`{"a": 4}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.wal.appendReplacing(WAL_DELETE, "col", deleted, []byte(`{"a": 1}`), nil); err != nil {
+		t.Fatal(err)
+	} else if err := col.parts[deleted%db.numParts].Delete(deleted); err != nil {
+		t.Fatal(err)
+	}
+	for _, col := range db.cols {
+		col.close()
+	}
+	db.wal.close()
+
+	db = openWALTestDB(t, "os")
+	defer db.Close()
+	col = db.Use("col")
+	for str, expected := range map[string][]int{
+		`{"eq": 1, "in": ["a"]}`: {},
+		`{"eq": 2, "in": ["a"]}`: {},
+		`{"eq": 4, "in": ["a"]}`: {updated},
+	} {
+		result, err := runQuery(str, col)
+		if err != nil || len(result) != len(expected) || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(str, result, err)
+		}
+	}
+	// Values of the replaced documents are no longer on the index
+	if err := db.VerifyIndexes(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db := openWALTestDB(t, "os")
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = col.Update(id, map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	walPath := path.Join(TEST_DATA_DIR, WAL_FILE)
+	if entries, err := readWAL(walPath); err != nil || len(entries) != 3 {
+		t.Fatal(entries, err)
+	}
+	// Schema change and close empty the log
+	if err := db.Truncate("col"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := readWAL(walPath); err != nil || len(entries) != 0 {
+		t.Fatal(entries, err)
+	}
+	if _, err := col.Insert(map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := readWAL(walPath); err != nil || len(entries) != 0 {
+		t.Fatal(entries, err)
+	}
+	// Disabling the log removes the log file
+	db = openWALTestDB(t, "none")
+	defer db.Close()
+	if _, err := os.Stat(walPath); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestWALCheckpointSize(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db := openWALTestDB(t, "os")
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	db.wal.limit = 500
+	for i := 0; i < 100; i++ {
+		if _, err := col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The log is emptied in the background once it grows beyond the limit
+	walPath := path.Join(TEST_DATA_DIR, WAL_FILE)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if info, err := os.Stat(walPath); err != nil {
+			t.Fatal(err)
+		} else if info.Size() <= 500 {
+			break
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatal("Log was not emptied", info.Size())
+		}
+	}
+	if entries, err := readWAL(walPath); err != nil || len(entries) >= 100 {
+		t.Fatal(len(entries), err)
+	}
+}
+
+func TestWALBadPolicy(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", []byte(`{"WALSync": "sometimes"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDB(TEST_DATA_DIR); err == nil {
+		t.Fatal("Did not error")
+	}
+}
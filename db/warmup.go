@@ -0,0 +1,51 @@
+// Index warm-up.
+//
+// Hash tables are memory-mapped files, and the operating system reads their pages from disk as queries first need
+// them, which makes the first queries after opening a database slow. Warm-up reads every page of the index files
+// beforehand, so that they are in memory (as long as memory allows) before the database serves queries.
+
+package db
+
+import (
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+// Load index files of all collections into memory. Return the time it took and the size of the files loaded.
+func (db *DB) Warmup() (took time.Duration, size int) {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	start := time.Now()
+	for _, col := range db.cols {
+		size += col.warmup()
+	}
+	return time.Since(start), size
+}
+
+// Load index files of the collection into memory. Return the time it took and the size of the files loaded.
+func (col *Col) Warmup() (took time.Duration, size int) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	start := time.Now()
+	size = col.warmup()
+	return time.Since(start), size
+}
+
+// Read every page of the document ID lookup tables (of the documents kept in data files) and index hash tables of the
+// collection. Document data is not loaded. Return the size of the files loaded. Does not place schema lock.
+func (col *Col) warmup() (size int) {
+	for i := 0; i < col.db.numParts; i++ {
+		if part, inFiles := col.parts[i].DocStore.(*data.Partition); inFiles {
+			part.DataLock.RLock()
+			size += part.TouchLookup()
+			part.DataLock.RUnlock()
+		}
+		for _, ht := range col.hts[i] {
+			ht.Lock.RLock()
+			size += ht.Touch()
+			ht.Lock.RUnlock()
+		}
+	}
+	return
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWarmup(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("other"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := col.Insert(map[string]interface{}{"a": 1})
+	// Every collection has ID lookup tables, and the indexed collection has hash tables of the index too
+	took, colSize := col.Warmup()
+	if took <= 0 || colSize <= 0 {
+		t.Fatal(took, colSize)
+	}
+	if took, size := db.Warmup(); took <= 0 || size <= colSize || size >= 2*colSize {
+		t.Fatal(took, size, colSize)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Warm up on open
+	if err = ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", []byte(`{"WarmupOnOpen": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if !db.Config.WarmupOnOpen {
+		t.Fatal("config not read")
+	} else if result, err := runQuery(`{"eq": 1, "in": ["a"]}`, db.Use("col")); err != nil || !ensureMapHasKeys(result, id) {
+		t.Fatal(result, err)
+	}
+}
@@ -14,12 +14,25 @@ const (
 
 	// Document errors
 	ErrorDocTooLarge errorType = "Document is too large. Max: `%d`, Given: `%d`"
+	ErrorInvalidDoc  errorType = "Document is rejected by validator %s: %v"
 
 	// Query input errors
 	ErrorNeedIndex         errorType = "Please index %v and retry query %v."
 	ErrorExpectingSubQuery errorType = "Expecting a vector of sub-queries, but %v given."
 	ErrorExpectingInt      errorType = "Expecting `%s` as an integer, but %v given."
 	ErrorMissing           errorType = "Missing `%s`"
+	ErrorQuerySyntax       errorType = "Query syntax error at column %d: %s"
+	ErrorColClosed         errorType = "Collection %s has been closed by rename, scrub or drop; please use the collection again."
+	ErrorDuplicateKey      errorType = "%d documents have value %v at %v"
+	ErrorResultTooLarge    errorType = "Query result has more than %d documents, please narrow down the query."
+	ErrorUnknownPath       errorType = "No document has a value on path %v of query %v, please check the path."
+	ErrorNoResultSet       errorType = "Result set %s does not exist or has expired, please run the query again."
+	ErrorIndexCorrupt      errorType = "Partition %d of index %s is corrupt or missing, please rebuild indexes."
+	ErrorTooBusy           errorType = "%d queries are scanning all documents, please retry the query later."
+	ErrorTimeout           errorType = "Query did not finish within %v, the result is partial."
+
+	// Database errors
+	ErrorReadOnly errorType = "Database %s is opened read-only."
 )
 
 func New(err errorType, details ...interface{}) Error {
@@ -37,7 +37,21 @@ func Map(f *os.File) (MMap, error) {
 	if int64(length) != fi.Size() {
 		return nil, errors.New("memory map file length overflow")
 	}
-	return mmap(length, fd)
+	return mmap(length, fd, true)
+}
+
+// MapReadOnly maps an entire file into memory without write access. Writing into the mapped memory is a fault.
+func MapReadOnly(f *os.File) (MMap, error) {
+	fd := uintptr(f.Fd())
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	length := int(fi.Size())
+	if int64(length) != fi.Size() {
+		return nil, errors.New("memory map file length overflow")
+	}
+	return mmap(length, fd, false)
 }
 
 func (m *MMap) header() *reflect.SliceHeader {
@@ -56,3 +70,9 @@ func (m *MMap) Unmap() error {
 	*m = nil
 	return err
 }
+
+// Flush synchronously writes modified pages of the memory mapped region back to the underlying file.
+func (m *MMap) Flush() error {
+	dh := m.header()
+	return flush(dh.Data, uintptr(dh.Len))
+}
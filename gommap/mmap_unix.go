@@ -10,8 +10,12 @@ import (
 	"syscall"
 )
 
-func mmap(len int, fd uintptr) ([]byte, error) {
-	return syscall.Mmap(int(fd), 0, len, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+func mmap(len int, fd uintptr, writable bool) ([]byte, error) {
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	return syscall.Mmap(int(fd), 0, len, prot, syscall.MAP_SHARED)
 }
 
 func unmap(addr, len uintptr) error {
@@ -21,3 +25,11 @@ func unmap(addr, len uintptr) error {
 	}
 	return nil
 }
+
+func flush(addr, len uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, addr, len, syscall.MS_SYNC)
+	if errno != 0 {
+		return syscall.Errno(errno)
+	}
+	return nil
+}
@@ -22,13 +22,17 @@ var handleLock sync.Mutex
 var handleMap = map[uintptr]syscall.Handle{}
 
 // Windows mmap always mapes the entire file regardless of the specified length.
-func mmap(length int, hfile uintptr) ([]byte, error) {
-	h, errno := syscall.CreateFileMapping(syscall.Handle(hfile), nil, syscall.PAGE_READWRITE, 0, 0, nil)
+func mmap(length int, hfile uintptr, writable bool) ([]byte, error) {
+	protect, access := uint32(syscall.PAGE_READONLY), uint32(syscall.FILE_MAP_READ)
+	if writable {
+		protect, access = syscall.PAGE_READWRITE, syscall.FILE_MAP_WRITE
+	}
+	h, errno := syscall.CreateFileMapping(syscall.Handle(hfile), nil, protect, 0, 0, nil)
 	if h == 0 {
 		return nil, os.NewSyscallError("CreateFileMapping", errno)
 	}
 
-	addr, errno := syscall.MapViewOfFile(h, syscall.FILE_MAP_WRITE, 0, 0, 0)
+	addr, errno := syscall.MapViewOfFile(h, access, 0, 0, 0)
 	if addr == 0 {
 		return nil, os.NewSyscallError("MapViewOfFile", errno)
 	}
@@ -57,3 +61,7 @@ func unmap(addr, len uintptr) error {
 
 	return os.NewSyscallError("CloseHandle", syscall.CloseHandle(syscall.Handle(handle)))
 }
+
+func flush(addr, len uintptr) error {
+	return os.NewSyscallError("FlushViewOfFile", syscall.FlushViewOfFile(addr, len))
+}
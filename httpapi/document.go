@@ -3,11 +3,18 @@
 package httpapi
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	exportFlushInterval = 100 // Number of documents written by export between flushes of the response.
 )
 
 // Insert a document into collection.
@@ -27,7 +34,7 @@ func Insert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var jsonDoc map[string]interface{}
-	if err := json.Unmarshal([]byte(doc), &jsonDoc); err != nil {
+	if err := decodeJSON(doc, &jsonDoc); err != nil {
 		http.Error(w, fmt.Sprintf("'%v' is not valid JSON document.", doc), 400)
 		return
 	}
@@ -128,6 +135,62 @@ func GetPage(w http.ResponseWriter, r *http.Request) {
 	w.Write(resp)
 }
 
+// Stream all documents of a collection as newline-delimited JSON, one `{"id": "document ID", "doc": document}` per line in
+// the ascending order of document ID, starting from document ID `from` (optional, 0 by default). Documents are written
+// to the client as they are read, so that a slow client slows down the export instead of having it buffered; the export
+// stops when the client disconnects. An interrupted export is resumed with `from` set to the last received ID plus one.
+func Export(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	from := 0
+	if fromStr := r.FormValue("from"); fromStr != "" {
+		var err error
+		if from, err = strconv.Atoi(fromStr); err != nil || from < 0 {
+			http.Error(w, fmt.Sprintf("Invalid document ID '%v'.", fromStr), 400)
+			return
+		}
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	flusher, canFlush := w.(http.Flusher)
+	var line bytes.Buffer
+	exported := 0
+	err := dbcol.ForEachDocFrom(from, func(id int, doc []byte) bool {
+		select {
+		case <-r.Context().Done():
+			// Client has disconnected
+			return false
+		default:
+		}
+		line.Reset()
+		line.WriteString(`{"id":"` + strconv.Itoa(id) + `","doc":`)
+		if err := json.Compact(&line, doc); err != nil {
+			tdlog.Noticef("Export of collection %s skips document %d that is not valid JSON: %v", col, id, err)
+			return true
+		}
+		line.WriteString("}\n")
+		if _, err := w.Write(line.Bytes()); err != nil {
+			return false
+		}
+		if exported++; canFlush && exported%exportFlushInterval == 0 {
+			flusher.Flush()
+		}
+		return true
+	})
+	if err != nil {
+		tdlog.Noticef("Export of collection %s stopped: %v", col, err)
+	}
+}
+
 // Update a document.
 func Update(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
@@ -153,7 +216,7 @@ func Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var newDoc map[string]interface{}
-	if err := json.Unmarshal([]byte(doc), &newDoc); err != nil {
+	if err := decodeJSON(doc, &newDoc); err != nil {
 		http.Error(w, fmt.Sprintf("'%v' is not valid JSON document.", newDoc), 400)
 		return
 	}
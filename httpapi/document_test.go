@@ -2,6 +2,7 @@ package httpapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +11,8 @@ import (
 	"github.com/bouk/monkey"
 	"math/rand"
 	"net/http/httptest"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -28,6 +31,8 @@ var (
 	requestGetPageNotTotal = "http://localhost:8080/getpage?col=%s&page=%s"
 	requestGetPage         = "http://localhost:8080/getpage?col=%s&page=%s&total=%d"
 
+	requestExport = "http://localhost:8080/export?col=%s&from=%s"
+
 	requestUpdateNotCol = "http://localhost:8080/update"
 	requestUpdateNotId  = "http://localhost:8080/update?col=%s"
 	requestUpdateNotDoc = "http://localhost:8080/update?col=%s&id=%s"
@@ -912,3 +917,65 @@ func TApproxDocCount(t *testing.T) {
 		t.Error("Expected code 200 and count 0")
 	}
 }
+
+func TestExport(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	ids := make([]int, 250)
+	for i := range ids {
+		ids[i], _ = HttpDB.Use(collection).Insert(map[string]interface{}{"a": i})
+	}
+	sort.Ints(ids)
+	// Export everything, then resume from the middle
+	for _, from := range []int{0, ids[100]} {
+		w := httptest.NewRecorder()
+		Export(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestExport, collection, strconv.Itoa(from)), nil))
+		if w.Code != 200 {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		exportedIDs := make([]int, 0)
+		for _, line := range strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n") {
+			var exported struct {
+				ID  string
+				Doc map[string]interface{}
+			}
+			if err = json.Unmarshal([]byte(line), &exported); err != nil || len(exported.Doc) != 1 {
+				t.Fatal(line, err)
+			}
+			id, _ := strconv.Atoi(exported.ID)
+			exportedIDs = append(exportedIDs, id)
+		}
+		expected := ids
+		if from > 0 {
+			expected = ids[100:]
+		}
+		if !reflect.DeepEqual(exportedIDs, expected) {
+			t.Fatal(from, len(exportedIDs), len(expected))
+		}
+	}
+	// Nothing is exported to a client that has gone
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	Export(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestExport, collection, "0"), nil).WithContext(ctx))
+	if w.Body.Len() != 0 {
+		t.Fatal(w.Body.String())
+	}
+	for _, reqURL := range []string{
+		fmt.Sprintf(requestExport, collection, "x"),
+		fmt.Sprintf(requestExport, collection, "-1"),
+		fmt.Sprintf(requestExport, "notExistCol", "0"),
+		"http://localhost:8080/export",
+	} {
+		w := httptest.NewRecorder()
+		Export(w, httptest.NewRequest(RandMethodRequest(), reqURL, nil))
+		if w.Code != 400 {
+			t.Fatal(reqURL, w.Code)
+		}
+	}
+}
@@ -6,12 +6,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 
 	"github.com/HouzuoGuo/tiedot/db"
 )
 
-// Execute a query and return documents from the result.
+const (
+	streamFlushInterval = 100 // Number of documents read and written by a streamed query response between flushes.
+)
+
+// Execute a query and return documents from the result, or only the fields of them if a JSON array of paths `fields`
+// is given. With `stream=true` the response is the same JSON object of documents by ID, but it is written out as the
+// documents are read instead of being built in memory first.
 func Query(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
 	w.Header().Set("Content-Type", "application/json")
@@ -25,10 +32,17 @@ func Query(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var qJson interface{}
-	if err := json.Unmarshal([]byte(q), &qJson); err != nil {
+	if err := decodeJSON(q, &qJson); err != nil {
 		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
 		return
 	}
+	var fields [][]string
+	if fieldsStr := r.FormValue("fields"); fieldsStr != "" {
+		if err := json.Unmarshal([]byte(fieldsStr), &fields); err != nil {
+			http.Error(w, fmt.Sprintf("'%v' is not a JSON array of paths.", fieldsStr), 400)
+			return
+		}
+	}
 	dbcol := HttpDB.Use(col)
 	if dbcol == nil {
 		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
@@ -40,15 +54,17 @@ func Query(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprint(err), 400)
 		return
 	}
+	if r.FormValue("stream") == "true" {
+		streamResult(w, r, dbcol, queryResult, fields)
+		return
+	}
 	// Construct array of result
 	resultDocs := make(map[string]interface{}, len(queryResult))
-	counter := 0
-	for docID := range queryResult {
-		doc, _ := dbcol.Read(docID)
-		if doc != nil {
-			resultDocs[strconv.Itoa(docID)] = doc
-			counter++
+	for docID, doc := range dbcol.ReadMany(resultIDs(queryResult)) {
+		if fields != nil {
+			doc = db.Project(doc, fields)
 		}
+		resultDocs[strconv.Itoa(docID)] = doc
 	}
 	// Serialize the array
 	resp, err := json.Marshal(resultDocs)
@@ -59,6 +75,168 @@ func Query(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(string(resp)))
 }
 
+// Write the documents of query result as a JSON object of documents by ID, in the ascending order of ID, reading
+// and flushing a handful of documents at a time. A document that cannot be read, e.g. deleted since the query, is left
+// out. Writing stops when the client disconnects, which leaves the object unterminated.
+func streamResult(w http.ResponseWriter, r *http.Request, dbcol *db.Col, queryResult map[int]struct{}, fields [][]string) {
+	ids := resultIDs(queryResult)
+	sort.Ints(ids)
+	flusher, canFlush := w.(http.Flusher)
+	separator := "{"
+	for start := 0; start < len(ids); start += streamFlushInterval {
+		select {
+		case <-r.Context().Done():
+			// Client has disconnected
+			return
+		default:
+		}
+		end := start + streamFlushInterval
+		if end > len(ids) {
+			end = len(ids)
+		}
+		docs := dbcol.ReadMany(ids[start:end])
+		for _, id := range ids[start:end] {
+			doc, exists := docs[id]
+			if !exists {
+				continue
+			} else if fields != nil {
+				doc = db.Project(doc, fields)
+			}
+			docJS, err := json.Marshal(doc)
+			if err != nil {
+				continue
+			} else if _, err = w.Write([]byte(separator + `"` + strconv.Itoa(id) + `":` + string(docJS))); err != nil {
+				return
+			}
+			separator = ","
+		}
+		if canFlush {
+			flusher.Flush()
+		}
+	}
+	if separator == "{" {
+		w.Write([]byte("{}"))
+	} else {
+		w.Write([]byte("}"))
+	}
+}
+
+// Return the document IDs of a query result.
+func resultIDs(queryResult map[int]struct{}) []int {
+	ids := make([]int, 0, len(queryResult))
+	for id := range queryResult {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Execute a JSON array of queries in one call, and return an array of either result documents or error of each query.
+func BatchQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, q string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "q", &q) {
+		return
+	}
+	var queries []interface{}
+	if err := decodeJSON(q, &queries); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not a valid JSON array.", q), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	// Evaluate the queries, a failed query does not stop the others
+	queryResults, err := db.EvalQueries(queries, dbcol)
+	queryErrs, _ := err.(db.QueryErrors)
+	if err != nil && queryErrs == nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	// Construct array of results
+	resp := make([]map[string]interface{}, len(queries))
+	for i, queryResult := range queryResults {
+		if queryErrs != nil && queryErrs[i] != nil {
+			resp[i] = map[string]interface{}{"error": fmt.Sprint(queryErrs[i])}
+			continue
+		}
+		resultDocs := make(map[string]interface{}, len(queryResult))
+		for docID, doc := range dbcol.ReadMany(resultIDs(queryResult)) {
+			resultDocs[strconv.Itoa(docID)] = doc
+		}
+		resp[i] = map[string]interface{}{"result": resultDocs}
+	}
+	// Serialize the array
+	respJS, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Server error: query returned invalid structure"), 500)
+		return
+	}
+	w.Write(respJS)
+}
+
+// Execute a query against a JSON array of collections `cols` in one call, and return either the result documents or the
+// error of each collection by collection name.
+func MultiQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var cols, q string
+	if !Require(w, r, "cols", &cols) {
+		return
+	}
+	if !Require(w, r, "q", &q) {
+		return
+	}
+	var colNames []string
+	if err := json.Unmarshal([]byte(cols), &colNames); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not a JSON array of collection names.", cols), 400)
+		return
+	}
+	var qJson interface{}
+	if err := decodeJSON(q, &qJson); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
+		return
+	}
+	// Evaluate the query, a failed collection does not stop the others
+	queryResults, err := HttpDB.QueryMulti(colNames, qJson)
+	colErrs, _ := err.(db.ColErrors)
+	if err != nil && colErrs == nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	// Construct results by collection name
+	resp := make(map[string]map[string]interface{}, len(colNames))
+	for _, name := range colNames {
+		if colErr, failed := colErrs[name]; failed {
+			resp[name] = map[string]interface{}{"error": fmt.Sprint(colErr)}
+			continue
+		}
+		resultDocs := make(map[string]interface{}, len(queryResults[name]))
+		if dbcol := HttpDB.Use(name); dbcol != nil {
+			for docID, doc := range dbcol.ReadMany(resultIDs(queryResults[name])) {
+				resultDocs[strconv.Itoa(docID)] = doc
+			}
+		}
+		resp[name] = map[string]interface{}{"result": resultDocs}
+	}
+	// Serialize the results
+	respJS, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Server error: query returned invalid structure"), 500)
+		return
+	}
+	w.Write(respJS)
+}
+
 // Execute a query and return number of documents from the result.
 func Count(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
@@ -73,7 +251,7 @@ func Count(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var qJson interface{}
-	if err := json.Unmarshal([]byte(q), &qJson); err != nil {
+	if err := decodeJSON(q, &qJson); err != nil {
 		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
 		return
 	}
@@ -89,3 +267,172 @@ func Count(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Write([]byte(strconv.Itoa(len(queryResult))))
 }
+
+// Execute a query and store its result for paging through with /resultpage, return the result set token and the number
+// of documents in the result.
+func ResultSet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, q string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "q", &q) {
+		return
+	}
+	var qJson interface{}
+	if err := decodeJSON(q, &qJson); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	token, total, err := db.CreateResultSet(qJson, dbcol)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	resp, err := json.Marshal(map[string]interface{}{"token": token, "total": total})
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Return a page of a stored query result - the IDs of at most `limit` documents from `offset` in ascending order, the
+// documents themselves and the number of documents in the result.
+func ResultPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, token, offset, limit string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "token", &token) {
+		return
+	}
+	if !Require(w, r, "offset", &offset) {
+		return
+	}
+	if !Require(w, r, "limit", &limit) {
+		return
+	}
+	offsetNum, err := strconv.Atoi(offset)
+	if err != nil || offsetNum < 0 {
+		http.Error(w, fmt.Sprintf("Invalid offset '%v'.", offset), 400)
+		return
+	}
+	limitNum, err := strconv.Atoi(limit)
+	if err != nil || limitNum < 0 {
+		http.Error(w, fmt.Sprintf("Invalid limit '%v'.", limit), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	ids, total, err := dbcol.FetchResultPage(token, offsetNum, limitNum)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	resultDocs := make(map[string]interface{}, len(ids))
+	for docID, doc := range dbcol.ReadMany(ids) {
+		resultDocs[strconv.Itoa(docID)] = doc
+	}
+	resp, err := json.Marshal(map[string]interface{}{"ids": ids, "docs": resultDocs, "total": total})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Server error: query returned invalid structure"), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Execute a query and open a cursor over its result for reading with /cursornext, return the cursor token.
+func Cursor(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, q string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "q", &q) {
+		return
+	}
+	var qJson interface{}
+	if err := decodeJSON(q, &qJson); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	token, err := db.OpenQueryCursor(qJson, dbcol)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	resp, err := json.Marshal(map[string]interface{}{"token": token})
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Return the next batch of a query cursor - the IDs of at most `size` documents in ascending order, the documents
+// themselves, and whether the batch is the last one.
+func CursorNext(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, token, size string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "token", &token) {
+		return
+	}
+	if !Require(w, r, "size", &size) {
+		return
+	}
+	sizeNum, err := strconv.Atoi(size)
+	if err != nil || sizeNum <= 0 {
+		http.Error(w, fmt.Sprintf("Invalid size '%v'.", size), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	ids, done, err := dbcol.NextQueryBatch(token, sizeNum)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	resultDocs := make(map[string]interface{}, len(ids))
+	for docID, doc := range dbcol.ReadMany(ids) {
+		resultDocs[strconv.Itoa(docID)] = doc
+	}
+	resp, err := json.Marshal(map[string]interface{}{"ids": ids, "docs": resultDocs, "done": done})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Server error: query returned invalid structure"), 500)
+		return
+	}
+	w.Write(resp)
+}
@@ -8,7 +8,9 @@ import (
 	"github.com/pkg/errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
 )
@@ -17,6 +19,15 @@ var (
 	requestQuery        = "http://localhost:8080/query"
 	requestQueryWithCol = "http://localhost:8080/query?col=%s"
 	requestQueryWithAll = "http://localhost:8080/query?col=%s&q=%s"
+	requestQueryFields  = "http://localhost:8080/query?col=%s&q=%s&fields=%s"
+	requestQueryStream  = "http://localhost:8080/query?col=%s&q=%s&stream=true"
+
+	requestBatchQueryWithAll = "http://localhost:8080/batchquery?col=%s&q=%s"
+	requestMultiQueryWithAll = "http://localhost:8080/multiquery?cols=%s&q=%s"
+	requestResultSet         = "http://localhost:8080/resultset?col=%s&q=%s"
+	requestResultPage        = "http://localhost:8080/resultpage?col=%s&token=%s&offset=%s&limit=%s"
+	requestCursor            = "http://localhost:8080/cursor?col=%s&q=%s"
+	requestCursorNext        = "http://localhost:8080/cursornext?col=%s&token=%s&size=%s"
 
 	requestCount        = "http://localhost:8080/count"
 	requestCountWithCol = "http://localhost:8080/count?col=%s"
@@ -55,7 +66,7 @@ func TestQuery(t *testing.T) {
 	defer pathCol.Unpatch()
 
 	reqCreate := httptest.NewRequest(RandMethodRequest(), requestCreate, nil)
-	req := httptest.NewRequest("POST", fmt.Sprintf(requestQueryWithAll, collection, "1"), nil)
+	req := httptest.NewRequest("POST", fmt.Sprintf(requestQueryWithAll, collection, "%22all%22"), nil)
 	w := httptest.NewRecorder()
 	wQuery := httptest.NewRecorder()
 	var err error
@@ -68,6 +79,71 @@ func TestQuery(t *testing.T) {
 		t.Errorf("Expected status %d", http.StatusOK)
 	}
 }
+func TestQueryFields(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	id, _ := HttpDB.Use(collection).Insert(map[string]interface{}{"a": 1, "b": map[string]interface{}{"c": 2, "d": 3}, "e": 4})
+	q := url.QueryEscape(fmt.Sprintf(`"%d"`, id))
+	w := httptest.NewRecorder()
+	Query(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestQueryFields, collection, q, url.QueryEscape(`[["a"], ["b", "c"], ["x"]]`)), nil))
+	var resp map[string]map[string]interface{}
+	if err = json.Unmarshal(w.Body.Bytes(), &resp); w.Code != http.StatusOK || err != nil {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if doc := resp[fmt.Sprint(id)]; !reflect.DeepEqual(doc, map[string]interface{}{"a": 1.0, "b": map[string]interface{}{"c": 2.0}}) {
+		t.Fatal(resp)
+	}
+	w = httptest.NewRecorder()
+	Query(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestQueryFields, collection, q, "a"), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code)
+	}
+}
+func TestQueryStream(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	HttpDB.Use(collection).Index([]string{"b"})
+	for i := 0; i < 250; i++ {
+		HttpDB.Use(collection).Insert(map[string]interface{}{"a": i, "b": i % 2})
+	}
+	// Streamed response is the same object of documents as the buffered one
+	for _, q := range []string{`"all"`, `{"eq": 1, "in": ["b"]}`, `{"eq": 2, "in": ["b"]}`} {
+		var buffered, streamed map[string]map[string]interface{}
+		w := httptest.NewRecorder()
+		Query(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestQueryWithAll, collection, url.QueryEscape(q)), nil))
+		if err = json.Unmarshal(w.Body.Bytes(), &buffered); err != nil {
+			t.Fatal(q, w.Body.String())
+		}
+		w = httptest.NewRecorder()
+		Query(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestQueryStream, collection, url.QueryEscape(q)), nil))
+		if err = json.Unmarshal(w.Body.Bytes(), &streamed); w.Code != http.StatusOK || err != nil {
+			t.Fatal(q, w.Code, w.Body.String())
+		} else if !reflect.DeepEqual(streamed, buffered) {
+			t.Fatal(q, len(streamed), len(buffered))
+		}
+	}
+	w := httptest.NewRecorder()
+	Query(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestQueryStream, collection, url.QueryEscape(`{"eq": 1, "in": ["b"]}`))+"&fields="+url.QueryEscape(`[["a"]]`), nil))
+	var resp map[string]map[string]interface{}
+	if err = json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp) != 125 {
+		t.Fatal(w.Body.String())
+	}
+	for _, doc := range resp {
+		if len(doc) != 1 {
+			t.Fatal(doc)
+		}
+	}
+}
 func TestQueryCollectionNot(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
@@ -133,7 +209,7 @@ func TestQuerySerializeError(t *testing.T) {
 	defer tearDownTestCase()
 
 	reqCreate := httptest.NewRequest(RandMethodRequest(), requestCreate, nil)
-	req := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestQueryWithAll, collection, "1"), nil)
+	req := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestQueryWithAll, collection, "%22all%22"), nil)
 	w := httptest.NewRecorder()
 	wQuery := httptest.NewRecorder()
 	var err error
@@ -189,7 +265,7 @@ func TestCount(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
 	reqCreate := httptest.NewRequest(RandMethodRequest(), requestCreate, nil)
-	req := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestCountWithAll, collection, "1"), nil)
+	req := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestCountWithAll, collection, "%22all%22"), nil)
 	w := httptest.NewRecorder()
 	wCount := httptest.NewRecorder()
 
@@ -246,3 +322,199 @@ func TestCountErrEvalQuery(t *testing.T) {
 		t.Errorf("Expected status %d and error message eval query", http.StatusBadRequest)
 	}
 }
+func TestBatchQuery(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	id, _ := HttpDB.Use(collection).Insert(map[string]interface{}{"a": 1})
+	q := url.QueryEscape(fmt.Sprintf(`["%d", {"eq": 1, "in": ["a"]}]`, id))
+	req := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestBatchQueryWithAll, collection, q), nil)
+	w := httptest.NewRecorder()
+	BatchQuery(w, req)
+	var resp []map[string]interface{}
+	if err = json.Unmarshal(w.Body.Bytes(), &resp); w.Code != http.StatusOK || err != nil || len(resp) != 2 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if _, hasID := resp[0]["result"].(map[string]interface{})[fmt.Sprint(id)]; !hasID {
+		t.Fatal(resp)
+	}
+	if _, hasErr := resp[1]["error"]; !hasErr {
+		t.Fatal(resp)
+	}
+}
+func TestBatchQueryErr(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	for _, reqURL := range []string{
+		fmt.Sprintf(requestBatchQueryWithAll, collection, "1"),
+		fmt.Sprintf(requestBatchQueryWithAll, "notExistCol", "[]"),
+		"http://localhost:8080/batchquery?col=" + collection,
+	} {
+		w := httptest.NewRecorder()
+		BatchQuery(w, httptest.NewRequest(RandMethodRequest(), reqURL, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatal(reqURL, w.Code)
+		}
+	}
+}
+func TestMultiQuery(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	id, _ := HttpDB.Use(collection).Insert(map[string]interface{}{"a": 1})
+	cols := url.QueryEscape(fmt.Sprintf(`["%s", "notExistCol"]`, collection))
+	req := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestMultiQueryWithAll, cols, url.QueryEscape(`"all"`)), nil)
+	w := httptest.NewRecorder()
+	MultiQuery(w, req)
+	var resp map[string]map[string]interface{}
+	if err = json.Unmarshal(w.Body.Bytes(), &resp); w.Code != http.StatusOK || err != nil || len(resp) != 2 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if _, hasID := resp[collection]["result"].(map[string]interface{})[fmt.Sprint(id)]; !hasID {
+		t.Fatal(resp)
+	}
+	if _, hasErr := resp["notExistCol"]["error"]; !hasErr {
+		t.Fatal(resp)
+	}
+	for _, reqURL := range []string{
+		fmt.Sprintf(requestMultiQueryWithAll, collection, url.QueryEscape(`"all"`)),
+		fmt.Sprintf(requestMultiQueryWithAll, cols, "{"),
+		"http://localhost:8080/multiquery?cols=" + cols,
+	} {
+		w := httptest.NewRecorder()
+		MultiQuery(w, httptest.NewRequest(RandMethodRequest(), reqURL, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatal(reqURL, w.Code)
+		}
+	}
+}
+
+func TestResultSetAndPage(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	ids := make([]int, 3)
+	for i := range ids {
+		ids[i], _ = HttpDB.Use(collection).Insert(map[string]interface{}{"a": i})
+	}
+	sort.Ints(ids)
+	w := httptest.NewRecorder()
+	ResultSet(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestResultSet, collection, url.QueryEscape(`"all"`)), nil))
+	var created struct {
+		Token string
+		Total int
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &created); w.Code != http.StatusOK || err != nil || created.Total != 3 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	ResultPage(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestResultPage, collection, created.Token, "1", "5"), nil))
+	var page struct {
+		IDs   []int
+		Docs  map[string]map[string]interface{}
+		Total int
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &page); w.Code != http.StatusOK || err != nil || page.Total != 3 || !reflect.DeepEqual(page.IDs, ids[1:]) || len(page.Docs) != 2 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if _, hasDoc := page.Docs[fmt.Sprint(ids[2])]; !hasDoc {
+		t.Fatal(page)
+	}
+	for _, reqURL := range []string{
+		fmt.Sprintf(requestResultPage, collection, "nonexistent", "0", "1"),
+		fmt.Sprintf(requestResultPage, collection, created.Token, "-1", "1"),
+		fmt.Sprintf(requestResultPage, collection, created.Token, "0", "x"),
+		fmt.Sprintf(requestResultPage, "notExistCol", created.Token, "0", "1"),
+	} {
+		w := httptest.NewRecorder()
+		ResultPage(w, httptest.NewRequest(RandMethodRequest(), reqURL, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatal(reqURL, w.Code)
+		}
+	}
+	for _, reqURL := range []string{
+		fmt.Sprintf(requestResultSet, collection, "{"),
+		fmt.Sprintf(requestResultSet, "notExistCol", url.QueryEscape(`"all"`)),
+		fmt.Sprintf(requestResultSet, collection, url.QueryEscape(`{"eq": 1, "in": ["a"]}`)),
+	} {
+		w := httptest.NewRecorder()
+		ResultSet(w, httptest.NewRequest(RandMethodRequest(), reqURL, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatal(reqURL, w.Code)
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	ids := make([]int, 3)
+	for i := range ids {
+		ids[i], _ = HttpDB.Use(collection).Insert(map[string]interface{}{"a": i})
+	}
+	sort.Ints(ids)
+	w := httptest.NewRecorder()
+	Cursor(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestCursor, collection, url.QueryEscape(`"all"`)), nil))
+	var opened struct {
+		Token string
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &opened); w.Code != http.StatusOK || err != nil || opened.Token == "" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	for _, expected := range [][]int{ids[:2], ids[2:]} {
+		w = httptest.NewRecorder()
+		CursorNext(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestCursorNext, collection, opened.Token, "2"), nil))
+		var batch struct {
+			IDs  []int
+			Docs map[string]map[string]interface{}
+			Done bool
+		}
+		if err = json.Unmarshal(w.Body.Bytes(), &batch); w.Code != http.StatusOK || err != nil || !reflect.DeepEqual(batch.IDs, expected) || len(batch.Docs) != len(expected) || batch.Done != (len(expected) == 1) {
+			t.Fatal(w.Code, w.Body.String())
+		}
+	}
+	for _, reqURL := range []string{
+		fmt.Sprintf(requestCursorNext, collection, opened.Token, "2"),
+		fmt.Sprintf(requestCursorNext, collection, "nonexistent", "1"),
+		fmt.Sprintf(requestCursorNext, collection, opened.Token, "0"),
+		fmt.Sprintf(requestCursorNext, "notExistCol", opened.Token, "1"),
+	} {
+		w := httptest.NewRecorder()
+		CursorNext(w, httptest.NewRequest(RandMethodRequest(), reqURL, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatal(reqURL, w.Code)
+		}
+	}
+	for _, reqURL := range []string{
+		fmt.Sprintf(requestCursor, collection, "{"),
+		fmt.Sprintf(requestCursor, "notExistCol", url.QueryEscape(`"all"`)),
+	} {
+		w := httptest.NewRecorder()
+		Cursor(w, httptest.NewRequest(RandMethodRequest(), reqURL, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatal(reqURL, w.Code)
+		}
+	}
+}
@@ -19,9 +19,12 @@ These API endpoints will never require authorization: / (root), /version, and /m
 package httpapi
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/HouzuoGuo/tiedot/db"
 	"github.com/HouzuoGuo/tiedot/tdlog"
@@ -42,6 +45,20 @@ func Require(w http.ResponseWriter, r *http.Request, key string, val *string) bo
 	return true
 }
 
+// Decode JSON text into *val, numbers become json.Number so that large integers retain their precision.
+func decodeJSON(str string, val interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(str))
+	decoder.UseNumber()
+	if err := decoder.Decode(val); err != nil {
+		return err
+	}
+	// The text must not carry anything after the value
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("Unexpected content after JSON value")
+	}
+	return nil
+}
+
 // Start HTTP server and block until the server shuts down. Panic on error.
 func Start(dir string, port int, tlsCrt, tlsKey, jwtPubKey, jwtPrivateKey, bind, authToken string) {
 	var err error
@@ -101,10 +118,17 @@ func Start(dir string, port int, tlsCrt, tlsKey, jwtPubKey, jwtPrivateKey, bind,
 	// query
 	http.HandleFunc("/query", authWrap(Query))
 	http.HandleFunc("/count", authWrap(Count))
+	http.HandleFunc("/batchquery", authWrap(BatchQuery))
+	http.HandleFunc("/multiquery", authWrap(MultiQuery))
+	http.HandleFunc("/resultset", authWrap(ResultSet))
+	http.HandleFunc("/resultpage", authWrap(ResultPage))
+	http.HandleFunc("/cursor", authWrap(Cursor))
+	http.HandleFunc("/cursornext", authWrap(CursorNext))
 	// document management
 	http.HandleFunc("/insert", authWrap(Insert))
 	http.HandleFunc("/get", authWrap(Get))
 	http.HandleFunc("/getpage", authWrap(GetPage))
+	http.HandleFunc("/export", authWrap(Export))
 	http.HandleFunc("/update", authWrap(Update))
 	http.HandleFunc("/delete", authWrap(Delete))
 	http.HandleFunc("/approxdoccount", authWrap(ApproxDocCount))
@@ -6,6 +6,7 @@ import (
 	"github.com/HouzuoGuo/tiedot/benchmark"
 	"github.com/HouzuoGuo/tiedot/examples"
 	"github.com/HouzuoGuo/tiedot/httpapi"
+	"github.com/HouzuoGuo/tiedot/repl"
 	"github.com/HouzuoGuo/tiedot/tdlog"
 	"io/ioutil"
 	"os"
@@ -52,11 +53,12 @@ func main() {
 	// General params
 	var mode string
 	var maxprocs int
-	flag.StringVar(&mode, "mode", "", "Mandatory - specify the execution mode [httpd|bench|bench2|example]")
+	flag.StringVar(&mode, "mode", "", "Mandatory - specify the execution mode [httpd|repl|bench|bench2|example]")
 	flag.IntVar(&maxprocs, "gomaxprocs", defaultMaxprocs, "GOMAXPROCS")
 	// Debug params
 	var profile, debug bool
 	flag.BoolVar(&tdlog.VerboseLog, "verbose", false, "Turn verbose logging on/off")
+	flag.BoolVar(&tdlog.StructuredLog, "querylog", false, "Write structured (JSON) log entries of query execution to standard error")
 	flag.BoolVar(&profile, "profile", false, "Write profiler results to prof.out")
 	flag.BoolVar(&debug, "debug", false, "Dump goroutine stack traces upon receiving interrupt signal")
 	// HTTP mode params
@@ -65,7 +67,7 @@ func main() {
 	var port int
 	var authToken string
 	var tlsCrt, tlsKey string
-	flag.StringVar(&dir, "dir", "", "(HTTP server) database directory")
+	flag.StringVar(&dir, "dir", "", "(HTTP server and query console) database directory")
 	flag.StringVar(&bind, "bind", "", "(HTTP server) bind to IP address (all network interfaces by default)")
 	flag.IntVar(&port, "port", 8080, "(HTTP server) port number")
 	flag.StringVar(&tlsCrt, "tlscrt", "", "(HTTP server) TLS certificate (empty to disable TLS).")
@@ -146,6 +148,16 @@ func main() {
 			os.Exit(1)
 		}
 		httpapi.Start(dir, port, tlsCrt, tlsKey, jwtPubKey, jwtPrivateKey, bind, authToken)
+	case "repl":
+		// Run interactive query console
+		if dir == "" {
+			tdlog.Notice("Please specify database directory, for example -dir=/tmp/db")
+			os.Exit(1)
+		}
+		if err := repl.Start(dir, os.Stdin, os.Stdout); err != nil {
+			tdlog.Noticef("Query console stopped - %v", err)
+			os.Exit(1)
+		}
 	case "example":
 		// Run embedded usage examples
 		examples.EmbeddedExample()
@@ -0,0 +1,247 @@
+/*
+Interactive query console.
+
+The console opens a database, and reads one command per line:
+- cols                  List all collections.
+- use COLLECTION        Choose the collection to query.
+- indexes               List indexed paths of the chosen collection.
+- ids QUERY             Run the query and print document IDs.
+- docs QUERY            Run the query and print documents.
+- explain QUERY         Print the optimized query plan and its selectivity estimates, without running the query.
+- help                  Print command usage.
+- quit                  Close the database and exit.
+
+A line that is not a command is treated as "docs QUERY".
+QUERY is written either in string query syntax (see db.ParseQuery) or in JSON, e.g. `{"eq": 1, "in": ["a"]}`.
+*/
+
+package repl
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+const usage = `Commands:
+  cols                 list all collections
+  use COLLECTION       choose the collection to query
+  indexes              list indexed paths of the chosen collection
+  ids QUERY            run the query and print document IDs
+  docs QUERY           run the query and print documents
+  explain QUERY        print query plan and selectivity estimates without running it
+  help                 print this message
+  quit                 exit
+A line that is not a command runs as "docs QUERY". QUERY is string query syntax or JSON.`
+
+// Console state.
+type Console struct {
+	db  *db.DB
+	col string
+	out io.Writer
+}
+
+// Start a console on the database directory, read commands from in and write results to out until "quit" or end of input.
+func Start(dir string, in io.Reader, out io.Writer) error {
+	myDB, err := db.OpenDB(dir)
+	if err != nil {
+		return err
+	}
+	defer myDB.Close()
+	console := &Console{db: myDB, out: out}
+	fmt.Fprintln(out, "tiedot query console - type \"help\" for usage.")
+	scanner := bufio.NewScanner(in)
+	for console.prompt(); scanner.Scan(); console.prompt() {
+		if !console.Run(scanner.Text()) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+func (console *Console) prompt() {
+	fmt.Fprintf(console.out, "%s> ", console.col)
+}
+
+// Run a single command line and print its outcome. Return false if the console should exit.
+func (console *Console) Run(line string) (moveOn bool) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return true
+	}
+	cmd, arg := line, ""
+	if space := strings.IndexAny(line, " \t"); space != -1 {
+		cmd, arg = line[:space], strings.TrimSpace(line[space+1:])
+	}
+	switch strings.ToLower(cmd) {
+	case "quit", "exit":
+		return false
+	case "help":
+		fmt.Fprintln(console.out, usage)
+	case "cols":
+		names := console.db.AllCols()
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintln(console.out, name)
+		}
+	case "use":
+		if !console.db.ColExists(arg) {
+			fmt.Fprintf(console.out, "Collection '%s' does not exist.\n", arg)
+		} else {
+			console.col = arg
+		}
+	case "indexes":
+		if col := console.use(); col != nil {
+			paths := make([]string, 0)
+			for _, path := range col.AllIndexes() {
+				paths = append(paths, strings.Join(path, "."))
+			}
+			sort.Strings(paths)
+			for _, path := range paths {
+				fmt.Fprintln(console.out, path)
+			}
+		}
+	case "explain":
+		console.explain(arg)
+	case "ids":
+		console.query(arg, false)
+	case "docs":
+		console.query(arg, true)
+	default:
+		console.query(line, true)
+	}
+	return true
+}
+
+// Return the chosen collection, or print an error and return nil.
+func (console *Console) use() *db.Col {
+	if console.col == "" {
+		fmt.Fprintln(console.out, "Please choose a collection with \"use COLLECTION\" first.")
+		return nil
+	}
+	col := console.db.Use(console.col)
+	if col == nil {
+		fmt.Fprintf(console.out, "Collection '%s' no longer exists.\n", console.col)
+	}
+	return col
+}
+
+// Parse query in JSON or string query syntax.
+func parse(query string) (q interface{}, err error) {
+	if query == "" {
+		return nil, fmt.Errorf("Please specify a query.")
+	}
+	if strings.ContainsAny(query[:1], `{["`) {
+		// Numbers are kept in json.Number, so that large integers are looked up without precision loss
+		decoder := json.NewDecoder(strings.NewReader(query))
+		decoder.UseNumber()
+		if err = decoder.Decode(&q); err != nil {
+			return nil, fmt.Errorf("'%s' is not valid JSON: %v", query, err)
+		}
+		return
+	}
+	return db.ParseQuery(query)
+}
+
+// Print the query as it will be evaluated on the chosen collection, followed by estimated selectivity of the query and
+// of each sub-query of a top-level union or intersection, in the order of evaluation.
+func (console *Console) explain(query string) {
+	col := console.use()
+	if col == nil {
+		return
+	}
+	q, err := parse(query)
+	if err != nil {
+		fmt.Fprintln(console.out, err)
+		return
+	}
+	plan, err := db.OptimizeQuery(q, col)
+	if err != nil {
+		fmt.Fprintln(console.out, err)
+		return
+	}
+	js, _ := json.MarshalIndent(plan, "", "  ")
+	fmt.Fprintln(console.out, string(js))
+	selectivity, err := db.EstimateSelectivity(plan, col)
+	if err != nil {
+		fmt.Fprintln(console.out, err)
+		return
+	}
+	fmt.Fprintf(console.out, "Estimated selectivity: %.2f%%\n", selectivity*100)
+	subExprs, intersect := []interface{}(nil), false
+	if union, isUnion := plan.([]interface{}); isUnion {
+		subExprs = union
+	} else if expr, isMap := plan.(map[string]interface{}); isMap && len(expr) == 1 {
+		subExprs, intersect = expr["n"].([]interface{})
+	}
+	if len(subExprs) < 2 {
+		return
+	}
+	estimates := make([]float64, len(subExprs))
+	for i, subExpr := range subExprs {
+		if estimates[i], err = db.EstimateSelectivity(subExpr, col); err != nil {
+			fmt.Fprintln(console.out, err)
+			return
+		}
+	}
+	order := make([]int, len(subExprs))
+	for i := range order {
+		order[i] = i
+	}
+	if intersect {
+		// Intersection runs the most selective sub-query first
+		fmt.Fprintln(console.out, "Intersection evaluates sub-queries in this order:")
+		sort.SliceStable(order, func(i, j int) bool { return estimates[order[i]] < estimates[order[j]] })
+	} else {
+		fmt.Fprintln(console.out, "Union of sub-queries:")
+	}
+	for _, i := range order {
+		js, _ := json.Marshal(subExprs[i])
+		fmt.Fprintf(console.out, "  %6.2f%% %s\n", estimates[i]*100, js)
+	}
+}
+
+// Run query on the chosen collection, print result IDs or documents and time taken.
+func (console *Console) query(query string, printDocs bool) {
+	col := console.use()
+	if col == nil {
+		return
+	}
+	q, err := parse(query)
+	if err != nil {
+		fmt.Fprintln(console.out, err)
+		return
+	}
+	start := time.Now()
+	result := make(map[int]struct{})
+	if err := db.EvalQuery(q, col, &result); err != nil {
+		fmt.Fprintln(console.out, err)
+		return
+	}
+	elapsed := time.Since(start)
+	ids := make([]int, 0, len(result))
+	for id := range result {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if !printDocs {
+			fmt.Fprintln(console.out, id)
+			continue
+		}
+		doc, err := col.Read(id)
+		if err != nil {
+			continue
+		}
+		js, _ := json.Marshal(doc)
+		fmt.Fprintf(console.out, "%s %s\n", strconv.Itoa(id), js)
+	}
+	fmt.Fprintf(console.out, "%d result(s) in %v\n", len(ids), elapsed)
+}
@@ -0,0 +1,80 @@
+package repl
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+const TEST_DATA_DIR = "/tmp/tiedot_repl_test"
+
+func TestConsole(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	myDB, err := db.OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = myDB.Create("people"); err != nil {
+		t.Fatal(err)
+	}
+	col := myDB.Use("people")
+	col.Index([]string{"name", "first"})
+	id, _ := col.Insert(map[string]interface{}{"name": map[string]interface{}{"first": "Jane"}})
+	col.Insert(map[string]interface{}{"name": map[string]interface{}{"first": "John"}})
+	// Selectivity is estimated relative to the approximate number of documents, which needs more than a few documents
+	for i := 0; i < 200; i++ {
+		col.Insert(map[string]interface{}{"name": map[string]interface{}{"first": fmt.Sprint(i)}})
+	}
+	if err = myDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	in := strings.NewReader(strings.Join([]string{
+		`name.first == "Jane"`,
+		`cols`,
+		`use nothing`,
+		`use people`,
+		`indexes`,
+		`ids name.first == "Jane"`,
+		`docs {"eq": "Jane", "in": ["name", "first"]}`,
+		`explain has name.first`,
+		`explain {"n": [{"has": ["name", "first"]}, {"n": [{"eq": "Jane", "in": ["name", "first"]}]}]}`,
+		`ids name.first ==`,
+		`quit`,
+		`cols`,
+	}, "\n"))
+	out := new(bytes.Buffer)
+	if err := Start(TEST_DATA_DIR, in, out); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`Please choose a collection`,
+		"> people\n",
+		`Collection 'nothing' does not exist.`,
+		"people> name.first\n",
+		fmt.Sprintf("people> %d\n1 result(s) in ", id),
+		fmt.Sprintf(`people> %d {"name":{"first":"Jane"}}`, id),
+		"people> {\n  \"has\": [\n    \"name\",\n    \"first\"\n  ]\n}\nEstimated selectivity: 100.00%\n",
+		"Intersection evaluates sub-queries in this order:\n",
+		`Query syntax error at column 14`,
+	}
+	for _, str := range expected {
+		if !strings.Contains(out.String(), str) {
+			t.Fatal(str, out.String())
+		}
+	}
+	// Nested intersection is flattened, and the most selective sub-query runs first
+	if explained := out.String()[strings.Index(out.String(), "Intersection"):]; !regexp.MustCompile(`^[^\n]+\n +[0-9.]+% \{"eq":"Jane","in":\["name","first"\]\}\n +100\.00% \{"has":\["name","first"\]\}\n`).MatchString(explained) {
+		t.Fatal(out.String())
+	}
+	// Nothing runs after "quit"
+	if strings.Count(out.String(), "people\n") != 1 {
+		t.Fatal(out.String())
+	}
+}
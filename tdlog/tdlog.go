@@ -1,17 +1,49 @@
 package tdlog
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"sync"
+	"time"
 )
 
 // Controls whether INFO log messages are generated
 var VerboseLog = false
 
+// Controls whether structured DEBUG log entries are generated, e.g. of query execution
+var StructuredLog = false
+
+// Structured log entries are written to here, one JSON object per line
+var StructuredOutput io.Writer = os.Stderr
+var structuredLock = new(sync.Mutex)
+
 // const limit crit message
 const limitCritHistory = 100
 
+// LVL 7 - write the event name, time and fields as a single line of JSON object
+func Structured(event string, fields map[string]interface{}) {
+	if !StructuredLog {
+		return
+	}
+	entry := make(map[string]interface{}, len(fields)+2)
+	for key, val := range fields {
+		entry[key] = val
+	}
+	entry["event"] = event
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to make structured log entry of %s - %v", event, err)
+		return
+	}
+	structuredLock.Lock()
+	StructuredOutput.Write(append(line, '\n'))
+	structuredLock.Unlock()
+}
+
 // LVL 6
 func Infof(template string, params ...interface{}) {
 	if VerboseLog {
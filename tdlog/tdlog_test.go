@@ -2,9 +2,11 @@ package tdlog
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
 	"strings"
 	"testing"
 )
@@ -65,3 +67,30 @@ func TestAllLogLevels(t *testing.T) {
 	Panicf("a %s %s", "b", "c")
 	t.Fatal("Cannot reach here")
 }
+
+func TestStructured(t *testing.T) {
+	var str bytes.Buffer
+	StructuredOutput = &str
+	defer func() {
+		StructuredLog = false
+		StructuredOutput = os.Stderr
+	}()
+	Structured("disabled", nil)
+	if str.Len() != 0 {
+		t.Fatal(str.String())
+	}
+	StructuredLog = true
+	Structured("query", map[string]interface{}{"op": "eq", "results": 2})
+	Structured("unsupported", map[string]interface{}{"value": func() {}})
+	lines := strings.Split(strings.TrimSpace(str.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatal(lines)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["event"] != "query" || entry["op"] != "eq" || entry["results"].(float64) != 2 || entry["time"] == nil {
+		t.Fatal(entry)
+	}
+}